@@ -10,8 +10,11 @@ import (
 	"os/signal"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/discv5"
 	"github.com/vipnode/vipnode/v2/agent"
+	"github.com/vipnode/vipnode/v2/internal/pretty"
 	"github.com/vipnode/vipnode/v2/jsonrpc2"
 	ws "github.com/vipnode/vipnode/v2/jsonrpc2/ws/gorilla"
 	"github.com/vipnode/vipnode/v2/pool"
@@ -112,6 +115,38 @@ func (runner *agentRunner) LoadAgent(options Options) error {
 		StrictPeers:    options.Agent.StrictPeers,
 	}
 	runner.Agent = a
+	if options.Agent.Price != "" {
+		if a.Price, err = pretty.ParseEther(options.Agent.Price); err != nil {
+			return ErrExplain{err, `Failed to parse the agent --price value. Try using a value like "150 gwei".`}
+		}
+	}
+	if options.Agent.MaxPrice != "" {
+		if a.MaxPrice, err = pretty.ParseEther(options.Agent.MaxPrice); err != nil {
+			return ErrExplain{err, `Failed to parse the agent --max-price value. Try using a value like "200 gwei".`}
+		}
+	}
+	if options.Agent.ChannelKeyStore != "" {
+		if !common.IsHexAddress(options.Agent.ChannelAddress) {
+			return ErrExplain{errors.New("invalid channel address"), "Paying with balance proofs requires the --channel.address of the contract that holds the deposit."}
+		}
+		privkey, err := unlockKey(options.Agent.ChannelKeyStore)
+		if err != nil {
+			return ErrExplain{err, "Failed to unlock the keystore for the balance proof wallet. Make sure the path is correct and the decryption password is set in the `KEYSTORE_PASSPHRASE` environment variable."}
+		}
+		a.Channel = &agent.ChannelPayer{
+			PrivateKey: privkey,
+			Channel:    common.HexToAddress(options.Agent.ChannelAddress).Hex(),
+		}
+		if a.Channel.Target, err = pretty.ParseEther(options.Agent.ChannelTarget); err != nil {
+			return ErrExplain{err, `Failed to parse the agent --channel.target value. Try using a value like "0.01 ether".`}
+		}
+		if options.Agent.ChannelLimit != "off" {
+			if a.Channel.Limit, err = pretty.ParseEther(options.Agent.ChannelLimit); err != nil {
+				return ErrExplain{err, `Failed to parse the agent --channel.limit value. Try using a value like "0.5 ether" or "off".`}
+			}
+		}
+		logger.Infof("Paying the pool with balance proofs from wallet: %s", crypto.PubkeyToAddress(privkey.PublicKey).Hex())
+	}
 	if options.Agent.NodeURI != "" {
 		if err := matchEnode(options.Agent.NodeURI, nodeID); err != nil {
 			return err
@@ -133,6 +168,26 @@ func (runner *agentRunner) LoadAgent(options Options) error {
 	a.PoolMessageCallback = func(msg string) {
 		logger.Alertf("Message from pool: %s", msg)
 	}
+	a.BalanceWarningCallback = func(warning pool.BalanceWarning) {
+		if warning.SecondsLeft > 0 {
+			logger.Alertf("Balance is too low, deposit %s within %s to stay connected. %s", pretty.Ether(*warning.AmountNeeded), time.Duration(warning.SecondsLeft)*time.Second, warning.Message)
+		} else {
+			logger.Alertf("Balance is too low, deposit %s to stay connected. %s", pretty.Ether(*warning.AmountNeeded), warning.Message)
+		}
+	}
+
+	var lockedUntil time.Time
+	a.BalanceCallback = func(balance store.Balance) {
+		if !balance.IsLocked() {
+			lockedUntil = time.Time{}
+			return
+		}
+		if balance.Unlocks.Equal(lockedUntil) {
+			return
+		}
+		lockedUntil = balance.Unlocks
+		logger.Alertf("Deposit of %s is timelocked for withdraw and can be taken out of the contract after %s.", pretty.Ether(balance.Locked), balance.Unlocks.Format(time.RFC1123))
+	}
 
 	drifting := false
 	a.BlockNumberCallback = func(blockNumber uint64, latestBlockNumber uint64) {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/big"
 	"strings"
 	"sync"
 	"time"
@@ -53,6 +54,12 @@ type Agent struct {
 	// displayed to the client. (Optional)
 	PoolMessageCallback func(string)
 
+	// BalanceWarningCallback is called whenever the pool warns that the
+	// client's balance is too low and it will be disconnected after the grace
+	// period unless more balance is deposited. It should be displayed to the
+	// client. (Optional)
+	BalanceWarningCallback func(pool.BalanceWarning)
+
 	// BlockNumberCallback is called every update with the agent node's block
 	// number and the latest block number that the pool knows about.
 	BlockNumberCallback func(nodeBlockNumber uint64, poolBlockNumber uint64)
@@ -65,6 +72,18 @@ type Agent struct {
 	// (Optional)
 	Payout string
 
+	// Price is the amount in wei that the host charges per minute of a client
+	// connection. If not set, the pool's default price is used. (Optional)
+	Price *big.Int
+
+	// MaxPrice is the highest per-minute host price in wei that the client is
+	// willing to pay. If not set, hosts of any price are accepted. (Optional)
+	MaxPrice *big.Int
+
+	// Channel signs balance proofs that are sent with
+	// updates to pay the pool. (Optional)
+	Channel *ChannelPayer
+
 	// UpdateInterval is the time between updates sent to the pool. If not set,
 	// then store.KeepaliveInterval is used.
 	UpdateInterval time.Duration
@@ -83,6 +102,7 @@ type Agent struct {
 	stopCh   chan struct{}
 	waitCh   chan error
 	nodeInfo ethnode.UserAgent // cached during Start
+	balance  *store.Balance    // latest balance from the pool
 }
 
 func (a *Agent) init() {
@@ -122,6 +142,7 @@ func (a *Agent) Start(p pool.Pool) error {
 
 	connectReq := pool.ConnectRequest{
 		Payout:         a.Payout,
+		Price:          a.Price,
 		NodeURI:        a.NodeURI,
 		VipnodeVersion: version,
 		NodeInfo:       ua,
@@ -221,17 +242,50 @@ func (a *Agent) UpdatePeers(ctx context.Context, p pool.Pool) error {
 		return err
 	}
 
+	var usage []ethnode.PeerUsage
+	if reporter, ok := a.EthNode.(ethnode.UsageReporter); ok {
+		usage, err = reporter.PeerUsage(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	var proof *pool.BalanceProof
+	if a.Channel != nil {
+		// Before the first update, the balance is assumed to be empty. If
+		// the pool already accepted a larger proof, then it's ignored.
+		var balance store.Balance
+		if a.balance != nil {
+			balance = *a.balance
+		}
+		proof, err = a.Channel.Proof(balance)
+		if err != nil {
+			return err
+		}
+	}
+
 	update, err := p.Update(ctx, pool.UpdateRequest{
 		PeerInfo:    peers,
 		BlockNumber: blockNumber,
+		Usage:       usage,
+		Proof:       proof,
 	})
 	if err != nil {
 		return AgentPoolError{err, "Failed during pool update request"}
 	}
+	if a.Channel != nil && update.ChannelAmount != nil {
+		a.Channel.Accepted(update.ChannelAmount)
+	}
 	var balance store.Balance
-	if a.BalanceCallback != nil && update.Balance != nil {
+	if update.Balance != nil {
 		balance = *update.Balance
-		a.BalanceCallback(balance)
+		a.balance = &balance
+		if a.BalanceCallback != nil {
+			a.BalanceCallback(balance)
+		}
+	}
+	if a.BalanceWarningCallback != nil && update.Warning != nil {
+		a.BalanceWarningCallback(*update.Warning)
 	}
 
 	logger.Printf("Pool update: peers=%d active=%d invalid=%d block=%d balance=%s", len(peers), len(update.ActivePeers), len(update.InvalidPeers), blockNumber, balance.String())
@@ -312,8 +366,9 @@ func (a *Agent) AddPeers(ctx context.Context, p pool.Pool, num int) error {
 
 	logger.Printf("Requesting more kind=%q peers from pool: %d", kind, num)
 	peerResp, err := p.Peer(ctx, pool.PeerRequest{
-		Num:  num,
-		Kind: kind,
+		Num:      num,
+		Kind:     kind,
+		MaxPrice: a.MaxPrice,
 	})
 	if err != nil && jsonrpc2.IsErrorCode(err, jsonrpc2.ErrCodeInternal) {
 		if strings.HasPrefix(err.Error(), "no available") {
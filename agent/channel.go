@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/vipnode/vipnode/v2/pool"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// ChannelPayer signs the balance proofs that pay the pool from a client's
+// contract deposit. Each proof tops up the client's pool balance to Target.
+// The wallet must be the account that the node is registered to. The pool
+// claims the proofs without on-chain verification, so they're receipts
+// rather than a trust-minimized payment channel.
+type ChannelPayer struct {
+	// PrivateKey is the key of the wallet that funds the channel deposit.
+	PrivateKey *ecdsa.PrivateKey
+	// Channel is the address of the contract that holds the deposit.
+	Channel string
+	// Target is the pool balance to top up to.
+	Target *big.Int
+	// Limit is the highest cumulative amount to sign, such as the size of
+	// the deposit. (Optional)
+	Limit *big.Int
+
+	mu     sync.Mutex
+	amount *big.Int // Cumulative amount accepted by the pool
+}
+
+// Proof returns a signed balance proof that tops up the balance to Target,
+// or nil if no top up is needed.
+func (c *ChannelPayer) Proof(balance store.Balance) (*pool.BalanceProof, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.amount == nil {
+		c.amount = new(big.Int)
+	}
+	total := new(big.Int).Add(&balance.Deposit, &balance.Credit)
+	if total.Cmp(c.Target) >= 0 {
+		return nil, nil
+	}
+	amount := new(big.Int).Sub(c.Target, total)
+	amount.Add(amount, c.amount)
+	if c.Limit != nil && amount.Cmp(c.Limit) > 0 {
+		amount.Set(c.Limit)
+	}
+	if amount.Cmp(c.amount) <= 0 {
+		logger.Printf("Balance proof limit reached, not signing more balance proofs: %d", c.Limit)
+		return nil, nil
+	}
+
+	proof := &pool.BalanceProof{
+		Channel: c.Channel,
+		Account: crypto.PubkeyToAddress(c.PrivateKey.PublicKey).Hex(),
+		Amount:  amount,
+		Nonce:   time.Now().UnixNano(),
+	}
+	if err := proof.Sign(c.PrivateKey); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// Accepted sets the cumulative amount of the latest proof that the pool
+// accepted, which the next proof builds on.
+func (c *ChannelPayer) Accepted(amount *big.Int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.amount = new(big.Int).Set(amount)
+}
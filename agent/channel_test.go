@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+func TestChannelPayer(t *testing.T) {
+	privkey, _ := crypto.GenerateKey()
+	payer := ChannelPayer{
+		PrivateKey: privkey,
+		Channel:    "0x961Aa96FebeE5465149a0787B03bFa14D8e9033F",
+		Target:     big.NewInt(100),
+		Limit:      big.NewInt(250),
+	}
+	balanceOf := func(credit int64) store.Balance {
+		var b store.Balance
+		b.Credit.SetInt64(credit)
+		return b
+	}
+
+	proof, err := payer.Proof(balanceOf(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.Amount.Int64() != 100 {
+		t.Errorf("wrong proof amount: %d", proof.Amount)
+	}
+	if err := proof.Verify(); err != nil {
+		t.Errorf("proof failed to verify: %s", err)
+	}
+
+	// Pool accepted a larger proof before, such as before a restart
+	payer.Accepted(big.NewInt(120))
+	if proof, err := payer.Proof(balanceOf(100)); err != nil {
+		t.Error(err)
+	} else if proof != nil {
+		t.Errorf("unexpected proof: %+v", proof)
+	}
+	if proof, err := payer.Proof(balanceOf(30)); err != nil {
+		t.Error(err)
+	} else if proof.Amount.Int64() != 190 {
+		t.Errorf("wrong proof amount: %d", proof.Amount)
+	}
+
+	// Limit is reached
+	payer.Accepted(big.NewInt(190))
+	if proof, err := payer.Proof(balanceOf(-50)); err != nil {
+		t.Error(err)
+	} else if proof.Amount.Int64() != 250 {
+		t.Errorf("wrong proof amount: %d", proof.Amount)
+	}
+	payer.Accepted(big.NewInt(250))
+	if proof, err := payer.Proof(balanceOf(0)); err != nil {
+		t.Error(err)
+	} else if proof != nil {
+		t.Errorf("unexpected proof past the limit: %+v", proof)
+	}
+}
@@ -74,3 +74,69 @@ func (n *gethNode) Enode(ctx context.Context) (string, error) {
 	}
 	return info.Enode, nil
 }
+
+var _ UsageReporter = &gethNode{}
+
+// lesClientInfo is the part of the les_clientInfo serving stats that is used
+// to meter light clients.
+type lesClientInfo struct {
+	IsConnected    bool    `json:"isConnected"`
+	ConnectionTime float64 `json:"connectionTime"` // Seconds since the client connected
+	Capacity       uint64  `json:"capacity"`
+}
+
+// PeerUsage returns the service that an LES server gave each of its connected
+// light clients, from the les_clientInfo serving stats. Requests are counted
+// in seconds of the minimum client capacity, which is the unit that LES
+// prices its service in. Geth doesn't keep traffic counters per peer, so
+// nodes that aren't LES servers report no usage.
+func (n *gethNode) PeerUsage(ctx context.Context) ([]PeerUsage, error) {
+	peers, err := n.Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	enodeIDs := map[string]string{}
+	for _, peer := range peers {
+		if _, ok := peer.Protocols["les"]; !ok || peer.ID == "" {
+			continue
+		}
+		ids = append(ids, peer.ID)
+		enodeIDs[peer.ID] = peer.EnodeID()
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var server struct {
+		MinimumCapacity uint64 `json:"minimumCapacity"`
+	}
+	if err := n.client.CallContext(ctx, &server, "les_serverInfo"); err != nil {
+		if err, ok := err.(codedError); ok && err.ErrorCode() == errCodeMethodNotFound {
+			// Not an LES server
+			return nil, nil
+		}
+		return nil, err
+	}
+	if server.MinimumCapacity == 0 {
+		server.MinimumCapacity = 1
+	}
+
+	var clients map[string]lesClientInfo
+	if err := n.client.CallContext(ctx, &clients, "les_clientInfo", ids); err != nil {
+		return nil, err
+	}
+	r := make([]PeerUsage, 0, len(clients))
+	for id, info := range clients {
+		enodeID, ok := enodeIDs[strings.TrimPrefix(id, "0x")]
+		if !ok || !info.IsConnected {
+			continue
+		}
+		units := info.ConnectionTime * float64(info.Capacity) / float64(server.MinimumCapacity)
+		r = append(r, PeerUsage{
+			ID:       enodeID,
+			Requests: uint64(units),
+		})
+	}
+	return r, nil
+}
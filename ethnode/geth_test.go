@@ -1,9 +1,13 @@
 package ethnode
 
 import (
+	"context"
 	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
 func TestGethParsePeerInfo(t *testing.T) {
@@ -83,3 +87,74 @@ func TestGethParsePeerInfo(t *testing.T) {
 	}
 
 }
+
+type fakeAdminAPI struct{}
+
+func (fakeAdminAPI) Peers() []map[string]interface{} {
+	return []map[string]interface{}{
+		{
+			"id":        "aa",
+			"enode":     "enode://" + strings.Repeat("a", 128) + "@127.0.0.1:30303",
+			"protocols": map[string]interface{}{"les": "handshake"},
+		},
+		{
+			"id":        "bb",
+			"enode":     "enode://" + strings.Repeat("b", 128) + "@127.0.0.1:30303",
+			"protocols": map[string]interface{}{"les": map[string]interface{}{}},
+		},
+		{
+			"id":        "cc",
+			"enode":     "enode://" + strings.Repeat("c", 128) + "@127.0.0.1:30303",
+			"protocols": map[string]interface{}{"eth": map[string]interface{}{}},
+		},
+	}
+}
+
+type fakeLesAPI struct{}
+
+func (fakeLesAPI) ServerInfo() map[string]interface{} {
+	return map[string]interface{}{"minimumCapacity": 100}
+}
+
+func (fakeLesAPI) ClientInfo(ids []string) map[string]map[string]interface{} {
+	r := map[string]map[string]interface{}{}
+	for _, id := range ids {
+		switch id {
+		case "aa":
+			r[id] = map[string]interface{}{"isConnected": true, "connectionTime": 60.5, "capacity": 200}
+		case "bb":
+			r[id] = map[string]interface{}{"isConnected": false}
+		}
+	}
+	return r
+}
+
+func TestGethPeerUsage(t *testing.T) {
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("admin", fakeAdminAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	node := &gethNode{baseNode{client: rpc.DialInProc(server)}}
+
+	// Not an LES server
+	usage, err := node.PeerUsage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 0 {
+		t.Errorf("unexpected usage without LES: %+v", usage)
+	}
+
+	if err := server.RegisterName("les", fakeLesAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = node.PeerUsage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PeerUsage{{ID: strings.Repeat("a", 128), Requests: 121}}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("wrong usage:\n  got: %+v;\n want: %+v", usage, want)
+	}
+}
@@ -245,6 +245,23 @@ func (p *PeerInfo) IsFullNode() bool {
 	return ok
 }
 
+// PeerUsage is the cumulative traffic exchanged with a connected peer since
+// the connection was established.
+type PeerUsage struct {
+	ID       string `json:"id"`        // Enode ID of the peer, as returned by PeerInfo.EnodeID()
+	BytesIn  uint64 `json:"bytes_in"`  // Bytes received from the peer
+	BytesOut uint64 `json:"bytes_out"` // Bytes sent to the peer
+	Requests uint64 `json:"requests"`  // Request units sent to (as a client) or served for (as a host) the peer
+}
+
+// UsageReporter is implemented by EthNode implementations that can report
+// per-peer traffic counters, such as from network stats or LES serving stats.
+// Parity doesn't expose any per-peer stats, so it doesn't report usage.
+type UsageReporter interface {
+	// PeerUsage returns the traffic counters of the connected peers.
+	PeerUsage(ctx context.Context) ([]PeerUsage, error)
+}
+
 // Peers is a list of PeerInfo
 type Peers []PeerInfo
 
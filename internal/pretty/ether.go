@@ -40,15 +40,8 @@ func (e Ether) String() string {
 
 // ParseEther takes a string like "2 eth" and converts it to the wei equivalent.
 func ParseEther(s string) (*big.Int, error) {
-	var splitPos int
-	for pos, ch := range s {
-		if !unicode.IsNumber(ch) && ch != '-' && ch != '.' {
-			splitPos = pos
-			break
-		}
-	}
-
-	if splitPos == 0 {
+	number, unit := splitUnit(s)
+	if unit == "" {
 		// Must be wei
 		if r, ok := new(big.Int).SetString(s, 0); ok {
 			return r, nil
@@ -56,8 +49,6 @@ func ParseEther(s string) (*big.Int, error) {
 		return nil, fmt.Errorf("failed to parse ether value: %q", s)
 	}
 
-	number, unit := s[:splitPos], s[splitPos:]
-
 	n, ok := new(big.Rat).SetString(number)
 	if !ok {
 		return nil, fmt.Errorf("failed to parse ether value: %q", s)
@@ -85,3 +76,17 @@ func ParseEther(s string) (*big.Int, error) {
 	n.Mul(n, mul)
 	return new(big.Int).Div(n.Num(), n.Denom()), nil
 }
+
+// splitUnit splits a string like "2 eth" into its number and unit. The unit
+// is empty if there is none.
+func splitUnit(s string) (number string, unit string) {
+	for pos, ch := range s {
+		if !unicode.IsNumber(ch) && ch != '-' && ch != '.' {
+			if pos == 0 {
+				break
+			}
+			return s[:pos], s[pos:]
+		}
+	}
+	return s, ""
+}
@@ -0,0 +1,31 @@
+package pretty
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ParsePercent takes a string like "2.5%" and converts it to the fraction
+// equivalent (1/40). The percent sign is optional.
+func ParsePercent(s string) (*big.Rat, error) {
+	number := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	r, ok := new(big.Rat).SetString(number)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse percent value: %q", s)
+	}
+	return r.Quo(r, big.NewRat(100, 1)), nil
+}
+
+// ParseRate is like ParsePercent, but it only accepts rates between 0% and
+// 100%, such as for a commission.
+func ParseRate(s string) (*big.Rat, error) {
+	r, err := ParsePercent(s)
+	if err != nil {
+		return nil, err
+	}
+	if r.Sign() < 0 || r.Cmp(big.NewRat(1, 1)) > 0 {
+		return nil, fmt.Errorf("percent value must be between 0%% and 100%%: %q", s)
+	}
+	return r, nil
+}
@@ -0,0 +1,44 @@
+package pretty
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestParsePercent(t *testing.T) {
+	cases := []struct {
+		Input string
+		Want  *big.Rat
+	}{
+		{"5%", big.NewRat(1, 20)},
+		{"2.5 %", big.NewRat(1, 40)},
+		{"100", big.NewRat(1, 1)},
+		{"0%", big.NewRat(0, 1)},
+	}
+
+	for i, tc := range cases {
+		got, err := ParsePercent(tc.Input)
+		if err != nil {
+			t.Errorf("case #%d: unexpected error: %s", i, err)
+		} else if got.Cmp(tc.Want) != 0 {
+			t.Errorf("case #%d: got: %s; want %s", i, got, tc.Want)
+		}
+	}
+
+	if _, err := ParsePercent("five"); err == nil {
+		t.Errorf("expected error for invalid percent")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	if got, err := ParseRate("5%"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if got.Cmp(big.NewRat(1, 20)) != 0 {
+		t.Errorf("got: %s; want 1/20", got)
+	}
+	for _, input := range []string{"-5%", "100.1%", "five"} {
+		if _, err := ParseRate(input); err == nil {
+			t.Errorf("expected error for out of range rate: %q", input)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package pretty
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Token implements a String() formatter for an amount of an ERC-20 token in
+// its base units, such as "1.5 DAI".
+type Token struct {
+	Amount   big.Int
+	Decimals uint8
+	Symbol   string
+}
+
+func (t Token) String() string {
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(t.Decimals)), nil)
+	s := new(big.Rat).SetFrac(&t.Amount, denom).FloatString(int(t.Decimals))
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s + " " + t.Symbol
+}
+
+// ParseToken takes a string like "2.5 DAI" and converts it to the base unit
+// equivalent for a token with the given decimals. The unit can be the token
+// symbol or "token". Values without a unit are in base units already, like
+// wei for ParseEther.
+func ParseToken(s string, decimals uint8, symbol string) (*big.Int, error) {
+	number, unit := splitUnit(s)
+	if unit == "" {
+		if r, ok := new(big.Int).SetString(s, 0); ok {
+			return r, nil
+		}
+		return nil, fmt.Errorf("failed to parse token value: %q", s)
+	}
+
+	unit = strings.TrimSpace(unit)
+	if !strings.EqualFold(unit, symbol) && !strings.EqualFold(unit, "token") {
+		return nil, fmt.Errorf("failed to parse token unit: %q", s)
+	}
+	n, ok := new(big.Rat).SetString(number)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse token value: %q", s)
+	}
+	mul := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	n.Mul(n, new(big.Rat).SetInt(mul))
+	return new(big.Int).Div(n.Num(), n.Denom()), nil
+}
@@ -0,0 +1,53 @@
+package pretty
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	cases := []struct {
+		Amount   int64
+		Decimals uint8
+		Want     string
+	}{
+		{0, 6, "0 USDC"},
+		{1500000, 6, "1.5 USDC"},
+		{-250000, 6, "-0.25 USDC"},
+		{42, 0, "42 USDC"},
+		{1, 6, "0.000001 USDC"},
+	}
+	for i, tc := range cases {
+		got := Token{Amount: *big.NewInt(tc.Amount), Decimals: tc.Decimals, Symbol: "USDC"}.String()
+		if got != tc.Want {
+			t.Errorf("case #%d: got: %q; want %q", i, got, tc.Want)
+		}
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	cases := []struct {
+		Input   string
+		Want    *big.Int
+		IsError bool
+	}{
+		{Input: "0", Want: big.NewInt(0)},
+		{Input: "42", Want: big.NewInt(42)},
+		{Input: "1.5 USDC", Want: big.NewInt(1500000)},
+		{Input: "1.5 usdc", Want: big.NewInt(1500000)},
+		{Input: "0.25 token", Want: big.NewInt(250000)},
+		{Input: "-2 USDC", Want: big.NewInt(-2000000)},
+		{Input: "", IsError: true},
+		{Input: "foo", IsError: true},
+		{Input: "1 ether", IsError: true},
+		{Input: "- USDC", IsError: true},
+	}
+	for i, tc := range cases {
+		got, err := ParseToken(tc.Input, 6, "USDC")
+		if (err != nil) != tc.IsError {
+			t.Errorf("case #%d: got error: %v; wanted IsError=%t", i, err, tc.IsError)
+		} else if err == nil && got.Cmp(tc.Want) != 0 {
+			t.Errorf("case #%d: got: %q; want %q (input: %q)", i, got, tc.Want, tc.Input)
+		}
+	}
+}
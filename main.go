@@ -29,6 +29,7 @@ import (
 	"github.com/vipnode/vipnode/v2/internal/pretty"
 	"github.com/vipnode/vipnode/v2/jsonrpc2"
 	"github.com/vipnode/vipnode/v2/pool"
+	"github.com/vipnode/vipnode/v2/pool/balance"
 	"github.com/vipnode/vipnode/v2/pool/payment"
 )
 
@@ -49,33 +50,86 @@ type Options struct {
 		Args struct {
 			Coordinator string `positional-arg-name:"coordinator" description:"vipnode pool URL or stand-alone vipnode enode string" default:"wss://pool.vipnode.org/"`
 		} `positional-args:"yes"`
-		RPC            string `long:"rpc" description:"RPC path or URL of the host node."`
-		NodeKey        string `long:"nodekey" description:"Path to the host node's private key."`
-		NodeURI        string `long:"enode" description:"Public enode://... URI for clients to connect to. (If node is on a different IP from the vipnode agent)"`
-		NodeHost       string `long:"enode.host" description:"Override just the host component of reported enode:// URI. Useful for overriding network routing."`
-		Payout         string `long:"payout" description:"Ethereum wallet address to associate pool credits."`
-		MinPeers       int    `long:"min-peers" description:"Minimum number of peers to maintain." default:"3"`
-		StrictPeers    bool   `long:"strict-peers" description:"Disconnect peers that were not provided by the pool."`
-		UpdateInterval string `long:"update-interval" description:"Time between updates sent to pool, should be under 120s." default:"60s"`
+		RPC             string `long:"rpc" description:"RPC path or URL of the host node."`
+		NodeKey         string `long:"nodekey" description:"Path to the host node's private key."`
+		NodeURI         string `long:"enode" description:"Public enode://... URI for clients to connect to. (If node is on a different IP from the vipnode agent)"`
+		NodeHost        string `long:"enode.host" description:"Override just the host component of reported enode:// URI. Useful for overriding network routing."`
+		Payout          string `long:"payout" description:"Ethereum wallet address to associate pool credits."`
+		Price           string `long:"price" description:"Price per minute charged to clients when hosting, instead of the pool's default price. (Example: \"150 gwei\")"`
+		MaxPrice        string `long:"max-price" description:"Maximum price per minute to pay for a host as a client. (Example: \"200 gwei\")"`
+		MinPeers        int    `long:"min-peers" description:"Minimum number of peers to maintain." default:"3"`
+		StrictPeers     bool   `long:"strict-peers" description:"Disconnect peers that were not provided by the pool."`
+		UpdateInterval  string `long:"update-interval" description:"Time between updates sent to pool, should be under 120s." default:"60s"`
+		ChannelKeyStore string `long:"channel.keystore" description:"Path to encrypted JSON wallet keystore that signs balance proofs for the pool to claim from the contract deposit, instead of the pool's internal ledger. The proofs are receipts, the pool still settles the deposit without on-chain verification. Must be the wallet that the node is registered to. (Password set in KEYSTORE_PASSPHRASE env)"`
+		ChannelAddress  string `long:"channel.address" description:"Contract address that holds the deposit which balance proofs are claimed from."`
+		ChannelTarget   string `long:"channel.target" description:"Pool balance to keep topped up with balance proofs." default:"0.01 ether"`
+		ChannelLimit    string `long:"channel.limit" description:"Maximum cumulative amount to sign in balance proofs, such as the channel deposit, or 'off'." default:"off"`
 	} `command:"agent" description:"Connect as a node to a pool or another vipnode."`
 
 	Pool struct {
 		Bind            string `long:"bind" description:"Address and port to listen on." default:"0.0.0.0:8080"`
-		Store           string `long:"store" description:"Storage driver. (persist|memory)" default:"persist"`
+		Store           string `long:"store" description:"Storage driver. (persist|memory|sqlite)" default:"persist"`
 		DataDir         string `long:"datadir" description:"Path for storing the persistent database."`
 		TLSHost         string `long:"tlshost" description:"Acquire an ACME TLS cert for this host (forces bind to port :443)."`
 		AllowOrigin     string `long:"allow-origin" description:"Include Access-Control-Allow-Origin header for CORS."`
 		RestrictNetwork string `long:"restrict-network" description:"Restrict nodes to a single Ethereum network, such as: mainnet, rinkeby, goerli"`
 		MaxRequestHosts int    `long:"max-request-hosts" description:"Maximum number of hosts a node is allowed to request."`
+		PruneAfter      string `long:"prune-after" description:"Remove nodes that haven't been seen for this duration, along with their peers and empty trial balances, or 'off'. Nonzero balances and account authorizations are kept." default:"720h"`
+		PruneInterval   string `long:"prune-interval" description:"Time between removing stale nodes." default:"1h"`
 		Contract        struct {
-			RPC        string `long:"rpc" description:"Path or URL of an Ethereum RPC provider for payment contract operations. Must match the network of the contract."`
-			Addr       string `long:"address" description:"Deployed contract address, prefixed with network name scheme. (Example: \"rinkeby://0xb2f8987986259facdc539ac1745f7a0b395972b1\")"`
-			KeyStore   string `long:"keystore" description:"Path to encrypted JSON wallet keystore for contract operator. (Password set in KEYSTORE_PASSPHRASE env)"`
-			Price      string `long:"price" description:"Price per minute." default:"100 gwei"`
-			MinBalance string `long:"min-balance" description:"Minimum balance required to join as a client, or 'off'." default:"off"`
-			Welcome    string `long:"welcome" description:"Welcome message for clients. (Example: \"Welcome, {{.NodeID}}\")"`
+			RPC               string   `long:"rpc" description:"Path or URL of an Ethereum RPC provider for payment contract operations. Must match the network of the contract."`
+			Addr              string   `long:"address" description:"Deployed contract address, prefixed with network name scheme. (Example: \"rinkeby://0xb2f8987986259facdc539ac1745f7a0b395972b1\")"`
+			Kind              string   `long:"kind" description:"Payment contract kind: \"ether\" for vipnode-contract deposits, or \"erc20\" for a token escrow contract. Amounts of erc20 contracts are in the token's units. (Example: \"1.5 DAI\")" default:"ether"`
+			KeyStore          string   `long:"keystore" description:"Path to encrypted JSON wallet keystore for contract operator. (Password set in KEYSTORE_PASSPHRASE env)"`
+			Signer            string   `long:"signer" description:"URL of an external signer's JSON-RPC endpoint that signs the contract operator's transactions instead of a keystore, such as clef's --http endpoint."`
+			SignerAccount     string   `long:"signer-account" description:"Contract operator wallet address managed by the external signer. (Defaults to the signer's only account)"`
+			Price             string   `long:"price" description:"Price per minute." default:"100 gwei"`
+			MaxHostPrice      string   `long:"max-host-price" description:"Highest price per minute that hosts can set for themselves, or 'off'." default:"off"`
+			PricePerMB        string   `long:"price-per-mb" description:"Bill clients per MB served by hosts instead of per minute, or 'off'." default:"off"`
+			PricePerRequest   string   `long:"price-per-request" description:"Bill clients per request unit served by hosts instead of per minute, or 'off'." default:"off"`
+			MinBalance        string   `long:"min-balance" description:"Minimum balance required to join as a client, or 'off'." default:"off"`
+			GracePeriod       string   `long:"grace-period" description:"Duration that clients stay connected after their balance drops below the minimum, or 'off'." default:"off"`
+			Overdraft         string   `long:"overdraft" description:"Amount that clients can go below the minimum balance before they are disconnected, or 'off'." default:"off"`
+			SpendLocked       bool     `long:"spend-locked" description:"Count deposits that are timelocked for a forced withdraw towards the minimum balance until they unlock."`
+			TrialPeriod       string   `long:"trial-period" description:"Duration that clients can connect without a registered account, or 'off'." default:"off"`
+			TrialAmount       string   `long:"trial-amount" description:"Amount that clients can spend without a registered account, or 'off'." default:"off"`
+			Commission        string   `long:"commission" description:"Percentage of each host payment kept by the pool operator, or 'off'. (Example: \"5%\")" default:"off"`
+			CommissionFee     string   `long:"commission-fee" description:"Fixed amount per minute of each peer connection kept by the pool operator, or 'off'." default:"off"`
+			CommissionAccount string   `long:"commission-account" description:"Wallet address credited with the pool operator commission. (Defaults to the contract operator wallet)"`
+			Policies          []string `long:"policy" description:"Charge policy applied to each client update, in order. Can be repeated. One of: \"discount:<min hosts>,<percent>\", \"surge:<clients per host>,<multiplier>\", \"cap:<period>,<amount>\""`
+			Plans             []string `long:"plan" description:"Prepaid subscription plan as name,duration,max-hosts,price. Can be repeated. (Example: \"monthly,720h,3,0.05 ether\")"`
+			WithdrawFee       string   `long:"withdraw-fee" description:"Fixed fee deducted from each withdraw, if the gas-based fee estimate is disabled. (Default: \"0.0025 ether\" for ether contracts)"`
+			WithdrawMin       string   `long:"withdraw-min" description:"Minimum balance required to withdraw. (Default: \"0.005 ether\" for ether contracts)"`
+			DefaultMaxFee     string   `long:"default-max-fee" description:"Maximum withdraw fee for withdraw requests that don't sign their own maximum, such as from older clients. (Example: \"0.01 ether\")"`
+			FeeMargin         string   `long:"fee-margin" description:"Margin added to the estimated gas cost of a withdraw to quote its fee, or 'off' for a fixed fee. (Example: \"20%\")" default:"20%"`
+			Channels          bool     `long:"channels" description:"Accept signed balance proofs from clients, claimed from their contract deposits instead of counting the deposits as balance. These are not trust-minimized payment channels: the contract doesn't verify the proofs, so settlement is still operator-trusted."`
+			ClaimInterval     string   `long:"claim-interval" description:"Time between claiming the latest balance proofs from the deposits, which must be shorter than the contract's withdraw timelock." default:"24h"`
+			Confirmations     uint64   `long:"confirmations" description:"Number of blocks before a withdraw transaction is considered confirmed." default:"12"`
+			SettleInterval    string   `long:"settle-interval" description:"Automatically pay out account credit above the withdraw minimum on this interval, or 'off'. (Example: \"168h\")" default:"off"`
+			SettleDryRun      bool     `long:"settle-dry-run" description:"Only log the planned automatic settlements, without paying them out."`
+			ReconcileInterval string   `long:"reconcile-interval" description:"Replay the contract's deposit events since the last checkpoint on startup and on this interval, or 'off'." default:"10m"`
+			CacheSize         int      `long:"cache-size" description:"Number of account deposits to cache before the least recently used are evicted." default:"10000"`
+			CacheRefresh      string   `long:"cache-refresh" description:"Refresh the cached deposits of recently used accounts on this interval, or 'off'." default:"5m"`
+			StartBlock        uint64   `long:"start-block" description:"First block to replay deposit events from if there is no checkpoint yet, such as the contract's deployment block."`
+			Welcome           string   `long:"welcome" description:"Welcome message for clients. (Example: \"Welcome, {{.NodeID}}\")"`
+			DepositMessage    string   `long:"deposit-message" description:"Deposit instructions for clients with a low balance. (Example: \"Deposit {{.Amount}} at https://vipnode.org/account\")"`
 		} `group:"contract" namespace:"contract"`
-	} `command:"pool" description:"Start a vipnode pool coordinator."`
+
+		Export struct {
+			Args struct {
+				Path string `positional-arg-name:"path" description:"File to write the dump to. (Default: stdout)"`
+			} `positional-args:"yes"`
+		} `command:"export" description:"Export the pool's store as JSON lines, for backups or to move to another storage driver."`
+		Import struct {
+			Args struct {
+				Path string `positional-arg-name:"path" description:"File to read the dump from. (Default: stdin)"`
+			} `positional-args:"yes"`
+		} `command:"import" description:"Import a dump from \"vipnode pool export\" into the pool's store."`
+		Migrate struct {
+			Store   string `long:"to" description:"Storage driver to copy the pool's store to. (persist|sqlite)" required:"true"`
+			DataDir string `long:"to-datadir" description:"Path for the destination's persistent database. (Default: --datadir)"`
+		} `command:"migrate" description:"Copy the pool's store to another storage driver, and verify the copy. The pool should not be running."`
+	} `command:"pool" description:"Start a vipnode pool coordinator." subcommands-optional:"true"`
 
 	// DEPRECATED
 	Client struct {
@@ -208,8 +262,15 @@ func matchEnode(enode string, nodeID string) error {
 }
 
 func subcommand(cmd string, options Options) error {
-	if cmd == "pool" {
+	switch cmd {
+	case "pool":
 		return runPool(options)
+	case "pool export":
+		return runPoolExport(options)
+	case "pool import":
+		return runPoolImport(options)
+	case "pool migrate":
+		return runPoolMigrate(options)
 	}
 
 	// Run with retries for host/client
@@ -315,6 +376,7 @@ func main() {
 		pool.SetLogger(logWriter)
 		agent.SetLogger(logWriter)
 		payment.SetLogger(logWriter)
+		balance.SetLogger(logWriter)
 		ethnode.SetLogger(logWriter)
 		jsonrpc2.SetLogger(logWriter)
 	}
@@ -342,6 +404,9 @@ func main() {
 	cmd := "agent"
 	if parser.Active != nil {
 		cmd = parser.Active.Name
+		if parser.Active.Active != nil {
+			cmd += " " + parser.Active.Active.Name
+		}
 	}
 	err = subcommand(cmd, options)
 	if err == nil {
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/big"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -18,10 +23,12 @@ import (
 	"github.com/OpenPeeDeeP/xdg"
 	"github.com/dgraph-io/badger/v2"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/vipnode/vipnode/v2/ethnode"
 	"github.com/vipnode/vipnode/v2/internal/pretty"
+	"github.com/vipnode/vipnode/v2/jsonrpc2"
 	ws "github.com/vipnode/vipnode/v2/jsonrpc2/ws/gorilla"
 	"github.com/vipnode/vipnode/v2/pool"
 	"github.com/vipnode/vipnode/v2/pool/balance"
@@ -30,11 +37,16 @@ import (
 	"github.com/vipnode/vipnode/v2/pool/store"
 	badgerStore "github.com/vipnode/vipnode/v2/pool/store/badger"
 	memoryStore "github.com/vipnode/vipnode/v2/pool/store/memory"
+	sqlStore "github.com/vipnode/vipnode/v2/pool/store/sqlstore"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 const healthTimeout = time.Second * 5
 
+// subscriptionFunding is the internal account that collects subscription plan
+// payments and pays the hosts of subscribed clients.
+const subscriptionFunding = store.Account("vipnode:subscriptions")
+
 // findDataDir returns a valid data dir, will create it if it doesn't
 // exist.
 func findDataDir(overridePath string) (string, error) {
@@ -46,33 +58,64 @@ func findDataDir(overridePath string) (string, error) {
 	return path, err
 }
 
-func runPool(options Options) error {
-	var storeDriver store.Store
-	switch options.Pool.Store {
+// openStore opens the pool's storage driver. The store should be Close()'d
+// after use.
+func openStore(driver string, dataDir string) (store.Store, error) {
+	switch driver {
 	case "memory":
-		storeDriver = memoryStore.New()
-		defer storeDriver.Close()
+		return memoryStore.New(), nil
 	case "persist":
 		fallthrough
 	case "badger":
-		dir, err := findDataDir(options.Pool.DataDir)
+		dir, err := findDataDir(dataDir)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		badgerOpts := badger.DefaultOptions(dir)
-		storeDriver, err = badgerStore.Open(badgerOpts)
+		storeDriver, err := badgerStore.Open(badgerOpts)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer storeDriver.Close()
 		logger.Infof("Persistent store using badger backend: %s", dir)
-	default:
-		return errors.New("storage driver not implemented")
+		return storeDriver, nil
+	case "sqlite":
+		dir, err := findDataDir(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, "pool.sqlite")
+		storeDriver, err := sqlStore.OpenSQLite(path)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Persistent store using sqlite backend: %s", path)
+		return storeDriver, nil
+	}
+	return nil, errors.New("storage driver not implemented")
+}
+
+func runPool(options Options) error {
+	storeDriver, err := openStore(options.Pool.Store, options.Pool.DataDir)
+	if err != nil {
+		return err
 	}
+	defer storeDriver.Close()
 
 	balanceStore := store.BalanceStore(storeDriver)
+	var operatorAccount store.Account
 	var settleHandler payment.SettleHandler
+	var withdrawalTracker *payment.WithdrawalTracker
+	var depositReconciler *payment.DepositReconciler
+	var feeQuoter payment.FeeQuoter
+	var channels *payment.PaymentChannels
 	var depositGetter func(ctx context.Context) (*big.Int, error)
+	var cacheStatsGetter func() store.CacheStats
+	// Contract amounts are in wei, or in the token's base units for erc20
+	// contracts.
+	parseAmount := pretty.ParseEther
+	formatAmount := func(amount big.Int) string { return pretty.Ether(amount).String() }
+	withdrawFee := big.NewInt(2500000000000000) // 0.0025 ETH
+	withdrawMin := big.NewInt(5000000000000000) // 0.005 ETH
 	if options.Pool.Contract.Addr != "" {
 		// Payment contract implements NodeBalanceStore used by the balance
 		// manager, but with contract awareness.
@@ -101,53 +144,219 @@ func runPool(options Options) error {
 			}
 		}
 
-		var transactOpts *bind.TransactOpts
-		if options.Pool.Contract.KeyStore != "" {
-			transactOpts, err = unlockTransactor(options.Pool.Contract.KeyStore)
+		var signer payment.Signer
+		if options.Pool.Contract.Signer != "" {
+			if options.Pool.Contract.KeyStore != "" {
+				return ErrExplain{
+					errors.New("conflicting contract operator keys"),
+					"Only one of --contract.keystore or --contract.signer can be set.",
+				}
+			}
+			var account common.Address
+			if options.Pool.Contract.SignerAccount != "" {
+				if !common.IsHexAddress(options.Pool.Contract.SignerAccount) {
+					return ErrExplain{
+						errors.New("invalid contract signer account"),
+						"The --contract.signer-account must be a hex wallet address.",
+					}
+				}
+				account = common.HexToAddress(options.Pool.Contract.SignerAccount)
+			}
+			signer, err = payment.ExternalSigner(&jsonrpc2.HTTPService{Endpoint: options.Pool.Contract.Signer}, account)
+			if err != nil {
+				return ErrExplain{
+					err,
+					"Failed to connect to the external signer for the contract operator wallet. Make sure the signer's JSON-RPC endpoint is reachable and it manages the operator account.",
+				}
+			}
+		} else if options.Pool.Contract.KeyStore != "" {
+			privkey, err := unlockKey(options.Pool.Contract.KeyStore)
 			if err != nil {
 				return ErrExplain{
 					err,
 					"Failed to unlock the keystore for the contract operator wallet. Make sure the path is correct and the decryption password is set in the `KEYSTORE_PASSPHRASE` environment variable.",
 				}
 			}
+			signer = payment.KeySigner(privkey)
+		}
+
+		var transactOpts *bind.TransactOpts
+		if signer != nil {
+			chainID, err := ethclient.ChainID(context.Background())
+			if err != nil {
+				return err
+			}
+			transactOpts = payment.SignerTransactor(signer, chainID)
 		}
 
 		if transactOpts == nil {
-			logger.Warningf("Contract payment starting in read-only mode because --contract-keystore was not set. Withdraw and settlement attempts will fail.")
+			logger.Warningf("Contract payment starting in read-only mode because --contract.keystore or --contract.signer was not set. Withdraw and settlement attempts will fail.")
+		} else {
+			operatorAccount = store.Account(transactOpts.From.Hex())
 		}
 
-		contract, err := payment.ContractPayment(storeDriver, contractAddr, ethclient, transactOpts)
-		if err != nil {
-			if err, ok := err.(payment.AddressMismatchError); ok {
-				return ErrExplain{
-					err,
-					"Contract keystore must match the wallet of the contract operator. Make sure you're providing the correct keystore.",
-				}
+		var contract payment.Contract
+		switch options.Pool.Contract.Kind {
+		case "ether":
+			contract, err = payment.ContractPayment(storeDriver, contractAddr, ethclient, transactOpts)
+			if err != nil {
+				return explainContractError(err)
 			}
-			return err
+		case "erc20":
+			tokenContract, err := payment.TokenPayment(storeDriver, contractAddr, ethclient, transactOpts)
+			if err != nil {
+				return explainContractError(err)
+			}
+			contract = tokenContract
+			parseAmount = tokenContract.ParseAmount
+			formatAmount = tokenContract.FormatAmount
+			depositGetter = tokenContract.TotalDeposit
+			// The default withdraw fee and minimum are in ether
+			withdrawFee, withdrawMin = nil, nil
+			logger.Infof("Payment contract holds %s token deposits: %s", tokenContract.Symbol, tokenContract.Token.Hex())
+		default:
+			return ErrExplain{fmt.Errorf("unknown contract kind: %q", options.Pool.Contract.Kind), `The --contract.kind value must be "ether" or "erc20".`}
 		}
 		balanceStore = contract
 		settleHandler = contract.OpSettle
-
-		depositGetter = func(ctx context.Context) (*big.Int, error) {
-			r, err := ethclient.PendingBalanceAt(ctx, contractAddr)
+		contract.SetCacheSize(options.Pool.Contract.CacheSize)
+		cacheStatsGetter = contract.CacheStats
+		if options.Pool.Contract.CacheRefresh != "off" {
+			interval, err := time.ParseDuration(options.Pool.Contract.CacheRefresh)
 			if err != nil {
-				// Try again in case the connection dropped
-				logger.Warningf("PoolStatus: ethclient.PendingBalanceAt failed, retrying: %s", err)
-				r, err = ethclient.PendingBalanceAt(ctx, contractAddr)
+				return ErrExplain{err, `Failed to parse the --contract.cache-refresh value. Try using a value like "5m" or "off".`}
 			}
+			go func() {
+				if err := contract.RefreshBalances(context.Background(), interval); err != nil {
+					logger.Errorf("Deposit cache refresh stopped: %s", err)
+				}
+			}()
+		}
+		if options.Pool.Contract.Channels {
+			claimInterval, err := time.ParseDuration(options.Pool.Contract.ClaimInterval)
 			if err != nil {
-				logger.Errorf("PoolStatus: ethclient.PendingBalanceAt failed twice: %s", err)
+				return ErrExplain{err, `Failed to parse the --contract.claim-interval value. Try using a value like "24h".`}
+			}
+			// Proofs that aren't claimed before a forced withdraw unlocks
+			// can't be claimed anymore.
+			if timelock, err := contract.WithdrawInterval(); err != nil {
+				logger.Warningf("Failed to read the contract withdraw timelock, so the channel claim interval can't be checked against it: %s", err)
+			} else if claimInterval >= timelock {
+				return ErrExplain{fmt.Errorf("channel claim interval (%s) is not shorter than the contract withdraw timelock (%s)", claimInterval, timelock), "Set --contract.claim-interval to a shorter duration, so that balance proofs are claimed before a forced withdraw unlocks."}
+			}
+			channels = &payment.PaymentChannels{
+				Store:           storeDriver,
+				BalanceStore:    storeDriver,
+				SettlementStore: storeDriver,
+				Address:         contractAddr,
+				Deposit:         contract.ChannelDeposit,
+				Settle:          settleHandler,
+				Interval:        claimInterval,
+			}
+			// Deposits are collateral for the balance proofs, so only the
+			// credit from proofs is spendable.
+			balanceStore = storeDriver
+			logger.Infof("Accepting balance proofs for contract: %s", contractAddr.Hex())
+			logger.Warningf("The contract does not verify balance proofs, so claims are operator-trusted settlements and not trust-minimized payment channels.")
+		}
+		withdrawalTracker = &payment.WithdrawalTracker{
+			Store:         storeDriver,
+			BalanceStore:  contract,
+			Backend:       ethclient,
+			Confirmations: options.Pool.Contract.Confirmations,
+			Interval:      time.Minute * 1,
+			Resubmit:      contract.OpResettle,
+			StuckTimeout:  time.Minute * 10,
+			MaxAttempts:   5,
+			Channels:      channels,
+		}
+		if transactOpts != nil {
+			withdrawalTracker.From = transactOpts.From
+		}
+		if options.Pool.Contract.ReconcileInterval != "off" {
+			interval, err := time.ParseDuration(options.Pool.Contract.ReconcileInterval)
+			if err != nil {
+				return ErrExplain{err, `Failed to parse the --contract.reconcile-interval value. Try using a value like "10m" or "off".`}
+			}
+			depositReconciler = &payment.DepositReconciler{
+				Store:      storeDriver,
+				Contract:   contract,
+				Backend:    ethclient,
+				Checkpoint: "deposits:" + contractAddr.Hex(),
+				StartBlock: options.Pool.Contract.StartBlock,
+				Interval:   interval,
+			}
+		}
+		if options.Pool.Contract.Kind != "ether" {
+			// Gas fees are paid in ether, which can't be converted to token units
+			logger.Infof("Gas-based withdraw fee estimates are disabled for %s contracts.", options.Pool.Contract.Kind)
+		} else if options.Pool.Contract.FeeMargin != "off" && transactOpts != nil {
+			margin, err := pretty.ParsePercent(options.Pool.Contract.FeeMargin)
+			if err != nil {
+				return fmt.Errorf("failed to parse contract fee margin: %s", err)
+			}
+			feeQuoter = &payment.GasFeeEstimator{
+				Backend:     ethclient,
+				Contract:    contractAddr,
+				Operator:    transactOpts.From,
+				Margin:      margin,
+				FallbackGas: 100000,
+			}
+		}
+
+		if depositGetter == nil {
+			depositGetter = func(ctx context.Context) (*big.Int, error) {
+				r, err := ethclient.PendingBalanceAt(ctx, contractAddr)
+				if err != nil {
+					// Try again in case the connection dropped
+					logger.Warningf("PoolStatus: ethclient.PendingBalanceAt failed, retrying: %s", err)
+					r, err = ethclient.PendingBalanceAt(ctx, contractAddr)
+				}
+				if err != nil {
+					logger.Errorf("PoolStatus: ethclient.PendingBalanceAt failed twice: %s", err)
+				}
+				return r, err
 			}
-			return r, err
 		}
 	}
 
+	if options.Pool.Contract.WithdrawFee != "" {
+		if withdrawFee, err = parseAmount(options.Pool.Contract.WithdrawFee); err != nil {
+			return fmt.Errorf("failed to parse contract withdraw fee: %s", err)
+		}
+	}
+	if options.Pool.Contract.WithdrawMin != "" {
+		if withdrawMin, err = parseAmount(options.Pool.Contract.WithdrawMin); err != nil {
+			return fmt.Errorf("failed to parse contract withdraw minimum: %s", err)
+		}
+	}
+
+	var defaultMaxFee *big.Int
+	if options.Pool.Contract.DefaultMaxFee != "" {
+		if defaultMaxFee, err = parseAmount(options.Pool.Contract.DefaultMaxFee); err != nil {
+			return fmt.Errorf("failed to parse contract default max fee: %s", err)
+		}
+	}
+
+	if options.Pool.Contract.Channels && channels == nil {
+		return ErrExplain{errors.New("balance proofs require a contract"), "Balance proofs are claimed from contract deposits. Set --contract.address and --contract.rpc."}
+	}
+
 	// Setup balance manager
-	creditPerInterval, err := pretty.ParseEther(options.Pool.Contract.Price)
+	creditPerInterval, err := parseAmount(options.Pool.Contract.Price)
 	if err != nil {
 		return fmt.Errorf("failed to parse contract price: %s", err)
 	}
+	var maxHostPrice *big.Int
+	if options.Pool.Contract.MaxHostPrice != "off" {
+		maxHostPrice, err = parseAmount(options.Pool.Contract.MaxHostPrice)
+		if err != nil {
+			return fmt.Errorf("failed to parse contract max host price: %s", err)
+		}
+		if maxHostPrice.Cmp(creditPerInterval) < 0 {
+			return ErrExplain{errors.New("max host price is below the default price"), "Hosts that don't set a price are charged --contract.price, so --contract.max-host-price must be at least that much."}
+		}
+	}
 	balanceManager := balance.PayPerInterval(
 		balanceStore,
 		time.Minute*1, // Interval
@@ -155,13 +364,125 @@ func runPool(options Options) error {
 	)
 
 	if options.Pool.Contract.MinBalance != "off" {
-		minBalance, err := pretty.ParseEther(options.Pool.Contract.MinBalance)
+		minBalance, err := parseAmount(options.Pool.Contract.MinBalance)
 		if err != nil {
 			return fmt.Errorf("failed to parse contract minimum balance: %s", err)
 		}
 
 		balanceManager.MinBalance = minBalance
 	}
+	if options.Pool.Contract.GracePeriod != "off" {
+		balanceManager.GracePeriod, err = time.ParseDuration(options.Pool.Contract.GracePeriod)
+		if err != nil {
+			return fmt.Errorf("failed to parse contract grace period: %s", err)
+		}
+	}
+	if options.Pool.Contract.Overdraft != "off" {
+		balanceManager.Overdraft, err = parseAmount(options.Pool.Contract.Overdraft)
+		if err != nil {
+			return fmt.Errorf("failed to parse contract overdraft: %s", err)
+		}
+	}
+	balanceManager.SpendLocked = options.Pool.Contract.SpendLocked
+
+	var commission *balance.Commission
+	if options.Pool.Contract.Commission != "off" || options.Pool.Contract.CommissionFee != "off" {
+		if options.Pool.Contract.CommissionAccount != "" {
+			if !common.IsHexAddress(options.Pool.Contract.CommissionAccount) {
+				return ErrExplain{errors.New("invalid commission account"), "The --contract.commission-account value must be a wallet address."}
+			}
+			operatorAccount = store.Account(common.HexToAddress(options.Pool.Contract.CommissionAccount).Hex())
+		}
+		if operatorAccount == "" {
+			return ErrExplain{errors.New("missing commission account"), "Collecting a pool operator commission requires an account to credit. Set --contract.commission-account, --contract.keystore, or --contract.signer."}
+		}
+		commission = &balance.Commission{
+			Operator: operatorAccount,
+			Interval: balanceManager.Interval,
+		}
+		if options.Pool.Contract.Commission != "off" {
+			commission.Rate, err = pretty.ParseRate(options.Pool.Contract.Commission)
+			if err != nil {
+				return fmt.Errorf("failed to parse contract commission: %s", err)
+			}
+		}
+		if options.Pool.Contract.CommissionFee != "off" {
+			commission.PerInterval, err = parseAmount(options.Pool.Contract.CommissionFee)
+			if err != nil {
+				return fmt.Errorf("failed to parse contract commission fee: %s", err)
+			}
+			if commission.PerInterval.Sign() < 0 {
+				return fmt.Errorf("contract commission fee must not be negative: %s", options.Pool.Contract.CommissionFee)
+			}
+		}
+		logger.Infof("Pool operator commission is credited to account: %s", operatorAccount)
+	}
+
+	var policies []balance.Policy
+	for _, s := range options.Pool.Contract.Policies {
+		policy, err := parsePolicy(s, parseAmount)
+		if err != nil {
+			return ErrExplain{err, `Failed to parse --contract.policy value. It should look like one of: "discount:3,10%", "surge:4,1.5", "cap:24h,0.1 ether"`}
+		}
+		policies = append(policies, policy)
+	}
+	if commission != nil {
+		// Commission is taken from the credits after the other policies
+		// adjusted them.
+		policies = append(policies, *commission)
+	}
+
+	var biller balance.Biller = balanceManager
+	if options.Pool.Contract.PricePerMB != "off" || options.Pool.Contract.PricePerRequest != "off" {
+		var pricePerMB, pricePerRequest *big.Int
+		if options.Pool.Contract.PricePerMB != "off" {
+			pricePerMB, err = parseAmount(options.Pool.Contract.PricePerMB)
+			if err != nil {
+				return fmt.Errorf("failed to parse contract price per MB: %s", err)
+			}
+		}
+		if options.Pool.Contract.PricePerRequest != "off" {
+			pricePerRequest, err = parseAmount(options.Pool.Contract.PricePerRequest)
+			if err != nil {
+				return fmt.Errorf("failed to parse contract price per request: %s", err)
+			}
+		}
+		biller = balance.PayPerUsage(biller, pricePerMB, pricePerRequest)
+		logger.Infof("Billing clients by usage instead of per minute. Connections that both sides don't report usage for are billed per minute.")
+	}
+	var manager balance.Manager = balance.Chain(biller, policies...)
+	var subscriptions payment.Subscriber
+	if len(options.Pool.Contract.Plans) > 0 {
+		subscriptionManager := balance.Subscriptions(manager, balanceStore, storeDriver, storeDriver, subscriptionFunding, balanceManager.Interval, creditPerInterval)
+		for _, s := range options.Pool.Contract.Plans {
+			plan, err := parsePlan(s, parseAmount)
+			if err == nil {
+				err = subscriptionManager.AddPlan(plan)
+			}
+			if err != nil {
+				return ErrExplain{err, `Failed to parse --contract.plan value. It should look like: "monthly,720h,3,0.05 ether" (name, duration, max hosts, price)`}
+			}
+		}
+		manager = subscriptionManager
+		subscriptions = subscriptionManager
+	}
+	if options.Pool.Contract.TrialPeriod != "off" || options.Pool.Contract.TrialAmount != "off" {
+		var trialPeriod time.Duration
+		if options.Pool.Contract.TrialPeriod != "off" {
+			trialPeriod, err = time.ParseDuration(options.Pool.Contract.TrialPeriod)
+			if err != nil {
+				return ErrExplain{err, `Failed to parse the --contract.trial-period value. Try using a value like "24h" or "off".`}
+			}
+		}
+		var trialAmount *big.Int
+		if options.Pool.Contract.TrialAmount != "off" {
+			trialAmount, err = parseAmount(options.Pool.Contract.TrialAmount)
+			if err != nil {
+				return fmt.Errorf("failed to parse contract trial amount: %s", err)
+			}
+		}
+		manager = balance.Trial(manager, balanceStore, storeDriver, trialPeriod, trialAmount)
+	}
 
 	// Setup welcome message template
 	var welcomeTmpl *template.Template
@@ -172,6 +493,15 @@ func runPool(options Options) error {
 		}
 	}
 
+	// Setup deposit instructions template
+	var depositTmpl *template.Template
+	if depositMsg := options.Pool.Contract.DepositMessage; depositMsg != "" {
+		depositTmpl, err = template.New("vipnode_deposit").Parse(depositMsg)
+		if err != nil {
+			return err
+		}
+	}
+
 	var networkID ethnode.NetworkID
 	if options.Pool.RestrictNetwork != "" {
 		networkID = ethnode.ParseNetwork(options.Pool.RestrictNetwork)
@@ -180,9 +510,14 @@ func runPool(options Options) error {
 		}
 	}
 
-	p := pool.New(storeDriver, balanceManager)
+	p := pool.New(storeDriver, manager)
 	p.MaxRequestHosts = options.Pool.MaxRequestHosts
+	p.DefaultHostPrice = creditPerInterval
+	p.MaxHostPrice = maxHostPrice
 	p.Version = fmt.Sprintf("vipnode/pool/%s", Version)
+	if channels != nil {
+		p.Channels = channels
+	}
 
 	if welcomeTmpl != nil {
 		p.ClientMessager = func(nodeID string) string {
@@ -199,6 +534,22 @@ func runPool(options Options) error {
 			return buf.String()
 		}
 	}
+	if depositTmpl != nil {
+		p.DepositMessager = func(nodeID string, amountNeeded *big.Int) string {
+			var buf bytes.Buffer
+			err := depositTmpl.Execute(&buf, struct {
+				NodeID string
+				Amount string
+			}{
+				NodeID: nodeID,
+				Amount: formatAmount(*amountNeeded),
+			})
+			if err != nil {
+				logger.Errorf("DepositMessager failed: %s", err)
+			}
+			return buf.String()
+		}
+	}
 
 	p.RestrictNetwork = networkID
 	p.BlockNumberProvider = func(network ethnode.NetworkID) (uint64, error) {
@@ -227,30 +578,128 @@ func runPool(options Options) error {
 	}
 
 	// Pool payment management API (optional)
-	payment := &payment.PaymentService{
-		NonceStore:   storeDriver,
-		AccountStore: storeDriver,
-		BalanceStore: balanceStore, // Proxy smart contract store if available
-
-		WithdrawFee: func(amount *big.Int) *big.Int {
-			// TODO: Adjust fee dynamically based on gas price?
-			fee := big.NewInt(2500000000000000) // 0.0025 ETH
-			return amount.Sub(amount, fee)
-		},
-		WithdrawMin: big.NewInt(5000000000000000), // 0.005 ETH
-		Settle:      settleHandler,
-	}
-	if err := handler.Register("pool_", payment); err != nil {
+	paymentService := &payment.PaymentService{
+		NonceStore:      storeDriver,
+		AccountStore:    storeDriver,
+		BalanceStore:    balanceStore, // Proxy smart contract store if available
+		SettlementStore: storeDriver,
+
+		Fees:          feeQuoter,
+		WithdrawMin:   withdrawMin,
+		DefaultMaxFee: defaultMaxFee,
+		Settle:        settleHandler,
+		Channels:      channels,
+		Subscriptions: subscriptions,
+	}
+	if withdrawFee != nil {
+		// Fixed fee, used if the gas-based fee estimate is disabled
+		paymentService.WithdrawFee = func(amount *big.Int) *big.Int {
+			return amount.Sub(amount, withdrawFee)
+		}
+	}
+	if err := handler.Register("pool_", paymentService); err != nil {
 		return err
 	}
 
+	if withdrawalTracker != nil {
+		go func() {
+			if err := withdrawalTracker.Start(context.Background()); err != nil {
+				logger.Errorf("Withdrawal tracker stopped: %s", err)
+			}
+		}()
+	}
+
+	if depositReconciler != nil {
+		go func() {
+			if err := depositReconciler.Start(context.Background()); err != nil {
+				logger.Errorf("Deposit reconciler stopped: %s", err)
+			}
+		}()
+	}
+
+	if channels != nil {
+		go func() {
+			if err := channels.Start(context.Background()); err != nil {
+				logger.Errorf("Balance proof claims stopped: %s", err)
+			}
+		}()
+	}
+
+	if options.Pool.Contract.SettleInterval != "off" {
+		interval, err := time.ParseDuration(options.Pool.Contract.SettleInterval)
+		if err != nil {
+			return ErrExplain{err, `Failed to parse the --contract.settle-interval value. Try using a value like "168h" or "off".`}
+		}
+		if settleHandler == nil && !options.Pool.Contract.SettleDryRun {
+			return ErrExplain{errors.New("settlement is disabled"), "Automatic settlement requires a contract operator wallet. Set --contract.keystore or --contract.signer, or use --contract.settle-dry-run."}
+		}
+		scheduler := &payment.SettlementScheduler{
+			Store:        storeDriver,
+			BalanceStore: balanceStore,
+			Settle:       settleHandler,
+			WithdrawFee:  paymentService.WithdrawFee,
+			Fees:         feeQuoter,
+			WithdrawMin:  paymentService.WithdrawMin,
+			Channels:     channels,
+			Interval:     interval,
+			DryRun:       options.Pool.Contract.SettleDryRun,
+			OnSettle: func(settlement store.Settlement) {
+				if options.Pool.Contract.SettleDryRun {
+					logger.Infof("Settlement dry run: would pay %s to account %s", formatAmount(*settlement.Amount), settlement.Account)
+				} else {
+					logger.Infof("Settled %s to account %s: %s", formatAmount(*settlement.Amount), settlement.Account, settlement.TxID)
+				}
+			},
+		}
+		go func() {
+			if err := scheduler.Start(context.Background()); err != nil {
+				logger.Errorf("Settlement scheduler stopped: %s", err)
+			}
+		}()
+		logger.Infof("Scheduled automatic settlement every %s (dry run: %t)", interval, scheduler.DryRun)
+	}
+
+	var pruneStatsGetter func() store.PruneStats
+	if options.Pool.PruneAfter != "off" {
+		retention, err := time.ParseDuration(options.Pool.PruneAfter)
+		if err != nil {
+			return ErrExplain{err, `Failed to parse the --prune-after value. Try using a value like "720h" or "off".`}
+		}
+		interval, err := time.ParseDuration(options.Pool.PruneInterval)
+		if err != nil {
+			return ErrExplain{err, `Failed to parse the --prune-interval value. Try using a value like "1h".`}
+		}
+		if retention < store.ExpireInterval {
+			return ErrExplain{errors.New("prune retention is too short"), fmt.Sprintf("The --prune-after duration must be longer than the time that nodes are considered active (%s), otherwise connected nodes would be removed.", store.ExpireInterval)}
+		}
+		pruner := &pool.Pruner{
+			Store:     storeDriver,
+			Retention: retention,
+			Interval:  interval,
+		}
+		pruneStatsGetter = pruner.Stats
+		go func() {
+			if err := pruner.Start(context.Background()); err != nil {
+				logger.Errorf("Store pruning stopped: %s", err)
+			}
+		}()
+		logger.Infof("Pruning nodes not seen for %s every %s", retention, interval)
+	}
+
 	// Pool status dashboard API
+	var commissionAccount store.Account
+	if commission != nil {
+		commissionAccount = commission.Operator
+	}
 	dashboard := &status.PoolStatus{
 		Store:           storeDriver,
 		GetTotalDeposit: depositGetter,
+		GetCacheStats:   cacheStatsGetter,
+		GetPruneStats:   pruneStatsGetter,
 		TimeStarted:     time.Now(),
 		Version:         Version,
 		CacheDuration:   time.Minute * 1,
+		Operator:        commissionAccount,
 	}
 	if err := handler.Register("pool_", dashboard); err != nil {
 		return err
@@ -282,11 +731,199 @@ func runPool(options Options) error {
 	return http.ListenAndServe(options.Pool.Bind, handler)
 }
 
-func unlockTransactor(keystorePath string) (*bind.TransactOpts, error) {
+// explainContractError adds an explanation to payment contract setup errors.
+func explainContractError(err error) error {
+	if err, ok := err.(payment.AddressMismatchError); ok {
+		return ErrExplain{
+			err,
+			"Contract keystore must match the wallet of the contract operator. Make sure you're providing the correct keystore.",
+		}
+	}
+	return err
+}
+
+// parsePolicy parses a charge policy of the form: kind:arg,arg
+func parsePolicy(s string, parseAmount func(string) (*big.Int, error)) (balance.Policy, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid policy: %q", s)
+	}
+	args := strings.Split(parts[1], ",")
+	if len(args) != 2 {
+		return nil, fmt.Errorf("invalid policy arguments: %q", s)
+	}
+	for i := range args {
+		args[i] = strings.TrimSpace(args[i])
+	}
+	switch kind := strings.TrimSpace(parts[0]); kind {
+	case "discount":
+		minPeers, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := pretty.ParseRate(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return balance.VolumeDiscount{MinPeers: minPeers, Rate: rate}, nil
+	case "surge":
+		ratio, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		multiplier, ok := new(big.Rat).SetString(args[1])
+		if !ok || multiplier.Sign() < 0 {
+			return nil, fmt.Errorf("invalid surge multiplier: %q", args[1])
+		}
+		return &balance.SurgePricing{Ratio: ratio, Multiplier: multiplier}, nil
+	case "cap":
+		period, err := time.ParseDuration(args[0])
+		if err != nil {
+			return nil, err
+		}
+		amount, err := parseAmount(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return balance.SpendingCap(period, amount), nil
+	default:
+		return nil, fmt.Errorf("unknown policy: %q", kind)
+	}
+}
+
+// parsePlan parses a subscription plan of the form: name,duration,max-hosts,price
+func parsePlan(s string, parseAmount func(string) (*big.Int, error)) (balance.Plan, error) {
+	var plan balance.Plan
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return plan, fmt.Errorf("invalid subscription plan: %q", s)
+	}
+	plan.Name = strings.TrimSpace(parts[0])
+	var err error
+	if plan.Duration, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil {
+		return plan, err
+	}
+	if plan.MaxHosts, err = strconv.Atoi(strings.TrimSpace(parts[2])); err != nil {
+		return plan, err
+	}
+	if plan.Price, err = parseAmount(strings.TrimSpace(parts[3])); err != nil {
+		return plan, err
+	}
+	return plan, nil
+}
+
+func unlockKey(keystorePath string) (*ecdsa.PrivateKey, error) {
 	pw := os.Getenv("KEYSTORE_PASSPHRASE")
-	r, err := os.Open(keystorePath)
+	keyjson, err := ioutil.ReadFile(keystorePath)
 	if err != nil {
 		return nil, err
 	}
-	return bind.NewTransactor(r, pw)
+	key, err := keystore.DecryptKey(keyjson, pw)
+	if err != nil {
+		return nil, err
+	}
+	return key.PrivateKey, nil
+}
+
+func runPoolExport(options Options) error {
+	storeDriver, err := openStore(options.Pool.Store, options.Pool.DataDir)
+	if err != nil {
+		return err
+	}
+	defer storeDriver.Close()
+
+	w := io.Writer(os.Stdout)
+	if path := options.Pool.Export.Args.Path; path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	n, err := store.Export(bw, storeDriver)
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	logger.Infof("Exported %d records.", n)
+	return nil
+}
+
+func runPoolImport(options Options) error {
+	storeDriver, err := openStore(options.Pool.Store, options.Pool.DataDir)
+	if err != nil {
+		return err
+	}
+	defer storeDriver.Close()
+
+	r := io.Reader(os.Stdin)
+	if path := options.Pool.Import.Args.Path; path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := store.Import(bufio.NewReader(r), storeDriver)
+	if err != nil {
+		return fmt.Errorf("import stopped after %d records: %s", n, err)
+	}
+	logger.Infof("Imported %d records.", n)
+	return nil
+}
+
+func runPoolMigrate(options Options) error {
+	dstDriver, dstDir := options.Pool.Migrate.Store, options.Pool.Migrate.DataDir
+	if dstDir == "" {
+		dstDir = options.Pool.DataDir
+	}
+	if dstDriver == "memory" {
+		return ErrExplain{errors.New("invalid migrate destination"), "The memory store is lost when the process exits. Set --to to a persistent storage driver."}
+	}
+	if storeKind(dstDriver) == storeKind(options.Pool.Store) && dstDir == options.Pool.DataDir {
+		return ErrExplain{errors.New("invalid migrate destination"), "The destination is the same as the pool's store. Set --to to another storage driver, or --to-datadir to another path."}
+	}
+
+	src, err := openStore(options.Pool.Store, options.Pool.DataDir)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openStore(dstDriver, dstDir)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// Copying into a store with existing state would merge the two, which
+	// the verification can't tell apart from a broken copy.
+	errNotEmpty := errors.New("destination store is not empty")
+	if err := dst.Dump(func(store.Record) error { return errNotEmpty }); err == errNotEmpty {
+		return ErrExplain{err, "Migrating requires an empty destination, so that the copy can be verified. Use `vipnode pool import` to merge a dump into an existing store."}
+	} else if err != nil {
+		return err
+	}
+
+	n, err := store.Copy(dst, src)
+	if err != nil {
+		return fmt.Errorf("copy stopped after %d records: %s", n, err)
+	}
+	if err := store.Verify(src, dst); err != nil {
+		return err
+	}
+	logger.Infof("Migrated %d records from the %s store to the %s store.", n, options.Pool.Store, dstDriver)
+	return nil
+}
+
+// storeKind normalizes storage driver aliases.
+func storeKind(driver string) string {
+	if driver == "persist" {
+		return "badger"
+	}
+	return driver
 }
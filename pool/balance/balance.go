@@ -3,6 +3,7 @@ package balance
 import (
 	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/vipnode/vipnode/v2/pool/store"
 )
@@ -11,20 +12,129 @@ import (
 type LowBalanceError struct {
 	MinBalance     *big.Int
 	CurrentBalance *big.Int
+	// Locked is the deposit that was not included in CurrentBalance because
+	// it's timelocked for a withdraw until Unlocks. (Optional)
+	Locked  *big.Int
+	Unlocks time.Time
 }
 
 func (err LowBalanceError) Error() string {
-	return fmt.Sprintf("low balance error: Current balance (%d) is less than the required minimum (%d)", err.CurrentBalance, err.MinBalance)
+	msg := fmt.Sprintf("low balance error: Current balance (%d) is less than the required minimum (%d)", err.CurrentBalance, err.MinBalance)
+	if err.Locked != nil && err.Locked.Sign() > 0 {
+		msg += fmt.Sprintf(", excluding a deposit (%d) that is timelocked for withdraw until %s", err.Locked, err.Unlocks.Format(time.RFC3339))
+	}
+	return msg
+}
+
+// spendable returns the balance that a node can spend, and the timelocked
+// deposit that was excluded from it. A timelocked deposit is only spendable
+// if spendLocked is set and it hasn't unlocked yet, since the account can
+// take it out of the contract after that.
+func spendable(balance store.Balance, spendLocked bool, now time.Time) (total *big.Int, excluded *big.Int) {
+	total = new(big.Int).Add(&balance.Credit, &balance.Deposit)
+	if !balance.IsLocked() {
+		return total, nil
+	}
+	if spendLocked && now.Before(balance.Unlocks) {
+		return total.Add(total, &balance.Locked), nil
+	}
+	return total, &balance.Locked
+}
+
+// lowBalanceError returns a LowBalanceError with the excluded timelocked
+// deposit, if any.
+func lowBalanceError(balance store.Balance, total *big.Int, excluded *big.Int, min *big.Int) LowBalanceError {
+	err := LowBalanceError{
+		CurrentBalance: total,
+		MinBalance:     min,
+	}
+	if excluded != nil {
+		err.Locked = excluded
+		err.Unlocks = balance.Unlocks
+	}
+	return err
+}
+
+// LowBalanceWarning is returned by a Manager along with a valid balance when
+// the node's balance is below the minimum, but the node is still within its
+// grace period or overdraft limit. The node should not be disconnected yet.
+type LowBalanceWarning struct {
+	MinBalance     *big.Int
+	CurrentBalance *big.Int
+	// Deadline is when the node will be disconnected unless more balance is
+	// deposited. (Zero if there is no grace period)
+	Deadline time.Time
+}
+
+func (err LowBalanceWarning) Error() string {
+	if err.Deadline.IsZero() {
+		return fmt.Sprintf("low balance warning: Current balance (%d) is less than the required minimum (%d)", err.CurrentBalance, err.MinBalance)
+	}
+	return fmt.Sprintf("low balance warning: Current balance (%d) is less than the required minimum (%d), disconnecting at %s", err.CurrentBalance, err.MinBalance, err.Deadline.Format(time.RFC3339))
+}
+
+// DisconnectError is returned by a Manager when the node must be disconnected
+// from its peers, such as when a trial has expired.
+type DisconnectError struct {
+	Reason string
+}
+
+func (err DisconnectError) Error() string {
+	return fmt.Sprintf("forced disconnect: %s", err.Reason)
+}
+
+// IsDisconnect returns true if the error returned by a Manager should cause
+// the node to be disconnected from its peers.
+func IsDisconnect(err error) bool {
+	switch err.(type) {
+	case LowBalanceError, DisconnectError:
+		return true
+	}
+	return false
 }
 
 // Manager is the minimal interface required to support a payment scheme. The
 // payment implementation will receive handler calls.
-// TODO: OnConnect, OnDisconnect, etc? OnConnect would be useful for time-based trials.
-// TODO: Support error type that forces a disconnect (eg. trial expired?)
 type Manager interface {
 	// OnClient is called when a client connects to the pool. If an error is
 	// returned, the client is disconnected with the error.
 	OnClient(node store.Node) error
 	// OnUpdate is called every time the state of a node's peers is updated.
 	OnUpdate(node store.Node, peers []store.Node) (store.Balance, error)
+
+	// OnConnect is called when a host connects to the pool and is ready to
+	// accept whitelist requests. If an error is returned, the host is
+	// disconnected with the error.
+	OnConnect(node store.Node) error
+	// OnDisconnect is called when a host's connection to the pool is closed.
+	OnDisconnect(node store.Node) error
+	// OnExpire is called when the pool stops tracking a node's peer links,
+	// such as when a peer stops reporting the connection from its side.
+	OnExpire(node store.Node, expired []store.NodeID) error
+	// OnUsage is called before OnUpdate with the traffic counters that the
+	// node reported for its active peers.
+	OnUsage(node store.Node, usage []store.Usage) error
+}
+
+// Biller is a Manager that splits a client's OnUpdate into computing the
+// charge and applying it, so that wrappers can meter or adjust the charge in
+// between, such as the Policies of a Chain.
+type Biller interface {
+	Manager
+	// Quote returns the charge for a client update without applying it.
+	Quote(node store.Node, peers []store.Node) (*Charge, error)
+	// Bill applies a charge from Quote, which may have been adjusted since.
+	// LowBalanceError and LowBalanceWarning are returned after the charge
+	// was applied.
+	Bill(charge *Charge) (store.Balance, error)
+}
+
+// isBilled returns true if the error returned by Bill means that the charge
+// was still applied.
+func isBilled(err error) bool {
+	switch err.(type) {
+	case nil, LowBalanceError, LowBalanceWarning:
+		return true
+	}
+	return false
 }
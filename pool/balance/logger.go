@@ -0,0 +1,20 @@
+package balance
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+var logger *log.Logger
+
+// SetLogger overrides the logger output for this package.
+func SetLogger(w io.Writer) {
+	flags := log.Flags()
+	prefix := "[balance] "
+	logger = log.New(w, prefix, flags)
+}
+
+func init() {
+	SetLogger(ioutil.Discard)
+}
@@ -12,3 +12,19 @@ func (b NoBalance) OnUpdate(node store.Node, peers []store.Node) (store.Balance,
 func (b NoBalance) OnClient(node store.Node) error {
 	return nil
 }
+
+func (b NoBalance) OnConnect(node store.Node) error {
+	return nil
+}
+
+func (b NoBalance) OnDisconnect(node store.Node) error {
+	return nil
+}
+
+func (b NoBalance) OnExpire(node store.Node, expired []store.NodeID) error {
+	return nil
+}
+
+func (b NoBalance) OnUsage(node store.Node, usage []store.Usage) error {
+	return nil
+}
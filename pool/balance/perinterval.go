@@ -3,6 +3,7 @@ package balance
 import (
 	"fmt"
 	"math/big"
+	"sync"
 	"time"
 
 	"github.com/vipnode/vipnode/v2/pool/store"
@@ -24,26 +25,109 @@ type payPerInterval struct {
 	// normalized by Interval to be the same over time.
 	Interval time.Duration
 	// CreditPerInterval is the cost per interval that gets credited to the host (and debited from the client)
+	// Hosts that set their own store.Node.Price are credited at that price instead.
 	CreditPerInterval big.Int
 	// MinBalance, if set, is the minimum balance a node must have before it gets errored out.
 	MinBalance *big.Int
+	// GracePeriod is how long a client can stay connected after its balance
+	// drops below MinBalance. During the grace period, OnUpdate returns a
+	// LowBalanceWarning instead of a LowBalanceError. (Optional)
+	// Grace periods only end when the balance is topped up, reconnecting
+	// doesn't reset them. They are not persisted, so they reset when the
+	// pool restarts.
+	GracePeriod time.Duration
+	// Overdraft is how far below MinBalance a client's balance can go before
+	// it gets errored out, even during the grace period. If there is no
+	// GracePeriod, then clients are only errored out past the overdraft.
+	// (Optional)
+	Overdraft *big.Int
+
+	// SpendLocked counts deposits that are timelocked for a withdraw towards
+	// MinBalance until they unlock, since the pool can still settle them
+	// until then.
+	SpendLocked bool
+
+	mu       sync.Mutex
+	lowSince map[store.NodeID]time.Time
 
 	// now is used for testing to override time-based behaviour
 	now func() time.Time
 }
 
-func (b *payPerInterval) intervalCredit(lastSeen time.Time) *big.Int {
+func (b *payPerInterval) timeNow() time.Time {
 	if b.now == nil {
-		b.now = time.Now
+		return time.Now()
+	}
+	return b.now()
+}
+
+func (b *payPerInterval) intervalCredit(lastSeen time.Time) *big.Int {
+	return b.intervalPrice(lastSeen, &b.CreditPerInterval)
+}
+
+// intervalPrice normalizes price per Interval to the time since lastSeen.
+func (b *payPerInterval) intervalPrice(lastSeen time.Time, price *big.Int) *big.Int {
+	return intervalAmount(b.timeNow().Sub(lastSeen), b.Interval, price)
+}
+
+// intervalAmount normalizes an amount per interval to the elapsed duration.
+func intervalAmount(elapsed time.Duration, interval time.Duration, amount *big.Int) *big.Int {
+	delta := big.NewInt(int64(elapsed))
+	r := new(big.Int).Mul(delta, amount)
+	return r.Div(r, big.NewInt(int64(interval)))
+}
+
+// checkBalance compares the balance to MinBalance. It returns a
+// LowBalanceWarning if the node is within its grace period or overdraft, or a
+// LowBalanceError once it's past them.
+func (b *payPerInterval) checkBalance(nodeID store.NodeID, balance store.Balance) error {
+	if b.MinBalance == nil {
+		return nil
+	}
+	now := b.timeNow()
+	total, excluded := spendable(balance, b.SpendLocked, now)
+	lowBalanceErr := lowBalanceError(balance, total, excluded, b.MinBalance)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.MinBalance.Cmp(total) <= 0 {
+		delete(b.lowSince, nodeID)
+		return nil
+	}
+	if b.GracePeriod == 0 && b.Overdraft == nil {
+		return lowBalanceErr
+	}
+
+	if b.lowSince == nil {
+		b.lowSince = map[store.NodeID]time.Time{}
+	}
+	since, ok := b.lowSince[nodeID]
+	if !ok {
+		since = now
+		b.lowSince[nodeID] = since
+	}
+
+	var deadline time.Time
+	if b.GracePeriod > 0 {
+		deadline = since.Add(b.GracePeriod)
+		if !now.Before(deadline) {
+			return lowBalanceErr
+		}
+	}
+	if b.Overdraft != nil && new(big.Int).Sub(b.MinBalance, b.Overdraft).Cmp(total) > 0 {
+		return lowBalanceErr
+	}
+	return LowBalanceWarning{
+		CurrentBalance: total,
+		MinBalance:     b.MinBalance,
+		Deadline:       deadline,
 	}
-	delta := big.NewInt(int64(b.now().Sub(lastSeen)))
-	interval := big.NewInt(int64(b.Interval))
-	credit := new(big.Int).Mul(delta, &b.CreditPerInterval)
-	return credit.Div(credit, interval)
 }
 
 // OnClient is called when a client connects to the pool. If an error is
-// returned, the client is disconnected with the error.
+// returned, the client is disconnected with the error. Clients that are
+// within their grace period are allowed to connect.
 func (b *payPerInterval) OnClient(node store.Node) error {
 	if b.MinBalance == nil {
 		return nil
@@ -52,17 +136,36 @@ func (b *payPerInterval) OnClient(node store.Node) error {
 	if err != nil {
 		return err
 	}
-	// TODO: Write a test for this
-	total := new(big.Int).Add(&balance.Credit, &balance.Deposit)
-	if b.MinBalance.Cmp(total) > 0 {
-		return LowBalanceError{
-			CurrentBalance: total,
-			MinBalance:     b.MinBalance,
+	if err := b.checkBalance(node.ID, balance); err != nil {
+		if _, ok := err.(LowBalanceWarning); !ok {
+			return err
 		}
 	}
 	return nil
 }
 
+// OnConnect is a no-op, hosts are credited during client updates.
+func (b *payPerInterval) OnConnect(node store.Node) error {
+	return nil
+}
+
+// OnDisconnect is a no-op, the client stops being billed for a host once the
+// peer link expires. The client's grace period keeps running, so that it
+// can't be restarted by reconnecting.
+func (b *payPerInterval) OnDisconnect(node store.Node) error {
+	return nil
+}
+
+// OnExpire is a no-op, expired peers are no longer included in OnUpdate.
+func (b *payPerInterval) OnExpire(node store.Node, expired []store.NodeID) error {
+	return nil
+}
+
+// OnUsage is a no-op, payPerInterval only meters connection time.
+func (b *payPerInterval) OnUsage(node store.Node, usage []store.Usage) error {
+	return nil
+}
+
 // OnUpdate takes a node instance (with a LastSeen timestamp of the previous
 // update) and the current active peers.
 func (b *payPerInterval) OnUpdate(node store.Node, peers []store.Node) (store.Balance, error) {
@@ -71,31 +174,65 @@ func (b *payPerInterval) OnUpdate(node store.Node, peers []store.Node) (store.Ba
 		// client fails to update, then the host will disconnect.
 		return b.Store.GetNodeBalance(node.ID)
 	}
+	charge, err := b.Quote(node, peers)
+	if err != nil {
+		return store.Balance{}, err
+	}
+	return b.Bill(charge)
+}
+
+// Quote returns the charge for the client's connection time to each of its
+// peers since its LastSeen.
+func (b *payPerInterval) Quote(node store.Node, peers []store.Node) (*Charge, error) {
 	if b.Interval <= 0 || b.CreditPerInterval.Cmp(new(big.Int)) == 0 {
 		// FIXME: Ideally this should be caught earlier. Maybe move to an earlier On* callback once we have more. Also check to make sure the values are big enough for the int64/float64 math.
-		return store.Balance{}, fmt.Errorf("payPerInterval: Invalid interval settings: %d per %s", &b.CreditPerInterval, b.Interval)
+		return nil, fmt.Errorf("payPerInterval: Invalid interval settings: %d per %s", &b.CreditPerInterval, b.Interval)
 	}
 
 	credit := b.intervalCredit(node.LastSeen)
-	if credit.Cmp(new(big.Int)) == 0 {
+	charge := &Charge{
+		Node:    node,
+		Peers:   peers,
+		Elapsed: b.timeNow().Sub(node.LastSeen),
+		Credits: make([]*big.Int, 0, len(peers)),
+	}
+	for _, peer := range peers {
+		peerCredit := credit
+		if peer.Price != nil {
+			// Host set its own price
+			peerCredit = b.intervalPrice(node.LastSeen, peer.Price)
+		}
+		charge.Credits = append(charge.Credits, peerCredit)
+	}
+	return charge, nil
+}
+
+// Bill credits each host of the charge, minus the commission which goes to
+// the charge's Operator, and debits the client the total.
+func (b *payPerInterval) Bill(charge *Charge) (store.Balance, error) {
+	node := charge.Node
+	if !hasCredit(charge.Credits) {
 		// No time passed?
 		return b.Store.GetNodeBalance(node.ID)
 	}
 
 	total := new(big.Int)
-	for _, peer := range peers {
-		b.Store.AddNodeBalance(peer.ID, credit)
-		total.Add(total, credit)
-	}
-
-	// If this comparison is in the wrong place, it could make the pool
-	// insolvent. On the other hand, if we compare too early, then the client
-	// could get into a loop where it disconnects due to low balance, connects
-	// successfully, repeat.
-	if b.MinBalance != nil && b.MinBalance.Cmp(total) > 0 {
-		return store.Balance{}, LowBalanceError{
-			CurrentBalance: total,
-			MinBalance:     b.MinBalance,
+	operatorTotal := new(big.Int)
+	for i, peer := range charge.Peers {
+		peerCredit := charge.Credits[i]
+		commission := new(big.Int)
+		if charge.Operator != "" && i < len(charge.Commissions) && charge.Commissions[i] != nil {
+			commission = boundCommission(charge.Commissions[i], peerCredit)
+		}
+		if err := b.Store.AddNodeBalance(peer.ID, new(big.Int).Sub(peerCredit, commission)); err != nil {
+			return store.Balance{}, err
+		}
+		operatorTotal.Add(operatorTotal, commission)
+		total.Add(total, peerCredit)
+	}
+	if operatorTotal.Sign() > 0 {
+		if err := b.Store.AddAccountBalance(charge.Operator, operatorTotal); err != nil {
+			return store.Balance{}, err
 		}
 	}
 
@@ -107,5 +244,36 @@ func (b *payPerInterval) OnUpdate(node store.Node, peers []store.Node) (store.Ba
 		return balance, err
 	}
 
-	return b.Store.GetNodeBalance(node.ID)
+	// The balance is checked after the hosts are paid, otherwise the pool
+	// could become insolvent. A LowBalanceWarning is returned along with the
+	// balance, so that the client can be notified before it's disconnected.
+	if err := b.checkBalance(node.ID, balance); err != nil {
+		if _, ok := err.(LowBalanceWarning); ok {
+			return balance, err
+		}
+		return store.Balance{}, err
+	}
+	return balance, nil
+}
+
+// boundCommission returns the commission, bounded so that it's never
+// negative or more than the credit.
+func boundCommission(commission *big.Int, credit *big.Int) *big.Int {
+	if commission.Sign() < 0 || credit.Sign() <= 0 {
+		return new(big.Int)
+	}
+	if commission.Cmp(credit) > 0 {
+		return credit
+	}
+	return commission
+}
+
+// hasCredit returns whether any of the credits are set.
+func hasCredit(credits []*big.Int) bool {
+	for _, credit := range credits {
+		if credit != nil && credit.Sign() != 0 {
+			return true
+		}
+	}
+	return false
 }
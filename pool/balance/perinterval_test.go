@@ -2,6 +2,7 @@ package balance
 
 import (
 	"math/big"
+	"strings"
 	"testing"
 	"time"
 
@@ -36,7 +37,7 @@ func TestPerInterval(t *testing.T) {
 
 	nodes := []store.Node{}
 	{
-		ids := []string{"a", "b"}
+		ids := []string{strings.Repeat("a", 128), strings.Repeat("b", 128)}
 		for _, id := range ids {
 			parsedID, err := store.ParseNodeID(id)
 			if err != nil {
@@ -45,7 +46,7 @@ func TestPerInterval(t *testing.T) {
 			node := store.Node{
 				ID:       parsedID,
 				LastSeen: now,
-				IsHost:   id == "a",
+				IsHost:   id == ids[0],
 			}
 			nodes = append(nodes, node)
 			if err := storeDriver.SetNode(node); err != nil {
@@ -82,3 +83,199 @@ func TestPerInterval(t *testing.T) {
 	check(nodes[1], nodes[0:1], -7000)
 	check(nodes[0], nodes[1:], 7000) // host
 }
+
+func TestPerIntervalHostPrice(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	balanceManager := &payPerInterval{
+		Store:             storeDriver,
+		Interval:          time.Minute * 1,
+		CreditPerInterval: *big.NewInt(1000),
+		now:               func() time.Time { return now },
+	}
+
+	client := store.Node{ID: "client", LastSeen: now}
+	hosts := []store.Node{
+		{ID: "default", IsHost: true, LastSeen: now},
+		{ID: "pricey", IsHost: true, LastSeen: now, Price: big.NewInt(3000)},
+	}
+	for _, node := range append(hosts, client) {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(time.Minute * 2)
+	balance, err := balanceManager.OnUpdate(client, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := balance.Credit.Int64(), int64(-8000); got != want {
+		t.Errorf("wrong client balance: got %d; want %d", got, want)
+	}
+
+	for _, host := range hosts {
+		want := int64(2000)
+		if host.Price != nil {
+			want = 2 * host.Price.Int64()
+		}
+		balance, err := storeDriver.GetNodeBalance(host.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := balance.Credit.Int64(); got != want {
+			t.Errorf("[host=%s] wrong balance: got %d; want %d", host.ID, got, want)
+		}
+	}
+}
+
+func TestPerIntervalGracePeriod(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	payManager := &payPerInterval{
+		Store:             storeDriver,
+		Interval:          time.Minute * 1,
+		CreditPerInterval: *big.NewInt(1000),
+		MinBalance:        big.NewInt(0),
+		GracePeriod:       time.Minute * 5,
+		Overdraft:         big.NewInt(4000),
+		now:               func() time.Time { return now },
+	}
+
+	host := store.Node{ID: "a", IsHost: true, LastSeen: now}
+	client := store.Node{ID: "b", LastSeen: now}
+	for _, node := range []store.Node{host, client} {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storeDriver.AddNodeBalance(client.ID, big.NewInt(1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Balance drops below the minimum, grace period starts
+	now = now.Add(time.Minute * 2)
+	balance, err := payManager.OnUpdate(client, []store.Node{host})
+	warning, ok := err.(LowBalanceWarning)
+	if !ok {
+		t.Fatalf("expected low balance warning, got: %v", err)
+	}
+	if balance.Credit.Cmp(big.NewInt(-1000)) != 0 {
+		t.Errorf("client was not charged during grace period: %d", &balance.Credit)
+	}
+	if want := now.Add(time.Minute * 5); !warning.Deadline.Equal(want) {
+		t.Errorf("wrong deadline: got %s; want %s", warning.Deadline, want)
+	}
+	if IsDisconnect(err) {
+		t.Errorf("warning should not disconnect")
+	}
+	if err := payManager.OnClient(client); err != nil {
+		t.Errorf("unexpected OnClient error during grace period: %s", err)
+	}
+
+	// Grace period is over
+	client.LastSeen = now
+	now = now.Add(time.Minute * 5)
+	if _, err := payManager.OnUpdate(client, []store.Node{host}); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error after grace period, got: %v", err)
+	}
+	if err := payManager.OnClient(client); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error on reconnect, got: %v", err)
+	}
+
+	// Topping up the balance resets the grace period
+	if err := storeDriver.AddNodeBalance(client.ID, big.NewInt(10000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := payManager.OnClient(client); err != nil {
+		t.Errorf("unexpected OnClient error after deposit: %s", err)
+	}
+	client.LastSeen = now
+	now = now.Add(time.Minute * 3)
+	if _, err := payManager.OnUpdate(client, []store.Node{host}); err != nil {
+		t.Errorf("unexpected OnUpdate error after deposit: %s", err)
+	}
+	client.LastSeen = now
+	now = now.Add(time.Minute * 2)
+	if _, err := payManager.OnUpdate(client, []store.Node{host}); err == nil {
+		t.Errorf("expected low balance warning")
+	} else if IsDisconnect(err) {
+		t.Errorf("expected low balance warning after reset, got: %s", err)
+	}
+
+	// Exceeding the overdraft disconnects, even during the grace period
+	client.LastSeen = now
+	now = now.Add(time.Minute * 4)
+	if _, err := payManager.OnUpdate(client, []store.Node{host}); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error past the overdraft, got: %v", err)
+	}
+
+	// Reconnecting or cycling hosts doesn't restart the grace period
+	since := payManager.lowSince[client.ID]
+	if err := payManager.OnExpire(host, []store.NodeID{client.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := payManager.OnDisconnect(client); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := payManager.lowSince[client.ID]; !ok || !got.Equal(since) {
+		t.Errorf("grace period was reset: got %s; want %s", got, since)
+	}
+}
+
+// lockedStore reports a timelocked deposit for every balance.
+type lockedStore struct {
+	store.BalanceStore
+	locked  *big.Int
+	unlocks time.Time
+}
+
+func (s *lockedStore) GetNodeBalance(nodeID store.NodeID) (store.Balance, error) {
+	balance, err := s.BalanceStore.GetNodeBalance(nodeID)
+	balance.Locked = *s.locked
+	balance.Unlocks = s.unlocks
+	return balance, err
+}
+
+func TestPerIntervalLocked(t *testing.T) {
+	memStore := memory.New()
+	now := time.Now()
+	storeDriver := &lockedStore{
+		BalanceStore: memStore,
+		locked:       big.NewInt(5000),
+		unlocks:      now.Add(time.Hour),
+	}
+	payManager := &payPerInterval{
+		Store:             storeDriver,
+		Interval:          time.Minute * 1,
+		CreditPerInterval: *big.NewInt(1000),
+		MinBalance:        big.NewInt(1000),
+		now:               func() time.Time { return now },
+	}
+
+	client := store.Node{ID: "b", LastSeen: now}
+	if err := memStore.SetNode(client); err != nil {
+		t.Fatal(err)
+	}
+
+	err := payManager.OnClient(client)
+	lowBalanceErr, ok := err.(LowBalanceError)
+	if !ok {
+		t.Fatalf("expected low balance error, got: %v", err)
+	}
+	if lowBalanceErr.Locked == nil || lowBalanceErr.Locked.Cmp(big.NewInt(5000)) != 0 || !lowBalanceErr.Unlocks.Equal(storeDriver.unlocks) {
+		t.Errorf("missing timelock in error: %s", err)
+	}
+
+	// Policy can allow spending the deposit until it unlocks
+	payManager.SpendLocked = true
+	if err := payManager.OnClient(client); err != nil {
+		t.Errorf("unexpected OnClient error: %s", err)
+	}
+	now = now.Add(time.Hour)
+	if err := payManager.OnClient(client); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error after unlock, got: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package balance
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// bytesPerMB is the unit that PricePerMB is charged for.
+const bytesPerMB = 1000000
+
+// PayPerUsage creates a balance Manager which bills clients for the traffic
+// that hosts serve them, instead of for connection time. Both sides of a
+// connection report their cumulative traffic counters, and the host's
+// counters are billed as long as the client's agree with them. Links that
+// only one side reports, or whose reports disagree, are billed by the
+// wrapped Biller for connection time instead, so that under-reporting
+// doesn't pay off for either side.
+func PayPerUsage(biller Biller, pricePerMB *big.Int, pricePerRequest *big.Int) *payPerUsage {
+	return &payPerUsage{
+		Biller:          biller,
+		PricePerMB:      pricePerMB,
+		PricePerRequest: pricePerRequest,
+		Tolerance:       big.NewRat(1, 10),
+		reported:        map[usageKey]store.Usage{},
+		links:           map[usageKey]*usageLink{},
+		quoted:          map[store.NodeID][]quotedUsage{},
+	}
+}
+
+// usageKey identifies a directional (reporter, peer) or (client, host) pair.
+type usageKey struct {
+	a, b store.NodeID
+}
+
+// usageLink is the traffic of a client-host connection, as reported by each
+// side, and how much of it was billed so far.
+type usageLink struct {
+	clientBytes, clientRequests uint64
+	hostBytes, hostRequests     uint64
+	billedBytes, billedRequests uint64
+
+	clientReported, hostReported bool
+	// metered is set once both sides have reported, from then on the link is
+	// billed by usage.
+	metered bool
+	// disputed is set once the reports disagree, from then on the link is
+	// billed by connection time.
+	disputed bool
+}
+
+// quotedUsage is the traffic of a client-host link that a quote charged for,
+// which is marked as billed once the charge is applied.
+type quotedUsage struct {
+	link            usageKey
+	bytes, requests uint64
+}
+
+type payPerUsage struct {
+	// Biller quotes the links without usage by connection time, and bills
+	// the charges with its low balance handling.
+	Biller
+	// PricePerMB is charged to the client for every MB the host sends it,
+	// and credited to the host. (Optional)
+	PricePerMB *big.Int
+	// PricePerRequest is charged to the client for every request unit the
+	// host serves, and credited to the host. (Optional)
+	PricePerRequest *big.Int
+	// Tolerance is how much more than the client a host can report before
+	// the link is disputed, as a fraction of the client's report. Links are
+	// billed right after the client reports, so honest hosts report less
+	// than their clients.
+	Tolerance *big.Rat
+
+	// Traffic counters are not persisted, so any unbilled traffic is lost
+	// when the pool restarts.
+	mu       sync.Mutex
+	reported map[usageKey]store.Usage       // Last counters by (reporter, peer)
+	links    map[usageKey]*usageLink        // Traffic by (client, host)
+	quoted   map[store.NodeID][]quotedUsage // Usage of the last quote by client
+}
+
+// cost returns the price of the given traffic.
+func (b *payPerUsage) cost(bytes uint64, requests uint64) *big.Int {
+	r := new(big.Int)
+	if b.PricePerMB != nil {
+		r.Mul(new(big.Int).SetUint64(bytes), b.PricePerMB)
+		r.Div(r, big.NewInt(bytesPerMB))
+	}
+	if b.PricePerRequest != nil {
+		r.Add(r, new(big.Int).Mul(new(big.Int).SetUint64(requests), b.PricePerRequest))
+	}
+	return r
+}
+
+// exceeds returns whether the host's counter is more than the client's
+// counter allows for within the Tolerance.
+func (b *payPerUsage) exceeds(host uint64, client uint64) bool {
+	if host <= client {
+		return false
+	}
+	if b.Tolerance == nil {
+		return true
+	}
+	limit := new(big.Rat).SetInt(new(big.Int).SetUint64(client))
+	limit.Mul(limit, new(big.Rat).Add(big.NewRat(1, 1), b.Tolerance))
+	return new(big.Rat).SetInt(new(big.Int).SetUint64(host)).Cmp(limit) > 0
+}
+
+// delta returns the increase of the counter since the last report. Counters
+// that went down are assumed to have been reset by a reconnect.
+func delta(last, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// OnExpire forgets the traffic counters of the expired peer links. Any
+// traffic that wasn't billed yet is not billed.
+func (b *payPerUsage) OnExpire(node store.Node, expired []store.NodeID) error {
+	b.mu.Lock()
+	for _, peerID := range expired {
+		delete(b.reported, usageKey{node.ID, peerID})
+		if node.IsHost {
+			delete(b.links, usageKey{peerID, node.ID})
+		} else {
+			delete(b.links, usageKey{node.ID, peerID})
+		}
+	}
+	b.mu.Unlock()
+	return b.Biller.OnExpire(node, expired)
+}
+
+// OnUsage adds the traffic that the node reported to its peer links, to be
+// billed on the client's next OnUpdate. Hosts report the bytes they sent and
+// the requests they served, clients report the bytes they received and the
+// requests they sent.
+func (b *payPerUsage) OnUsage(node store.Node, usage []store.Usage) error {
+	b.mu.Lock()
+	for _, u := range usage {
+		reportKey := usageKey{node.ID, u.Peer}
+		last := b.reported[reportKey]
+		b.reported[reportKey] = u
+
+		linkKey := usageKey{node.ID, u.Peer}
+		if node.IsHost {
+			linkKey = usageKey{u.Peer, node.ID}
+		}
+		link, ok := b.links[linkKey]
+		if !ok {
+			link = &usageLink{}
+			b.links[linkKey] = link
+		}
+		if node.IsHost {
+			link.hostBytes += delta(last.BytesOut, u.BytesOut)
+			link.hostRequests += delta(last.Requests, u.Requests)
+			link.hostReported = true
+		} else {
+			link.clientBytes += delta(last.BytesIn, u.BytesIn)
+			link.clientRequests += delta(last.Requests, u.Requests)
+			link.clientReported = true
+		}
+	}
+	b.mu.Unlock()
+	return b.Biller.OnUsage(node, usage)
+}
+
+// usageCredit returns the credit of the link's traffic since it was last
+// billed, or nil if the link is billed by connection time.
+func (b *payPerUsage) usageCredit(client store.NodeID, host store.NodeID) *big.Int {
+	key := usageKey{client, host}
+	link, ok := b.links[key]
+	if !ok || link.disputed || !link.clientReported || !link.hostReported {
+		return nil
+	}
+	if !link.metered {
+		// The traffic so far was billed by connection time, usage is
+		// billed from here on.
+		*link = usageLink{clientReported: true, hostReported: true, metered: true}
+		return nil
+	}
+	if b.exceeds(link.hostBytes, link.clientBytes) || b.exceeds(link.hostRequests, link.clientRequests) {
+		logger.Printf("Usage reports of client %s and host %s disagree, billing by connection time instead: host=%d bytes/%d requests client=%d bytes/%d requests", client, host, link.hostBytes, link.hostRequests, link.clientBytes, link.clientRequests)
+		link.disputed = true
+		return nil
+	}
+	// Billing the difference of the cumulative cost avoids losing fractions
+	// of a unit price to rounding on every update.
+	credit := new(big.Int).Sub(b.cost(link.hostBytes, link.hostRequests), b.cost(link.billedBytes, link.billedRequests))
+	b.quoted[client] = append(b.quoted[client], quotedUsage{key, link.hostBytes, link.hostRequests})
+	return credit
+}
+
+// Quote returns the wrapped Biller's charge, with the usage of the client's
+// metered peer links instead of their connection time.
+func (b *payPerUsage) Quote(node store.Node, peers []store.Node) (*Charge, error) {
+	if b.PricePerMB == nil && b.PricePerRequest == nil {
+		return nil, fmt.Errorf("payPerUsage: Invalid price settings: No price per MB or per request")
+	}
+	charge, err := b.Biller.Quote(node, peers)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.quoted, node.ID)
+	for i, peer := range charge.Peers {
+		if credit := b.usageCredit(node.ID, peer.ID); credit != nil {
+			charge.Credits[i] = credit
+		}
+	}
+	return charge, nil
+}
+
+// Bill applies the charge with the wrapped Biller, then marks the usage that
+// was quoted for it as billed. Usage that isn't billed is quoted again on the
+// client's next update.
+func (b *payPerUsage) Bill(charge *Charge) (store.Balance, error) {
+	balance, err := b.Biller.Bill(charge)
+	if !isBilled(err) {
+		return balance, err
+	}
+
+	b.mu.Lock()
+	for _, q := range b.quoted[charge.Node.ID] {
+		if link, ok := b.links[q.link]; ok {
+			link.billedBytes, link.billedRequests = q.bytes, q.requests
+		}
+	}
+	delete(b.quoted, charge.Node.ID)
+	b.mu.Unlock()
+	return balance, err
+}
+
+// OnUpdate bills the client for the usage of its metered peer links, and
+// for the connection time of the rest.
+func (b *payPerUsage) OnUpdate(node store.Node, peers []store.Node) (store.Balance, error) {
+	if node.IsHost {
+		return b.Biller.OnUpdate(node, peers)
+	}
+	charge, err := b.Quote(node, peers)
+	if err != nil {
+		return store.Balance{}, err
+	}
+	return b.Bill(charge)
+}
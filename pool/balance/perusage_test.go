@@ -0,0 +1,127 @@
+package balance
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestPerUsage(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	payManager := &payPerInterval{
+		Store:             storeDriver,
+		Interval:          time.Minute * 1,
+		CreditPerInterval: *big.NewInt(1000),
+		now:               func() time.Time { return now },
+	}
+	usageManager := PayPerUsage(payManager, big.NewInt(1000), big.NewInt(10))
+	chainManager := Chain(usageManager, Commission{Operator: "operator", Rate: big.NewRat(1, 10)})
+
+	host := store.Node{ID: "a", IsHost: true, LastSeen: now}
+	client := store.Node{ID: "b", LastSeen: now}
+	for _, node := range []store.Node{host, client} {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update := func(wantHost, wantClient, wantOperator int64) {
+		t.Helper()
+		now = now.Add(time.Minute)
+		clientBalance, err := chainManager.OnUpdate(client, []store.Node{host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.LastSeen = now
+		hostBalance, err := chainManager.OnUpdate(host, []store.Node{client})
+		if err != nil {
+			t.Fatal(err)
+		}
+		operatorBalance, err := storeDriver.GetAccountBalance("operator")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hostBalance.Credit.Cmp(big.NewInt(wantHost)) != 0 {
+			t.Errorf("wrong host balance: got %d; want %d", &hostBalance.Credit, wantHost)
+		}
+		if clientBalance.Credit.Cmp(big.NewInt(wantClient)) != 0 {
+			t.Errorf("wrong client balance: got %d; want %d", &clientBalance.Credit, wantClient)
+		}
+		if operatorBalance.Credit.Cmp(big.NewInt(wantOperator)) != 0 {
+			t.Errorf("wrong operator balance: got %d; want %d", &operatorBalance.Credit, wantOperator)
+		}
+	}
+
+	// Only one side reported, billed by connection time with commission
+	if err := usageManager.OnUsage(host, []store.Usage{{Peer: client.ID, BytesOut: 2500000, Requests: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	update(900, -1000, 100)
+
+	// Both sides reported, usage is billed from here on
+	if err := usageManager.OnUsage(client, []store.Usage{{Peer: host.ID, BytesIn: 2600000, Requests: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	update(1800, -2000, 200)
+
+	// Host reports a little less than the client, the host's usage is billed
+	if err := usageManager.OnUsage(host, []store.Usage{{Peer: client.ID, BytesOut: 4500000, Requests: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := usageManager.OnUsage(client, []store.Usage{{Peer: host.ID, BytesIn: 4700000, Requests: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	// Usage that was quoted but not billed is quoted again
+	if _, err := usageManager.Quote(client, []store.Node{host}); err != nil {
+		t.Fatal(err)
+	}
+	update(1800+1818, -2000-2020, 200+202)
+	if len(usageManager.quoted) != 0 {
+		t.Errorf("billed usage is still quoted: %v", usageManager.quoted)
+	}
+
+	// Counters reset after reconnecting
+	if err := usageManager.OnUsage(host, []store.Usage{{Peer: client.ID, BytesOut: 1000000}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := usageManager.OnUsage(client, []store.Usage{{Peer: host.ID, BytesIn: 1000500}}); err != nil {
+		t.Fatal(err)
+	}
+	update(3618+900, -4020-1000, 402+100)
+
+	// Client under-reports, the link is disputed and billed by time again
+	if err := usageManager.OnUsage(host, []store.Usage{{Peer: client.ID, BytesOut: 5000000}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := usageManager.OnUsage(client, []store.Usage{{Peer: host.ID, BytesIn: 1000600}}); err != nil {
+		t.Fatal(err)
+	}
+	update(4518+900, -5020-1000, 502+100)
+	if err := usageManager.OnUsage(client, []store.Usage{{Peer: host.ID, BytesIn: 9000000}}); err != nil {
+		t.Fatal(err)
+	}
+	update(5418+900, -6020-1000, 602+100)
+
+	// Expired links are forgotten
+	if err := usageManager.OnExpire(client, []store.NodeID{host.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if len(usageManager.links) != 0 || len(usageManager.reported) != 1 {
+		t.Errorf("expired link is still tracked: %v", usageManager.links)
+	}
+
+	// The wrapped manager's minimum balance applies
+	payManager.MinBalance = big.NewInt(0)
+	now = now.Add(time.Minute)
+	if _, err := usageManager.OnUpdate(client, []store.Node{host}); !IsDisconnect(err) {
+		t.Errorf("expected low balance error, got: %v", err)
+	}
+	if err := usageManager.OnClient(client); !IsDisconnect(err) {
+		t.Errorf("expected low balance error on connect, got: %v", err)
+	}
+}
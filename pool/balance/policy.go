@@ -0,0 +1,382 @@
+package balance
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// Charge is the computed charge for a client update, which is passed through
+// each Policy of a Chain in order before it is applied to the balances.
+type Charge struct {
+	// Node is the client being charged, with the LastSeen timestamp of the
+	// previous update.
+	Node store.Node
+	// Peers are the client's active hosts.
+	Peers []store.Node
+	// Elapsed is the time since the previous update that is being charged.
+	Elapsed time.Duration
+	// Credits is the amount that each host in Peers is credited, by index.
+	// The client is debited the total. Policies can adjust the credits in
+	// place.
+	Credits []*big.Int
+	// Operator is the account that is credited the Commissions. (Optional)
+	Operator store.Account
+	// Commissions is the part of each credit, by index, that goes to the
+	// Operator instead of the host. Commissions are bounded by their credit
+	// when the charge is applied. (Optional)
+	Commissions []*big.Int
+	// Notes are annotations added by policies, such as which discount was
+	// applied.
+	Notes []string
+}
+
+// Total returns the total amount that the client is charged.
+func (c *Charge) Total() *big.Int {
+	r := new(big.Int)
+	for _, credit := range c.Credits {
+		r.Add(r, credit)
+	}
+	return r
+}
+
+// Scale multiplies each of the credits by the rate.
+func (c *Charge) Scale(rate *big.Rat) {
+	for i, credit := range c.Credits {
+		scaled := new(big.Rat).Mul(new(big.Rat).SetInt(credit), rate)
+		c.Credits[i] = new(big.Int).Div(scaled.Num(), scaled.Denom())
+	}
+}
+
+// Annotate adds a note to the charge.
+func (c *Charge) Annotate(format string, a ...interface{}) {
+	c.Notes = append(c.Notes, fmt.Sprintf(format, a...))
+}
+
+// Policy is a step in a Chain. Policies run in order, each can adjust or
+// annotate the charge. If a Policy returns an error, then the update is
+// vetoed: the policies after it don't run, and the error is returned after
+// the charge is applied as it was adjusted so far, so that hosts are still
+// paid for the time they served. Returning a DisconnectError will disconnect
+// the client from its peers.
+type Policy interface {
+	Charge(charge *Charge) error
+}
+
+// Chain creates a balance Manager which wraps a Biller, such as PayPerInterval
+// or PayPerUsage, and passes each client charge through the policies in order
+// before it's applied. Clients are also checked by the policies that
+// implement ClientPolicy before they connect, and the policies that implement
+// HostPolicy are notified when hosts connect and disconnect.
+func Chain(biller Biller, policies ...Policy) *chain {
+	return &chain{
+		Biller:   biller,
+		Policies: policies,
+	}
+}
+
+type chain struct {
+	Biller
+	Policies []Policy
+}
+
+// OnClient runs the ClientPolicy checks before the wrapped Biller's.
+func (c *chain) OnClient(node store.Node) error {
+	for _, policy := range c.Policies {
+		if policy, ok := policy.(ClientPolicy); ok {
+			if err := policy.OnClient(node); err != nil {
+				return err
+			}
+		}
+	}
+	return c.Biller.OnClient(node)
+}
+
+// OnConnect notifies the HostPolicy policies before the wrapped Biller.
+func (c *chain) OnConnect(node store.Node) error {
+	for _, policy := range c.Policies {
+		if policy, ok := policy.(HostPolicy); ok {
+			policy.OnConnect(node)
+		}
+	}
+	return c.Biller.OnConnect(node)
+}
+
+// OnDisconnect notifies the HostPolicy policies before the wrapped Biller.
+func (c *chain) OnDisconnect(node store.Node) error {
+	for _, policy := range c.Policies {
+		if policy, ok := policy.(HostPolicy); ok {
+			policy.OnDisconnect(node)
+		}
+	}
+	return c.Biller.OnDisconnect(node)
+}
+
+// Bill runs the charge through the policies, then applies it. A vetoed
+// charge is applied as it was adjusted before the veto.
+func (c *chain) Bill(charge *Charge) (store.Balance, error) {
+	for _, policy := range c.Policies {
+		if err := policy.Charge(charge); err != nil {
+			if _, billErr := c.Biller.Bill(charge); !isBilled(billErr) {
+				return store.Balance{}, billErr
+			}
+			return store.Balance{}, err
+		}
+	}
+	if len(charge.Notes) > 0 {
+		logger.Printf("Charge for %s: %s", charge.Node.ID, strings.Join(charge.Notes, "; "))
+	}
+	return c.Biller.Bill(charge)
+}
+
+// OnUpdate quotes the client's charge and bills it through the policies.
+func (c *chain) OnUpdate(node store.Node, peers []store.Node) (store.Balance, error) {
+	if node.IsHost {
+		return c.Biller.OnUpdate(node, peers)
+	}
+	charge, err := c.Quote(node, peers)
+	if err != nil {
+		return store.Balance{}, err
+	}
+	return c.Bill(charge)
+}
+
+// ClientPolicy is an optional interface for a Policy that can veto clients
+// when they connect.
+type ClientPolicy interface {
+	OnClient(node store.Node) error
+}
+
+// HostPolicy is an optional interface for a Policy that keeps track of the
+// hosts that are connected to the pool.
+type HostPolicy interface {
+	OnConnect(node store.Node)
+	OnDisconnect(node store.Node)
+}
+
+// PolicyFunc is an adapter to use an ordinary function as a Policy.
+type PolicyFunc func(charge *Charge) error
+
+func (fn PolicyFunc) Charge(charge *Charge) error {
+	return fn(charge)
+}
+
+// Commission takes a part of each host credit for the pool Operator: Rate of
+// the credit, plus PerInterval for each Interval of the charge. It should be
+// after the policies that adjust the credits in the chain.
+type Commission struct {
+	Operator    store.Account
+	Rate        *big.Rat
+	PerInterval *big.Int
+	Interval    time.Duration
+}
+
+func (p Commission) Charge(charge *Charge) error {
+	if p.Operator == "" {
+		return nil
+	}
+	charge.Operator = p.Operator
+	charge.Commissions = make([]*big.Int, len(charge.Credits))
+	for i, credit := range charge.Credits {
+		r := new(big.Int)
+		if p.Rate != nil {
+			rate := new(big.Rat).Mul(new(big.Rat).SetInt(credit), p.Rate)
+			r.Div(rate.Num(), rate.Denom())
+		}
+		if p.PerInterval != nil && p.Interval > 0 {
+			r.Add(r, intervalAmount(charge.Elapsed, p.Interval, p.PerInterval))
+		}
+		charge.Commissions[i] = r
+	}
+	return nil
+}
+
+// VolumeDiscount discounts the charge by Rate for clients that are connected
+// to at least MinPeers hosts. Hosts are credited the discounted amount. Rate
+// must be between 0 and 1.
+type VolumeDiscount struct {
+	MinPeers int
+	Rate     *big.Rat
+}
+
+func (p VolumeDiscount) Charge(charge *Charge) error {
+	if len(charge.Peers) < p.MinPeers {
+		return nil
+	}
+	if p.Rate.Sign() < 0 || p.Rate.Cmp(big.NewRat(1, 1)) > 0 {
+		return fmt.Errorf("invalid volume discount rate: %s", p.Rate.FloatString(2))
+	}
+	charge.Scale(new(big.Rat).Sub(big.NewRat(1, 1), p.Rate))
+	charge.Annotate("volume discount: %s", p.Rate.FloatString(2))
+	return nil
+}
+
+// SurgePricing multiplies the charge by Multiplier while the pool has more
+// than Ratio active clients per connected host. Clients are active while
+// they were charged within the last store.ExpireInterval. The counts are
+// kept in memory from the charges and host connections that the policy
+// sees, so they start over when the pool restarts. Multiplier must not be
+// negative.
+type SurgePricing struct {
+	Ratio      float64
+	Multiplier *big.Rat
+
+	mu      sync.Mutex
+	hosts   map[store.NodeID]struct{}
+	clients map[store.NodeID]time.Time
+
+	// now is used for testing to override time-based behaviour
+	now func() time.Time
+}
+
+func (p *SurgePricing) timeNow() time.Time {
+	if p.now == nil {
+		return time.Now()
+	}
+	return p.now()
+}
+
+// OnConnect counts the host as connected.
+func (p *SurgePricing) OnConnect(node store.Node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.hosts == nil {
+		p.hosts = map[store.NodeID]struct{}{}
+	}
+	p.hosts[node.ID] = struct{}{}
+}
+
+// OnDisconnect stops counting the host.
+func (p *SurgePricing) OnDisconnect(node store.Node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.hosts, node.ID)
+}
+
+// isSurging counts the client as active, and returns whether there are too
+// many active clients per host. Clients that are no longer active are
+// forgotten.
+func (p *SurgePricing) isSurging(client store.NodeID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.timeNow()
+	if p.clients == nil {
+		p.clients = map[store.NodeID]time.Time{}
+	}
+	p.clients[client] = now
+	activeSince := now.Add(-store.ExpireInterval)
+	for id, charged := range p.clients {
+		if charged.Before(activeSince) {
+			delete(p.clients, id)
+		}
+	}
+	return float64(len(p.clients)) > float64(len(p.hosts))*p.Ratio
+}
+
+func (p *SurgePricing) Charge(charge *Charge) error {
+	if p.Multiplier.Sign() < 0 {
+		return fmt.Errorf("invalid surge pricing multiplier: %s", p.Multiplier.FloatString(2))
+	}
+	if !p.isSurging(charge.Node.ID) {
+		return nil
+	}
+	charge.Scale(p.Multiplier)
+	charge.Annotate("surge pricing: %s", p.Multiplier.FloatString(2))
+	return nil
+}
+
+// SpendingCap disconnects clients that have spent more than Amount within
+// the last Period. The charge is counted when the policy runs, so it should
+// be the last policy in the chain. Spending is not persisted, so it resets
+// when the pool restarts, and the windows that ended are forgotten once per
+// Period.
+func SpendingCap(period time.Duration, amount *big.Int) *spendingCap {
+	return &spendingCap{
+		Period: period,
+		Amount: amount,
+		spent:  map[store.NodeID]*capWindow{},
+	}
+}
+
+type capWindow struct {
+	start time.Time
+	spent *big.Int
+}
+
+type spendingCap struct {
+	Period time.Duration
+	Amount *big.Int
+
+	mu       sync.Mutex
+	spent    map[store.NodeID]*capWindow
+	prunedAt time.Time
+
+	// now is used for testing to override time-based behaviour
+	now func() time.Time
+}
+
+func (p *spendingCap) timeNow() time.Time {
+	if p.now == nil {
+		return time.Now()
+	}
+	return p.now()
+}
+
+// window returns the node's current spending window. Must be called with
+// the lock held.
+func (p *spendingCap) window(nodeID store.NodeID) *capWindow {
+	now := p.timeNow()
+	if now.Sub(p.prunedAt) >= p.Period {
+		for id, w := range p.spent {
+			if now.Sub(w.start) >= p.Period {
+				delete(p.spent, id)
+			}
+		}
+		p.prunedAt = now
+	}
+	w, ok := p.spent[nodeID]
+	if !ok || now.Sub(w.start) >= p.Period {
+		w = &capWindow{start: now, spent: new(big.Int)}
+		p.spent[nodeID] = w
+	}
+	return w
+}
+
+func (p *spendingCap) capError(w *capWindow) error {
+	return DisconnectError{
+		Reason: fmt.Sprintf("spending cap of %d per %s reached, resets at %s", p.Amount, p.Period, w.start.Add(p.Period).Format(time.RFC3339)),
+	}
+}
+
+// OnClient rejects clients that already reached their cap.
+func (p *spendingCap) OnClient(node store.Node) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if w := p.window(node.ID); w.spent.Cmp(p.Amount) >= 0 {
+		return p.capError(w)
+	}
+	return nil
+}
+
+func (p *spendingCap) Charge(charge *Charge) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w := p.window(charge.Node.ID)
+	reached := w.spent.Cmp(p.Amount) >= 0
+	// The charge is applied even if the cap was reached, so that hosts are
+	// paid for the time they served.
+	w.spent.Add(w.spent, charge.Total())
+	if reached {
+		return p.capError(w)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package balance
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestPolicies(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	capPolicy := SpendingCap(time.Hour, big.NewInt(5000))
+	capPolicy.now = func() time.Time { return now }
+	vetoErr := errors.New("vetoed")
+	veto := false
+	balanceManager := Chain(
+		&payPerInterval{
+			Store:             storeDriver,
+			Interval:          time.Minute * 1,
+			CreditPerInterval: *big.NewInt(1000),
+			now:               func() time.Time { return now },
+		},
+		VolumeDiscount{MinPeers: 2, Rate: big.NewRat(1, 4)},
+		PolicyFunc(func(charge *Charge) error {
+			if veto {
+				return vetoErr
+			}
+			return nil
+		}),
+		capPolicy,
+	)
+
+	client := store.Node{ID: "client", LastSeen: now}
+	hosts := []store.Node{
+		{ID: "a", IsHost: true, LastSeen: now},
+		{ID: "b", IsHost: true, LastSeen: now},
+	}
+	for _, node := range append(hosts, client) {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One host, no discount
+	now = now.Add(time.Minute * 2)
+	balance, err := balanceManager.OnUpdate(client, hosts[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := big.NewInt(-2000); balance.Credit.Cmp(want) != 0 {
+		t.Errorf("wrong balance: got %d; want %d", &balance.Credit, want)
+	}
+
+	// Two hosts, discounted
+	client.LastSeen = now
+	now = now.Add(time.Minute * 2)
+	balance, err = balanceManager.OnUpdate(client, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := big.NewInt(-2000 - 3000); balance.Credit.Cmp(want) != 0 {
+		t.Errorf("wrong balance: got %d; want %d", &balance.Credit, want)
+	}
+	if hostBalance, _ := storeDriver.GetNodeBalance("b"); hostBalance.Credit.Cmp(big.NewInt(1500)) != 0 {
+		t.Errorf("wrong discounted host balance: %d", &hostBalance.Credit)
+	}
+
+	// Vetoed updates are still charged for the time that was served, with
+	// the policies before the veto applied
+	veto = true
+	client.LastSeen = now
+	now = now.Add(time.Minute * 2)
+	if _, err := balanceManager.OnUpdate(client, hosts); err != vetoErr {
+		t.Errorf("expected veto error, got: %v", err)
+	}
+	if balance, _ := storeDriver.GetNodeBalance(client.ID); balance.Credit.Cmp(big.NewInt(-8000)) != 0 {
+		t.Errorf("vetoed update was not charged: %d", &balance.Credit)
+	}
+	if hostBalance, _ := storeDriver.GetNodeBalance("b"); hostBalance.Credit.Cmp(big.NewInt(3000)) != 0 {
+		t.Errorf("host was not paid for a vetoed update: %d", &hostBalance.Credit)
+	}
+	veto = false
+
+	// Spending cap was reached
+	client.LastSeen = now
+	now = now.Add(time.Minute * 2)
+	if _, err := balanceManager.OnUpdate(client, hosts); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error, got: %v", err)
+	}
+	if balance, _ := storeDriver.GetNodeBalance(client.ID); balance.Credit.Cmp(big.NewInt(-11000)) != 0 {
+		t.Errorf("capped update was not charged: %d", &balance.Credit)
+	}
+	if err := balanceManager.OnClient(client); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error on reconnect, got: %v", err)
+	}
+
+	// Spending cap resets after the period, and the windows that ended are
+	// forgotten
+	now = now.Add(time.Hour)
+	if err := balanceManager.OnClient(store.Node{ID: "other"}); err != nil {
+		t.Errorf("unexpected OnClient error: %s", err)
+	}
+	if _, ok := capPolicy.spent[client.ID]; ok {
+		t.Errorf("spending window that ended was not forgotten")
+	}
+	if err := balanceManager.OnClient(client); err != nil {
+		t.Errorf("unexpected OnClient error: %s", err)
+	}
+}
+
+func TestSurgePricing(t *testing.T) {
+	now := time.Now()
+	surge := &SurgePricing{Ratio: 1, Multiplier: big.NewRat(3, 2)}
+	surge.now = func() time.Time { return now }
+	surge.OnConnect(store.Node{ID: "a", IsHost: true})
+
+	charge := Charge{Node: store.Node{ID: "b"}, Credits: []*big.Int{big.NewInt(1000)}}
+	if err := surge.Charge(&charge); err != nil {
+		t.Fatal(err)
+	}
+	if got := charge.Total(); got.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("unexpected surge: %d", got)
+	}
+
+	// A second active client
+	charge.Node.ID = "c"
+	if err := surge.Charge(&charge); err != nil {
+		t.Fatal(err)
+	}
+	if got := charge.Total(); got.Cmp(big.NewInt(1500)) != 0 {
+		t.Errorf("expected surge: %d", got)
+	}
+	if len(charge.Notes) != 1 {
+		t.Errorf("expected surge annotation: %q", charge.Notes)
+	}
+
+	// Another host connects
+	surge.OnConnect(store.Node{ID: "d", IsHost: true})
+	charge = Charge{Node: store.Node{ID: "c"}, Credits: []*big.Int{big.NewInt(1000)}}
+	if err := surge.Charge(&charge); err != nil {
+		t.Fatal(err)
+	}
+	if got := charge.Total(); got.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("unexpected surge: %d", got)
+	}
+
+	// The host disconnects, but the other client is no longer active
+	surge.OnDisconnect(store.Node{ID: "d", IsHost: true})
+	now = now.Add(store.ExpireInterval + time.Minute)
+	if err := surge.Charge(&charge); err != nil {
+		t.Fatal(err)
+	}
+	if got := charge.Total(); got.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("unexpected surge: %d", got)
+	}
+	if len(surge.clients) != 1 {
+		t.Errorf("inactive clients were not forgotten: %v", surge.clients)
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	for _, policy := range []Policy{
+		VolumeDiscount{Rate: big.NewRat(5, 4)},
+		VolumeDiscount{Rate: big.NewRat(-1, 4)},
+		&SurgePricing{Multiplier: big.NewRat(-3, 2)},
+	} {
+		charge := Charge{Credits: []*big.Int{big.NewInt(1000)}}
+		if err := policy.Charge(&charge); err == nil {
+			t.Errorf("expected invalid policy error: %+v", policy)
+		}
+	}
+}
+
+func TestCommission(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	operator := store.Account("operator")
+	balanceManager := Chain(
+		&payPerInterval{
+			Store:             storeDriver,
+			Interval:          time.Minute * 1,
+			CreditPerInterval: *big.NewInt(1000),
+			now:               func() time.Time { return now },
+		},
+		Commission{
+			Operator:    operator,
+			Rate:        big.NewRat(1, 10),
+			PerInterval: big.NewInt(50),
+			Interval:    time.Minute * 1,
+		},
+	)
+
+	host := store.Node{ID: "host", IsHost: true, LastSeen: now}
+	client := store.Node{ID: "client", LastSeen: now}
+	for _, node := range []store.Node{host, client} {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(time.Minute * 2)
+	balance, err := balanceManager.OnUpdate(client, []store.Node{host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := balance.Credit.Int64(), int64(-2000); got != want {
+		t.Errorf("wrong client balance: got %d; want %d", got, want)
+	}
+
+	// 2000 credit - 10% - 2*50 fixed
+	if balance, err := storeDriver.GetNodeBalance(host.ID); err != nil {
+		t.Fatal(err)
+	} else if got, want := balance.Credit.Int64(), int64(1700); got != want {
+		t.Errorf("wrong host balance: got %d; want %d", got, want)
+	}
+
+	if balance, err := storeDriver.GetAccountBalance(operator); err != nil {
+		t.Fatal(err)
+	} else if got, want := balance.Credit.Int64(), int64(300); got != want {
+		t.Errorf("wrong operator balance: got %d; want %d", got, want)
+	}
+
+	stats, err := storeDriver.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.TotalCredit.Int64(), int64(0); got != want {
+		t.Errorf("pool is not balanced: total credit %d; want %d", got, want)
+	}
+}
+
+func TestCommissionBounds(t *testing.T) {
+	credit := big.NewInt(1000)
+	for _, tc := range []struct {
+		commission Commission
+		want       *big.Int
+	}{
+		{Commission{Operator: "operator", Rate: big.NewRat(-1, 10)}, big.NewInt(0)},
+		{Commission{Operator: "operator", Rate: big.NewRat(3, 2)}, credit},
+		{Commission{Operator: "operator", PerInterval: big.NewInt(-50), Interval: time.Minute}, big.NewInt(0)},
+	} {
+		charge := Charge{Elapsed: time.Minute, Credits: []*big.Int{credit}}
+		if err := tc.commission.Charge(&charge); err != nil {
+			t.Fatal(err)
+		}
+		if got := boundCommission(charge.Commissions[0], credit); got.Cmp(tc.want) != 0 {
+			t.Errorf("wrong commission for %+v: got %d; want %d", tc.commission, got, tc.want)
+		}
+	}
+}
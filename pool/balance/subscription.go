@@ -0,0 +1,352 @@
+package balance
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// ErrUnknownPlan is returned when subscribing to a plan that does not exist.
+var ErrUnknownPlan = errors.New("unknown subscription plan")
+
+// Plan is a prepaid subscription plan that an account can buy.
+type Plan struct {
+	Name string `json:"name"`
+	// Duration is how long the subscription lasts once bought.
+	Duration time.Duration `json:"duration"`
+	// MaxHosts is the number of concurrent hosts covered by the plan. Any
+	// additional hosts are metered. (0 is unlimited)
+	MaxHosts int `json:"max_hosts"`
+	// Price is the amount that is charged from the account's balance when
+	// the plan is bought or renewed.
+	Price *big.Int `json:"price"`
+}
+
+// Subscriptions creates a balance Manager for prepaid subscription plans.
+// Clients with an active subscription are not metered. Instead, their hosts
+// are paid CreditPerInterval from the funding account, which collects the
+// plan payments. Clients without a subscription, and any hosts beyond the
+// plan's MaxHosts, are billed by the metered Manager. The funding account is
+// internal, so its balance is kept in fundingStore rather than going through
+// a contract balance proxy.
+func Subscriptions(metered Manager, balanceStore store.BalanceStore, fundingStore store.BalanceStore, subscriptionStore store.SubscriptionStore, funding store.Account, interval time.Duration, creditPerInterval *big.Int) *subscriptions {
+	return &subscriptions{
+		Manager:           metered,
+		BalanceStore:      balanceStore,
+		FundingStore:      fundingStore,
+		SubscriptionStore: subscriptionStore,
+		Funding:           funding,
+		Interval:          interval,
+		CreditPerInterval: creditPerInterval,
+	}
+}
+
+type subscriptions struct {
+	Manager
+
+	BalanceStore      store.BalanceStore
+	FundingStore      store.BalanceStore
+	SubscriptionStore store.SubscriptionStore
+	// Plans are the subscription plans that are available to buy.
+	Plans []Plan
+	// Funding is the account that receives plan payments and pays the hosts
+	// of subscribed clients.
+	Funding store.Account
+	// Interval and CreditPerInterval is the rate that hosts are paid for
+	// serving subscribed clients. Hosts with a lower price of their own are
+	// paid their price, hosts with a higher price are still paid this rate.
+	Interval          time.Duration
+	CreditPerInterval *big.Int
+
+	// mu serializes charging for plans, so that renewals are not charged
+	// twice.
+	mu sync.Mutex
+
+	// now is used for testing to override time-based behaviour
+	now func() time.Time
+}
+
+func (b *subscriptions) timeNow() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+// AddPlan makes a plan available to buy.
+func (b *subscriptions) AddPlan(plan Plan) error {
+	if plan.Name == "" || plan.Duration <= 0 || plan.Price == nil || plan.Price.Sign() < 0 {
+		return fmt.Errorf("invalid subscription plan: %+v", plan)
+	}
+	if _, ok := b.plan(plan.Name); ok {
+		return fmt.Errorf("duplicate subscription plan: %q", plan.Name)
+	}
+	b.Plans = append(b.Plans, plan)
+	return nil
+}
+
+// AvailablePlans returns the plans that are available to buy.
+func (b *subscriptions) AvailablePlans() []Plan {
+	return b.Plans
+}
+
+func (b *subscriptions) plan(name string) (Plan, bool) {
+	for _, plan := range b.Plans {
+		if plan.Name == name {
+			return plan, true
+		}
+	}
+	return Plan{}, false
+}
+
+// Subscribe buys a plan for the account, paid from the account's balance. If
+// the account already has an active subscription to the plan, then it is
+// extended. If it's subscribed to another plan, then the unused time of the
+// old plan is credited back before the new plan is charged.
+func (b *subscriptions) Subscribe(account store.Account, planName string, renew bool) (*store.Subscription, error) {
+	plan, ok := b.plan(planName)
+	if !ok {
+		return nil, ErrUnknownPlan
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := b.timeNow()
+	refund := new(big.Int)
+	subscription, err := b.SubscriptionStore.GetSubscription(account)
+	if err == store.ErrNoSubscription {
+		subscription = &store.Subscription{Account: account}
+	} else if err != nil {
+		return nil, err
+	} else if subscription.Active(start) {
+		if subscription.Plan == plan.Name {
+			start = subscription.Expires
+		} else if refund, err = b.unusedCredit(*subscription, start); err != nil {
+			return nil, err
+		}
+	}
+
+	if refund.Sign() > 0 {
+		if err := b.transfer(b.Funding, account, refund); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.charge(account, plan); err != nil {
+		if refund.Sign() > 0 {
+			if undoErr := b.transfer(account, b.Funding, refund); undoErr != nil {
+				return nil, fmt.Errorf("failed to undo the plan change refund: %s (after: %s)", undoErr, err)
+			}
+		}
+		return nil, err
+	}
+	subscription.Plan = plan.Name
+	subscription.MaxHosts = plan.MaxHosts
+	subscription.Expires = start.Add(plan.Duration)
+	subscription.Renew = renew
+	if err := b.SubscriptionStore.SetSubscription(*subscription); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// charge moves the plan price from the account to the funding account.
+func (b *subscriptions) charge(account store.Account, plan Plan) error {
+	balance, err := b.BalanceStore.GetAccountBalance(account)
+	if err != nil {
+		return err
+	}
+	// Timelocked deposits are being withdrawn, so they can't buy plans
+	total, excluded := spendable(balance, false, b.timeNow())
+	if total.Cmp(plan.Price) < 0 {
+		return lowBalanceError(balance, total, excluded, plan.Price)
+	}
+	return b.transfer(account, b.Funding, plan.Price)
+}
+
+// transfer moves amount from one account's credit to another.
+func (b *subscriptions) transfer(from store.Account, to store.Account, amount *big.Int) error {
+	if err := b.accountStore(from).AddAccountBalance(from, new(big.Int).Neg(amount)); err != nil {
+		return err
+	}
+	return b.accountStore(to).AddAccountBalance(to, amount)
+}
+
+// accountStore returns the store that keeps the account's balance.
+func (b *subscriptions) accountStore(account store.Account) store.BalanceStore {
+	if account == b.Funding {
+		return b.FundingStore
+	}
+	return b.BalanceStore
+}
+
+// unusedCredit returns the price of the subscription's time left after now,
+// prorated from its plan. It is never more than the funding account's
+// credit, so that refunds don't push it below zero.
+func (b *subscriptions) unusedCredit(subscription store.Subscription, now time.Time) (*big.Int, error) {
+	r := new(big.Int)
+	plan, ok := b.plan(subscription.Plan)
+	if !ok || !subscription.Active(now) {
+		// Plans that are no longer offered have no price to prorate
+		return r, nil
+	}
+	r.Mul(plan.Price, big.NewInt(int64(subscription.Expires.Sub(now))))
+	r.Div(r, big.NewInt(int64(plan.Duration)))
+
+	funding, err := b.FundingStore.GetAccountBalance(b.Funding)
+	if err != nil {
+		return nil, err
+	}
+	if r.Cmp(&funding.Credit) > 0 {
+		r.Set(&funding.Credit)
+	}
+	if r.Sign() < 0 {
+		r.SetInt64(0)
+	}
+	return r, nil
+}
+
+// activeSubscription returns the node's active subscription, renewing it if
+// it expired and it's set to renew. It returns nil if the node is not
+// subscribed.
+func (b *subscriptions) activeSubscription(node store.Node) (*store.Subscription, error) {
+	if node.IsHost {
+		return nil, nil
+	}
+	balance, err := b.BalanceStore.GetNodeBalance(node.ID)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Account == "" {
+		// Trial nodes can't subscribe
+		return nil, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscription, err := b.SubscriptionStore.GetSubscription(balance.Account)
+	if err == store.ErrNoSubscription {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := b.timeNow()
+	if subscription.Active(now) {
+		return subscription, nil
+	}
+	if !subscription.Renew {
+		return nil, nil
+	}
+
+	plan, ok := b.plan(subscription.Plan)
+	if !ok {
+		// Plan is no longer offered
+		return nil, nil
+	}
+	if err := b.charge(subscription.Account, plan); err != nil {
+		if _, ok := err.(LowBalanceError); ok {
+			// Not enough balance to renew, fall back to metering.
+			return nil, nil
+		}
+		return nil, err
+	}
+	subscription.MaxHosts = plan.MaxHosts
+	subscription.Expires = now.Add(plan.Duration)
+	if err := b.SubscriptionStore.SetSubscription(*subscription); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// OnClient skips the metered checks for subscribed clients.
+func (b *subscriptions) OnClient(node store.Node) error {
+	subscription, err := b.activeSubscription(node)
+	if err != nil {
+		return err
+	}
+	if subscription != nil {
+		return nil
+	}
+	return b.Manager.OnClient(node)
+}
+
+// OnUsage skips usage billing for subscribed clients.
+func (b *subscriptions) OnUsage(node store.Node, usage []store.Usage) error {
+	subscription, err := b.activeSubscription(node)
+	if err != nil {
+		return err
+	}
+	if subscription != nil {
+		return nil
+	}
+	return b.Manager.OnUsage(node, usage)
+}
+
+// OnUpdate pays the hosts of subscribed clients from the funding account.
+// Unsubscribed clients, hosts beyond the plan's MaxHosts, and hosts that the
+// funding account can't cover are passed to the metered Manager.
+func (b *subscriptions) OnUpdate(node store.Node, peers []store.Node) (store.Balance, error) {
+	subscription, err := b.activeSubscription(node)
+	if err != nil {
+		return store.Balance{}, err
+	}
+	if subscription == nil {
+		return b.Manager.OnUpdate(node, peers)
+	}
+	if b.Interval <= 0 || b.CreditPerInterval == nil {
+		return store.Balance{}, fmt.Errorf("subscriptions: Invalid interval settings: %d per %s", b.CreditPerInterval, b.Interval)
+	}
+
+	covered := peers
+	var metered []store.Node
+	if subscription.MaxHosts > 0 && len(peers) > subscription.MaxHosts {
+		covered = peers[:subscription.MaxHosts]
+		metered = append(metered, peers[subscription.MaxHosts:]...)
+	}
+
+	// The funding account only pays for as much as it collected from plans,
+	// so that it doesn't go below zero.
+	funding, err := b.FundingStore.GetAccountBalance(b.Funding)
+	if err != nil {
+		return store.Balance{}, err
+	}
+	available := new(big.Int).Set(&funding.Credit)
+
+	elapsed := b.timeNow().Sub(node.LastSeen)
+	total := new(big.Int)
+	for _, peer := range covered {
+		// Plan payments are shared by all the hosts, so a host's own price
+		// can't exceed the pool's rate.
+		price := b.CreditPerInterval
+		if peer.Price != nil && peer.Price.Cmp(price) < 0 {
+			price = peer.Price
+		}
+		credit := intervalAmount(elapsed, b.Interval, price)
+		if credit.Cmp(available) > 0 {
+			logger.Printf("Subscription funding account %q can't cover host %s for %s, metering it instead", b.Funding, peer.ID, subscription.Account)
+			metered = append(metered, peer)
+			continue
+		}
+		if err := b.BalanceStore.AddNodeBalance(peer.ID, credit); err != nil {
+			return store.Balance{}, err
+		}
+		available.Sub(available, credit)
+		total.Add(total, credit)
+	}
+	if total.Sign() > 0 {
+		if err := b.FundingStore.AddAccountBalance(b.Funding, total.Neg(total)); err != nil {
+			return store.Balance{}, err
+		}
+	}
+
+	if len(metered) > 0 {
+		return b.Manager.OnUpdate(node, metered)
+	}
+	return b.BalanceStore.GetNodeBalance(node.ID)
+}
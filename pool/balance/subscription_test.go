@@ -0,0 +1,228 @@
+package balance
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestSubscriptions(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	payManager := &payPerInterval{
+		Store:             storeDriver,
+		Interval:          time.Minute * 1,
+		CreditPerInterval: *big.NewInt(1000),
+		now:               func() time.Time { return now },
+	}
+	subManager := Subscriptions(payManager, storeDriver, storeDriver, storeDriver, "funding", time.Minute*1, big.NewInt(100))
+	subManager.now = func() time.Time { return now }
+
+	if err := subManager.AddPlan(Plan{Name: "hourly", Duration: time.Hour, MaxHosts: 1, Price: big.NewInt(10000)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := subManager.AddPlan(Plan{Name: "hourly", Duration: time.Hour, Price: big.NewInt(1)}); err == nil {
+		t.Error("expected duplicate plan error")
+	}
+
+	hostA := store.Node{ID: "a", IsHost: true, LastSeen: now}
+	hostB := store.Node{ID: "b", IsHost: true, LastSeen: now}
+	client := store.Node{ID: "c", LastSeen: now}
+	for _, node := range []store.Node{hostA, hostB, client} {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storeDriver.AddAccountNode("abcd", client.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := subManager.Subscribe("abcd", "weekly", false); err != ErrUnknownPlan {
+		t.Errorf("expected ErrUnknownPlan, got: %v", err)
+	}
+	if _, err := subManager.Subscribe("abcd", "hourly", false); !isLowBalance(err) {
+		t.Errorf("expected low balance error, got: %v", err)
+	}
+
+	if err := storeDriver.AddAccountBalance("abcd", big.NewInt(25000)); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := subManager.Subscribe("abcd", "hourly", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(time.Hour); !sub.Expires.Equal(want) {
+		t.Errorf("wrong expiry: got %s; want %s", sub.Expires, want)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("abcd"); balance.Credit.Cmp(big.NewInt(15000)) != 0 {
+		t.Errorf("wrong balance after subscribing: %d", &balance.Credit)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("funding"); balance.Credit.Cmp(big.NewInt(10000)) != 0 {
+		t.Errorf("wrong funding balance after subscribing: %d", &balance.Credit)
+	}
+
+	if err := subManager.OnClient(client); err != nil {
+		t.Errorf("unexpected OnClient error: %s", err)
+	}
+
+	// Covered host is paid from the funding account, the extra host is metered.
+	now = now.Add(time.Minute * 2)
+	balance, err := subManager.OnUpdate(client, []store.Node{hostA, hostB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := big.NewInt(15000 - 2000); balance.Credit.Cmp(want) != 0 {
+		t.Errorf("wrong client balance: got %d; want %d", &balance.Credit, want)
+	}
+	if balance, _ := storeDriver.GetNodeBalance(hostA.ID); balance.Credit.Cmp(big.NewInt(200)) != 0 {
+		t.Errorf("wrong covered host balance: %d", &balance.Credit)
+	}
+	if balance, _ := storeDriver.GetNodeBalance(hostB.ID); balance.Credit.Cmp(big.NewInt(2000)) != 0 {
+		t.Errorf("wrong metered host balance: %d", &balance.Credit)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("funding"); balance.Credit.Cmp(big.NewInt(9800)) != 0 {
+		t.Errorf("wrong funding balance: %d", &balance.Credit)
+	}
+
+	// Subscription expires and renews from the remaining balance.
+	client.LastSeen = now
+	now = now.Add(time.Hour)
+	if _, err := subManager.OnUpdate(client, []store.Node{hostA}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err = storeDriver.GetSubscription("abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(time.Hour); !sub.Expires.Equal(want) {
+		t.Errorf("wrong renewed expiry: got %s; want %s", sub.Expires, want)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("abcd"); balance.Credit.Cmp(big.NewInt(3000)) != 0 {
+		t.Errorf("wrong balance after renewal: %d", &balance.Credit)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("funding"); balance.Credit.Cmp(big.NewInt(9800+10000-6000)) != 0 {
+		t.Errorf("wrong funding balance after renewal: %d", &balance.Credit)
+	}
+
+	// Not enough balance to renew again, falls back to metering.
+	client.LastSeen = now
+	now = now.Add(time.Hour + time.Minute)
+	if _, err := subManager.OnUpdate(client, []store.Node{hostA}); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("abcd"); balance.Credit.Cmp(big.NewInt(3000-61000)) != 0 {
+		t.Errorf("wrong metered balance after expiry: %d", &balance.Credit)
+	}
+}
+
+func TestSubscriptionFunding(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	payManager := &payPerInterval{
+		Store:             storeDriver,
+		Interval:          time.Minute * 1,
+		CreditPerInterval: *big.NewInt(1000),
+		now:               func() time.Time { return now },
+	}
+	subManager := Subscriptions(payManager, storeDriver, storeDriver, storeDriver, "funding", time.Minute*1, big.NewInt(500))
+	subManager.now = func() time.Time { return now }
+	for _, plan := range []Plan{
+		{Name: "hourly", Duration: time.Hour, Price: big.NewInt(6000)},
+		{Name: "daily", Duration: time.Hour * 24, Price: big.NewInt(50000)},
+	} {
+		if err := subManager.AddPlan(plan); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	host := store.Node{ID: "a", IsHost: true, LastSeen: now}
+	client := store.Node{ID: "c", LastSeen: now}
+	for _, node := range []store.Node{host, client} {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storeDriver.AddAccountNode("abcd", client.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeDriver.AddAccountBalance("abcd", big.NewInt(60000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subManager.Subscribe("abcd", "hourly", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Funding only has the 6000 from the plan, so it covers 12 minutes of the
+	// host and the rest is metered.
+	now = now.Add(time.Minute * 15)
+	balance, err := subManager.OnUpdate(client, []store.Node{host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := big.NewInt(60000 - 6000 - 15000); balance.Credit.Cmp(want) != 0 {
+		t.Errorf("wrong client balance: got %d; want %d", &balance.Credit, want)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("funding"); balance.Credit.Cmp(big.NewInt(6000)) != 0 {
+		t.Errorf("funding should not be spent beyond its balance: %d", &balance.Credit)
+	}
+
+	// A failed switch keeps the old plan and undoes the refund.
+	if _, err := subManager.Subscribe("abcd", "daily", false); !isLowBalance(err) {
+		t.Errorf("expected low balance error, got: %v", err)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("abcd"); balance.Credit.Cmp(big.NewInt(39000)) != 0 {
+		t.Errorf("wrong balance after failed switch: %d", &balance.Credit)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("funding"); balance.Credit.Cmp(big.NewInt(6000)) != 0 {
+		t.Errorf("wrong funding balance after failed switch: %d", &balance.Credit)
+	}
+
+	// Switching plans credits the unused 45 minutes of the hourly plan.
+	if err := storeDriver.AddAccountBalance("abcd", big.NewInt(11000)); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := subManager.Subscribe("abcd", "daily", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Plan != "daily" || !sub.Expires.Equal(now.Add(time.Hour*24)) {
+		t.Errorf("wrong subscription after switching plans: %+v", sub)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("abcd"); balance.Credit.Cmp(big.NewInt(50000+4500-50000)) != 0 {
+		t.Errorf("wrong balance after switching plans: %d", &balance.Credit)
+	}
+	if balance, _ := storeDriver.GetAccountBalance("funding"); balance.Credit.Cmp(big.NewInt(6000-4500+50000)) != 0 {
+		t.Errorf("wrong funding balance after switching plans: %d", &balance.Credit)
+	}
+
+	// Hosts are paid at most the pool's rate from the funding account, even
+	// if their own price is higher.
+	client.LastSeen = now
+	now = now.Add(time.Minute * 2)
+	pricey := store.Node{ID: "b", IsHost: true, LastSeen: now, Price: big.NewInt(2000)}
+	cheap := store.Node{ID: "d", IsHost: true, LastSeen: now, Price: big.NewInt(100)}
+	for _, node := range []store.Node{pricey, cheap} {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := subManager.OnUpdate(client, []store.Node{pricey, cheap}); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := storeDriver.GetNodeBalance(pricey.ID); balance.Credit.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("wrong balance of host with a higher price: %d", &balance.Credit)
+	}
+	if balance, _ := storeDriver.GetNodeBalance(cheap.ID); balance.Credit.Cmp(big.NewInt(200)) != 0 {
+		t.Errorf("wrong balance of host with a lower price: %d", &balance.Credit)
+	}
+}
+
+func isLowBalance(err error) bool {
+	_, ok := err.(LowBalanceError)
+	return ok
+}
@@ -0,0 +1,100 @@
+package balance
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// Trial creates a balance Manager which wraps another Manager and limits how
+// long clients without a registered account can use the pool. Once the trial
+// Period has passed or the trial Amount has been spent, whichever comes
+// first, the client is disconnected until it registers an account. Trial
+// start times are kept in trialStore, so they survive pool restarts.
+func Trial(manager Manager, storeDriver store.BalanceStore, trialStore store.TrialStore, period time.Duration, amount *big.Int) *trial {
+	return &trial{
+		Manager: manager,
+		Store:   storeDriver,
+		Trials:  trialStore,
+		Period:  period,
+		Amount:  amount,
+	}
+}
+
+type trial struct {
+	Manager
+
+	Store  store.BalanceStore
+	Trials store.TrialStore
+	// Period is the duration since a node first connected that it can use
+	// the pool without a registered account. (0 is unlimited)
+	Period time.Duration
+	// Amount is the trial credit a node can spend without a registered
+	// account. (nil is unlimited)
+	Amount *big.Int
+
+	// now is used for testing to override time-based behaviour
+	now func() time.Time
+}
+
+func (b *trial) timeNow() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+// check returns a DisconnectError if the node has exhausted its trial.
+func (b *trial) check(node store.Node, balance store.Balance) error {
+	if node.IsHost || balance.Account != "" {
+		// Only clients without a registered account are on a trial
+		return nil
+	}
+
+	if b.Period > 0 {
+		started, err := b.Trials.StartTrial(node.ID, b.timeNow())
+		if err != nil {
+			return err
+		}
+		if b.timeNow().Sub(started) > b.Period {
+			return DisconnectError{Reason: "trial period expired, register an account to continue"}
+		}
+	}
+
+	if b.Amount != nil {
+		spent := new(big.Int).Neg(&balance.Credit)
+		if spent.Cmp(b.Amount) >= 0 {
+			return DisconnectError{Reason: "trial amount spent, register an account to continue"}
+		}
+	}
+	return nil
+}
+
+// OnClient starts the node's trial if it has not started yet, and errors if
+// the trial is over.
+func (b *trial) OnClient(node store.Node) error {
+	if !node.IsHost {
+		balance, err := b.Store.GetNodeBalance(node.ID)
+		if err != nil {
+			return err
+		}
+		if err := b.check(node, balance); err != nil {
+			return err
+		}
+	}
+	return b.Manager.OnClient(node)
+}
+
+// OnUpdate calls the underlying manager's OnUpdate, then errors if the node's
+// trial is over.
+func (b *trial) OnUpdate(node store.Node, peers []store.Node) (store.Balance, error) {
+	balance, err := b.Manager.OnUpdate(node, peers)
+	if _, ok := err.(LowBalanceWarning); err != nil && !ok {
+		return balance, err
+	}
+	if err := b.check(node, balance); err != nil {
+		return store.Balance{}, err
+	}
+	return balance, err
+}
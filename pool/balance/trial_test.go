@@ -0,0 +1,101 @@
+package balance
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestTrial(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	payManager := &payPerInterval{
+		Store:             storeDriver,
+		Interval:          time.Minute * 1,
+		CreditPerInterval: *big.NewInt(1000),
+		now:               func() time.Time { return now },
+	}
+	trialManager := Trial(payManager, storeDriver, storeDriver, time.Minute*10, big.NewInt(3000))
+	trialManager.now = func() time.Time { return now }
+
+	host := store.Node{ID: "a", IsHost: true, LastSeen: now}
+	client := store.Node{ID: "b", LastSeen: now}
+	registered := store.Node{ID: "c", LastSeen: now}
+	for _, node := range []store.Node{host, client, registered} {
+		if err := storeDriver.SetNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storeDriver.AddAccountNode("abcd", registered.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range []store.Node{host, client, registered} {
+		if err := trialManager.OnClient(node); err != nil {
+			t.Errorf("[node=%s] unexpected OnClient error: %s", node.ID, err)
+		}
+	}
+
+	// Spend within the trial amount
+	now = now.Add(time.Minute * 2)
+	if _, err := trialManager.OnUpdate(client, []store.Node{host}); err != nil {
+		t.Errorf("unexpected OnUpdate error: %s", err)
+	}
+
+	// Exceed the trial amount
+	client.LastSeen = now
+	now = now.Add(time.Minute * 2)
+	if _, err := trialManager.OnUpdate(client, []store.Node{host}); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error, got: %v", err)
+	}
+	if err := trialManager.OnClient(client); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error on reconnect, got: %v", err)
+	}
+
+	// Registered accounts are not limited by the trial
+	if _, err := trialManager.OnUpdate(registered, []store.Node{host}); err != nil {
+		t.Errorf("unexpected OnUpdate error: %s", err)
+	}
+
+	// Hosts are not limited by the trial
+	if _, err := trialManager.OnUpdate(host, []store.Node{client}); err != nil {
+		t.Errorf("unexpected OnUpdate error: %s", err)
+	}
+}
+
+func TestTrialPeriod(t *testing.T) {
+	storeDriver := memory.New()
+
+	now := time.Now()
+	trialManager := Trial(NoBalance{}, storeDriver, storeDriver, time.Minute*10, nil)
+	trialManager.now = func() time.Time { return now }
+
+	client := store.Node{ID: "b", LastSeen: now}
+	if err := storeDriver.SetNode(client); err != nil {
+		t.Fatal(err)
+	}
+	if err := trialManager.OnClient(client); err != nil {
+		t.Errorf("unexpected OnClient error: %s", err)
+	}
+
+	now = now.Add(time.Minute * 5)
+	if err := trialManager.OnClient(client); err != nil {
+		t.Errorf("unexpected OnClient error: %s", err)
+	}
+
+	now = now.Add(time.Minute * 6)
+	if err := trialManager.OnClient(client); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error, got: %v", err)
+	}
+
+	// The trial doesn't restart with the pool
+	restarted := Trial(NoBalance{}, storeDriver, storeDriver, time.Minute*10, nil)
+	restarted.now = trialManager.now
+	if err := restarted.OnClient(client); !IsDisconnect(err) {
+		t.Errorf("expected disconnect error after restart, got: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package pool
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/request"
+)
+
+// ErrChannelsDisabled is returned when a client sends a balance proof to a
+// pool that does not accept balance proofs.
+var ErrChannelsDisabled = errors.New("balance proofs are disabled")
+
+// BalanceProof is a client's signed promise to pay the pool a cumulative
+// Amount from its channel deposit. Each proof replaces the previous one, so
+// the pool only needs to keep the latest proof to claim the payment.
+type BalanceProof struct {
+	// Channel is the address of the contract that holds the deposit.
+	Channel string `json:"channel"`
+	// Account is the wallet that funds the deposit and signs the proof.
+	Account string   `json:"account"`
+	Amount  *big.Int `json:"amount"`
+	Nonce   int64    `json:"nonce"`
+	Sig     string   `json:"sig"`
+}
+
+func (proof *BalanceProof) request() request.AddressRequest {
+	return request.AddressRequest{
+		Method:    "vipnode_balanceProof",
+		Address:   proof.Account,
+		Nonce:     proof.Nonce,
+		ExtraArgs: []interface{}{proof.Channel, proof.Amount.String()},
+	}
+}
+
+// Sign sets the proof's signature using the account's private key.
+func (proof *BalanceProof) Sign(privkey *ecdsa.PrivateKey) error {
+	if proof.Amount == nil {
+		return errors.New("balance proof is missing an amount")
+	}
+	sig, err := proof.request().Sign(privkey)
+	if err != nil {
+		return err
+	}
+	proof.Sig = sig
+	return nil
+}
+
+// Verify checks that the proof was signed by its account.
+func (proof *BalanceProof) Verify() error {
+	if proof.Amount == nil || proof.Amount.Sign() < 0 {
+		return errors.New("balance proof has an invalid amount")
+	}
+	if err := proof.request().Verify(proof.Sig); err != nil {
+		return VerifyFailedError{Cause: err, Method: "vipnode_balanceProof"}
+	}
+	return nil
+}
+
+// ProofHandler accepts the balance proofs that clients send with their
+// updates, such as payment.PaymentChannels.
+type ProofHandler interface {
+	// OnProof credits the node's account with the amount that the proof adds
+	// to the channel. It returns the cumulative amount of the latest proof
+	// that was accepted, which is unchanged if the proof is stale.
+	OnProof(nodeID store.NodeID, proof BalanceProof) (accepted *big.Int, err error)
+}
@@ -1,6 +1,8 @@
 package payment
 
 import (
+	"container/list"
+	"context"
 	"math/big"
 	"sync"
 	"time"
@@ -8,19 +10,52 @@ import (
 	"github.com/vipnode/vipnode/v2/pool/store"
 )
 
+// defaultCacheSize is the number of accounts that balanceCache keeps if
+// MaxSize is not set.
+const defaultCacheSize = 10000
+
 type balanceItem struct {
-	value  *big.Int
+	account store.Account
+	value   *big.Int
+	// block is the latest block that the value includes, so that it's only
+	// replaced by newer values.
+	block  uint64
 	expire time.Time
+	// hot is set when the item is read, and cleared when it's refreshed.
+	hot bool
+}
+
+// balanceCall is an in-flight Getter call that concurrent misses for the same
+// account wait on.
+type balanceCall struct {
+	done  chan struct{}
+	value *big.Int
+	block uint64
+	err   error
+	// stale is set if the account was Set during the call, so the result
+	// should not replace it.
+	stale bool
 }
 
-// FIXME: Sort of a DOS vector I suppose, since people can fill the memory with
-// a bunch of accounts. Need a cleanup goroutine?
+// balanceCache is a bounded LRU cache of contract balances. Values are
+// normally kept up to date by contract events through Set, so they only
+// expire if expireAfter is set, such as when the event subscription fails.
+// Each value is kept with the block it's from, so that events that arrive
+// late or replayed events never replace a newer value.
 type balanceCache struct {
-	Getter func(account store.Account) (*big.Int, error)
+	// Getter returns the account's value along with the latest block that
+	// it includes, or 0 if it's unknown.
+	Getter func(account store.Account) (value *big.Int, block uint64, err error)
+	// MaxSize is the number of accounts to keep before the least recently
+	// used are evicted. (Default: 10000)
+	MaxSize int
 
 	mu          sync.Mutex
 	expireAfter time.Duration
-	cache       map[store.Account]balanceItem
+	items       map[store.Account]*list.Element
+	lru         *list.List // Front is the most recently used
+	calls       map[store.Account]*balanceCall
+	stats       store.CacheStats
 	nowFn       func() time.Time // For testing override
 }
 
@@ -31,50 +66,234 @@ func (b *balanceCache) now() time.Time {
 	return time.Now()
 }
 
+func (b *balanceCache) maxSize() int {
+	if b.MaxSize <= 0 {
+		return defaultCacheSize
+	}
+	return b.MaxSize
+}
+
+// Reset clears the cache and expires values after expireAfter from now on.
+// (0 disables expiry)
 func (b *balanceCache) Reset(expireAfter time.Duration) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.expireAfter = expireAfter
-	b.cache = nil
+	b.items = nil
+	b.lru = nil
+	for _, call := range b.calls {
+		call.stale = true
+	}
 }
 
-func (b *balanceCache) Set(account store.Account, amount *big.Int) {
+// Set replaces the account's value with the value from block, such as from a
+// contract event. It returns false if the cached value is from a newer block,
+// in which case it's kept.
+func (b *balanceCache) Set(account store.Account, amount *big.Int, block uint64) bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	if b.cache == nil {
-		b.cache = map[store.Account]balanceItem{}
+	if item := b.lookup(account); item != nil && item.block > block {
+		return false
+	}
+	if call, ok := b.calls[account]; ok {
+		call.stale = true
+	}
+	b.set(account, amount, block, false)
+	return true
+}
+
+// set must be called with the lock held.
+func (b *balanceCache) set(account store.Account, amount *big.Int, block uint64, hot bool) {
+	if b.items == nil {
+		b.items = map[store.Account]*list.Element{}
+		b.lru = list.New()
 	}
 	expire := time.Time{}
 	if b.expireAfter != 0 {
 		expire = b.now().Add(b.expireAfter)
 	}
-	b.cache[account] = balanceItem{
-		amount,
-		expire,
+	if el, ok := b.items[account]; ok {
+		item := el.Value.(*balanceItem)
+		item.value = amount
+		item.block = block
+		item.expire = expire
+		item.hot = item.hot || hot
+		b.lru.MoveToFront(el)
+		return
+	}
+	b.items[account] = b.lru.PushFront(&balanceItem{
+		account: account,
+		value:   amount,
+		block:   block,
+		expire:  expire,
+		hot:     hot,
+	})
+	for b.lru.Len() > b.maxSize() {
+		b.remove(b.lru.Back())
+		b.stats.Evictions += 1
 	}
 }
 
+// remove must be called with the lock held.
+func (b *balanceCache) remove(el *list.Element) {
+	b.lru.Remove(el)
+	delete(b.items, el.Value.(*balanceItem).account)
+}
+
+// Invalidate removes the account, so that the next Get calls the Getter.
+func (b *balanceCache) Invalidate(account store.Account) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if call, ok := b.calls[account]; ok {
+		call.stale = true
+	}
+	if el, ok := b.items[account]; ok {
+		b.remove(el)
+	}
+}
+
+// lookup returns the account's unexpired item, and must be called with the
+// lock held.
+func (b *balanceCache) lookup(account store.Account) *balanceItem {
+	el, ok := b.items[account]
+	if !ok {
+		return nil
+	}
+	item := el.Value.(*balanceItem)
+	if !item.expire.IsZero() && !b.now().Before(item.expire) {
+		// Clear expired
+		b.remove(el)
+		return nil
+	}
+	return item
+}
+
+// Peek returns the cached value for account without calling the Getter, or
+// nil if it's missing or expired. It doesn't count as a use of the account.
+func (b *balanceCache) Peek(account store.Account) *big.Int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if item := b.lookup(account); item != nil {
+		return item.value
+	}
+	return nil
+}
+
+// Get returns the account's cached value, or calls the Getter on a miss.
+// Concurrent misses for the same account share a single Getter call.
 func (b *balanceCache) Get(account store.Account) (*big.Int, error) {
 	b.mu.Lock()
-	if b.cache == nil {
-	} else if r, ok := b.cache[account]; ok {
+	if item := b.lookup(account); item != nil {
 		// Hit
-		if r.expire.IsZero() || b.now().Before(r.expire) {
-			// Not expired
-			b.mu.Unlock()
-			return r.value, nil
-		}
-		// Clear expired
-		delete(b.cache, account)
+		item.hot = true
+		b.lru.MoveToFront(b.items[account])
+		b.stats.Hits += 1
+		b.mu.Unlock()
+		return item.value, nil
+	}
+	b.stats.Misses += 1
+	if call, ok := b.calls[account]; ok {
+		// Another miss is already getting this account
+		b.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &balanceCall{done: make(chan struct{})}
+	if b.calls == nil {
+		b.calls = map[store.Account]*balanceCall{}
 	}
+	b.calls[account] = call
 	getter := b.Getter
 	b.mu.Unlock()
 
 	// Miss (outside of cache lock)
-	val, err := getter(account)
-	if err != nil {
-		return nil, err
+	call.value, call.block, call.err = getter(account)
+
+	b.mu.Lock()
+	delete(b.calls, account)
+	if call.err == nil && !call.stale {
+		b.set(account, call.value, call.block, true)
+	}
+	b.mu.Unlock()
+	close(call.done)
+	return call.value, call.err
+}
+
+// Refresh calls the Getter for the accounts that were read since the last
+// refresh, so that hot accounts don't expire. Accounts that fail to refresh
+// are invalidated.
+func (b *balanceCache) Refresh() {
+	b.mu.Lock()
+	var hot []store.Account
+	if b.lru != nil {
+		for el := b.lru.Front(); el != nil; el = el.Next() {
+			item := el.Value.(*balanceItem)
+			if item.hot {
+				item.hot = false
+				hot = append(hot, item.account)
+			}
+		}
+	}
+	getter := b.Getter
+	b.mu.Unlock()
+
+	for _, account := range hot {
+		b.mu.Lock()
+		if _, ok := b.calls[account]; ok {
+			// Already being fetched
+			b.mu.Unlock()
+			continue
+		}
+		call := &balanceCall{done: make(chan struct{})}
+		if b.calls == nil {
+			b.calls = map[store.Account]*balanceCall{}
+		}
+		b.calls[account] = call
+		b.mu.Unlock()
+
+		call.value, call.block, call.err = getter(account)
+
+		b.mu.Lock()
+		delete(b.calls, account)
+		if el, ok := b.items[account]; !ok || call.stale {
+			// Evicted or replaced during the call
+		} else if call.err != nil {
+			logger.Printf("Failed to refresh cached balance for %q: %s", account, call.err)
+			b.remove(el)
+		} else if item := el.Value.(*balanceItem); item.block <= call.block {
+			item.value = call.value
+			item.block = call.block
+			if b.expireAfter != 0 {
+				item.expire = b.now().Add(b.expireAfter)
+			}
+		}
+		b.mu.Unlock()
+		close(call.done)
+	}
+}
+
+// Start refreshes the hot accounts every interval until the context is
+// cancelled.
+func (b *balanceCache) Start(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Refresh()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stats returns the cache counters.
+func (b *balanceCache) Stats() store.CacheStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.stats
+	if b.lru != nil {
+		r.Size = b.lru.Len()
 	}
-	b.Set(account, val)
-	return val, nil
+	return r
 }
@@ -1,7 +1,9 @@
 package payment
 
 import (
+	"errors"
 	"math/big"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,8 +12,8 @@ import (
 
 func TestBalanceCache(t *testing.T) {
 	val := big.NewInt(42)
-	getter := func(account store.Account) (*big.Int, error) {
-		return val, nil
+	getter := func(account store.Account) (*big.Int, uint64, error) {
+		return val, 0, nil
 	}
 	now := time.Now()
 	cache := balanceCache{
@@ -44,3 +46,144 @@ func TestBalanceCache(t *testing.T) {
 	now = now.Add(time.Second * 10)
 	assertKey("foo", 100)
 }
+
+func TestBalanceCacheEviction(t *testing.T) {
+	calls := map[store.Account]int{}
+	cache := balanceCache{
+		Getter: func(account store.Account) (*big.Int, uint64, error) {
+			calls[account] += 1
+			return big.NewInt(int64(len(account))), 0, nil
+		},
+		MaxSize: 2,
+	}
+
+	for _, account := range []store.Account{"a", "bb", "a", "ccc", "a", "bb"} {
+		if _, err := cache.Get(account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "bb" was the least recently used when "ccc" was added, and "ccc" when
+	// "bb" came back.
+	if calls["a"] != 1 || calls["bb"] != 2 || calls["ccc"] != 1 {
+		t.Errorf("wrong getter calls: %v", calls)
+	}
+	want := store.CacheStats{Size: 2, Hits: 2, Misses: 4, Evictions: 2}
+	if got := cache.Stats(); got != want {
+		t.Errorf("wrong stats: got %+v; want %+v", got, want)
+	}
+	if v := cache.Peek("ccc"); v != nil {
+		t.Errorf("evicted account is still cached: %d", v)
+	}
+
+	// Events replace values without calling the getter
+	cache.Set("a", big.NewInt(42), 0)
+	if v, err := cache.Get("a"); err != nil {
+		t.Error(err)
+	} else if v.Int64() != 42 || calls["a"] != 1 {
+		t.Errorf("wrong value after set: %d", v)
+	}
+	cache.Invalidate("a")
+	if v, err := cache.Get("a"); err != nil {
+		t.Error(err)
+	} else if v.Int64() != 1 || calls["a"] != 2 {
+		t.Errorf("wrong value after invalidate: %d", v)
+	}
+}
+
+func TestBalanceCacheCollapse(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var mu sync.Mutex
+	numCalls := 0
+	cache := balanceCache{
+		Getter: func(account store.Account) (*big.Int, uint64, error) {
+			mu.Lock()
+			numCalls += 1
+			mu.Unlock()
+			started <- struct{}{}
+			<-release
+			return big.NewInt(1), 0, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	get := func() {
+		defer wg.Done()
+		if v, err := cache.Get("foo"); err != nil {
+			t.Error(err)
+		} else if v.Int64() != 1 {
+			t.Errorf("wrong value: %d", v)
+		}
+	}
+	wg.Add(1)
+	go get()
+	<-started
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go get()
+	}
+	// Wait for the other misses to join the call
+	waitFor(t, "collapsed misses", func() bool {
+		return cache.Stats().Misses == 6
+	})
+
+	// An event during the call takes precedence over the getter result
+	cache.Set("foo", big.NewInt(2), 0)
+	close(release)
+	wg.Wait()
+
+	if numCalls != 1 {
+		t.Errorf("wrong number of getter calls: %d", numCalls)
+	}
+	if v := cache.Peek("foo"); v == nil || v.Int64() != 2 {
+		t.Errorf("event was replaced by the getter result: %d", v)
+	}
+}
+
+func TestBalanceCacheRefresh(t *testing.T) {
+	val := big.NewInt(1)
+	var getErr error
+	now := time.Now()
+	cache := balanceCache{
+		Getter: func(account store.Account) (*big.Int, uint64, error) {
+			return val, 0, getErr
+		},
+		nowFn: func() time.Time { return now },
+	}
+	cache.Reset(time.Minute)
+
+	if _, err := cache.Get("hot"); err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("cold", big.NewInt(1), 0)
+
+	// Only accounts that were read get refreshed
+	val = big.NewInt(2)
+	now = now.Add(time.Second * 50)
+	cache.Refresh()
+	if v := cache.Peek("hot"); v == nil || v.Int64() != 2 {
+		t.Errorf("hot account was not refreshed: %d", v)
+	}
+	if v := cache.Peek("cold"); v == nil || v.Int64() != 1 {
+		t.Errorf("cold account was refreshed: %d", v)
+	}
+
+	// Refreshing extends the expiry
+	now = now.Add(time.Second * 20)
+	if v := cache.Peek("hot"); v == nil {
+		t.Errorf("refreshed account expired")
+	}
+	if v := cache.Peek("cold"); v != nil {
+		t.Errorf("cold account did not expire: %d", v)
+	}
+
+	// Failed refreshes are invalidated
+	if _, err := cache.Get("hot"); err != nil {
+		t.Fatal(err)
+	}
+	getErr = errors.New("boom")
+	cache.Refresh()
+	if v := cache.Peek("hot"); v != nil {
+		t.Errorf("failed refresh was kept: %d", v)
+	}
+}
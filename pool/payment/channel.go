@@ -0,0 +1,315 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vipnode/vipnode/v2/pool"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// ChannelDepositError is returned when a balance proof promises more than
+// the account's unclaimed channel deposit.
+type ChannelDepositError struct {
+	Deposit *big.Int
+	Amount  *big.Int
+}
+
+func (err ChannelDepositError) Error() string {
+	return fmt.Sprintf("balance proof for %d exceeds the unclaimed channel deposit (%d)", err.Amount, err.Deposit)
+}
+
+// ChannelDepositGetter returns an account's on-chain deposit that backs its
+// payment channel, and whether the account is timelocked for withdrawing it.
+type ChannelDepositGetter func(account store.Account) (deposit *big.Int, timelocked bool, err error)
+
+var _ pool.ProofHandler = &PaymentChannels{}
+
+// PaymentChannels accepts signed balance proofs from clients, which promise
+// the pool a cumulative amount of the client's contract deposit. Each proof
+// credits the client's pool balance with the amount it adds, and the latest
+// proof is kept to claim the total from the deposit.
+//
+// These are not trust-minimized payment channels. The VipnodePool contract
+// has no channel support, so proofs are never verified on-chain and claims
+// are plain OpSettle transactions that set the client's deposit to whatever
+// the operator sends. Settlement is as operator-trusted as the internal
+// ledger: the proofs only serve as the client's signed receipts of what it
+// agreed to pay.
+type PaymentChannels struct {
+	Store        store.ChannelStore
+	BalanceStore store.BalanceStore
+	// SettlementStore (optional) records the claims of ClaimAll, so that a
+	// WithdrawalTracker can unclaim them if their transaction fails.
+	SettlementStore store.SettlementStore
+
+	// Address is the contract that holds the channel deposits, which proofs
+	// must be signed for.
+	Address common.Address
+	// Deposit returns an account's on-chain deposit.
+	Deposit ChannelDepositGetter
+	// Settle disburses a payment and sets the account's on-chain deposit,
+	// see PaymentService.Settle. If nil, then claims will error with
+	// ErrWithdrawDisabled.
+	Settle SettleHandler
+	// Interval is the time between claiming all the channels, which must be
+	// shorter than the contract's withdraw timelock.
+	Interval time.Duration
+
+	mu sync.Mutex
+
+	// now is used for testing to override time-based behaviour
+	now func() time.Time
+}
+
+func (c *PaymentChannels) timeNow() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+// Start claims all the channels every Interval until the context is
+// cancelled.
+func (c *PaymentChannels) Start(ctx context.Context) error {
+	if c.Interval <= 0 {
+		return errors.New("channel claim interval must be positive")
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			txIDs, err := c.ClaimAll()
+			if err != nil {
+				logger.Printf("Channel claim failed after %d claims: %s", len(txIDs), err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// getChannel returns the account's channel, or a new empty channel. Must be
+// called with the lock held.
+func (c *PaymentChannels) getChannel(account store.Account) (*store.Channel, error) {
+	channel, err := c.Store.GetChannel(account)
+	if err == store.ErrNoChannel {
+		return &store.Channel{
+			Account: account,
+			Amount:  new(big.Int),
+			Claimed: new(big.Int),
+		}, nil
+	}
+	return channel, err
+}
+
+// OnProof verifies a balance proof from a node, and credits the node's
+// account with the amount that the proof adds to the channel.
+func (c *PaymentChannels) OnProof(nodeID store.NodeID, proof pool.BalanceProof) (*big.Int, error) {
+	if err := proof.Verify(); err != nil {
+		return nil, err
+	}
+	if !common.IsHexAddress(proof.Channel) || common.HexToAddress(proof.Channel) != c.Address {
+		return nil, AddressMismatchError{
+			Prelude: "balance proof is for the wrong channel contract",
+			Want:    c.Address,
+			Got:     common.HexToAddress(proof.Channel),
+		}
+	}
+	nodeBalance, err := c.BalanceStore.GetNodeBalance(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if nodeBalance.Account == "" || !strings.EqualFold(string(nodeBalance.Account), proof.Account) {
+		return nil, store.ErrNotAuthorized
+	}
+	account := nodeBalance.Account
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	channel, err := c.getChannel(account)
+	if err != nil {
+		return nil, err
+	}
+	if proof.Amount.Cmp(channel.Amount) <= 0 {
+		// Stale proof, the client can resume from the accepted amount
+		return channel.Amount, nil
+	}
+	if proof.Nonce <= channel.Nonce {
+		return nil, store.ErrInvalidNonce
+	}
+
+	deposit, timelocked, err := c.Deposit(account)
+	if err != nil {
+		return nil, err
+	}
+	if timelocked {
+		return nil, ErrDepositTimelocked
+	}
+	unclaimed := new(big.Int).Sub(proof.Amount, channel.Claimed)
+	if unclaimed.Cmp(deposit) > 0 {
+		return nil, ChannelDepositError{
+			Deposit: deposit,
+			Amount:  unclaimed,
+		}
+	}
+
+	credit := new(big.Int).Sub(proof.Amount, channel.Amount)
+	channel.Amount = new(big.Int).Set(proof.Amount)
+	channel.Nonce = proof.Nonce
+	channel.Sig = proof.Sig
+	channel.Updated = c.timeNow()
+	// The channel is saved first, so that a proof can't be credited twice
+	if err := c.Store.SetChannel(*channel); err != nil {
+		return nil, err
+	}
+	if err := c.BalanceStore.AddAccountBalance(account, credit); err != nil {
+		return nil, err
+	}
+	logger.Printf("Accepted balance proof from account %q for %d (credit %d)", account, channel.Amount, credit)
+	return channel.Amount, nil
+}
+
+// Claim claims the unclaimed amount of the account's latest balance proof
+// from its deposit, and disburses paymentAmount to the account in the same
+// transaction. It returns the account's new on-chain deposit, and the claimed
+// amount to record in the transaction's settlement so that Unclaim can roll
+// it back if the transaction fails.
+func (c *PaymentChannels) Claim(account store.Account, paymentAmount *big.Int) (txID string, newBalance *big.Int, claimed *big.Int, err error) {
+	if c.Settle == nil {
+		return "", nil, nil, ErrWithdrawDisabled
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	channel, err := c.getChannel(account)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	newBalance, unclaimed, err := c.claimBalance(channel)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if unclaimed.Sign() == 0 {
+		txID, err = c.Settle(account, paymentAmount, newBalance)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return txID, newBalance, unclaimed, nil
+	}
+
+	// The claim is saved first, so that it can't be claimed twice
+	previous := *channel
+	channel.Claimed = new(big.Int).Set(channel.Amount)
+	channel.Updated = c.timeNow()
+	if err := c.Store.SetChannel(*channel); err != nil {
+		return "", nil, nil, err
+	}
+	txID, err = c.Settle(account, paymentAmount, newBalance)
+	if err != nil {
+		if undoErr := c.Store.SetChannel(previous); undoErr != nil {
+			return "", nil, nil, fmt.Errorf("failed to roll back channel claim: %s (after: %s)", undoErr, err)
+		}
+		return "", nil, nil, err
+	}
+	logger.Printf("Claimed %d from the channel deposit of account %q: %s", unclaimed, account, txID)
+	return txID, newBalance, unclaimed, nil
+}
+
+// Unclaim rolls back a claim of amount from the account's channel, such as
+// when its settlement transaction failed, so that the next claim includes it
+// again.
+func (c *PaymentChannels) Unclaim(account store.Account, amount *big.Int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	channel, err := c.getChannel(account)
+	if err != nil {
+		return err
+	}
+	channel.Claimed = new(big.Int).Sub(channel.Claimed, amount)
+	if channel.Claimed.Sign() < 0 {
+		channel.Claimed.SetInt64(0)
+	}
+	channel.Updated = c.timeNow()
+	if err := c.Store.SetChannel(*channel); err != nil {
+		return err
+	}
+	logger.Printf("Unclaimed %d from the channel deposit of account %q", amount, account)
+	return nil
+}
+
+// ClaimBalance returns the account's on-chain deposit that would be left
+// after claiming its unclaimed balance proofs.
+func (c *PaymentChannels) ClaimBalance(account store.Account) (*big.Int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	channel, err := c.getChannel(account)
+	if err != nil {
+		return nil, err
+	}
+	newBalance, _, err := c.claimBalance(channel)
+	return newBalance, err
+}
+
+// claimBalance returns the channel's on-chain deposit after claiming its
+// unclaimed amount, and the unclaimed amount. Must be called with the lock
+// held.
+func (c *PaymentChannels) claimBalance(channel *store.Channel) (newBalance *big.Int, unclaimed *big.Int, err error) {
+	deposit, _, err := c.Deposit(channel.Account)
+	if err != nil {
+		return nil, nil, err
+	}
+	unclaimed = new(big.Int).Sub(channel.Amount, channel.Claimed)
+	newBalance = new(big.Int).Sub(deposit, unclaimed)
+	if newBalance.Sign() < 0 {
+		// Should not happen unless the deposit was withdrawn out from under us
+		logger.Printf("Channel deposit of account %q (%d) does not cover its unclaimed proofs (%d)", channel.Account, deposit, unclaimed)
+		newBalance.SetInt64(0)
+	}
+	return newBalance, unclaimed, nil
+}
+
+// ClaimAll claims the unclaimed balance proofs of every channel from the
+// deposits, without any payout. It returns the claim transaction IDs.
+func (c *PaymentChannels) ClaimAll() ([]string, error) {
+	channels, err := c.Store.GetChannels()
+	if err != nil {
+		return nil, err
+	}
+	txIDs := []string{}
+	for _, channel := range channels {
+		if channel.Amount.Cmp(channel.Claimed) <= 0 {
+			continue
+		}
+		now := c.timeNow()
+		settlement := store.Settlement{
+			Account:  channel.Account,
+			Amount:   new(big.Int),
+			Time:     now,
+			Attempts: 1,
+			Updated:  now,
+		}
+		err := submitSettlement(c.SettlementStore, c.BalanceStore, &settlement, func() (string, *big.Int, error) {
+			txID, newBalance, claimed, err := c.Claim(channel.Account, settlement.Amount)
+			settlement.Claimed = claimed
+			return txID, newBalance, err
+		})
+		if err != nil {
+			return txIDs, err
+		}
+		txIDs = append(txIDs, settlement.TxID)
+	}
+	return txIDs, nil
+}
@@ -0,0 +1,189 @@
+package payment
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/vipnode/vipnode/v2/pool"
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestPaymentChannels(t *testing.T) {
+	sim := newSimulatedPool(t, 1)
+	defer sim.Close()
+	contractAddr := sim.Address
+	operatorOpts := sim.Operator
+
+	// Client deposits 1 ether to back its channel
+	sim.Deposit(t, 0, ether(1, 1))
+
+	memStore := memory.New()
+	cp, err := ContractPayment(memStore, contractAddr, sim, operatorOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := sim.Account(0)
+	node := store.Node{ID: "abcd"}
+	if err := memStore.SetNode(node); err != nil {
+		t.Fatal(err)
+	}
+	if err := memStore.AddAccountNode(account, node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	channels := &PaymentChannels{
+		Store:        memStore,
+		BalanceStore: memStore,
+		Address:      contractAddr,
+		Deposit:      cp.ChannelDeposit,
+		Settle:       cp.OpSettle,
+	}
+
+	nonce := int64(0)
+	newProof := func(amount *big.Int, key, channel string) pool.BalanceProof {
+		nonce += 1
+		proof := pool.BalanceProof{
+			Channel: channel,
+			Account: string(account),
+			Amount:  amount,
+			Nonce:   nonce,
+		}
+		privkey := sim.clientKeys[0]
+		if key == "operator" {
+			privkey = sim.operatorKey
+		}
+		if err := proof.Sign(privkey); err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	sendProof := func(proof pool.BalanceProof) (*big.Int, error) {
+		return channels.OnProof(node.ID, proof)
+	}
+	assertCredit := func(want *big.Int) {
+		t.Helper()
+		balance, err := memStore.GetAccountBalance(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Credit.Cmp(want) != 0 {
+			t.Errorf("wrong credit: got %d; want %d", &balance.Credit, want)
+		}
+	}
+	assertDeposit := func(want *big.Int) {
+		t.Helper()
+		deposit, _, err := cp.ChannelDeposit(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deposit.Cmp(want) != 0 {
+			t.Errorf("wrong deposit: got %d; want %d", deposit, want)
+		}
+	}
+
+	if accepted, err := sendProof(newProof(ether(1, 10), "client", contractAddr.Hex())); err != nil {
+		t.Fatal(err)
+	} else if accepted.Cmp(ether(1, 10)) != 0 {
+		t.Errorf("wrong accepted amount: %d", accepted)
+	}
+	assertCredit(ether(1, 10))
+
+	// Stale proofs are ignored
+	if accepted, err := sendProof(newProof(ether(1, 20), "client", contractAddr.Hex())); err != nil {
+		t.Error(err)
+	} else if accepted.Cmp(ether(1, 10)) != 0 {
+		t.Errorf("wrong accepted amount: %d", accepted)
+	}
+	assertCredit(ether(1, 10))
+
+	// Proofs are cumulative
+	if _, err := sendProof(newProof(ether(3, 10), "client", contractAddr.Hex())); err != nil {
+		t.Fatal(err)
+	}
+	assertCredit(ether(3, 10))
+
+	// Invalid proofs
+	if _, err := sendProof(newProof(ether(4, 10), "operator", contractAddr.Hex())); err == nil {
+		t.Errorf("expected signature error")
+	}
+	if _, err := sendProof(newProof(ether(4, 10), "client", operatorOpts.From.Hex())); err == nil {
+		t.Errorf("expected channel mismatch error")
+	}
+	if _, err := sendProof(newProof(ether(2, 1), "client", contractAddr.Hex())); err == nil {
+		t.Errorf("expected deposit error")
+	} else if _, ok := err.(ChannelDepositError); !ok {
+		t.Errorf("wrong deposit error: %s", err)
+	}
+	assertCredit(ether(3, 10))
+
+	// Claim the latest proof from the deposit
+	channels.SettlementStore = memStore
+	if txIDs, err := channels.ClaimAll(); err != nil {
+		t.Fatal(err)
+	} else if len(txIDs) != 1 {
+		t.Errorf("wrong number of claims: %q", txIDs)
+	}
+	if settlements, err := memStore.GetSettlements(account); err != nil {
+		t.Fatal(err)
+	} else if len(settlements) != 1 || settlements[0].Claimed.Cmp(ether(3, 10)) != 0 {
+		t.Errorf("claim was not recorded: %+v", settlements)
+	}
+	sim.Commit()
+	assertDeposit(ether(7, 10))
+	if txIDs, err := channels.ClaimAll(); err != nil {
+		t.Fatal(err)
+	} else if len(txIDs) != 0 {
+		t.Errorf("unexpected claims: %q", txIDs)
+	}
+
+	// Proofs after the claim are backed by the remaining deposit
+	if _, err := sendProof(newProof(ether(5, 10), "client", contractAddr.Hex())); err != nil {
+		t.Fatal(err)
+	}
+	assertCredit(ether(5, 10))
+	if _, err := sendProof(newProof(ether(11, 10), "client", contractAddr.Hex())); err == nil {
+		t.Errorf("expected deposit error")
+	}
+
+	// Payouts claim the proof in the same transaction
+	_, newBalance, claimed, err := channels.Claim(account, ether(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBalance.Cmp(ether(5, 10)) != 0 {
+		t.Errorf("wrong new balance: %d", newBalance)
+	}
+	if claimed.Cmp(ether(2, 10)) != 0 {
+		t.Errorf("wrong claimed amount: %d", claimed)
+	}
+	sim.Commit()
+	assertDeposit(ether(5, 10))
+
+	channel, err := memStore.GetChannel(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Claimed.Cmp(ether(5, 10)) != 0 || channel.Amount.Cmp(ether(5, 10)) != 0 {
+		t.Errorf("wrong channel state: %+v", channel)
+	}
+	if channel.Sig == "" {
+		t.Errorf("missing channel signature")
+	}
+
+	// A failed claim is rolled back by the withdrawal tracker
+	tracker := &WithdrawalTracker{
+		Store:        memStore,
+		BalanceStore: memStore,
+		Channels:     channels,
+	}
+	if err := tracker.fail(store.Settlement{Account: account, Claimed: claimed}); err != nil {
+		t.Fatal(err)
+	}
+	if newBalance, err := channels.ClaimBalance(account); err != nil {
+		t.Fatal(err)
+	} else if newBalance.Cmp(ether(3, 10)) != 0 {
+		t.Errorf("wrong claim balance after rollback: %d", newBalance)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
@@ -26,8 +28,8 @@ func (e AddressMismatchError) Error() string {
 
 var zeroInt = &big.Int{}
 
-// ErrDepositTimelocked is returned when a balance is checked but the deposit
-// is timelocked.
+// ErrDepositTimelocked is returned when a balance proof is backed by a
+// deposit that is timelocked.
 var ErrDepositTimelocked = errors.New("deposit is timelocked")
 
 // ContractPayment returns an abstraction around a vipnode pool payment
@@ -60,8 +62,11 @@ func ContractPayment(storeDriver store.AccountStore, address common.Address, bac
 		}
 	}
 	// Setup cache getter and subscribe to the event-based value fill
-	p.balanceCache.Getter = p.GetBalance
-	if err := p.SubscribeBalance(context.Background(), p.balanceCache.Set); err != nil {
+	p.balanceCache.Getter = p.fetchBalance
+	if err := p.SubscribeBalance(context.Background(), p.onBalance); err != nil {
+		return nil, err
+	}
+	if err := p.SubscribeForceSettle(context.Background(), p.setTimelock); err != nil {
 		return nil, err
 	}
 	return p, nil
@@ -77,6 +82,65 @@ type contractPayment struct {
 	backend      bind.ContractBackend
 	balanceCache balanceCache
 	transactOpts *bind.TransactOpts
+
+	// timelocks are the unlock times of accounts that forced a withdraw.
+	mu        sync.Mutex
+	timelocks map[store.Account]time.Time
+}
+
+// timelock returns when the account's deposit unlocks, or zero if it's not
+// timelocked.
+func (p *contractPayment) timelock(account store.Account) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.timelocks[account]
+}
+
+// setTimelock saves when the account's deposit unlocks, or clears it if
+// unlocks is zero.
+func (p *contractPayment) setTimelock(account store.Account, unlocks time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if unlocks.IsZero() {
+		delete(p.timelocks, account)
+		return
+	}
+	if p.timelocks == nil {
+		p.timelocks = map[store.Account]time.Time{}
+	}
+	p.timelocks[account] = unlocks
+}
+
+// onBalance updates the cache from a Balance event in block, unless the
+// cache has a newer deposit. Settling and withdrawing reset the timelock but
+// adding a balance doesn't, and the event doesn't say which one it was, so
+// timelocked accounts are checked again.
+func (p *contractPayment) onBalance(account store.Account, amount *big.Int, block uint64) {
+	if p.balanceCache.Set(account, amount, block) {
+		p.checkTimelock(account)
+	}
+}
+
+// checkTimelock reads the account again if it's timelocked, to find out
+// whether its timelock was reset.
+func (p *contractPayment) checkTimelock(account store.Account) {
+	if p.timelock(account).IsZero() {
+		return
+	}
+	if _, err := p.GetBalance(account); err != nil {
+		logger.Printf("Failed to check timelock for account %q: %s", account, err)
+	}
+}
+
+// setDeposit sets the contract deposit on the balance, as Locked if the
+// account forced a withdraw.
+func (p *contractPayment) setDeposit(balance *store.Balance, account store.Account, deposit *big.Int) {
+	if unlocks := p.timelock(account); !unlocks.IsZero() {
+		balance.Locked = *deposit
+		balance.Unlocks = unlocks
+		return
+	}
+	balance.Deposit = *deposit
 }
 
 // GetNodeBalance proxies the normal store implementation
@@ -97,7 +161,7 @@ func (p *contractPayment) GetNodeBalance(nodeID store.NodeID) (store.Balance, er
 	if err != nil {
 		return balance, err
 	}
-	balance.Deposit = *deposit
+	p.setDeposit(&balance, balance.Account, deposit)
 	return balance, nil
 }
 
@@ -118,7 +182,7 @@ func (p *contractPayment) GetAccountBalance(account store.Account) (store.Balanc
 	if err != nil {
 		return balance, err
 	}
-	balance.Deposit = *deposit
+	p.setDeposit(&balance, account, deposit)
 	return balance, nil
 }
 
@@ -127,7 +191,7 @@ func (p *contractPayment) AddAccountBalance(account store.Account, credit *big.I
 	return p.store.AddAccountBalance(account, credit)
 }
 
-func (p *contractPayment) SubscribeBalance(ctx context.Context, handler func(account store.Account, amount *big.Int)) error {
+func (p *contractPayment) SubscribeBalance(ctx context.Context, handler func(account store.Account, amount *big.Int, block uint64)) error {
 	sink := make(chan *vipnodepool.VipnodePoolBalance, 1)
 	sub, err := p.contract.WatchBalance(&bind.WatchOpts{
 		Context: ctx,
@@ -141,7 +205,7 @@ func (p *contractPayment) SubscribeBalance(ctx context.Context, handler func(acc
 			case balanceEvent := <-sink:
 				account := store.Account(balanceEvent.Account.Hex())
 				logger.Printf("SubscribeBalance: Processing event for account: %s", account)
-				go handler(account, balanceEvent.Balance)
+				go handler(account, balanceEvent.Balance, balanceEvent.Raw.BlockNumber)
 			case err := <-sub.Err():
 				return err
 			case <-ctx.Done():
@@ -172,7 +236,74 @@ func (p *contractPayment) SubscribeBalance(ctx context.Context, handler func(acc
 	return nil
 }
 
-// GetBalance returns the unlocked deposit balance for an account.
+// SetCacheSize sets the number of account deposits to cache before the least
+// recently used are evicted.
+func (p *contractPayment) SetCacheSize(size int) {
+	p.balanceCache.mu.Lock()
+	defer p.balanceCache.mu.Unlock()
+	p.balanceCache.MaxSize = size
+}
+
+// CacheStats returns the counters of the deposit cache.
+func (p *contractPayment) CacheStats() store.CacheStats {
+	return p.balanceCache.Stats()
+}
+
+// RefreshBalances refreshes the cached deposits of recently used accounts
+// every interval until the context is cancelled, so that they don't expire
+// if the contract event subscription fails.
+func (p *contractPayment) RefreshBalances(ctx context.Context, interval time.Duration) error {
+	return p.balanceCache.Start(ctx, interval)
+}
+
+// SubscribeForceSettle calls handler with the unlock time of each account that
+// forces a withdraw. If the subscription fails, then timelocks are only
+// updated when deposits are fetched from the contract.
+func (p *contractPayment) SubscribeForceSettle(ctx context.Context, handler func(account store.Account, unlocks time.Time)) error {
+	sink := make(chan *vipnodepool.VipnodePoolForceSettle, 1)
+	sub, err := p.contract.WatchForceSettle(&bind.WatchOpts{
+		Context: ctx,
+	}, sink)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case event := <-sink:
+				account := store.Account(event.Account.Hex())
+				logger.Printf("SubscribeForceSettle: Processing event for account: %s", account)
+				handler(account, time.Unix(event.TimeLocked.Int64(), 0))
+			case err := <-sub.Err():
+				logger.Printf("SubscribeForceSettle event loop aborted: %s", err)
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// fetchBalance is the balance cache Getter. The deposit is read from the
+// pending state, so it includes the block after the current head, if the
+// backend can tell the head.
+func (p *contractPayment) fetchBalance(account store.Account) (*big.Int, uint64, error) {
+	var block uint64
+	if backend, ok := p.backend.(HeadBackend); ok {
+		head, err := backend.HeaderByNumber(context.Background(), nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		block = head.Number.Uint64() + 1
+	}
+	balance, err := p.GetBalance(account)
+	return balance, block, err
+}
+
+// GetBalance returns the deposit balance for an account, and updates whether
+// it's timelocked.
 func (p *contractPayment) GetBalance(account store.Account) (*big.Int, error) {
 	if account == store.Account("") {
 		return nil, errors.New("failed to get balance: empty account")
@@ -182,9 +313,11 @@ func (p *contractPayment) GetBalance(account store.Account) (*big.Int, error) {
 	if err != nil {
 		return nil, err
 	}
+	var unlocks time.Time
 	if r.TimeLocked.Cmp(zeroInt) != 0 {
-		return nil, ErrDepositTimelocked
+		unlocks = time.Unix(r.TimeLocked.Int64(), 0)
 	}
+	p.setTimelock(account, unlocks)
 	logger.Printf("Retrieved contract balance for %q in %s: %d", account, time.Now().Sub(timer), r.Balance)
 	return r.Balance, nil
 }
@@ -205,3 +338,107 @@ func (p *contractPayment) OpSettle(account store.Account, paymentAmount *big.Int
 	}
 	return txn.Hash().Hex(), nil
 }
+
+// OpResettle replaces a stuck settlement transaction by submitting it again
+// with the same nonce and a higher gas price.
+func (p *contractPayment) OpResettle(settlement store.Settlement, gasPrice *big.Int) (tx string, err error) {
+	if p.transactOpts == nil {
+		return "", errors.New("OpResettle contract write failed: Payment provider is in read-only mode.")
+	}
+	opts := *p.transactOpts
+	opts.Nonce = new(big.Int).SetUint64(settlement.Nonce)
+	opts.GasPrice = gasPrice
+	addr := common.HexToAddress(string(settlement.Account))
+	txn, err := p.contract.OpSettle(&opts, addr, settlement.Amount, settlement.NewBalance)
+	if err != nil {
+		return "", err
+	}
+	return txn.Hash().Hex(), nil
+}
+
+// ChannelDeposit returns the account's on-chain deposit, including while it
+// is timelocked. It is used as a ChannelDepositGetter for PaymentChannels.
+func (p *contractPayment) ChannelDeposit(account store.Account) (deposit *big.Int, timelocked bool, err error) {
+	if account == store.Account("") {
+		return nil, false, errors.New("failed to get channel deposit: empty account")
+	}
+	r, err := p.contract.Accounts(&bind.CallOpts{Pending: true}, common.HexToAddress(string(account)))
+	if err != nil {
+		return nil, false, err
+	}
+	return r.Balance, r.TimeLocked.Sign() != 0, nil
+}
+
+// WithdrawInterval returns how long the contract timelocks a deposit after a
+// forced withdraw before it can be withdrawn.
+func (p *contractPayment) WithdrawInterval() (time.Duration, error) {
+	interval, err := p.contract.WithdrawInterval(&bind.CallOpts{})
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(interval.Int64()) * time.Second, nil
+}
+
+// LatestDeposits returns the latest deposit of each account that has a
+// Balance event between fromBlock and toBlock (inclusive). Accounts that
+// forced a withdraw in the range are marked as timelocked.
+func (p *contractPayment) LatestDeposits(ctx context.Context, fromBlock uint64, toBlock uint64) (map[store.Account]BlockDeposit, error) {
+	opts := &bind.FilterOpts{
+		Start:   fromBlock,
+		End:     &toBlock,
+		Context: ctx,
+	}
+	it, err := p.contract.FilterBalance(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	r := map[store.Account]BlockDeposit{}
+	for it.Next() {
+		r[store.Account(it.Event.Account.Hex())] = BlockDeposit{
+			Amount: it.Event.Balance,
+			Block:  it.Event.Raw.BlockNumber,
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	// A later settle in the range resets the timelock, which
+	// ReconcileDeposits checks.
+	locks, err := p.contract.FilterForceSettle(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer locks.Close()
+	for locks.Next() {
+		p.setTimelock(store.Account(locks.Event.Account.Hex()), time.Unix(locks.Event.TimeLocked.Int64(), 0))
+	}
+	return r, locks.Error()
+}
+
+// ReconcileDeposits replaces the cached deposits with the given ones, such as
+// the latest deposits from the event log. Cached deposits from newer blocks,
+// such as from live events that arrived during the replay, are kept. It
+// returns the accounts whose cached deposit was replaced with a different
+// one, such as from events that were missed while the pool was down.
+func (p *contractPayment) ReconcileDeposits(deposits map[store.Account]BlockDeposit) []DepositDrift {
+	var drifts []DepositDrift
+	for account, deposit := range deposits {
+		cached := p.balanceCache.Peek(account)
+		if !p.balanceCache.Set(account, deposit.Amount, deposit.Block) {
+			continue
+		}
+		if cached != nil && cached.Cmp(deposit.Amount) != 0 {
+			drifts = append(drifts, DepositDrift{
+				Account:  account,
+				Cached:   cached,
+				Contract: deposit.Amount,
+			})
+		}
+		p.checkTimelock(account)
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].Account < drifts[j].Account })
+	return drifts
+}
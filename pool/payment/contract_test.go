@@ -0,0 +1,297 @@
+package payment
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+	"github.com/vipnode/vipnode/v2/request"
+)
+
+func TestContractPaymentOperator(t *testing.T) {
+	sim := newSimulatedPool(t, 1)
+	defer sim.Close()
+
+	_, err := ContractPayment(memory.New(), sim.Address, sim, sim.Clients[0])
+	if err, ok := err.(AddressMismatchError); !ok {
+		t.Fatalf("expected AddressMismatchError, got: %v", err)
+	} else if err.Want != sim.Operator.From || err.Got != sim.Clients[0].From {
+		t.Errorf("wrong mismatch: %s", err)
+	}
+
+	// Read-only mode skips the operator check, but can't settle
+	p, err := ContractPayment(memory.New(), sim.Address, sim, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.OpSettle(sim.Account(0), big.NewInt(1), big.NewInt(0)); err == nil {
+		t.Error("expected read-only OpSettle error")
+	}
+	if interval, err := p.WithdrawInterval(); err != nil {
+		t.Fatal(err)
+	} else if interval != time.Hour*24*7 {
+		t.Errorf("wrong withdraw interval: %s", interval)
+	}
+}
+
+func TestContractPaymentBalance(t *testing.T) {
+	sim := newSimulatedPool(t, 2)
+	defer sim.Close()
+
+	memStore := memory.New()
+	p, err := ContractPayment(memStore, sim.Address, sim, sim.Operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := sim.Account(0)
+
+	if _, err := p.GetBalance(""); err == nil {
+		t.Error("expected empty account error")
+	}
+	if balance, err := p.GetBalance(account); err != nil {
+		t.Fatal(err)
+	} else if balance.Sign() != 0 {
+		t.Errorf("wrong balance before deposit: %d", balance)
+	}
+
+	// Deposit events fill the cache without querying the contract
+	sim.Deposit(t, 0, ether(1, 1))
+	waitFor(t, "deposit event", func() bool {
+		cached := p.balanceCache.Peek(account)
+		return cached != nil && cached.Cmp(ether(1, 1)) == 0
+	})
+	sim.Deposit(t, 0, ether(1, 2))
+	waitFor(t, "second deposit event", func() bool {
+		cached := p.balanceCache.Peek(account)
+		return cached != nil && cached.Cmp(ether(3, 2)) == 0
+	})
+	if cached := p.balanceCache.Peek(sim.Account(1)); cached != nil {
+		t.Errorf("unexpected cached balance for other account: %d", cached)
+	}
+
+	if err := memStore.AddAccountBalance(account, big.NewInt(42)); err != nil {
+		t.Fatal(err)
+	}
+	balance, err := p.GetAccountBalance(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Deposit.Cmp(ether(3, 2)) != 0 || balance.Credit.Int64() != 42 {
+		t.Errorf("wrong balance: deposit=%d credit=%d", &balance.Deposit, &balance.Credit)
+	}
+
+	// Node balances include the deposit once the node is added to the account
+	nodeID := store.NodeID("abcd")
+	if err := memStore.SetNode(store.Node{ID: nodeID}); err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := p.GetNodeBalance(nodeID); err != nil {
+		t.Fatal(err)
+	} else if balance.Deposit.Sign() != 0 {
+		t.Errorf("unexpected deposit on trial balance: %d", &balance.Deposit)
+	}
+	if err := memStore.AddAccountNode(account, nodeID); err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := p.GetNodeBalance(nodeID); err != nil {
+		t.Fatal(err)
+	} else if balance.Deposit.Cmp(ether(3, 2)) != 0 {
+		t.Errorf("wrong node deposit: %d", &balance.Deposit)
+	}
+}
+
+func TestContractPaymentTimelocked(t *testing.T) {
+	sim := newSimulatedPool(t, 1)
+	defer sim.Close()
+
+	p, err := ContractPayment(memory.New(), sim.Address, sim, sim.Operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := sim.Account(0)
+	sim.Deposit(t, 0, ether(1, 1))
+	sim.ForceSettle(t, 0)
+
+	// ForceSettle events mark the deposit as locked
+	waitFor(t, "force settle event", func() bool {
+		return !p.timelock(account).IsZero()
+	})
+	assertLocked := func(p *contractPayment, want *big.Int) {
+		t.Helper()
+		balance, err := p.GetAccountBalance(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Deposit.Sign() != 0 || balance.Locked.Cmp(want) != 0 {
+			t.Errorf("wrong locked balance: deposit=%d locked=%d", &balance.Deposit, &balance.Locked)
+		}
+		// The contract's withdraw interval is 7 days of chain time
+		head, err := sim.HeaderByNumber(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !balance.Unlocks.After(time.Unix(int64(head.Time), 0).Add(time.Hour * 24 * 6)) {
+			t.Errorf("wrong unlock time: %s", balance.Unlocks)
+		}
+	}
+	assertLocked(p, ether(1, 1))
+
+	// Adding to the balance doesn't reset the timelock
+	sim.Deposit(t, 0, ether(1, 2))
+	waitFor(t, "deposit event", func() bool {
+		cached := p.balanceCache.Peek(account)
+		return cached != nil && cached.Cmp(ether(3, 2)) == 0
+	})
+	assertLocked(p, ether(3, 2))
+
+	// Uncached balances get the timelock from the contract
+	fresh, err := ContractPayment(memory.New(), sim.Address, sim, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLocked(fresh, ether(3, 2))
+
+	// Channels still see the timelocked deposit
+	if deposit, timelocked, err := p.ChannelDeposit(account); err != nil {
+		t.Fatal(err)
+	} else if !timelocked || deposit.Cmp(ether(3, 2)) != 0 {
+		t.Errorf("wrong channel deposit: %d timelocked=%t", deposit, timelocked)
+	}
+
+	// Settling answers the timelock and unlocks the new balance
+	if _, err := p.OpSettle(account, ether(1, 1), ether(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	waitFor(t, "settle event", func() bool {
+		cached := p.balanceCache.Peek(account)
+		return cached != nil && cached.Cmp(ether(1, 2)) == 0 && p.timelock(account).IsZero()
+	})
+	if balance, err := p.GetAccountBalance(account); err != nil {
+		t.Fatal(err)
+	} else if balance.Deposit.Cmp(ether(1, 2)) != 0 || balance.IsLocked() {
+		t.Errorf("wrong balance after settle: deposit=%d locked=%d", &balance.Deposit, &balance.Locked)
+	}
+}
+
+func TestContractPaymentSettle(t *testing.T) {
+	sim := newSimulatedPool(t, 2)
+	defer sim.Close()
+
+	memStore := memory.New()
+	p, err := ContractPayment(memStore, sim.Address, sim, sim.Operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := sim.Account(0)
+	wallet := sim.Clients[0].From
+	sim.Deposit(t, 0, ether(1, 1))
+	// The other client's deposit covers paying out the credit
+	sim.Deposit(t, 1, ether(1, 1))
+
+	if err := memStore.AddAccountBalance(account, ether(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	service := PaymentService{
+		NonceStore:      memStore,
+		AccountStore:    memStore,
+		BalanceStore:    p,
+		SettlementStore: memStore,
+
+		Settle: p.OpSettle,
+	}
+	tracker := &WithdrawalTracker{
+		Store:         memStore,
+		BalanceStore:  memStore,
+		Backend:       sim,
+		Confirmations: 2,
+	}
+
+	// Withdraw the deposit and credit to the client's wallet
+	walletBefore := sim.WalletBalance(t, wallet)
+	nonce := time.Now().UnixNano()
+	maxFee := "0"
+	sig, err := request.AddressRequest{
+		Method:    "pool_withdraw",
+		Address:   wallet.Hex(),
+		Nonce:     nonce,
+		ExtraArgs: []interface{}{maxFee},
+	}.Sign(sim.clientKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Withdraw(context.Background(), sig, wallet.Hex(), nonce, &maxFee); err != nil {
+		t.Fatal(err)
+	}
+
+	checkStatus := func(want store.SettlementStatus) {
+		t.Helper()
+		if err := tracker.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		settlements, err := memStore.GetSettlements(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(settlements) != 1 {
+			t.Fatalf("wrong number of settlements: %d", len(settlements))
+		}
+		if got := settlements[0].Status; got != want {
+			t.Errorf("wrong settlement status: got %q; want %q", got, want)
+		}
+	}
+	checkStatus(store.SettlementPending)
+
+	sim.Commit()
+	checkStatus(store.SettlementMined)
+	sim.Commit()
+	sim.Commit()
+	checkStatus(store.SettlementConfirmed)
+
+	if deposit, _, err := p.ChannelDeposit(account); err != nil {
+		t.Fatal(err)
+	} else if deposit.Sign() != 0 {
+		t.Errorf("wrong deposit after withdraw: %d", deposit)
+	}
+	// The operator pays for gas, so the wallet receives the exact total
+	if paid := new(big.Int).Sub(sim.WalletBalance(t, wallet), walletBefore); paid.Cmp(ether(11, 10)) != 0 {
+		t.Errorf("wrong paid amount: got %d; want %d", paid, ether(11, 10))
+	}
+	waitFor(t, "settle event", func() bool {
+		cached := p.balanceCache.Peek(account)
+		return cached != nil && cached.Sign() == 0
+	})
+	if balance, err := memStore.GetAccountBalance(account); err != nil {
+		t.Fatal(err)
+	} else if balance.Credit.Sign() != 0 {
+		t.Errorf("credit was not settled: %d", &balance.Credit)
+	}
+
+	// Paying out more than the contract holds fails before the credit is
+	// settled
+	if err := memStore.AddAccountBalance(account, ether(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	nonce++
+	sig, err = request.AddressRequest{
+		Method:    "pool_withdraw",
+		Address:   wallet.Hex(),
+		Nonce:     nonce,
+		ExtraArgs: []interface{}{maxFee},
+	}.Sign(sim.clientKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Withdraw(context.Background(), sig, wallet.Hex(), nonce, &maxFee); err == nil {
+		t.Error("expected failed withdraw")
+	}
+	if balance, err := memStore.GetAccountBalance(account); err != nil {
+		t.Fatal(err)
+	} else if balance.Credit.Cmp(ether(2, 1)) != 0 {
+		t.Errorf("wrong credit after failed withdraw: %d", &balance.Credit)
+	}
+}
@@ -0,0 +1,78 @@
+package payment
+
+import (
+	"context"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vipnode/vipnode-contract/go/vipnodepool"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// FeeQuoter quotes the fee for paying out an amount to an account, along
+// with resetting its deposit to newBalance.
+type FeeQuoter interface {
+	QuoteFee(ctx context.Context, account store.Account, amount *big.Int, newBalance *big.Int) (*big.Int, error)
+}
+
+// GasBackend is the subset of bind.ContractBackend required to estimate
+// transaction fees.
+type GasBackend interface {
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, call ethereum.CallMsg) (gas uint64, err error)
+}
+
+// GasFeeEstimator quotes the withdraw fee as the estimated gas cost of the
+// OpSettle transaction at the suggested gas price, plus a margin.
+type GasFeeEstimator struct {
+	Backend  GasBackend
+	Contract common.Address
+	// Operator is the contract operator wallet that sends the transaction.
+	Operator common.Address
+	// Margin is the fraction added on top of the estimated fee, to cover
+	// gas price changes before the transaction is mined. (Optional)
+	Margin *big.Rat
+	// FallbackGas is used if the gas estimate fails, such as when the
+	// contract can't cover the payment yet. If 0, then the error is
+	// returned instead.
+	FallbackGas uint64
+}
+
+// QuoteFee returns the estimated fee for settling amount to account with the
+// given newBalance.
+func (e *GasFeeEstimator) QuoteFee(ctx context.Context, account store.Account, amount *big.Int, newBalance *big.Int) (*big.Int, error) {
+	contractABI, err := abi.JSON(strings.NewReader(vipnodepool.VipnodePoolABI))
+	if err != nil {
+		return nil, err
+	}
+	data, err := contractABI.Pack("opSettle", common.HexToAddress(string(account)), amount, newBalance)
+	if err != nil {
+		return nil, err
+	}
+	gas, err := e.Backend.EstimateGas(ctx, ethereum.CallMsg{
+		From: e.Operator,
+		To:   &e.Contract,
+		Data: data,
+	})
+	if err != nil {
+		if e.FallbackGas == 0 {
+			return nil, err
+		}
+		logger.Printf("Failed to estimate settlement gas for %q, using fallback gas limit %d: %s", account, e.FallbackGas, err)
+		gas = e.FallbackGas
+	}
+	gasPrice, err := e.Backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fee := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gas))
+	if e.Margin != nil {
+		margin := new(big.Rat).Mul(new(big.Rat).SetInt(fee), e.Margin)
+		fee.Add(fee, new(big.Int).Div(margin.Num(), margin.Denom()))
+	}
+	return fee, nil
+}
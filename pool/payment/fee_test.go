@@ -0,0 +1,98 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+type fakeGasBackend struct {
+	gas      uint64
+	gasPrice *big.Int
+	calls    []ethereum.CallMsg
+}
+
+func (b *fakeGasBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return b.gasPrice, nil
+}
+
+func (b *fakeGasBackend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	b.calls = append(b.calls, call)
+	if b.gas == 0 {
+		return 0, errors.New("gas required exceeds allowance")
+	}
+	return b.gas, nil
+}
+
+func TestWithdrawQuote(t *testing.T) {
+	backend := &fakeGasBackend{gas: 50000, gasPrice: big.NewInt(10)}
+	estimator := &GasFeeEstimator{
+		Backend: backend,
+		Margin:  big.NewRat(1, 5),
+	}
+
+	memStore := memory.New()
+	p := PaymentService{
+		NonceStore:   memStore,
+		AccountStore: memStore,
+		BalanceStore: memStore,
+		Fees:         estimator,
+		WithdrawMin:  big.NewInt(500),
+	}
+
+	wallet := "0x961Aa96FebeE5465149a0787B03bFa14D8e9033F"
+	if err := memStore.AddAccountBalance(store.Account(wallet), big.NewInt(1000000)); err != nil {
+		t.Fatal(err)
+	}
+
+	quote, err := p.WithdrawQuote(context.Background(), wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := big.NewInt(600000); quote.Fee.Cmp(want) != 0 {
+		t.Errorf("wrong fee: got %d; want %d", quote.Fee, want)
+	}
+	if want := big.NewInt(400000); quote.Amount.Cmp(want) != 0 {
+		t.Errorf("wrong amount: got %d; want %d", quote.Amount, want)
+	}
+	if len(backend.calls) != 1 || len(backend.calls[0].Data) != 4+32*3 {
+		t.Errorf("wrong gas estimate call: %+v", backend.calls)
+	}
+
+	// The estimate uses the new balance that the settlement leaves
+	if _, err := estimator.QuoteFee(context.Background(), store.Account(wallet), big.NewInt(1000), big.NewInt(42)); err != nil {
+		t.Fatal(err)
+	}
+	if data := backend.calls[1].Data; new(big.Int).SetBytes(data[len(data)-32:]).Int64() != 42 {
+		t.Errorf("wrong new balance in gas estimate call: %x", data)
+	}
+
+	// Gas price spike, the fee is more than the balance
+	backend.gasPrice = big.NewInt(100)
+	quote, err = p.WithdrawQuote(context.Background(), wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.Amount.Sign() != 0 || quote.Fee.Cmp(big.NewInt(6000000)) != 0 {
+		t.Errorf("wrong quote: %+v", quote)
+	}
+
+	// Failed estimates use the fallback gas
+	backend.gas = 0
+	if _, err := p.WithdrawQuote(context.Background(), wallet); err == nil {
+		t.Errorf("expected gas estimate error")
+	}
+	estimator.FallbackGas = 1000
+	quote, err = p.WithdrawQuote(context.Background(), wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := big.NewInt(120000); quote.Fee.Cmp(want) != 0 {
+		t.Errorf("wrong fallback fee: got %d; want %d", quote.Fee, want)
+	}
+}
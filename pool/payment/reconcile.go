@@ -0,0 +1,158 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// defaultReconcileRange is the number of blocks that are filtered per log
+// query, since most providers limit the range of a single query.
+const defaultReconcileRange = 5000
+
+// DepositDrift is an account whose cached contract deposit disagreed with the
+// contract's event log.
+type DepositDrift struct {
+	Account  store.Account
+	Cached   *big.Int
+	Contract *big.Int
+}
+
+func (d DepositDrift) String() string {
+	return fmt.Sprintf("DepositDrift(%q, cached=%d, contract=%d)", d.Account, d.Cached, d.Contract)
+}
+
+// BlockDeposit is an account's contract deposit as of a block.
+type BlockDeposit struct {
+	Amount *big.Int
+	Block  uint64
+}
+
+// DepositLogReader replays contract deposit events into the pool's view of
+// the deposits, such as contractPayment.
+type DepositLogReader interface {
+	// LatestDeposits returns the latest deposit of each account that has a
+	// deposit event between fromBlock and toBlock (inclusive).
+	LatestDeposits(ctx context.Context, fromBlock uint64, toBlock uint64) (map[store.Account]BlockDeposit, error)
+	// ReconcileDeposits replaces the pool's view of the deposits, unless it
+	// has a deposit from a newer block, and returns the accounts that
+	// disagreed.
+	ReconcileDeposits(deposits map[store.Account]BlockDeposit) []DepositDrift
+}
+
+// HeadBackend is the subset of an Ethereum client that is required to find
+// the latest block, such as *ethclient.Client.
+type HeadBackend interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// DepositReconciler replays the contract's deposit events since the last
+// checkpoint, to warm the balance cache on startup and to catch up on any
+// events that the live subscription missed.
+type DepositReconciler struct {
+	Store    store.CheckpointStore
+	Contract DepositLogReader
+	Backend  HeadBackend
+
+	// Checkpoint is the name of the store checkpoint, which should be unique
+	// per contract. (Default: "deposits")
+	Checkpoint string
+	// StartBlock is the first block to replay if there is no checkpoint yet,
+	// such as the block the contract was deployed in.
+	StartBlock uint64
+	// BlockRange is the maximum number of blocks per log query. (Default: 5000)
+	BlockRange uint64
+	// Interval is the time between reconciliations.
+	Interval time.Duration
+
+	// OnDrift (optional) is called for each account whose cached deposit
+	// disagreed with the contract.
+	OnDrift func(drift DepositDrift)
+}
+
+func (r *DepositReconciler) checkpoint() string {
+	if r.Checkpoint == "" {
+		return "deposits"
+	}
+	return r.Checkpoint
+}
+
+// Start reconciles the deposits immediately and then every Interval until the
+// context is cancelled.
+func (r *DepositReconciler) Start(ctx context.Context) error {
+	if r.Interval <= 0 {
+		return errors.New("deposit reconciler interval must be positive")
+	}
+	if _, err := r.Reconcile(ctx); err != nil {
+		logger.Printf("Deposit reconciliation failed: %s", err)
+	}
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := r.Reconcile(ctx); err != nil {
+				logger.Printf("Deposit reconciliation failed: %s", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Reconcile replays the deposit events from the checkpoint up to the latest
+// block, and returns any drift that was found. The events are queried in
+// block ranges, but only the latest deposit of each account is applied once
+// all of them succeed, so the pool never sees an older deposit.
+func (r *DepositReconciler) Reconcile(ctx context.Context) ([]DepositDrift, error) {
+	head, err := r.Backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	toBlock := head.Number.Uint64()
+
+	fromBlock := r.StartBlock
+	if checkpoint, err := r.Store.GetCheckpoint(r.checkpoint()); err != nil {
+		return nil, err
+	} else if checkpoint != 0 && checkpoint+1 > fromBlock {
+		fromBlock = checkpoint + 1
+	}
+	if fromBlock > toBlock {
+		return nil, nil
+	}
+
+	blockRange := r.BlockRange
+	if blockRange == 0 {
+		blockRange = defaultReconcileRange
+	}
+
+	deposits := map[store.Account]BlockDeposit{}
+	for start := fromBlock; start <= toBlock; start += blockRange {
+		end := start + blockRange - 1
+		if end > toBlock {
+			end = toBlock
+		}
+		found, err := r.Contract.LatestDeposits(ctx, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for account, deposit := range found {
+			deposits[account] = deposit
+		}
+	}
+
+	drifts := r.Contract.ReconcileDeposits(deposits)
+	for _, drift := range drifts {
+		logger.Printf("Reconciled deposit drift: %s", drift)
+		if r.OnDrift != nil {
+			r.OnDrift(drift)
+		}
+	}
+	logger.Printf("Reconciled %d account deposits from blocks %d to %d", len(deposits), fromBlock, toBlock)
+	return drifts, r.Store.SetCheckpoint(r.checkpoint(), toBlock)
+}
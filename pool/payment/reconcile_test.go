@@ -0,0 +1,110 @@
+package payment
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestDepositReconciler(t *testing.T) {
+	sim := newSimulatedPool(t, 2)
+	defer sim.Close()
+
+	// Deposits that happen while the pool is down are missed by the
+	// subscription
+	sim.Deposit(t, 0, ether(1, 1))
+	sim.Deposit(t, 1, ether(2, 1))
+	sim.Deposit(t, 0, ether(1, 2))
+
+	memStore := memory.New()
+	p, err := ContractPayment(memStore, sim.Address, sim, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached := p.balanceCache.Peek(sim.Account(0)); cached != nil {
+		t.Fatalf("unexpected cached deposit: %d", cached)
+	}
+
+	var onDrift []DepositDrift
+	reconciler := &DepositReconciler{
+		Store:      memStore,
+		Contract:   p,
+		Backend:    sim,
+		Checkpoint: "deposits:" + sim.Address.Hex(),
+		BlockRange: 2,
+		OnDrift: func(drift DepositDrift) {
+			onDrift = append(onDrift, drift)
+		},
+	}
+	if drifts, err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(drifts) != 0 {
+		t.Errorf("unexpected drift on cold cache: %s", drifts)
+	}
+	if cached := p.balanceCache.Peek(sim.Account(0)); cached == nil || cached.Cmp(ether(3, 2)) != 0 {
+		t.Errorf("wrong cached deposit: %d", cached)
+	}
+	if cached := p.balanceCache.Peek(sim.Account(1)); cached == nil || cached.Cmp(ether(2, 1)) != 0 {
+		t.Errorf("wrong cached deposit: %d", cached)
+	}
+
+	head, err := sim.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint, err := memStore.GetCheckpoint(reconciler.Checkpoint); err != nil {
+		t.Fatal(err)
+	} else if checkpoint != head.Number.Uint64() {
+		t.Errorf("wrong checkpoint: got %d; want %d", checkpoint, head.Number.Uint64())
+	}
+
+	// Nothing new to replay
+	if drifts, err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(drifts) != 0 {
+		t.Errorf("unexpected drift: %s", drifts)
+	}
+
+	// Stale cache values, such as from missed events, are corrected from the
+	// log
+	p.balanceCache.Invalidate(sim.Account(1))
+	p.balanceCache.Set(sim.Account(1), ether(1, 1), 1)
+	if err := memStore.SetCheckpoint(reconciler.Checkpoint, 0); err != nil {
+		t.Fatal(err)
+	}
+	drifts, err := reconciler.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 1 || len(onDrift) != 1 {
+		t.Fatalf("wrong drifts: %s", drifts)
+	}
+	if drift := drifts[0]; drift.Account != sim.Account(1) || drift.Cached.Cmp(ether(1, 1)) != 0 || drift.Contract.Cmp(ether(2, 1)) != 0 {
+		t.Errorf("wrong drift: %s", drift)
+	}
+	if cached := p.balanceCache.Peek(sim.Account(1)); cached == nil || cached.Cmp(ether(2, 1)) != 0 {
+		t.Errorf("drift was not corrected: %d", cached)
+	}
+
+	// Deposits from newer blocks, such as from live events that arrive during
+	// the replay, are not replaced by older ones
+	newer := head.Number.Uint64() + 1
+	if !p.balanceCache.Set(sim.Account(0), ether(1, 1), newer) {
+		t.Fatal("deposit from a newer block was not set")
+	}
+	if p.balanceCache.Set(sim.Account(0), ether(3, 2), newer-1) {
+		t.Error("deposit was replaced by an older one")
+	}
+	if err := memStore.SetCheckpoint(reconciler.Checkpoint, 0); err != nil {
+		t.Fatal(err)
+	}
+	if drifts, err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(drifts) != 0 {
+		t.Errorf("unexpected drift for a newer deposit: %s", drifts)
+	}
+	if cached := p.balanceCache.Peek(sim.Account(0)); cached == nil || cached.Cmp(ether(1, 1)) != 0 {
+		t.Errorf("newer deposit was replaced: %d", cached)
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/vipnode/vipnode/v2/pool"
+	"github.com/vipnode/vipnode/v2/pool/balance"
 	"github.com/vipnode/vipnode/v2/pool/store"
 	"github.com/vipnode/vipnode/v2/request"
 )
@@ -14,6 +16,9 @@ import (
 // ErrWithdrawDisabled is returned when the PaymentService is initialized in read-only mode.
 var ErrWithdrawDisabled = errors.New("withdraw is disabled")
 
+// ErrSubscriptionsDisabled is returned when the PaymentService is initialized without subscription plans.
+var ErrSubscriptionsDisabled = errors.New("subscriptions are disabled")
+
 // WithdrawBalanceMinimumError is returned when the account balance is below
 // the configured minimum to withdraw.
 type WithdrawBalanceMinimumError struct {
@@ -25,21 +30,58 @@ func (err WithdrawBalanceMinimumError) Error() string {
 	return fmt.Sprintf("account balance (%d) is below the minimum required to withdraw (%d)", err.Balance, err.Minimum)
 }
 
+// WithdrawFeeError is returned when the current withdraw fee is more than the
+// maximum fee that the withdraw request allows.
+type WithdrawFeeError struct {
+	Fee    *big.Int
+	MaxFee *big.Int
+}
+
+func (err WithdrawFeeError) Error() string {
+	return fmt.Sprintf("withdraw fee (%d) is more than the maximum fee (%d)", err.Fee, err.MaxFee)
+}
+
+// WithdrawQuoteResponse is returned on RPC calls to pool_withdrawQuote
+type WithdrawQuoteResponse struct {
+	// Balance is the account's total balance that would be withdrawn.
+	Balance *big.Int `json:"balance"`
+	// Fee is the current fee that would be deducted from the balance.
+	Fee *big.Int `json:"fee"`
+	// Amount is the amount that would be paid out after the fee.
+	Amount *big.Int `json:"amount"`
+	// Minimum is the minimum balance required to withdraw. (Optional)
+	Minimum *big.Int `json:"minimum,omitempty"`
+}
+
 // AccountResponse is returned on RPC calls to pool_account
 type AccountResponse struct {
-	NodeShortIDs []string      `json:"node_short_ids"`
-	Balance      store.Balance `json:"balance"`
+	NodeShortIDs []string `json:"node_short_ids"`
+	// NodeIDs are the full node IDs, only set for signed requests.
+	NodeIDs []string      `json:"node_ids,omitempty"`
+	Balance store.Balance `json:"balance"`
 }
 
 // SettleHandler is a function that settles the balance of a given account by
 // updating the internal balance to newBalance and disbursing paymentAmount.
 type SettleHandler func(account store.Account, paymentAmount *big.Int, newBalance *big.Int) (txID string, err error)
 
+// Subscriber sells prepaid subscription plans, such as the
+// balance.Subscriptions manager.
+type Subscriber interface {
+	// AvailablePlans returns the plans that are available to buy.
+	AvailablePlans() []balance.Plan
+	// Subscribe buys a plan for the account, paid from its balance.
+	Subscribe(account store.Account, plan string, renew bool) (*store.Subscription, error)
+}
+
 // PaymentService is an RPC service for managing pool payment-relatd requests.
 type PaymentService struct {
 	NonceStore   store.NonceStore
 	AccountStore store.AccountStore
 	BalanceStore store.BalanceStore
+	// SettlementStore (optional) keeps a record of each withdrawal, which is
+	// tracked by a WithdrawalTracker.
+	SettlementStore store.SettlementStore
 
 	// Settle is a function that disburses the given paymentAmount and replaces
 	// the current "on-chain" balance with newBalance. It returns a transaction
@@ -47,29 +89,66 @@ type PaymentService struct {
 	Settle SettleHandler
 	// WithdrawFee (optional) takes the withdraw total and returns the new total to withdraw (with any fees applied).
 	WithdrawFee func(*big.Int) *big.Int
+	// Fees (optional) quotes the withdraw fee dynamically, such as from the
+	// current gas price. It takes precedence over WithdrawFee.
+	Fees FeeQuoter
 	// WithdrawMin (optional) is the minimum amount required to allow a withdraw.
 	WithdrawMin *big.Int
+	// DefaultMaxFee (optional) is the maximum withdraw fee for requests that
+	// don't sign their own maxFee. If nil, then their fee is not limited.
+	DefaultMaxFee *big.Int
+
+	// Channels (optional) claims the account's payment channel proofs from
+	// its deposit along with each withdraw, instead of resetting the deposit.
+	Channels *PaymentChannels
+
+	// Subscriptions (optional) sells prepaid subscription plans. If nil, then
+	// Subscribe calls will error with ErrSubscriptionsDisabled.
+	Subscriptions Subscriber
 }
 
-func (p *PaymentService) verify(sig string, method string, wallet string, nonce int64, args ...interface{}) error {
-	if err := p.NonceStore.CheckAndSaveNonce(wallet, nonce); err != nil {
-		return pool.VerifyFailedError{Cause: err, Method: method}
+// verify checks the signature and nonce of a request, and returns the
+// normalized account of the wallet that signed it.
+func (p *PaymentService) verify(sig string, method string, wallet string, nonce int64, args ...interface{}) (store.Account, error) {
+	account, err := store.ParseAccount(wallet)
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.NonceStore.CheckAndSaveNonce(string(account), nonce); err != nil {
+		return "", pool.VerifyFailedError{Cause: err, Method: method}
 	}
 
+	// The signature covers the wallet as it was sent.
 	if err := request.Verify(sig, method, wallet, nonce, args...); err != nil {
-		return pool.VerifyFailedError{Cause: err, Method: method}
+		return "", pool.VerifyFailedError{Cause: err, Method: method}
 	}
-	return nil
+	return account, nil
 }
 
 // Account is an *unverified* endpoint for retrieving the balance and list of
-// node shortIDs associated with a wallet.
-func (p *PaymentService) Account(ctx context.Context, wallet string) (*AccountResponse, error) {
+// node shortIDs associated with a wallet. If the optional sig and nonce are
+// provided, then the request is verified and the full node IDs are included.
+func (p *PaymentService) Account(ctx context.Context, wallet string, sig *string, nonce *int64) (*AccountResponse, error) {
 	if wallet == "" {
 		return nil, errors.New("missing wallet parameter")
 	}
+	account, err := store.ParseAccount(wallet)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	if sig != nil || nonce != nil {
+		if sig == nil || nonce == nil {
+			return nil, errors.New("signed account request requires both sig and nonce")
+		}
+		if _, err := p.verify(*sig, "pool_account", wallet, *nonce); err != nil {
+			return nil, err
+		}
+		verified = true
+	}
 
-	balance, err := p.BalanceStore.GetAccountBalance(store.Account(wallet))
+	balance, err := p.BalanceStore.GetAccountBalance(account)
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +156,7 @@ func (p *PaymentService) Account(ctx context.Context, wallet string) (*AccountRe
 		Balance: balance,
 	}
 
-	nodeIDs, err := p.AccountStore.GetAccountNodes(store.Account(wallet))
+	nodeIDs, err := p.AccountStore.GetAccountNodes(account)
 	if err != nil {
 		return nil, err
 	}
@@ -85,36 +164,88 @@ func (p *PaymentService) Account(ctx context.Context, wallet string) (*AccountRe
 	for _, nodeID := range nodeIDs {
 		r.NodeShortIDs = append(r.NodeShortIDs, string(nodeID)[:12])
 	}
+	if verified {
+		r.NodeIDs = make([]string, 0, len(nodeIDs))
+		for _, nodeID := range nodeIDs {
+			r.NodeIDs = append(r.NodeIDs, string(nodeID))
+		}
+	}
 	return r, nil
 }
 
 // AddNode authorizes a nodeID to be spent by a wallet account.
 func (p *PaymentService) AddNode(ctx context.Context, sig string, wallet string, nonce int64, nodeID string) error {
-	if err := p.verify(sig, "pool_addNode", wallet, nonce, nodeID); err != nil {
+	account, err := p.verify(sig, "pool_addNode", wallet, nonce, nodeID)
+	if err != nil {
 		return err
 	}
+	id, err := store.ParseNodeID(nodeID)
+	if err != nil {
+		return err
+	}
+
+	return p.AccountStore.AddAccountNode(account, id)
+}
 
-	return p.AccountStore.AddAccountNode(store.Account(wallet), store.NodeID(nodeID))
+// RemoveNode de-authorizes a nodeID from spending a wallet account, such as
+// when the node's key is lost or compromised. If toTrial is set, then the
+// node's share of the account's credit is moved back to its trial balance.
+func (p *PaymentService) RemoveNode(ctx context.Context, sig string, wallet string, nonce int64, nodeID string, toTrial bool) error {
+	account, err := p.verify(sig, "pool_removeNode", wallet, nonce, nodeID, toTrial)
+	if err != nil {
+		return err
+	}
+	id, err := store.ParseNodeID(nodeID)
+	if err != nil {
+		return err
+	}
+
+	if err := p.AccountStore.RemoveAccountNode(account, id, toTrial); err != nil {
+		return err
+	}
+	logger.Printf("Removed node %q from account %q (toTrial=%t)", id, account, toTrial)
+	return nil
 }
 
-// Withdraw schedules a balance withdraw for an account
-func (p *PaymentService) Withdraw(ctx context.Context, sig string, wallet string, nonce int64) error {
-	if err := p.verify(sig, "pool_withdraw", wallet, nonce); err != nil {
+// Withdraw schedules a balance withdraw for an account. The optional maxFee
+// is the most that the account agrees to pay in fees, as a decimal string,
+// such as the fee from pool_withdrawQuote. If the fee went up since, then the
+// withdraw is rejected with WithdrawFeeError. Requests without a maxFee are
+// signed without it, and are limited to DefaultMaxFee.
+func (p *PaymentService) Withdraw(ctx context.Context, sig string, wallet string, nonce int64, maxFee *string) error {
+	var account store.Account
+	var err error
+	maxFeeAmount := p.DefaultMaxFee
+	if maxFee == nil {
+		// Older clients don't sign a maxFee
+		account, err = p.verify(sig, "pool_withdraw", wallet, nonce)
+	} else {
+		account, err = p.verify(sig, "pool_withdraw", wallet, nonce, *maxFee)
+	}
+	if err != nil {
 		return err
 	}
+	if maxFee != nil {
+		var ok bool
+		maxFeeAmount, ok = new(big.Int).SetString(*maxFee, 10)
+		if !ok || maxFeeAmount.Sign() < 0 {
+			return fmt.Errorf("invalid maxFee: %q", *maxFee)
+		}
+	}
 
 	if p.Settle == nil {
 		return ErrWithdrawDisabled
 	}
 
-	account := store.Account(wallet)
 	balance, err := p.BalanceStore.GetAccountBalance(account)
 	if err != nil {
 		return err
 	}
 
+	// A timelocked deposit is settled too, which answers the forced withdraw
 	total := new(big.Int)
 	total.Add(&balance.Deposit, &balance.Credit)
+	total.Add(total, &balance.Locked)
 
 	if p.WithdrawMin != nil && total.Cmp(p.WithdrawMin) < 0 {
 		return WithdrawBalanceMinimumError{
@@ -123,15 +254,161 @@ func (p *PaymentService) Withdraw(ctx context.Context, sig string, wallet string
 		}
 	}
 
-	if p.WithdrawFee != nil {
-		total = p.WithdrawFee(total)
+	newBalance, err := p.withdrawBalance(account)
+	if err != nil {
+		return err
+	}
+	total, fee, err := p.withdrawAmount(ctx, account, total, newBalance)
+	if err != nil {
+		return err
+	}
+	if maxFeeAmount != nil && fee.Cmp(maxFeeAmount) > 0 {
+		return WithdrawFeeError{
+			Fee:    fee,
+			MaxFee: maxFeeAmount,
+		}
 	}
 
-	newBalance := big.NewInt(0)
-	txID, err := p.Settle(account, total, newBalance)
+	// The credit is settled along with the deposit
+	now := time.Now()
+	settlement := store.Settlement{
+		Account:    account,
+		Amount:     total,
+		Time:       now,
+		Credit:     new(big.Int).Set(&balance.Credit),
+		NewBalance: newBalance,
+		Attempts:   1,
+		Updated:    now,
+	}
+	err = submitSettlement(p.SettlementStore, p.BalanceStore, &settlement, func() (string, *big.Int, error) {
+		if p.Channels != nil {
+			txID, newBalance, claimed, err := p.Channels.Claim(account, total)
+			settlement.Claimed = claimed
+			return txID, newBalance, err
+		}
+		txID, err := p.Settle(account, total, settlement.NewBalance)
+		return txID, settlement.NewBalance, err
+	})
 	if err != nil {
 		return err
 	}
-	logger.Printf("Withdraw from account %q for %d: %s", account, total, txID)
+	logger.Printf("Withdraw from account %q for %d: %s", account, total, settlement.TxID)
 	return nil
 }
+
+// withdrawBalance returns the account's on-chain deposit after a withdraw,
+// which is only left in place for the claims of payment channels.
+func (p *PaymentService) withdrawBalance(account store.Account) (*big.Int, error) {
+	if p.Channels != nil {
+		return p.Channels.ClaimBalance(account)
+	}
+	return big.NewInt(0), nil
+}
+
+// withdrawAmount returns the amount to pay out from the total, after fees.
+func (p *PaymentService) withdrawAmount(ctx context.Context, account store.Account, total *big.Int, newBalance *big.Int) (amount *big.Int, fee *big.Int, err error) {
+	amount = new(big.Int).Set(total)
+	if p.Fees != nil {
+		fee, err = p.Fees.QuoteFee(ctx, account, total, newBalance)
+		if err != nil {
+			return nil, nil, err
+		}
+		amount.Sub(amount, fee)
+	} else if p.WithdrawFee != nil {
+		amount = p.WithdrawFee(amount)
+		fee = new(big.Int).Sub(total, amount)
+	} else {
+		fee = new(big.Int)
+	}
+	if amount.Sign() <= 0 {
+		return nil, nil, WithdrawBalanceMinimumError{
+			Balance: total,
+			Minimum: fee,
+		}
+	}
+	return amount, fee, nil
+}
+
+// WithdrawQuote is an *unverified* endpoint for retrieving the fee that would
+// be deducted if the account's balance was withdrawn now.
+func (p *PaymentService) WithdrawQuote(ctx context.Context, wallet string) (*WithdrawQuoteResponse, error) {
+	if wallet == "" {
+		return nil, errors.New("missing wallet parameter")
+	}
+	account, err := store.ParseAccount(wallet)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := p.BalanceStore.GetAccountBalance(account)
+	if err != nil {
+		return nil, err
+	}
+	total := new(big.Int).Add(&balance.Deposit, &balance.Credit)
+	total.Add(total, &balance.Locked)
+	r := &WithdrawQuoteResponse{
+		Balance: total,
+		Minimum: p.WithdrawMin,
+	}
+	if total.Sign() <= 0 {
+		r.Fee, r.Amount = new(big.Int), new(big.Int)
+		return r, nil
+	}
+	newBalance, err := p.withdrawBalance(account)
+	if err != nil {
+		return nil, err
+	}
+	r.Amount, r.Fee, err = p.withdrawAmount(ctx, account, total, newBalance)
+	if feeErr, ok := err.(WithdrawBalanceMinimumError); ok {
+		// Balance doesn't cover the fee
+		r.Amount, r.Fee = new(big.Int), feeErr.Minimum
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Withdrawals is an *unverified* endpoint for retrieving the status of an
+// account's withdrawals and settlements, oldest first.
+func (p *PaymentService) Withdrawals(ctx context.Context, wallet string) ([]store.Settlement, error) {
+	if wallet == "" {
+		return nil, errors.New("missing wallet parameter")
+	}
+	account, err := store.ParseAccount(wallet)
+	if err != nil {
+		return nil, err
+	}
+	if p.SettlementStore == nil {
+		return []store.Settlement{}, nil
+	}
+	return p.SettlementStore.GetSettlements(account)
+}
+
+// Plans returns the subscription plans that are available to buy.
+func (p *PaymentService) Plans(ctx context.Context) ([]balance.Plan, error) {
+	if p.Subscriptions == nil {
+		return []balance.Plan{}, nil
+	}
+	return p.Subscriptions.AvailablePlans(), nil
+}
+
+// Subscribe buys a subscription plan for an account, paid from the account's
+// balance. If renew is set, then the subscription is renewed from the balance
+// when it expires.
+func (p *PaymentService) Subscribe(ctx context.Context, sig string, wallet string, nonce int64, plan string, renew bool) (*store.Subscription, error) {
+	account, err := p.verify(sig, "pool_subscribe", wallet, nonce, plan, renew)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Subscriptions == nil {
+		return nil, ErrSubscriptionsDisabled
+	}
+
+	subscription, err := p.Subscriptions.Subscribe(account, plan, renew)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Subscribed account %q to plan %q until %s", account, plan, subscription.Expires)
+	return subscription, nil
+}
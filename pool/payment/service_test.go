@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"strings"
 	"testing"
 	"time"
 
@@ -57,12 +58,13 @@ func TestPaymentWithdraw(t *testing.T) {
 
 	privkey := keygen.HardcodedKey(t)
 	wallet := crypto.PubkeyToAddress(privkey.PublicKey).Hex()
-	getSig := func(nonce int64) string {
+	getSig := func(nonce int64, maxFee string) string {
 		t.Helper()
 		req := request.AddressRequest{
-			Method:  "pool_withdraw",
-			Address: wallet,
-			Nonce:   nonce,
+			Method:    "pool_withdraw",
+			Address:   wallet,
+			Nonce:     nonce,
+			ExtraArgs: []interface{}{maxFee},
 		}
 		sig, err := req.Sign(privkey)
 		if err != nil {
@@ -70,8 +72,9 @@ func TestPaymentWithdraw(t *testing.T) {
 		}
 		return sig
 	}
+	maxFee999, maxFee1000 := "999", "1000"
 	nonce := time.Now().UnixNano()
-	err := p.Withdraw(context.Background(), getSig(nonce), wallet, nonce)
+	err := p.Withdraw(context.Background(), getSig(nonce, "1000"), wallet, nonce, &maxFee1000)
 	if _, ok := err.(WithdrawBalanceMinimumError); !ok {
 		t.Errorf("expected WithdrawBalanceMinimumError error, got: %s", err)
 	}
@@ -80,8 +83,21 @@ func TestPaymentWithdraw(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// The fee is more than the signed maximum
+	nonce++
+	err = p.Withdraw(context.Background(), getSig(nonce, "999"), wallet, nonce, &maxFee999)
+	if _, ok := err.(WithdrawFeeError); !ok {
+		t.Errorf("expected WithdrawFeeError error, got: %s", err)
+	}
+
+	// The maximum fee is signed
+	nonce++
+	if err := p.Withdraw(context.Background(), getSig(nonce, "999"), wallet, nonce, &maxFee1000); err == nil {
+		t.Error("expected verify error")
+	}
+
 	nonce++
-	if err := p.Withdraw(context.Background(), getSig(nonce), wallet, nonce); err != nil {
+	if err := p.Withdraw(context.Background(), getSig(nonce, "1000"), wallet, nonce, &maxFee1000); err != nil {
 		t.Error(err)
 	}
 
@@ -93,4 +109,119 @@ func TestPaymentWithdraw(t *testing.T) {
 		t.Errorf("wrong balance amount: got: %d; want %d", &got, want)
 	}
 
+	// Older clients sign without a maxFee, which is limited to DefaultMaxFee
+	if err := memStore.AddAccountBalance(store.Account(wallet), big.NewInt(5000)); err != nil {
+		t.Fatal(err)
+	}
+	getLegacySig := func(nonce int64) string {
+		t.Helper()
+		sig, err := request.AddressRequest{
+			Method:  "pool_withdraw",
+			Address: wallet,
+			Nonce:   nonce,
+		}.Sign(privkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	p.DefaultMaxFee = big.NewInt(999)
+	nonce++
+	err = p.Withdraw(context.Background(), getLegacySig(nonce), wallet, nonce, nil)
+	if _, ok := err.(WithdrawFeeError); !ok {
+		t.Errorf("expected WithdrawFeeError error for the default max fee, got: %s", err)
+	}
+	p.DefaultMaxFee = nil
+	nonce++
+	if err := p.Withdraw(context.Background(), getLegacySig(nonce), wallet, nonce, nil); err != nil {
+		t.Error(err)
+	}
+	if got, want := contract.Paid[store.Account(wallet)], big.NewInt(8000); got.Cmp(want) != 0 {
+		t.Errorf("wrong paid amount after legacy withdraw: got: %d; want %d", &got, want)
+	}
+}
+
+func TestPaymentRemoveNode(t *testing.T) {
+	memStore := memory.New()
+	p := PaymentService{
+		NonceStore:   memStore,
+		AccountStore: memStore,
+		BalanceStore: memStore,
+	}
+
+	privkey := keygen.HardcodedKey(t)
+	wallet := crypto.PubkeyToAddress(privkey.PublicKey).Hex()
+	account := store.Account(wallet)
+	nonce := time.Now().UnixNano()
+	sign := func(method string, args ...interface{}) (string, int64) {
+		t.Helper()
+		nonce++
+		sig, err := request.AddressRequest{
+			Method:    method,
+			Address:   wallet,
+			Nonce:     nonce,
+			ExtraArgs: args,
+		}.Sign(privkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig, nonce
+	}
+
+	nodeIDs := []store.NodeID{
+		store.NodeID(strings.Repeat("abcdef0123456789", 8)),
+		store.NodeID(strings.Repeat("9876543210fedcba", 8)),
+	}
+	for _, nodeID := range nodeIDs {
+		if err := memStore.SetNode(store.Node{ID: nodeID}); err != nil {
+			t.Fatal(err)
+		}
+		sig, nonce := sign("pool_addNode", string(nodeID))
+		if err := p.AddNode(context.Background(), sig, wallet, nonce, string(nodeID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := memStore.AddAccountBalance(account, big.NewInt(1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsigned requests only get short IDs
+	if r, err := p.Account(context.Background(), wallet, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if len(r.NodeShortIDs) != 2 || len(r.NodeIDs) != 0 {
+		t.Errorf("wrong unsigned account response: %+v", r)
+	}
+	sig, nonce := sign("pool_account")
+	if r, err := p.Account(context.Background(), wallet, &sig, &nonce); err != nil {
+		t.Fatal(err)
+	} else if len(r.NodeIDs) != 2 {
+		t.Errorf("wrong signed account response: %+v", r)
+	}
+	if _, err := p.Account(context.Background(), wallet, &sig, &nonce); err == nil {
+		t.Error("expected nonce error")
+	}
+
+	// Signature covers the toTrial option
+	sig, nonce = sign("pool_removeNode", string(nodeIDs[0]), false)
+	if err := p.RemoveNode(context.Background(), sig, wallet, nonce, string(nodeIDs[0]), true); err == nil {
+		t.Error("expected signature error")
+	}
+
+	sig, nonce = sign("pool_removeNode", string(nodeIDs[0]), true)
+	if err := p.RemoveNode(context.Background(), sig, wallet, nonce, string(nodeIDs[0]), true); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := memStore.GetNodeBalance(nodeIDs[0]); err != nil {
+		t.Fatal(err)
+	} else if b.Account != "" || b.Credit.Cmp(big.NewInt(500)) != 0 {
+		t.Errorf("wrong removed node balance: %s", &b)
+	}
+	if err := memStore.IsAccountNode(account, nodeIDs[1]); err != nil {
+		t.Errorf("remaining node was removed: %s", err)
+	}
+
+	sig, nonce = sign("pool_removeNode", string(nodeIDs[0]), false)
+	if err := p.RemoveNode(context.Background(), sig, wallet, nonce, string(nodeIDs[0]), false); err != store.ErrNotAuthorized {
+		t.Errorf("expected ErrNotAuthorized, got: %v", err)
+	}
 }
@@ -0,0 +1,229 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// SettlementStore is the store subset required by the SettlementScheduler.
+type SettlementStore interface {
+	store.AccountStore
+	store.SettlementStore
+}
+
+// SettlementScheduler periodically pays out the credit that accounts have
+// earned, such as hosts that never call pool_withdraw. Only credit is paid
+// out, deposits are left in place.
+type SettlementScheduler struct {
+	Store SettlementStore
+	// BalanceStore is used to read account balances with their deposits,
+	// such as the contract payment proxy. If nil, then Store is used.
+	BalanceStore store.BalanceStore
+
+	// Settle disburses the payment, see PaymentService.Settle.
+	Settle SettleHandler
+	// WithdrawFee (optional) takes the settlement amount and returns the new
+	// amount to pay out (with any fees applied).
+	WithdrawFee func(*big.Int) *big.Int
+	// Fees (optional) quotes the settlement fee dynamically. It takes
+	// precedence over WithdrawFee.
+	Fees FeeQuoter
+	// WithdrawMin (optional) is the minimum credit required for an account to
+	// be settled.
+	WithdrawMin *big.Int
+	// Channels (optional) claims the account's payment channel proofs from
+	// its deposit along with each settlement.
+	Channels *PaymentChannels
+
+	// Interval is the time between settlement runs, such as weekly.
+	Interval time.Duration
+	// DryRun will only plan the settlements, without paying them out or
+	// changing any balances.
+	DryRun bool
+	// OnSettle (optional) is called for each settlement that is paid out, or
+	// planned during a dry run.
+	OnSettle func(settlement store.Settlement)
+
+	// now is used for testing to override time-based behaviour
+	now func() time.Time
+}
+
+func (s *SettlementScheduler) timeNow() time.Time {
+	if s.now == nil {
+		return time.Now()
+	}
+	return s.now()
+}
+
+// Start runs settlements every Interval until the context is cancelled.
+func (s *SettlementScheduler) Start(ctx context.Context) error {
+	if s.Interval <= 0 {
+		return errors.New("settlement interval must be positive")
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			settlements, err := s.Run()
+			if err != nil {
+				logger.Printf("Settlement run failed after %d settlements: %s", len(settlements), err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run pays out the credit of every account with credit above WithdrawMin, and
+// records each settlement. It returns the settlements that were made, or
+// planned if DryRun is set.
+func (s *SettlementScheduler) Run() ([]store.Settlement, error) {
+	if s.Settle == nil && !s.DryRun {
+		return nil, ErrWithdrawDisabled
+	}
+	balanceStore := s.BalanceStore
+	if balanceStore == nil {
+		balanceStore = s.Store
+	}
+
+	accounts, err := s.Store.GetAccountBalances()
+	if err != nil {
+		return nil, err
+	}
+
+	settlements := []store.Settlement{}
+	for _, b := range accounts {
+		if !common.IsHexAddress(string(b.Account)) {
+			// Internal accounts can't be paid out
+			continue
+		}
+		if b.Credit.Sign() <= 0 {
+			continue
+		}
+		if s.WithdrawMin != nil && b.Credit.Cmp(s.WithdrawMin) < 0 {
+			continue
+		}
+
+		balance, err := balanceStore.GetAccountBalance(b.Account)
+		if err != nil {
+			return settlements, err
+		}
+		// The deposit is left in place, including if it's timelocked
+		deposit := new(big.Int).Add(&balance.Deposit, &balance.Locked)
+		if s.Channels != nil {
+			if deposit, err = s.Channels.ClaimBalance(b.Account); err != nil {
+				return settlements, err
+			}
+		}
+
+		credit := new(big.Int).Set(&balance.Credit)
+		amount := new(big.Int).Set(credit)
+		if s.Fees != nil {
+			fee, err := s.Fees.QuoteFee(context.Background(), b.Account, credit, deposit)
+			if err != nil {
+				return settlements, err
+			}
+			amount.Sub(amount, fee)
+		} else if s.WithdrawFee != nil {
+			amount = s.WithdrawFee(amount)
+		}
+		if amount.Sign() <= 0 {
+			continue
+		}
+
+		now := s.timeNow()
+		settlement := store.Settlement{
+			Account:    b.Account,
+			Amount:     amount,
+			Time:       now,
+			Credit:     credit,
+			NewBalance: deposit,
+			Status:     store.SettlementPending,
+			Attempts:   1,
+			Updated:    now,
+		}
+		if !s.DryRun {
+			err := submitSettlement(s.Store, balanceStore, &settlement, func() (string, *big.Int, error) {
+				if s.Channels != nil {
+					txID, newBalance, claimed, err := s.Channels.Claim(b.Account, amount)
+					settlement.Claimed = claimed
+					return txID, newBalance, err
+				}
+				txID, err := s.Settle(b.Account, amount, deposit)
+				return txID, deposit, err
+			})
+			if err != nil {
+				return settlements, err
+			}
+			logger.Printf("Settled account %q for %d: %s", settlement.Account, settlement.Amount, settlement.TxID)
+		}
+		if s.OnSettle != nil {
+			s.OnSettle(settlement)
+		}
+		settlements = append(settlements, settlement)
+	}
+	return settlements, nil
+}
+
+// submitSettlement deducts the settlement's credit and records it as
+// SettlementSubmitting before send pays it out, so that the same credit is
+// never paid twice, even if recording the transaction fails afterwards. If
+// send fails, then the credit is returned and the settlement is marked as
+// failed. settlementStore is optional.
+func submitSettlement(settlementStore store.SettlementStore, balanceStore store.BalanceStore, settlement *store.Settlement, send func() (txID string, newBalance *big.Int, err error)) error {
+	credit := settlement.Credit
+	if credit == nil {
+		credit = new(big.Int)
+	}
+	if credit.Sign() != 0 {
+		if err := balanceStore.AddAccountBalance(settlement.Account, new(big.Int).Neg(credit)); err != nil {
+			return err
+		}
+	}
+	settlement.Status = store.SettlementSubmitting
+	if settlementStore != nil {
+		if err := settlementStore.SetSettlement(*settlement); err != nil {
+			if credit.Sign() != 0 {
+				if undoErr := balanceStore.AddAccountBalance(settlement.Account, credit); undoErr != nil {
+					return fmt.Errorf("failed to return settlement credit: %s (after: %s)", undoErr, err)
+				}
+			}
+			return err
+		}
+	}
+
+	txID, newBalance, err := send()
+	if err != nil {
+		if credit.Sign() != 0 {
+			if undoErr := balanceStore.AddAccountBalance(settlement.Account, credit); undoErr != nil {
+				return fmt.Errorf("failed to return settlement credit: %s (after: %s)", undoErr, err)
+			}
+		}
+		settlement.Status = store.SettlementFailed
+		if settlementStore != nil {
+			if setErr := settlementStore.SetSettlement(*settlement); setErr != nil {
+				logger.Printf("Failed to mark settlement for account %q as failed: %s", settlement.Account, setErr)
+			}
+		}
+		return err
+	}
+
+	settlement.TxID = txID
+	settlement.NewBalance = newBalance
+	settlement.Status = store.SettlementPending
+	if settlementStore == nil {
+		return nil
+	}
+	if err := settlementStore.SetSettlement(*settlement); err != nil {
+		// The credit stays deducted, the settlement is left for manual review
+		return fmt.Errorf("failed to record settlement transaction %s for account %q: %s", txID, settlement.Account, err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package payment
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestSettlementScheduler(t *testing.T) {
+	contract := &fakeContract{
+		Balance: map[store.Account]big.Int{},
+		Paid:    map[store.Account]big.Int{},
+	}
+	host := store.Account("0x961Aa96FebeE5465149a0787B03bFa14D8e9033F")
+	small := store.Account("0x0000000000000000000000000000000000000001")
+	client := store.Account("0x0000000000000000000000000000000000000002")
+
+	memStore := memory.New()
+	for account, credit := range map[store.Account]int64{
+		host:                    5000,
+		small:                   100,
+		client:                  -3000,
+		"vipnode:subscriptions": 9000,
+	} {
+		if err := memStore.AddAccountBalance(account, big.NewInt(credit)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scheduler := &SettlementScheduler{
+		Store:       memStore,
+		Settle:      contract.OpSettle,
+		WithdrawMin: big.NewInt(500),
+		WithdrawFee: func(amount *big.Int) *big.Int {
+			return amount.Sub(amount, big.NewInt(1000))
+		},
+		DryRun: true,
+	}
+
+	settlements, err := scheduler.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settlements) != 1 || settlements[0].Account != host || settlements[0].Amount.Int64() != 4000 {
+		t.Errorf("wrong planned settlements: %+v", settlements)
+	}
+	if len(contract.Paid) != 0 {
+		t.Errorf("dry run paid out: %v", contract.Paid)
+	}
+	if records, _ := memStore.GetSettlements(host); len(records) != 0 {
+		t.Errorf("dry run recorded settlements: %+v", records)
+	}
+
+	scheduler.DryRun = false
+	settlements, err = scheduler.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settlements) != 1 {
+		t.Fatalf("wrong number of settlements: %d", len(settlements))
+	}
+	if paid := contract.Paid[host]; paid.Int64() != 4000 {
+		t.Errorf("wrong payment: %d", &paid)
+	}
+	if balance, _ := memStore.GetAccountBalance(host); balance.Credit.Sign() != 0 {
+		t.Errorf("credit was not settled: %d", &balance.Credit)
+	}
+	records, err := memStore.GetSettlements(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].TxID != settlements[0].TxID {
+		t.Errorf("wrong settlement records: %+v", records)
+	}
+
+	// Nothing left to settle
+	if settlements, err := scheduler.Run(); err != nil {
+		t.Fatal(err)
+	} else if len(settlements) != 0 {
+		t.Errorf("unexpected settlements: %+v", settlements)
+	}
+}
+
+// failingSettlementStore fails to save settlements once they have a TxID.
+type failingSettlementStore struct {
+	SettlementStore
+}
+
+func (s failingSettlementStore) SetSettlement(settlement store.Settlement) error {
+	if settlement.TxID != "" {
+		return errors.New("failed to save")
+	}
+	return s.SettlementStore.SetSettlement(settlement)
+}
+
+func TestSettlementSchedulerFailure(t *testing.T) {
+	host := store.Account("0x961Aa96FebeE5465149a0787B03bFa14D8e9033F")
+	memStore := memory.New()
+	if err := memStore.AddAccountBalance(host, big.NewInt(5000)); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := 0
+	scheduler := &SettlementScheduler{
+		Store: memStore,
+		Settle: func(account store.Account, amount *big.Int, newBalance *big.Int) (string, error) {
+			sent++
+			return "", errors.New("failed to send")
+		},
+	}
+
+	// Sending fails, the credit is returned
+	if _, err := scheduler.Run(); err == nil {
+		t.Error("expected settle error")
+	}
+	if balance, _ := memStore.GetAccountBalance(host); balance.Credit.Int64() != 5000 {
+		t.Errorf("credit was not returned: %d", &balance.Credit)
+	}
+	if records, _ := memStore.GetSettlements(host); len(records) != 1 || records[0].Status != store.SettlementFailed {
+		t.Errorf("wrong settlement records: %+v", records)
+	}
+
+	// Recording the transaction fails, the credit stays deducted and is not
+	// paid out again
+	scheduler.Store = failingSettlementStore{memStore}
+	scheduler.Settle = func(account store.Account, amount *big.Int, newBalance *big.Int) (string, error) {
+		sent++
+		return "0x1", nil
+	}
+	if _, err := scheduler.Run(); err == nil {
+		t.Error("expected record error")
+	}
+	if _, err := scheduler.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Errorf("wrong number of payments: %d", sent)
+	}
+	if balance, _ := memStore.GetAccountBalance(host); balance.Credit.Sign() != 0 {
+		t.Errorf("credit was not deducted: %d", &balance.Credit)
+	}
+	pending, err := memStore.GetPendingSettlements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Status != store.SettlementSubmitting {
+		t.Errorf("wrong pending settlements: %+v", pending)
+	}
+}
@@ -0,0 +1,184 @@
+package payment
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/vipnode/vipnode/v2/jsonrpc2"
+)
+
+// Signer signs the contract operator's transactions.
+type Signer interface {
+	// Address is the account that the signer signs for.
+	Address() common.Address
+	// SignTx returns tx signed for the given chain.
+	SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+// SignerTransactor returns contract TransactOpts that sign with signer.
+func SignerTransactor(signer Signer, chainID *big.Int) *bind.TransactOpts {
+	from := signer.Address()
+	return &bind.TransactOpts{
+		From: from,
+		Signer: func(_ types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != from {
+				return nil, AddressMismatchError{
+					Prelude: "signer is not authorized to sign for this account",
+					Want:    from,
+					Got:     address,
+				}
+			}
+			return signer.SignTx(tx, chainID)
+		},
+	}
+}
+
+// KeySigner returns a Signer that signs with a private key in the pool process.
+func KeySigner(privkey *ecdsa.PrivateKey) *keySigner {
+	return &keySigner{
+		privkey: privkey,
+		address: crypto.PubkeyToAddress(privkey.PublicKey),
+	}
+}
+
+type keySigner struct {
+	privkey *ecdsa.PrivateKey
+	address common.Address
+}
+
+func (s *keySigner) Address() common.Address {
+	return s.address
+}
+
+func (s *keySigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.NewEIP155Signer(chainID), s.privkey)
+}
+
+// SignTxArgs are the params of an account_signTransaction call, in the format
+// of clef's SendTxArgs.
+type SignTxArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      hexutil.Uint64  `json:"gas"`
+	GasPrice hexutil.Big     `json:"gasPrice"`
+	Value    hexutil.Big     `json:"value"`
+	Nonce    hexutil.Uint64  `json:"nonce"`
+	Data     hexutil.Bytes   `json:"data"`
+	ChainID  *hexutil.Big    `json:"chainId,omitempty"`
+}
+
+// SignTxResult is the result of an account_signTransaction call.
+type SignTxResult struct {
+	Raw hexutil.Bytes      `json:"raw"`
+	Tx  *types.Transaction `json:"tx"`
+}
+
+// ErrSignerAccount is returned when the external signer doesn't manage the
+// requested account.
+var ErrSignerAccount = errors.New("external signer does not list the operator account")
+
+// ExternalSigner returns a Signer that delegates signing to a separate process
+// over JSON-RPC, such as clef. The signer must list the account in
+// account_list. If account is the zero address, the signer must list exactly
+// one account, which is used.
+func ExternalSigner(service jsonrpc2.Service, account common.Address) (*externalSigner, error) {
+	s := &externalSigner{
+		service: service,
+		account: account,
+	}
+	var accounts []common.Address
+	if err := s.call(&accounts, "account_list"); err != nil {
+		return nil, err
+	}
+	if account == (common.Address{}) {
+		if len(accounts) != 1 {
+			return nil, fmt.Errorf("external signer lists %d accounts, the operator account must be specified", len(accounts))
+		}
+		s.account = accounts[0]
+		return s, nil
+	}
+	for _, addr := range accounts {
+		if addr == account {
+			return s, nil
+		}
+	}
+	return nil, ErrSignerAccount
+}
+
+type externalSigner struct {
+	service jsonrpc2.Service
+	account common.Address
+
+	// Timeout is the time to wait for each signature, which can include
+	// manual approval in the signer. (0 waits forever)
+	Timeout time.Duration
+}
+
+func (s *externalSigner) call(result interface{}, method string, params ...interface{}) error {
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	return s.service.Call(ctx, result, method, params...)
+}
+
+func (s *externalSigner) Address() common.Address {
+	return s.account
+}
+
+// SignTx sends tx to the external signer, and checks that the returned
+// transaction is the one that was requested and is signed by the account.
+func (s *externalSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	args := SignTxArgs{
+		From:     s.account,
+		To:       tx.To(),
+		Gas:      hexutil.Uint64(tx.Gas()),
+		GasPrice: hexutil.Big(*tx.GasPrice()),
+		Value:    hexutil.Big(*tx.Value()),
+		Nonce:    hexutil.Uint64(tx.Nonce()),
+		Data:     tx.Data(),
+		ChainID:  (*hexutil.Big)(chainID),
+	}
+	var result SignTxResult
+	if err := s.call(&result, "account_signTransaction", args); err != nil {
+		return nil, err
+	}
+	signed := result.Tx
+	if len(result.Raw) > 0 {
+		signed = new(types.Transaction)
+		if err := rlp.DecodeBytes(result.Raw, signed); err != nil {
+			return nil, err
+		}
+	}
+	if signed == nil {
+		return nil, errors.New("external signer returned no transaction")
+	}
+	signer := types.NewEIP155Signer(chainID)
+	if signer.Hash(signed) != signer.Hash(tx) {
+		return nil, errors.New("external signer returned a different transaction than requested")
+	}
+	sender, err := types.Sender(signer, signed)
+	if err != nil {
+		return nil, err
+	}
+	if sender != s.account {
+		return nil, AddressMismatchError{
+			Prelude: "external signer signed with the wrong account",
+			Want:    s.account,
+			Got:     sender,
+		}
+	}
+	return signed, nil
+}
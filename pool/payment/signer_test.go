@@ -0,0 +1,164 @@
+package payment
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/vipnode/vipnode/v2/jsonrpc2"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+// StandinSigner is a local stand-in for clef's account_* JSON-RPC API.
+type StandinSigner struct {
+	key *ecdsa.PrivateKey
+	// tamper (optional) modifies each transaction before it's signed.
+	tamper func(args *SignTxArgs)
+	// signWith (optional) replaces the key that transactions are signed with.
+	signWith *ecdsa.PrivateKey
+	// signed counts the signed transactions.
+	signed int
+}
+
+func (s *StandinSigner) List() []common.Address {
+	return []common.Address{crypto.PubkeyToAddress(s.key.PublicKey)}
+}
+
+func (s *StandinSigner) SignTransaction(args SignTxArgs) (*SignTxResult, error) {
+	if args.From != crypto.PubkeyToAddress(s.key.PublicKey) {
+		return nil, errors.New("unknown account")
+	}
+	if args.ChainID == nil {
+		return nil, errors.New("missing chain ID")
+	}
+	if s.tamper != nil {
+		s.tamper(&args)
+	}
+	var tx *types.Transaction
+	if args.To == nil {
+		tx = types.NewContractCreation(uint64(args.Nonce), args.Value.ToInt(), uint64(args.Gas), args.GasPrice.ToInt(), args.Data)
+	} else {
+		tx = types.NewTransaction(uint64(args.Nonce), *args.To, args.Value.ToInt(), uint64(args.Gas), args.GasPrice.ToInt(), args.Data)
+	}
+	key := s.key
+	if s.signWith != nil {
+		key = s.signWith
+	}
+	signed, err := types.SignTx(tx, types.NewEIP155Signer(args.ChainID.ToInt()), key)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		return nil, err
+	}
+	s.signed += 1
+	return &SignTxResult{Raw: raw, Tx: signed}, nil
+}
+
+// serveSigner serves the stand-in signer over HTTP, and returns a client for
+// it.
+func serveSigner(t *testing.T, signer *StandinSigner) (*jsonrpc2.HTTPService, func()) {
+	t.Helper()
+	server := &jsonrpc2.HTTPServer{}
+	if err := server.Register("account_", signer); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	return &jsonrpc2.HTTPService{Endpoint: ts.URL}, ts.Close
+}
+
+func TestExternalSigner(t *testing.T) {
+	sim := newSimulatedPool(t, 1)
+	defer sim.Close()
+	chainID := sim.Blockchain().Config().ChainID
+
+	standin := &StandinSigner{key: sim.operatorKey}
+	service, closer := serveSigner(t, standin)
+	defer closer()
+
+	signer, err := ExternalSigner(service, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Address() != sim.Operator.From {
+		t.Fatalf("wrong signer account: %s", signer.Address().Hex())
+	}
+	if _, err := ExternalSigner(service, sim.Clients[0].From); err != ErrSignerAccount {
+		t.Errorf("expected ErrSignerAccount, got: %v", err)
+	}
+
+	p, err := ContractPayment(memory.New(), sim.Address, sim, SignerTransactor(signer, chainID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := sim.Account(0)
+	sim.Deposit(t, 0, ether(1, 1))
+
+	before := sim.WalletBalance(t, sim.Clients[0].From)
+	if _, err := p.OpSettle(account, ether(1, 4), ether(3, 4)); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	if standin.signed != 1 {
+		t.Errorf("expected 1 signed transaction, got: %d", standin.signed)
+	}
+	if balance, err := p.GetBalance(account); err != nil {
+		t.Fatal(err)
+	} else if balance.Cmp(ether(3, 4)) != 0 {
+		t.Errorf("wrong balance after settle: %d", balance)
+	}
+	if got, want := new(big.Int).Sub(sim.WalletBalance(t, sim.Clients[0].From), before), ether(1, 4); got.Cmp(want) != 0 {
+		t.Errorf("wrong settle payout: got %d; want %d", got, want)
+	}
+
+	// Transactions that come back different from the request are rejected
+	standin.tamper = func(args *SignTxArgs) {
+		args.Value = hexutil.Big(*ether(1, 1))
+	}
+	if _, err := p.OpSettle(account, ether(1, 4), ether(1, 2)); err == nil || !strings.Contains(err.Error(), "different transaction") {
+		t.Errorf("expected tampered transaction error, got: %v", err)
+	}
+
+	// So are transactions signed by another account
+	standin.tamper = nil
+	standin.signWith = sim.clientKeys[0]
+	if _, err := p.OpSettle(account, ether(1, 4), ether(1, 2)); err == nil || !strings.Contains(err.Error(), "wrong account") {
+		t.Errorf("expected wrong account error, got: %v", err)
+	}
+}
+
+func TestKeySigner(t *testing.T) {
+	sim := newSimulatedPool(t, 1)
+	defer sim.Close()
+	chainID := sim.Blockchain().Config().ChainID
+
+	opts := SignerTransactor(KeySigner(sim.operatorKey), chainID)
+	p, err := ContractPayment(memory.New(), sim.Address, sim, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Deposit(t, 0, ether(1, 1))
+	if _, err := p.OpSettle(sim.Account(0), ether(1, 2), ether(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	if balance, err := p.GetBalance(sim.Account(0)); err != nil {
+		t.Fatal(err)
+	} else if balance.Cmp(ether(1, 2)) != 0 {
+		t.Errorf("wrong balance after settle: %d", balance)
+	}
+
+	// The transactor only signs for the key's account
+	if _, err := opts.Signer(types.HomesteadSigner{}, sim.Clients[0].From, types.NewTransaction(0, sim.Address, nil, 21000, big.NewInt(1), nil)); err == nil {
+		t.Error("expected unauthorized account error")
+	}
+}
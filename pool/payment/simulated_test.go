@@ -0,0 +1,112 @@
+package payment
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/vipnode/vipnode-contract/go/vipnodepool"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// ether returns n/div ether in wei.
+func ether(n int64, div int64) *big.Int {
+	r := new(big.Int).Mul(big.NewInt(n), big.NewInt(1e18))
+	return r.Div(r, big.NewInt(div))
+}
+
+// simulatedPool is a vipnode-contract pool deployed on a simulated chain,
+// with an operator wallet and funded client wallets.
+type simulatedPool struct {
+	*backends.SimulatedBackend
+
+	Address  common.Address
+	Contract *vipnodepool.VipnodePool
+	Operator *bind.TransactOpts
+	Clients  []*bind.TransactOpts
+
+	operatorKey *ecdsa.PrivateKey
+	clientKeys  []*ecdsa.PrivateKey
+}
+
+// newSimulatedPool deploys the pool contract with numClients client wallets
+// that have 10 ether each.
+func newSimulatedPool(t *testing.T, numClients int) *simulatedPool {
+	t.Helper()
+	s := &simulatedPool{}
+	alloc := core.GenesisAlloc{}
+	s.operatorKey, _ = crypto.GenerateKey()
+	s.Operator = bind.NewKeyedTransactor(s.operatorKey)
+	alloc[s.Operator.From] = core.GenesisAccount{Balance: ether(10, 1)}
+	for i := 0; i < numClients; i++ {
+		key, _ := crypto.GenerateKey()
+		opts := bind.NewKeyedTransactor(key)
+		alloc[opts.From] = core.GenesisAccount{Balance: ether(10, 1)}
+		s.clientKeys = append(s.clientKeys, key)
+		s.Clients = append(s.Clients, opts)
+	}
+	s.SimulatedBackend = backends.NewSimulatedBackend(alloc, 8000000)
+
+	var err error
+	s.Address, _, s.Contract, err = vipnodepool.DeployVipnodePool(s.Operator, s.SimulatedBackend, s.Operator.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Commit()
+	return s
+}
+
+// Account returns the store account of a client wallet.
+func (s *simulatedPool) Account(client int) store.Account {
+	return store.Account(s.Clients[client].From.Hex())
+}
+
+// Deposit adds amount to a client's contract balance and mines it.
+func (s *simulatedPool) Deposit(t *testing.T, client int, amount *big.Int) {
+	t.Helper()
+	opts := *s.Clients[client]
+	opts.Value = amount
+	if _, err := s.Contract.AddBalance(&opts); err != nil {
+		t.Fatal(err)
+	}
+	s.Commit()
+}
+
+// ForceSettle timelocks a client's deposit for withdrawing and mines it.
+func (s *simulatedPool) ForceSettle(t *testing.T, client int) {
+	t.Helper()
+	if _, err := s.Contract.ForceSettle(s.Clients[client]); err != nil {
+		t.Fatal(err)
+	}
+	s.Commit()
+}
+
+// WalletBalance returns the ether balance of an address at the latest block.
+func (s *simulatedPool) WalletBalance(t *testing.T, addr common.Address) *big.Int {
+	t.Helper()
+	r, err := s.BalanceAt(nil, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// waitFor polls fn until it returns true, or fails the test after a second.
+// It's used for effects of contract events, which are handled
+// asynchronously.
+func waitFor(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,112 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vipnode/vipnode/v2/internal/pretty"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// Contract is a payment contract backend, such as ContractPayment or
+// TokenPayment.
+type Contract interface {
+	store.BalanceStore
+
+	OpSettle(account store.Account, paymentAmount *big.Int, newBalance *big.Int) (tx string, err error)
+	OpResettle(settlement store.Settlement, gasPrice *big.Int) (tx string, err error)
+	ChannelDeposit(account store.Account) (deposit *big.Int, timelocked bool, err error)
+	WithdrawInterval() (time.Duration, error)
+	DepositLogReader
+
+	SetCacheSize(size int)
+	CacheStats() store.CacheStats
+	RefreshBalances(ctx context.Context, interval time.Duration) error
+}
+
+var _ Contract = &contractPayment{}
+var _ Contract = &tokenPayment{}
+
+// tokenEscrowABI is the subset of the token escrow contract that is not
+// shared with the vipnode-contract pool.
+const tokenEscrowABI = `[{"constant":true,"inputs":[],"name":"token","outputs":[{"name":"","type":"address"}],"payable":false,"stateMutability":"view","type":"function"}]`
+
+// erc20ABI is the subset of the ERC-20 token standard used for reading
+// token metadata and balances.
+const erc20ABI = `[{"constant":true,"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":true,"inputs":[],"name":"symbol","outputs":[{"name":"","type":"string"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":true,"inputs":[{"name":"_owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"balance","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"}]`
+
+// TokenPayment returns an abstraction around an ERC-20 token escrow
+// contract. The escrow has the same accounts, operator, opSettle, and Balance
+// interface as the vipnode-contract pool, but deposits are held in its
+// token() and settlements are paid out with token transfers. All amounts are
+// in the token's base units. TokenPayment implements store.BalanceStore.
+func TokenPayment(storeDriver store.AccountStore, address common.Address, backend bind.ContractBackend, transactOpts *bind.TransactOpts) (*tokenPayment, error) {
+	escrowABI, err := abi.JSON(strings.NewReader(tokenEscrowABI))
+	if err != nil {
+		return nil, err
+	}
+	tokenABI, err := abi.JSON(strings.NewReader(erc20ABI))
+	if err != nil {
+		return nil, err
+	}
+
+	escrow := bind.NewBoundContract(address, escrowABI, backend, backend, backend)
+	tokenAddr := new(common.Address)
+	if err := escrow.Call(nil, tokenAddr, "token"); err != nil {
+		return nil, fmt.Errorf("failed to get escrow token: %s", err)
+	}
+
+	p := &tokenPayment{
+		Token: *tokenAddr,
+		token: bind.NewBoundContract(*tokenAddr, tokenABI, backend, backend, backend),
+	}
+	if err := p.token.Call(nil, &p.Decimals, "decimals"); err != nil {
+		return nil, fmt.Errorf("failed to get token decimals: %s", err)
+	}
+	if err := p.token.Call(nil, &p.Symbol, "symbol"); err != nil {
+		return nil, fmt.Errorf("failed to get token symbol: %s", err)
+	}
+
+	p.contractPayment, err = ContractPayment(storeDriver, address, backend, transactOpts)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// tokenPayment uses an ERC-20 token escrow contract for payment.
+type tokenPayment struct {
+	*contractPayment
+
+	Token    common.Address
+	Decimals uint8
+	Symbol   string
+
+	token *bind.BoundContract
+}
+
+// ParseAmount takes a string like "2.5 DAI" and converts it to the token's
+// base units.
+func (p *tokenPayment) ParseAmount(s string) (*big.Int, error) {
+	return pretty.ParseToken(s, p.Decimals, p.Symbol)
+}
+
+// FormatAmount formats an amount in the token's base units, like "2.5 DAI".
+func (p *tokenPayment) FormatAmount(amount big.Int) string {
+	return pretty.Token{Amount: amount, Decimals: p.Decimals, Symbol: p.Symbol}.String()
+}
+
+// TotalDeposit returns the amount of the token held by the escrow contract.
+func (p *tokenPayment) TotalDeposit(ctx context.Context) (*big.Int, error) {
+	r := new(*big.Int)
+	if err := p.token.Call(&bind.CallOpts{Pending: true, Context: ctx}, r, "balanceOf", p.address); err != nil {
+		return nil, err
+	}
+	return *r, nil
+}
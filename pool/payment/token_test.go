@@ -0,0 +1,132 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+// tokenBackend answers the token escrow and ERC-20 calls that the
+// vipnode-contract pool doesn't have, so that a deployed pool can stand in
+// for the shared part of the escrow interface.
+type tokenBackend struct {
+	*backends.SimulatedBackend
+
+	escrow common.Address
+	token  common.Address
+	held   *big.Int
+}
+
+func (b *tokenBackend) intercept(call ethereum.CallMsg) ([]byte, bool) {
+	escrowABI, _ := abi.JSON(strings.NewReader(tokenEscrowABI))
+	tokenABI, _ := abi.JSON(strings.NewReader(erc20ABI))
+	if call.To == nil || len(call.Data) < 4 {
+		return nil, false
+	}
+	id := call.Data[:4]
+	var out []byte
+	var err error
+	switch {
+	case *call.To == b.escrow && bytes.Equal(id, escrowABI.Methods["token"].ID):
+		out, err = escrowABI.Methods["token"].Outputs.Pack(b.token)
+	case *call.To == b.token && bytes.Equal(id, tokenABI.Methods["decimals"].ID):
+		out, err = tokenABI.Methods["decimals"].Outputs.Pack(uint8(6))
+	case *call.To == b.token && bytes.Equal(id, tokenABI.Methods["symbol"].ID):
+		out, err = tokenABI.Methods["symbol"].Outputs.Pack("USDC")
+	case *call.To == b.token && bytes.Equal(id, tokenABI.Methods["balanceOf"].ID):
+		out, err = tokenABI.Methods["balanceOf"].Outputs.Pack(b.held)
+	default:
+		return nil, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return out, true
+}
+
+func (b *tokenBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if out, ok := b.intercept(call); ok {
+		return out, nil
+	}
+	return b.SimulatedBackend.CallContract(ctx, call, blockNumber)
+}
+
+func (b *tokenBackend) PendingCallContract(ctx context.Context, call ethereum.CallMsg) ([]byte, error) {
+	if out, ok := b.intercept(call); ok {
+		return out, nil
+	}
+	return b.SimulatedBackend.PendingCallContract(ctx, call)
+}
+
+func TestTokenPayment(t *testing.T) {
+	sim := newSimulatedPool(t, 1)
+	defer sim.Close()
+	escrowAddr := sim.Address
+	operatorOpts := sim.Operator
+
+	backend := &tokenBackend{
+		SimulatedBackend: sim.SimulatedBackend,
+		escrow:           escrowAddr,
+		token:            common.HexToAddress("0x961Aa96FebeE5465149a0787B03bFa14D8e9033F"),
+		held:             big.NewInt(2000000),
+	}
+
+	// Deposit 2 USDC
+	sim.Deposit(t, 0, big.NewInt(2000000))
+
+	memStore := memory.New()
+	p, err := TokenPayment(memStore, escrowAddr, backend, operatorOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Token != backend.token || p.Decimals != 6 || p.Symbol != "USDC" {
+		t.Errorf("wrong token metadata: %s %d %q", p.Token.Hex(), p.Decimals, p.Symbol)
+	}
+
+	if amount, err := p.ParseAmount("1.5 USDC"); err != nil {
+		t.Error(err)
+	} else if amount.Int64() != 1500000 {
+		t.Errorf("wrong parsed amount: %d", amount)
+	}
+	if _, err := p.ParseAmount("1.5 ether"); err == nil {
+		t.Errorf("expected unit error")
+	}
+	if got, want := p.FormatAmount(*big.NewInt(2500000)), "2.5 USDC"; got != want {
+		t.Errorf("wrong formatted amount: got %q; want %q", got, want)
+	}
+	if total, err := p.TotalDeposit(context.Background()); err != nil {
+		t.Error(err)
+	} else if total.Cmp(backend.held) != 0 {
+		t.Errorf("wrong total deposit: %d", total)
+	}
+
+	account := sim.Account(0)
+	if err := memStore.AddAccountBalance(account, big.NewInt(500000)); err != nil {
+		t.Fatal(err)
+	}
+	balance, err := p.GetAccountBalance(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Deposit.Int64() != 2000000 || balance.Credit.Int64() != 500000 {
+		t.Errorf("wrong balance: deposit=%d credit=%d", &balance.Deposit, &balance.Credit)
+	}
+
+	if _, err := p.OpSettle(account, big.NewInt(500000), big.NewInt(1000000)); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	if deposit, _, err := p.ChannelDeposit(account); err != nil {
+		t.Error(err)
+	} else if deposit.Int64() != 1000000 {
+		t.Errorf("wrong deposit after settle: %d", deposit)
+	}
+}
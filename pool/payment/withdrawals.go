@@ -0,0 +1,266 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// TxBackend is the subset of an Ethereum client that is required to watch
+// settlement transactions, such as *ethclient.Client.
+type TxBackend interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
+
+// defaultGasBump is the gas price multiplier for resubmitted transactions,
+// which must be at least 10% for nodes to accept the replacement.
+var defaultGasBump = big.NewRat(9, 8)
+
+// ResubmitHandler replaces a stuck settlement transaction by submitting it
+// again with the same nonce and the given gas price. It returns the new
+// transaction ID.
+type ResubmitHandler func(settlement store.Settlement, gasPrice *big.Int) (txID string, err error)
+
+// WithdrawalTracker watches the receipts of settlement transactions and
+// updates their status until they are confirmed or failed. Failed
+// settlements return their credit to the account.
+//
+// A settlement that isn't mined is only failed once its nonce is used by a
+// confirmed transaction that isn't one of its own, since until then any of
+// the transactions it was submitted with could still be mined.
+type WithdrawalTracker struct {
+	Store        store.SettlementStore
+	BalanceStore store.BalanceStore
+	Backend      TxBackend
+	// From is the operator wallet that sends the settlement transactions,
+	// whose nonce tells whether a settlement was dropped. If unset, then
+	// dropped settlements are left pending to be checked manually.
+	From common.Address
+	// Channels (optional) unclaims the payment channel amount of failed
+	// settlements, so that it's claimed again by the next settlement.
+	Channels *PaymentChannels
+
+	// Confirmations is the number of blocks required to consider a mined
+	// settlement confirmed.
+	Confirmations uint64
+	// Interval is the time between receipt checks.
+	Interval time.Duration
+
+	// Resubmit (optional) replaces transactions that are still pending after
+	// StuckTimeout, with the gas price bumped by GasBump. If nil, then stuck
+	// transactions are left pending.
+	Resubmit     ResubmitHandler
+	StuckTimeout time.Duration
+	GasBump      *big.Rat // Defaults to 1.125
+	// MaxAttempts is the number of submissions before a stuck transaction is
+	// no longer resubmitted. (0 is unlimited)
+	MaxAttempts int
+
+	// now is used for testing to override time-based behaviour
+	now func() time.Time
+}
+
+func (w *WithdrawalTracker) timeNow() time.Time {
+	if w.now == nil {
+		return time.Now()
+	}
+	return w.now()
+}
+
+// Start checks the pending settlements every Interval until the context is
+// cancelled.
+func (w *WithdrawalTracker) Start(ctx context.Context) error {
+	if w.Interval <= 0 {
+		return errors.New("withdrawal tracker interval must be positive")
+	}
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Check(ctx); err != nil {
+				logger.Printf("Withdrawal tracker check failed: %s", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Check updates the status of all the pending settlements.
+func (w *WithdrawalTracker) Check(ctx context.Context) error {
+	pending, err := w.Store.GetPendingSettlements()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	head, err := w.Backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, settlement := range pending {
+		if settlement.Status == store.SettlementSubmitting {
+			// The transaction may or may not have been sent, so it can't be
+			// failed or resubmitted safely.
+			logger.Printf("Settlement for account %q at %s was not recorded after submitting, it needs to be checked manually", settlement.Account, settlement.Time)
+			continue
+		}
+		if err := w.check(ctx, settlement, head.Number.Uint64()); err != nil {
+			logger.Printf("Failed to check settlement for account %q: %s", settlement.Account, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// receipt returns the receipt of the settlement's transaction, or of any of
+// the transactions it replaced. It returns nil if none were mined.
+func (w *WithdrawalTracker) receipt(ctx context.Context, settlement *store.Settlement) (*types.Receipt, error) {
+	txIDs := append([]string{settlement.TxID}, settlement.ReplacedTxIDs...)
+	for _, txID := range txIDs {
+		receipt, err := w.Backend.TransactionReceipt(ctx, common.HexToHash(txID))
+		if err == ethereum.NotFound || (err == nil && receipt == nil) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		settlement.TxID = txID
+		return receipt, nil
+	}
+	return nil, nil
+}
+
+// pendingTx returns the first of the settlement's transactions that the node
+// still knows, or nil if it knows none of them.
+func (w *WithdrawalTracker) pendingTx(ctx context.Context, settlement store.Settlement) (*types.Transaction, error) {
+	txIDs := append([]string{settlement.TxID}, settlement.ReplacedTxIDs...)
+	for _, txID := range txIDs {
+		tx, _, err := w.Backend.TransactionByHash(ctx, common.HexToHash(txID))
+		if err == ethereum.NotFound || (err == nil && tx == nil) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+	return nil, nil
+}
+
+// nonceUsed returns whether the settlement's nonce was used by a confirmed
+// transaction of the operator wallet. It's false if the nonce isn't known.
+func (w *WithdrawalTracker) nonceUsed(ctx context.Context, settlement store.Settlement, headNumber uint64) (bool, error) {
+	if w.From == (common.Address{}) || settlement.GasPrice == nil {
+		return false, nil
+	}
+	if headNumber < w.Confirmations {
+		return false, nil
+	}
+	nonce, err := w.Backend.NonceAt(ctx, w.From, new(big.Int).SetUint64(headNumber-w.Confirmations))
+	if err != nil {
+		return false, err
+	}
+	return nonce > settlement.Nonce, nil
+}
+
+func (w *WithdrawalTracker) check(ctx context.Context, settlement store.Settlement, headNumber uint64) error {
+	// The nonce is checked before the receipts, so that a transaction that
+	// gets mined in between isn't mistaken for a dropped one.
+	nonceUsed, err := w.nonceUsed(ctx, settlement, headNumber)
+	if err != nil {
+		return err
+	}
+	receipt, err := w.receipt(ctx, &settlement)
+	if err != nil {
+		return err
+	}
+	if receipt != nil {
+		if receipt.Status == types.ReceiptStatusFailed {
+			logger.Printf("Settlement for account %q reverted: %s", settlement.Account, settlement.TxID)
+			return w.fail(settlement)
+		}
+		settlement.Status = store.SettlementMined
+		settlement.BlockNumber = receipt.BlockNumber.Uint64()
+		if headNumber >= settlement.BlockNumber && headNumber-settlement.BlockNumber+1 >= w.Confirmations {
+			settlement.Status = store.SettlementConfirmed
+			logger.Printf("Settlement for account %q confirmed: %s", settlement.Account, settlement.TxID)
+		}
+		settlement.Updated = w.timeNow()
+		return w.Store.SetSettlement(settlement)
+	}
+	if nonceUsed {
+		// Another transaction took the nonce, so none of the settlement's
+		// transactions can be mined anymore.
+		logger.Printf("Settlement for account %q was dropped: %s", settlement.Account, settlement.TxID)
+		return w.fail(settlement)
+	}
+
+	// Not mined yet, or the node doesn't know the transactions
+	tx, err := w.pendingTx(ctx, settlement)
+	if err != nil {
+		return err
+	}
+	if tx != nil && settlement.GasPrice == nil {
+		// Remember the transaction details in case it needs to be replaced
+		settlement.Nonce = tx.Nonce()
+		settlement.GasPrice = tx.GasPrice()
+		return w.Store.SetSettlement(settlement)
+	}
+	if w.timeNow().Sub(settlement.Updated) < w.StuckTimeout {
+		return nil
+	}
+	if w.Resubmit == nil || settlement.GasPrice == nil || (w.MaxAttempts > 0 && settlement.Attempts >= w.MaxAttempts) {
+		if tx == nil {
+			logger.Printf("Settlement for account %q is not known to the node and its nonce is unused, it needs to be checked manually: %s", settlement.Account, settlement.TxID)
+		}
+		return nil
+	}
+
+	gasBump := w.GasBump
+	if gasBump == nil {
+		gasBump = defaultGasBump
+	}
+	gasPrice := new(big.Rat).Mul(new(big.Rat).SetInt(settlement.GasPrice), gasBump)
+	settlement.GasPrice = new(big.Int).Div(gasPrice.Num(), gasPrice.Denom())
+	txID, err := w.Resubmit(settlement, settlement.GasPrice)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Resubmitted stuck settlement for account %q with gas price %d: %s -> %s", settlement.Account, settlement.GasPrice, settlement.TxID, txID)
+	settlement.ReplacedTxIDs = append(settlement.ReplacedTxIDs, settlement.TxID)
+	settlement.TxID = txID
+	settlement.Attempts += 1
+	settlement.Updated = w.timeNow()
+	return w.Store.SetSettlement(settlement)
+}
+
+// fail marks the settlement as failed, returns its credit to the account, and
+// unclaims its payment channel claim.
+func (w *WithdrawalTracker) fail(settlement store.Settlement) error {
+	if settlement.Credit != nil && settlement.Credit.Sign() != 0 {
+		if err := w.BalanceStore.AddAccountBalance(settlement.Account, settlement.Credit); err != nil {
+			return err
+		}
+	}
+	if w.Channels != nil && settlement.Claimed != nil && settlement.Claimed.Sign() != 0 {
+		if err := w.Channels.Unclaim(settlement.Account, settlement.Claimed); err != nil {
+			return err
+		}
+	}
+	settlement.Status = store.SettlementFailed
+	settlement.Updated = w.timeNow()
+	return w.Store.SetSettlement(settlement)
+}
@@ -0,0 +1,225 @@
+package payment
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+type fakeTxBackend struct {
+	head     uint64
+	nonce    uint64
+	pending  map[common.Hash]*types.Transaction
+	receipts map[common.Hash]*types.Receipt
+}
+
+func (b *fakeTxBackend) NonceAt(ctx context.Context, account common.Address, number *big.Int) (uint64, error) {
+	return b.nonce, nil
+}
+
+func (b *fakeTxBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: new(big.Int).SetUint64(b.head)}, nil
+}
+
+func (b *fakeTxBackend) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	tx, ok := b.pending[hash]
+	if !ok {
+		return nil, false, ethereum.NotFound
+	}
+	return tx, true, nil
+}
+
+func (b *fakeTxBackend) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	receipt, ok := b.receipts[hash]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return receipt, nil
+}
+
+func TestWithdrawalTracker(t *testing.T) {
+	memStore := memory.New()
+	backend := &fakeTxBackend{
+		head:     100,
+		pending:  map[common.Hash]*types.Transaction{},
+		receipts: map[common.Hash]*types.Receipt{},
+	}
+	now := time.Now()
+	resubmitted := 0
+	tracker := &WithdrawalTracker{
+		Store:         memStore,
+		BalanceStore:  memStore,
+		Backend:       backend,
+		Confirmations: 3,
+		StuckTimeout:  time.Minute * 10,
+		MaxAttempts:   2,
+		Resubmit: func(settlement store.Settlement, gasPrice *big.Int) (string, error) {
+			resubmitted++
+			hash := common.BigToHash(big.NewInt(int64(100 + resubmitted)))
+			backend.pending[hash] = types.NewTransaction(settlement.Nonce, common.Address{}, settlement.Amount, 21000, gasPrice, nil)
+			return hash.Hex(), nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	accounts := []store.Account{"0x01", "0x02", "0x03"}
+	for i, account := range accounts {
+		hash := common.BigToHash(big.NewInt(int64(i + 1)))
+		backend.pending[hash] = types.NewTransaction(uint64(i), common.Address{}, big.NewInt(1000), 21000, big.NewInt(80), nil)
+		if err := memStore.SetSettlement(store.Settlement{
+			Account:  account,
+			Amount:   big.NewInt(1000),
+			Credit:   big.NewInt(1000),
+			TxID:     hash.Hex(),
+			Time:     now,
+			Status:   store.SettlementPending,
+			Attempts: 1,
+			Updated:  now,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(account store.Account, want store.SettlementStatus) store.Settlement {
+		t.Helper()
+		settlements, err := memStore.GetSettlements(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(settlements) != 1 {
+			t.Fatalf("wrong number of settlements: %d", len(settlements))
+		}
+		if got := settlements[0].Status; got != want {
+			t.Errorf("[%s] wrong status: got %q; want %q", account, got, want)
+		}
+		return settlements[0]
+	}
+
+	if err := tracker.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := check(accounts[0], store.SettlementPending); s.GasPrice.Int64() != 80 || s.Nonce != 0 {
+		t.Errorf("transaction details were not saved: %+v", s)
+	}
+
+	// First is mined, second reverts, third gets stuck
+	backend.receipts[common.BigToHash(big.NewInt(1))] = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(99)}
+	backend.receipts[common.BigToHash(big.NewInt(2))] = &types.Receipt{Status: types.ReceiptStatusFailed, BlockNumber: big.NewInt(99)}
+	now = now.Add(time.Minute * 15)
+	if err := tracker.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(accounts[0], store.SettlementMined)
+	check(accounts[1], store.SettlementFailed)
+	if balance, _ := memStore.GetAccountBalance(accounts[1]); balance.Credit.Int64() != 1000 {
+		t.Errorf("failed settlement credit was not returned: %d", &balance.Credit)
+	}
+	s := check(accounts[2], store.SettlementPending)
+	if want := common.BigToHash(big.NewInt(101)).Hex(); s.TxID != want || s.Attempts != 2 || s.GasPrice.Int64() != 90 {
+		t.Errorf("stuck settlement was not resubmitted: %+v", s)
+	}
+
+	// Enough confirmations, and the replaced transaction gets mined instead
+	backend.head = 101
+	backend.receipts[common.BigToHash(big.NewInt(3))] = &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(101)}
+	if err := tracker.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(accounts[0], store.SettlementConfirmed)
+	if s := check(accounts[2], store.SettlementMined); s.TxID != common.BigToHash(big.NewInt(3)).Hex() {
+		t.Errorf("wrong mined transaction: %s", s.TxID)
+	}
+	if resubmitted != 1 {
+		t.Errorf("wrong number of resubmits: %d", resubmitted)
+	}
+
+	if pending, _ := memStore.GetPendingSettlements(); len(pending) != 1 {
+		t.Errorf("wrong pending settlements: %+v", pending)
+	}
+}
+
+func TestWithdrawalTrackerDropped(t *testing.T) {
+	memStore := memory.New()
+	backend := &fakeTxBackend{
+		head:     100,
+		nonce:    5,
+		pending:  map[common.Hash]*types.Transaction{},
+		receipts: map[common.Hash]*types.Receipt{},
+	}
+	now := time.Now()
+	tracker := &WithdrawalTracker{
+		Store:         memStore,
+		BalanceStore:  memStore,
+		Backend:       backend,
+		From:          common.HexToAddress("0x961Aa96FebeE5465149a0787B03bFa14D8e9033F"),
+		Confirmations: 3,
+		StuckTimeout:  time.Minute * 10,
+		now:           func() time.Time { return now },
+	}
+
+	// The latest transaction was dropped, but the one it replaced is still
+	// pending
+	replaced := common.BigToHash(big.NewInt(1))
+	backend.pending[replaced] = types.NewTransaction(5, common.Address{}, big.NewInt(1000), 21000, big.NewInt(80), nil)
+	account, unknown := store.Account("0x01"), store.Account("0x02")
+	for _, s := range []store.Settlement{
+		{
+			Account:       account,
+			TxID:          common.BigToHash(big.NewInt(2)).Hex(),
+			ReplacedTxIDs: []string{replaced.Hex()},
+			Nonce:         5,
+			GasPrice:      big.NewInt(90),
+			Attempts:      2,
+		},
+		// The node never saw the transaction, so its nonce is unknown
+		{Account: unknown, TxID: common.BigToHash(big.NewInt(3)).Hex(), Attempts: 1},
+	} {
+		s.Amount = big.NewInt(1000)
+		s.Credit = big.NewInt(1000)
+		s.Time = now
+		s.Status = store.SettlementPending
+		s.Updated = now
+		if err := memStore.SetSettlement(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(want store.SettlementStatus, wantCredit int64) {
+		t.Helper()
+		if err := tracker.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		settlements, err := memStore.GetSettlements(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := settlements[0].Status; got != want {
+			t.Errorf("wrong status: got %q; want %q", got, want)
+		}
+		if balance, _ := memStore.GetAccountBalance(account); balance.Credit.Int64() != wantCredit {
+			t.Errorf("wrong credit: got %d; want %d", &balance.Credit, wantCredit)
+		}
+		if settlements, _ := memStore.GetSettlements(unknown); settlements[0].Status != store.SettlementPending {
+			t.Errorf("settlement of an unknown transaction was not left pending: %+v", settlements[0])
+		}
+	}
+
+	now = now.Add(time.Minute * 15)
+	check(store.SettlementPending, 0)
+
+	// The node forgot every transaction, but the nonce is unused so any of
+	// them could still be mined
+	delete(backend.pending, replaced)
+	check(store.SettlementPending, 0)
+
+	// Another transaction took the nonce
+	backend.nonce = 6
+	check(store.SettlementFailed, 1000)
+}
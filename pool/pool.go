@@ -2,6 +2,7 @@ package pool
 
 import (
 	"context"
+	"math/big"
 
 	"github.com/vipnode/vipnode/v2/ethnode"
 	"github.com/vipnode/vipnode/v2/pool/store"
@@ -24,6 +25,19 @@ type ConnectRequest struct {
 
 	// Payout sets the wallet account to register the host credit towards. (Optional)
 	Payout string `json:"payout"`
+
+	// Price sets the amount the host charges per minute of a client
+	// connection, in wei. If not set, then the pool's default host price is
+	// used. (Optional, only used by hosts)
+	Price *big.Int `json:"price,omitempty"`
+
+	// Capabilities are features of the node that clients can select hosts
+	// by, such as "archive". (Optional)
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Labels are attributes of the node that clients can select hosts by,
+	// such as "region": "eu". (Optional)
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // ConnectResponse is the response a vipnode agent receives from the pool after
@@ -96,6 +110,12 @@ type UpdateRequest struct {
 	Peers       []string           `json:"peers,omitempty"` // DEPRECATED
 	PeerInfo    []ethnode.PeerInfo `json:"peers_info"`
 	BlockNumber uint64             `json:"block_number"`
+	// Usage is the cumulative traffic exchanged with each peer, used by
+	// usage-based billing. (Optional)
+	Usage []ethnode.PeerUsage `json:"usage,omitempty"`
+	// Proof is the client's latest balance proof, which is
+	// credited to its account before it is charged. (Optional)
+	Proof *BalanceProof `json:"proof,omitempty"`
 }
 
 // UpdateResponse is the response type for Update RPC calls.
@@ -115,6 +135,25 @@ type UpdateResponse struct {
 	ActivePeers []string `json:"active_peers"`
 	// LatestBlockNumber is the highest block number that the pool knows about.
 	LatestBlockNumber uint64 `json:"latest_block_number"`
+	// Warning is set when the node's balance is too low and it will be
+	// disconnected unless more balance is deposited. (Optional)
+	Warning *BalanceWarning `json:"warning,omitempty"`
+	// ChannelAmount is the cumulative amount of the latest balance proof that
+	// the pool accepted, set if the update included a proof. (Optional)
+	ChannelAmount *big.Int `json:"channel_amount,omitempty"`
+}
+
+// BalanceWarning is a notice that the node's balance is below the pool's
+// minimum and the node is running on its grace period.
+type BalanceWarning struct {
+	// SecondsLeft is the time remaining before the node is disconnected.
+	// (0 if the grace period is not time-limited)
+	SecondsLeft int64 `json:"seconds_left,omitempty"`
+	// AmountNeeded is the amount that must be deposited to restore the
+	// balance to the pool's minimum.
+	AmountNeeded *big.Int `json:"amount_needed"`
+	// Message contains instructions for adding a balance deposit.
+	Message string `json:"message,omitempty"`
 }
 
 // PeerRequest is the request type for Peer RPC calls.
@@ -123,6 +162,21 @@ type PeerRequest struct {
 	Num int `json:"num"`
 	// Kind is the type of node we desire, such as "parity" or "geth" (optional)
 	Kind string `json:"kind,omitempty"`
+	// MaxPrice is the highest per-minute host price, in wei, that the node is
+	// willing to pay. Hosts that charge more are skipped. (Optional, defaults
+	// to the pool's default host price)
+	MaxPrice *big.Int `json:"max_price,omitempty"`
+	// MinBlockNumber skips hosts that are behind this block. (Optional)
+	MinBlockNumber uint64 `json:"min_block_number,omitempty"`
+	// Capabilities that the hosts must all have. (Optional)
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Labels that the hosts must all have with the same value. (Optional)
+	Labels map[string]string `json:"labels,omitempty"`
+	// MaxLoad skips hosts that have more peers than this. (Optional)
+	MaxLoad int `json:"max_load,omitempty"`
+	// Order of preference for the hosts, one of "last_seen", "block_number",
+	// "load", or "price". (Default: random)
+	Order store.HostOrder `json:"order,omitempty"`
 }
 
 // PeerResponse is the response type for Peer RPC calls.
@@ -0,0 +1,76 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// Pruner periodically removes nodes that haven't been seen for the Retention
+// duration, along with dangling peers and empty trial balances, so that the
+// store doesn't keep every node that ever connected.
+type Pruner struct {
+	Store store.PruneStore
+
+	// Retention is how long a node is kept after it was last seen.
+	Retention time.Duration
+	// Interval is the time between prunes.
+	Interval time.Duration
+
+	mu    sync.Mutex
+	total store.PruneStats
+}
+
+// Start prunes the store immediately and then every Interval until the
+// context is cancelled.
+func (p *Pruner) Start(ctx context.Context) error {
+	if p.Interval <= 0 || p.Retention <= 0 {
+		return errors.New("pruner interval and retention must be positive")
+	}
+	if _, err := p.Prune(); err != nil {
+		logger.Printf("Prune failed: %s", err)
+	}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := p.Prune(); err != nil {
+				logger.Printf("Prune failed: %s", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Prune removes the state that is older than the Retention duration, and
+// returns how much was removed.
+func (p *Pruner) Prune() (store.PruneStats, error) {
+	now := time.Now()
+	stats, err := p.Store.Prune(now.Add(-p.Retention))
+
+	// Partial prunes are still counted
+	p.mu.Lock()
+	p.total.Add(stats)
+	p.mu.Unlock()
+
+	if err != nil {
+		return stats, err
+	}
+	if stats != (store.PruneStats{}) {
+		logger.Printf("Pruned %d nodes not seen since %s, %d peers, and %d empty trial balances", stats.Nodes, now.Add(-p.Retention).Format(time.RFC3339), stats.Peers, stats.Trials)
+	}
+	return stats, nil
+}
+
+// Stats returns the cumulative counts of removed state since the pruner
+// started.
+func (p *Pruner) Stats() store.PruneStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total
+}
@@ -0,0 +1,50 @@
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestPruner(t *testing.T) {
+	s := memory.New()
+	p := &Pruner{
+		Store:     s,
+		Retention: time.Hour,
+		Interval:  time.Hour,
+	}
+	if err := s.SetNode(store.Node{ID: "stale", LastSeen: time.Now().Add(-2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetNode(store.Node{ID: "fresh", LastSeen: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Start prunes once before it notices that the context is done
+	if err := p.Start(ctx); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+	if want := (store.PruneStats{Nodes: 1}); p.Stats() != want {
+		t.Errorf("wrong prune stats: got %+v; want %+v", p.Stats(), want)
+	}
+	if _, err := s.GetNode("fresh"); err != nil {
+		t.Errorf("fresh node was pruned: %s", err)
+	}
+
+	if err := s.SetNode(store.Node{ID: "stale2", LastSeen: time.Now().Add(-2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := p.Prune(); err != nil {
+		t.Fatal(err)
+	} else if stats.Nodes != 1 {
+		t.Errorf("wrong prune stats: %+v", stats)
+	}
+	if want := (store.PruneStats{Nodes: 2}); p.Stats() != want {
+		t.Errorf("wrong cumulative prune stats: got %+v; want %+v", p.Stats(), want)
+	}
+}
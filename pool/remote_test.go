@@ -3,6 +3,8 @@ package pool
 import (
 	"context"
 	"fmt"
+	"math/big"
+	"reflect"
 	"testing"
 	"time"
 
@@ -37,7 +39,7 @@ func TestRemotePoolClient(t *testing.T) {
 		t.Fatal("failed to add host node:", err)
 	}
 
-	nodes, err := pool.Store.ActiveHosts("", 3)
+	nodes, err := pool.Store.ActiveHosts(store.HostQuery{Limit: 3})
 	if err != nil {
 		t.Error(err)
 	}
@@ -112,3 +114,47 @@ func TestRemotePoolHost(t *testing.T) {
 		}
 	}
 }
+
+func TestRemotePoolPeerPrice(t *testing.T) {
+	pool := New(memory.New(), nil)
+	pool.skipWhitelist = true
+	pool.DefaultHostPrice = big.NewInt(100)
+
+	server, client := jsonrpc2.ServePipe()
+	server.Server.Register("vipnode_", pool)
+
+	privkey := keygen.HardcodedKey(t)
+	remote := Remote(client, privkey)
+
+	hosts := []store.Node{
+		{ID: "cheap", URI: "enode://cheap", IsHost: true, LastSeen: time.Now(), Price: big.NewInt(50)},
+		{ID: "default", URI: "enode://default", IsHost: true, LastSeen: time.Now()},
+		{ID: "pricey", URI: "enode://pricey", IsHost: true, LastSeen: time.Now(), Price: big.NewInt(500)},
+	}
+	for _, host := range hosts {
+		if err := pool.Store.SetNode(host); err != nil {
+			t.Fatal("failed to add host node:", err)
+		}
+	}
+
+	if _, err := remote.Connect(context.Background(), ConnectRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(maxPrice *big.Int, want []string) {
+		t.Helper()
+		resp, err := remote.Peer(context.Background(), PeerRequest{Num: 3, MaxPrice: maxPrice})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := store.Nodes(resp.Peers).IDs(); !reflect.DeepEqual(got, want) {
+			t.Errorf("maxPrice=%d: got %q; want %q", maxPrice, got, want)
+		}
+	}
+
+	check(nil, []string{"cheap", "default"})
+	check(big.NewInt(500), []string{"cheap", "default", "pricey"})
+	check(big.NewInt(100), []string{"cheap", "default"})
+	check(big.NewInt(50), []string{"cheap"})
+	check(big.NewInt(10), []string{})
+}
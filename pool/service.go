@@ -3,6 +3,7 @@ package pool
 import (
 	"context"
 	"fmt"
+	"math/big"
 	"net/url"
 	"sync"
 	"time"
@@ -50,9 +51,13 @@ type VipnodePool struct {
 	Store               store.Store
 	BalanceManager      balance.Manager
 	ClientMessager      func(nodeID string) string
+	DepositMessager     func(nodeID string, amountNeeded *big.Int) string
 	MaxRequestHosts     int                                     // MaxRequestHosts is the maximum number of hosts a client is allowed to request (0 is unlimited)
+	DefaultHostPrice    *big.Int                                // DefaultHostPrice is assigned to hosts that connect without setting their own price, and is the MaxPrice of clients that don't set one (optional)
+	MaxHostPrice        *big.Int                                // MaxHostPrice is the highest price that hosts can set for themselves (optional)
 	RestrictNetwork     ethnode.NetworkID                       // TODO: Wire this up
 	BlockNumberProvider func(ethnode.NetworkID) (uint64, error) // BlockNumberProvider returns the latest block number that is known for the given network.
+	Channels            ProofHandler                            // Channels accepts balance proofs sent with updates (optional)
 	skipWhitelist       bool                                    // skipWhitelist is used for testing.
 
 	mu               sync.Mutex
@@ -65,18 +70,22 @@ type VipnodePool struct {
 // CloseRemote is to be called when a remote service is disconnected. It is used to clean up state.
 func (p *VipnodePool) CloseRemote(remote jsonrpc2.Service) error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
 	nodeID, ok := p.remoteNodeLookup[remote]
 	if !ok {
 		// Nothing to clean up
+		p.mu.Unlock()
 		return nil
 	}
 
 	delete(p.remoteNodeLookup, remote)
 	delete(p.remoteHosts, nodeID)
+	p.mu.Unlock()
 
-	return nil
+	node, err := p.Store.GetNode(nodeID)
+	if err != nil {
+		return err
+	}
+	return p.BalanceManager.OnDisconnect(*node)
 }
 
 // NumRemotes returns the number of remote hosts that the pool is currently maintaining.
@@ -86,19 +95,26 @@ func (p *VipnodePool) NumRemotes() int {
 	return len(p.remoteHosts)
 }
 
-func (p *VipnodePool) verify(sig string, method string, nodeID string, nonce int64, args ...interface{}) error {
+// verify checks the signature and nonce of a request, and returns the
+// normalized node ID that it was signed by.
+func (p *VipnodePool) verify(sig string, method string, nodeID string, nonce int64, args ...interface{}) (store.NodeID, error) {
 	// TODO: Switch nonce to strictly timestamp within X time
-	// TODO: Switch NodeID to pubkey?
+	id, err := store.ParseNodeID(nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	// The signature covers the node ID as it was sent.
 	if err := request.Verify(sig, method, nodeID, nonce, args...); err != nil {
-		return VerifyFailedError{Cause: err, Method: method}
+		return "", VerifyFailedError{Cause: err, Method: method}
 	}
 
 	// We check and save the nonce only after the verify passed, this allows us
 	// to check twice for backwards compatibility.
-	if err := p.Store.CheckAndSaveNonce(nodeID, nonce); err != nil {
-		return VerifyFailedError{Cause: err, Method: method}
+	if err := p.Store.CheckAndSaveNonce(string(id), nonce); err != nil {
+		return "", VerifyFailedError{Cause: err, Method: method}
 	}
-	return nil
+	return id, nil
 }
 
 func (p *VipnodePool) disconnectPeers(ctx context.Context, nodeID string, peers []store.Node) error {
@@ -137,27 +153,38 @@ func (p *VipnodePool) disconnectPeers(ctx context.Context, nodeID string, peers
 // Update submits a list of peers that the node is connected to, returning the current account balance.
 func (p *VipnodePool) Update(ctx context.Context, sig string, nodeID string, nonce int64, req UpdateRequest) (*UpdateResponse, error) {
 	// TODO: Send sync status?
-	if err := p.verify(sig, "vipnode_update", nodeID, nonce, req); err != nil {
+	id, err := p.verify(sig, "vipnode_update", nodeID, nonce, req)
+	if err != nil {
 		// Try again with old version (DEPRECATED)
-		if errOld := p.verify(sig, "vipnode_update", nodeID, nonce, oldUpdateRequest{req.Peers, req.BlockNumber}); errOld != nil {
+		var errOld error
+		if id, errOld = p.verify(sig, "vipnode_update", nodeID, nonce, oldUpdateRequest{req.Peers, req.BlockNumber}); errOld != nil {
 			return nil, err
 		}
 	}
+	nodeID = string(id)
 
-	node, err := p.Store.GetNode(store.NodeID(nodeID))
+	node, err := p.Store.GetNode(id)
 	if err != nil {
 		return nil, err
 	}
 	nodeBeforeUpdate := *node
 
-	peerIDs := ethnode.Peers(req.PeerInfo).IDs()
+	peerIDs := make([]string, 0, len(req.PeerInfo))
+	for _, peerID := range ethnode.Peers(req.PeerInfo).IDs() {
+		normalized, err := store.ParseNodeID(peerID)
+		if err != nil {
+			// Skip bad peers
+			continue
+		}
+		peerIDs = append(peerIDs, string(normalized))
+	}
 	count := len(req.PeerInfo)
 
-	inactive, err := p.Store.UpdateNodePeers(store.NodeID(nodeID), peerIDs, req.BlockNumber)
+	inactive, err := p.Store.UpdateNodePeers(id, peerIDs, req.BlockNumber)
 	if err != nil {
 		return nil, err
 	}
-	active, err := p.Store.NodePeers(store.NodeID(nodeID))
+	active, err := p.Store.NodePeers(id)
 	if err != nil {
 		return nil, err
 	}
@@ -179,14 +206,41 @@ func (p *VipnodePool) Update(ctx context.Context, sig string, nodeID string, non
 		}
 	}
 
+	if len(inactive) > 0 {
+		if err := p.BalanceManager.OnExpire(nodeBeforeUpdate, inactive); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Proof != nil {
+		if p.Channels == nil {
+			return nil, ErrChannelsDisabled
+		}
+		resp.ChannelAmount, err = p.Channels.OnProof(id, *req.Proof)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(req.Usage) > 0 {
+		if err := p.BalanceManager.OnUsage(nodeBeforeUpdate, activeUsage(req.Usage, active)); err != nil {
+			return nil, err
+		}
+	}
+
 	nodeBalance, err := p.BalanceManager.OnUpdate(nodeBeforeUpdate, active)
+	if warning, ok := err.(balance.LowBalanceWarning); ok {
+		resp.Warning = p.balanceWarning(nodeID, warning)
+		logger.Printf("Client balance warning: %q: %s", pretty.Abbrev(nodeID), warning)
+		err = nil
+	}
 	if err != nil {
-		if _, ok := err.(balance.LowBalanceError); ok {
+		if balance.IsDisconnect(err) {
 			disconnectErr := p.disconnectPeers(ctx, nodeID, active)
 			if disconnectErr != nil {
-				logger.Printf("Client disconnect due to low balance: %q; disconnect RPC errors: %s", pretty.Abbrev(nodeID), disconnectErr)
+				logger.Printf("Client disconnect due to balance manager: %q: %s; disconnect RPC errors: %s", pretty.Abbrev(nodeID), err, disconnectErr)
 			} else {
-				logger.Printf("Client disconnect due to low balance: %q", pretty.Abbrev(nodeID))
+				logger.Printf("Client disconnect due to balance manager: %q: %s", pretty.Abbrev(nodeID), err)
 			}
 		}
 		return nil, err
@@ -203,11 +257,56 @@ func (p *VipnodePool) Update(ctx context.Context, sig string, nodeID string, non
 	return &resp, nil
 }
 
+// activeUsage returns the usage reports for the active peers, skipping any
+// peers that the pool is not tracking.
+func activeUsage(usage []ethnode.PeerUsage, active []store.Node) []store.Usage {
+	isActive := make(map[store.NodeID]struct{}, len(active))
+	for _, peer := range active {
+		isActive[peer.ID] = struct{}{}
+	}
+	r := make([]store.Usage, 0, len(usage))
+	for _, u := range usage {
+		peerID, err := store.ParseNodeID(u.ID)
+		if err != nil {
+			continue
+		}
+		if _, ok := isActive[peerID]; !ok {
+			continue
+		}
+		r = append(r, store.Usage{
+			Peer:     peerID,
+			BytesIn:  u.BytesIn,
+			BytesOut: u.BytesOut,
+			Requests: u.Requests,
+		})
+	}
+	return r
+}
+
+// balanceWarning converts a balance manager warning into a BalanceWarning for
+// the node.
+func (p *VipnodePool) balanceWarning(nodeID string, warning balance.LowBalanceWarning) *BalanceWarning {
+	w := &BalanceWarning{
+		AmountNeeded: new(big.Int).Sub(warning.MinBalance, warning.CurrentBalance),
+	}
+	if !warning.Deadline.IsZero() {
+		w.SecondsLeft = int64(time.Until(warning.Deadline) / time.Second)
+		if w.SecondsLeft < 1 {
+			w.SecondsLeft = 1
+		}
+	}
+	if p.DepositMessager != nil {
+		w.Message = p.DepositMessager(nodeID, w.AmountNeeded)
+	}
+	return w
+}
+
 // Host registers a full node to participate as a vipnode host in this pool.
 // DEPRECATED: Use Connect
 func (p *VipnodePool) Host(ctx context.Context, sig string, nodeID string, nonce int64, req HostRequest) (*HostResponse, error) {
 	// This is a backport of Host using Connect behind the scenes.
-	if err := p.verify(sig, "vipnode_host", nodeID, nonce, req); err != nil {
+	id, err := p.verify(sig, "vipnode_host", nodeID, nonce, req)
+	if err != nil {
 		return nil, err
 	}
 
@@ -219,7 +318,7 @@ func (p *VipnodePool) Host(ctx context.Context, sig string, nodeID string, nonce
 		Payout:  req.Payout,
 		NodeURI: req.NodeURI,
 	}
-	connectResp, err := p.connect(ctx, nodeID, connectReq)
+	connectResp, err := p.connect(ctx, id, connectReq)
 	if err != nil {
 		return nil, err
 	}
@@ -234,7 +333,8 @@ func (p *VipnodePool) Host(ctx context.Context, sig string, nodeID string, nonce
 // DEPRECATED: Use Connect
 func (p *VipnodePool) Client(ctx context.Context, sig string, nodeID string, nonce int64, req ClientRequest) (*ClientResponse, error) {
 	// This is a backport of Client using Connect behind the scenes.
-	if err := p.verify(sig, "vipnode_client", nodeID, nonce, req); err != nil {
+	id, err := p.verify(sig, "vipnode_client", nodeID, nonce, req)
+	if err != nil {
 		return nil, err
 	}
 	connectReq := ConnectRequest{
@@ -243,7 +343,7 @@ func (p *VipnodePool) Client(ctx context.Context, sig string, nodeID string, non
 			IsFullNode: false,
 		},
 	}
-	connectResp, err := p.connect(ctx, nodeID, connectReq)
+	connectResp, err := p.connect(ctx, id, connectReq)
 	if err != nil {
 		return nil, err
 	}
@@ -253,7 +353,7 @@ func (p *VipnodePool) Client(ctx context.Context, sig string, nodeID string, non
 	if req.NumHosts > 0 {
 		numRequestHosts = req.NumHosts
 	}
-	hosts, err := p.requestHosts(ctx, nodeID, numRequestHosts, req.Kind)
+	hosts, err := p.requestHosts(ctx, id, store.HostQuery{Kind: req.Kind, Limit: numRequestHosts}, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -268,16 +368,17 @@ func (p *VipnodePool) Client(ctx context.Context, sig string, nodeID string, non
 
 // Connect returns a list of enodes who are ready for the client node to connect.
 func (p *VipnodePool) Connect(ctx context.Context, sig string, nodeID string, nonce int64, req ConnectRequest) (*ConnectResponse, error) {
-	if err := p.verify(sig, "vipnode_connect", nodeID, nonce, req); err != nil {
+	id, err := p.verify(sig, "vipnode_connect", nodeID, nonce, req)
+	if err != nil {
 		return nil, err
 	}
 
-	return p.connect(ctx, nodeID, req)
+	return p.connect(ctx, id, req)
 }
 
 // connect is same as Connect without signature verification. Used as a helper.
 // TODO: We can inline connect into Connect once Client/Host are removed.
-func (p *VipnodePool) connect(ctx context.Context, nodeID string, req ConnectRequest) (*ConnectResponse, error) {
+func (p *VipnodePool) connect(ctx context.Context, nodeID store.NodeID, req ConnectRequest) (*ConnectResponse, error) {
 	kind := req.NodeInfo.Kind.String()
 	if kind == "unknown" {
 		kind = ""
@@ -288,27 +389,49 @@ func (p *VipnodePool) connect(ctx context.Context, nodeID string, req ConnectReq
 		return nil, fmt.Errorf("node is on the wrong network, pool requires: %s", p.RestrictNetwork)
 	}
 
+	var payout store.Account
+	if req.Payout != "" {
+		var err error
+		if payout, err = store.ParseAccount(req.Payout); err != nil {
+			return nil, fmt.Errorf("invalid payout: %s", err)
+		}
+	}
+
 	response := &ConnectResponse{
 		PoolVersion: p.Version,
 	}
 	if p.ClientMessager != nil {
-		response.Message = p.ClientMessager(nodeID)
+		response.Message = p.ClientMessager(string(nodeID))
 	}
 
 	// FIXME: Need to investigate if there's a vuln here where a client could
 	// get successfully whitelisted, then switched to host status thus bypass
 	// billing?
 	node := store.Node{
-		ID:             store.NodeID(nodeID),
+		ID:             nodeID,
 		Kind:           kind,
 		LastSeen:       time.Now(),
 		IsHost:         isHost,
-		Payout:         store.Account(req.Payout),
+		Payout:         payout,
 		NodeVersion:    req.NodeInfo.Version,
 		VipnodeVersion: req.VipnodeVersion,
+		Network:        int(req.NodeInfo.Network),
+		Capabilities:   req.Capabilities,
+		Labels:         req.Labels,
 	}
 
 	if isHost {
+		node.Price = p.DefaultHostPrice
+		if req.Price != nil {
+			if req.Price.Sign() < 0 {
+				return nil, fmt.Errorf("invalid host price: %d", req.Price)
+			}
+			if p.MaxHostPrice != nil && req.Price.Cmp(p.MaxHostPrice) > 0 {
+				return nil, fmt.Errorf("host price %d is above the pool's maximum: %d", req.Price, p.MaxHostPrice)
+			}
+			node.Price = req.Price
+		}
+
 		// Hosts expose a reverse-RPC for vipnode_whitelist.
 		service, err := jsonrpc2.CtxService(ctx)
 		if err != nil {
@@ -321,7 +444,7 @@ func (p *VipnodePool) connect(ctx context.Context, nodeID string, req ConnectReq
 			remoteHost = (&url.URL{Host: withAddr.RemoteAddr()}).Hostname()
 		}
 		defaultPort := "30303"
-		node.URI, err = normalizeNodeURI(req.NodeURI, nodeID, remoteHost, defaultPort)
+		node.URI, err = normalizeNodeURI(req.NodeURI, string(nodeID), remoteHost, defaultPort)
 		if err != nil {
 			return nil, err
 		}
@@ -340,9 +463,15 @@ func (p *VipnodePool) connect(ctx context.Context, nodeID string, req ConnectReq
 		return nil, err
 	}
 
+	if isHost {
+		if err := p.BalanceManager.OnConnect(node); err != nil {
+			return nil, err
+		}
+	}
+
 	enode := node.URI
 	if enode == "" {
-		enode = "enode://" + nodeID + "@"
+		enode = "enode://" + string(nodeID) + "@"
 	}
 	logger.Printf("Connected %s peer: %q", req.NodeInfo.KindType(), enode)
 
@@ -353,7 +482,20 @@ func (p *VipnodePool) connect(ctx context.Context, nodeID string, req ConnectReq
 func (p *VipnodePool) Peer(ctx context.Context, sig string, nodeID string, nonce int64, req PeerRequest) (*PeerResponse, error) {
 	// TODO: Should we use protocol capability (eth, les, pip) instead of Kind?
 	// It's hard to get self-reported protocol capability versions though (les/2 vs just les).
-	hosts, err := p.requestHosts(ctx, nodeID, req.Num, req.Kind)
+	query := store.HostQuery{
+		Kind:           req.Kind,
+		MinBlockNumber: req.MinBlockNumber,
+		Capabilities:   req.Capabilities,
+		Labels:         req.Labels,
+		MaxLoad:        req.MaxLoad,
+		Order:          req.Order,
+		Limit:          req.Num,
+	}
+	id, err := store.ParseNodeID(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := p.requestHosts(ctx, id, query, req.MaxPrice)
 	if err != nil {
 		return nil, err
 	}
@@ -367,37 +509,63 @@ func (p *VipnodePool) Peer(ctx context.Context, sig string, nodeID string, nonce
 
 }
 
-func (p *VipnodePool) requestHosts(ctx context.Context, nodeID string, numRequestHosts int, kind string) ([]store.Node, error) {
-	if p.MaxRequestHosts > 0 && numRequestHosts > p.MaxRequestHosts {
-		numRequestHosts = p.MaxRequestHosts
+func (p *VipnodePool) requestHosts(ctx context.Context, nodeID store.NodeID, query store.HostQuery, maxPrice *big.Int) ([]store.Node, error) {
+	if p.MaxRequestHosts > 0 && query.Limit > p.MaxRequestHosts {
+		query.Limit = p.MaxRequestHosts
 	}
 
 	var hosts []store.Node
-	if numRequestHosts == 0 {
+	if query.Limit <= 0 {
 		// Nothing left to do
 		return hosts, nil
 	}
+	numRequestHosts := query.Limit
 
-	// Get existing peers that we can skip
-	selfNodeID := store.NodeID(nodeID)
-	peers, err := p.Store.NodePeers(selfNodeID)
+	// Skip existing peers, and ourself
+	peers, err := p.Store.NodePeers(nodeID)
 	if err != nil {
 		return nil, err
 	}
-	skipPeers := make(map[store.NodeID]struct{}, len(peers)+1)
-	skipPeers[selfNodeID] = struct{}{}
+	query.Exclude = make([]store.NodeID, 0, len(peers)+1)
+	query.Exclude = append(query.Exclude, nodeID)
 	for _, peer := range peers {
-		skipPeers[peer.ID] = struct{}{}
+		query.Exclude = append(query.Exclude, peer.ID)
+	}
+
+	// Only hosts on the same network are useful peers. Nodes that didn't
+	// report their network are matched with any network.
+	if self, err := p.Store.GetNode(nodeID); err != nil {
+		return nil, err
+	} else if self.Network != 0 {
+		query.Network = self.Network
+	}
+
+	// Clients that don't set a maximum are only matched with hosts that charge
+	// the default price or less, so they're not billed at whatever price a
+	// host sets.
+	if maxPrice == nil {
+		maxPrice = p.DefaultHostPrice
 	}
 
 	// Note that ActiveHosts returns hosts that have been active in the last
 	// minute. They may not be connected anymore, so we're likely to get fewer
 	// valid peers than number we want. That's okay, the agent can ask again
 	// next cycle for more.
-	r, err := p.Store.ActiveHosts(kind, numRequestHosts+len(skipPeers))
+	if maxPrice != nil {
+		// Some hosts will be filtered out by price, so we need all the
+		// candidates.
+		query.Limit = 0
+	}
+	r, err := p.Store.ActiveHosts(query)
 	if err != nil {
 		return nil, err
 	}
+	if maxPrice != nil {
+		r = p.withinPrice(r, maxPrice)
+		if len(r) > numRequestHosts {
+			r = r[:numRequestHosts]
+		}
+	}
 
 	if p.skipWhitelist {
 		// Bypass whitelisting, used for making testing simpler
@@ -407,11 +575,6 @@ func (p *VipnodePool) requestHosts(ctx context.Context, nodeID string, numReques
 	remotes := make([]hostService, 0, len(r))
 	p.mu.Lock()
 	for _, node := range r {
-		if _, skip := skipPeers[node.ID]; skip {
-			// Skip peers we're already connected to, and ourself
-			continue
-		}
-
 		remote, ok := p.remoteHosts[node.ID]
 		if ok {
 			remotes = append(remotes, hostService{
@@ -435,7 +598,7 @@ func (p *VipnodePool) requestHosts(ctx context.Context, nodeID string, numReques
 
 	for _, remote := range remotes {
 		go func(service jsonrpc2.Service, node store.Node) {
-			if err := service.Call(callCtx, nil, "vipnode_whitelist", nodeID); err != nil {
+			if err := service.Call(callCtx, nil, "vipnode_whitelist", string(nodeID)); err != nil {
 				errChan <- err
 			} else {
 				acceptChan <- node
@@ -457,9 +620,9 @@ func (p *VipnodePool) requestHosts(ctx context.Context, nodeID string, numReques
 
 	if len(errors) > 0 {
 		err = RemoteHostErrors{"vipnode_whitelist", errors}
-		logger.Printf("Request kind=%q hosts: %q (%d hosts found, %d accepted); failures: %s", kind, pretty.Abbrev(nodeID), len(remotes), len(accepted), err)
+		logger.Printf("Request kind=%q hosts: %q (%d hosts found, %d accepted); failures: %s", query.Kind, pretty.Abbrev(string(nodeID)), len(remotes), len(accepted), err)
 	} else {
-		logger.Printf("Request kind=%q hosts: %q (%d hosts found, %d accepted)", kind, pretty.Abbrev(nodeID), len(remotes), len(accepted))
+		logger.Printf("Request kind=%q hosts: %q (%d hosts found, %d accepted)", query.Kind, pretty.Abbrev(string(nodeID)), len(remotes), len(accepted))
 	}
 
 	if len(accepted) >= 1 {
@@ -474,6 +637,23 @@ func (p *VipnodePool) requestHosts(ctx context.Context, nodeID string, numReques
 	return nil, NoHostNodesError{len(r)}
 }
 
+// withinPrice returns the hosts whose price is at most maxPrice. Hosts
+// without a price are compared using DefaultHostPrice.
+func (p *VipnodePool) withinPrice(hosts []store.Node, maxPrice *big.Int) []store.Node {
+	r := hosts[:0]
+	for _, host := range hosts {
+		price := host.Price
+		if price == nil {
+			price = p.DefaultHostPrice
+		}
+		if price != nil && price.Cmp(maxPrice) > 0 {
+			continue
+		}
+		r = append(r, host)
+	}
+	return r
+}
+
 // Ping returns "pong", used for testing.
 func (p *VipnodePool) Ping(ctx context.Context) string {
 	return "pong"
@@ -2,12 +2,18 @@ package pool
 
 import (
 	"context"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/p2p/discv5"
+	"github.com/vipnode/vipnode/v2/ethnode"
 	"github.com/vipnode/vipnode/v2/internal/keygen"
 	"github.com/vipnode/vipnode/v2/jsonrpc2"
+	"github.com/vipnode/vipnode/v2/pool/store"
 	"github.com/vipnode/vipnode/v2/pool/store/memory"
 	"github.com/vipnode/vipnode/v2/request"
 )
@@ -78,3 +84,115 @@ func TestPoolService(t *testing.T) {
 		}
 	}
 }
+
+func TestPoolNormalizeNodeID(t *testing.T) {
+	storeDriver := memory.New()
+	pool := New(storeDriver, nil)
+
+	privkey := keygen.HardcodedKey(t)
+	nodeID := discv5.PubkeyID(&privkey.PublicKey).String()
+	connect := func(nodeID string, req ConnectRequest) error {
+		t.Helper()
+		r := request.NodeRequest{
+			Method:    "vipnode_connect",
+			NodeID:    nodeID,
+			Nonce:     time.Now().UnixNano(),
+			ExtraArgs: []interface{}{req},
+		}
+		sig, err := r.Sign(privkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pool.Connect(context.Background(), sig, r.NodeID, r.Nonce, req)
+		return err
+	}
+
+	if err := connect("foo", ConnectRequest{}); err != store.ErrInvalidNodeID {
+		t.Errorf("expected ErrInvalidNodeID, got: %v", err)
+	}
+	if err := connect(nodeID, ConnectRequest{Payout: "0x961aa96febeE5465149a0787B03bFa14D8e9033F"}); err == nil {
+		t.Error("expected a mixed-case payout with a bad checksum to fail")
+	}
+
+	payout := "0x961aa96febee5465149a0787b03bfa14d8e9033f"
+	if err := connect(strings.ToUpper(nodeID), ConnectRequest{Payout: payout}); err != nil {
+		t.Fatal(err)
+	}
+	node, err := storeDriver.GetNode(store.NodeID(nodeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Payout != "0x961Aa96FebeE5465149a0787B03bFa14D8e9033F" {
+		t.Errorf("payout was not normalized: %q", node.Payout)
+	}
+}
+
+func TestPoolMaxHostPrice(t *testing.T) {
+	pool := New(memory.New(), nil)
+	pool.MaxHostPrice = big.NewInt(100)
+
+	privkey := keygen.HardcodedKey(t)
+	req := ConnectRequest{
+		NodeInfo: ethnode.UserAgent{IsFullNode: true},
+		Price:    big.NewInt(101),
+	}
+	r := request.NodeRequest{
+		Method:    "vipnode_connect",
+		NodeID:    discv5.PubkeyID(&privkey.PublicKey).String(),
+		Nonce:     time.Now().UnixNano(),
+		ExtraArgs: []interface{}{req},
+	}
+	sig, err := r.Sign(privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Connect(context.Background(), sig, r.NodeID, r.Nonce, req); err == nil {
+		t.Error("expected an error for a host price above the maximum")
+	}
+}
+
+func TestPoolRequestHostsNetwork(t *testing.T) {
+	storeDriver := memory.New()
+	pool := New(storeDriver, nil)
+	pool.skipWhitelist = true
+
+	now := time.Now()
+	// The legacy host connected with vipnode_host, so its network is unknown
+	legacy := store.Node{ID: "legacy", IsHost: true, LastSeen: now}
+	mainnet := store.Node{ID: "mainnet", IsHost: true, LastSeen: now, Network: 1}
+	goerli := store.Node{ID: "goerli", IsHost: true, LastSeen: now, Network: 5}
+	client := store.Node{ID: "client", LastSeen: now, Network: 1}
+	legacyClient := store.Node{ID: "legacyclient", LastSeen: now}
+	for _, n := range []store.Node{legacy, mainnet, goerli, client, legacyClient} {
+		if err := storeDriver.SetNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		nodeID store.NodeID
+		want   []string
+	}{
+		{client.ID, []string{"legacy", "mainnet"}},
+		// Clients of unknown networks are matched with any network
+		{legacyClient.ID, []string{"goerli", "legacy", "mainnet"}},
+	} {
+		hosts, err := pool.requestHosts(context.Background(), tc.nodeID, store.HostQuery{Limit: 10}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, n := range hosts {
+			got = append(got, string(n.ID))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("[%s] wrong hosts: got %q; want %q", tc.nodeID, got, tc.want)
+		}
+	}
+
+	// Nodes that never connected can't request hosts
+	if _, err := pool.requestHosts(context.Background(), "unknown", store.HostQuery{Limit: 10}, nil); err != store.ErrUnregisteredNode {
+		t.Errorf("expected ErrUnregisteredNode for an unknown node, got: %v", err)
+	}
+}
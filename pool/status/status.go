@@ -60,6 +60,14 @@ type StatusResponse struct {
 	// Stats contains aggregate statistics about the state of the store.
 	Stats *store.Stats `json:"stats"`
 
+	// BalanceCache contains the counters of the contract deposit cache, if
+	// there is one.
+	BalanceCache *store.CacheStats `json:"balance_cache,omitempty"`
+
+	// Pruned contains the counts of stale state that was removed from the
+	// store since the pool started, if pruning is enabled.
+	Pruned *store.PruneStats `json:"pruned,omitempty"`
+
 	// Error is set if the last cache update attempt failed and the
 	// timestamp was extended.
 	Error error `json:"error,omitempty"`
@@ -77,6 +85,13 @@ type PoolStatus struct {
 	// balance (such as a smart contract).
 	GetTotalDeposit func(context.Context) (*big.Int, error)
 
+	// GetCacheStats returns the counters of the contract deposit cache.
+	// (Optional)
+	GetCacheStats func() store.CacheStats
+
+	// GetPruneStats returns the counts of pruned state. (Optional)
+	GetPruneStats func() store.PruneStats
+
 	// TimeStarted is the time when the server was started.
 	TimeStarted time.Time
 
@@ -86,6 +101,10 @@ type PoolStatus struct {
 	// CacheDuration is the time for responses to be cached.
 	CacheDuration time.Duration
 
+	// Operator is the account that receives the pool operator's commission.
+	// If set, its credit is included in the stats. (Optional)
+	Operator store.Account
+
 	mu         sync.RWMutex
 	cachedResp *StatusResponse
 }
@@ -115,7 +134,26 @@ func (s *PoolStatus) getStatus() (*StatusResponse, error) {
 		r.Stats.TotalDeposit = *totalDeposit
 	}
 
-	nodes, err := s.Store.ActiveHosts("", 0)
+	if s.GetCacheStats != nil {
+		cacheStats := s.GetCacheStats()
+		r.BalanceCache = &cacheStats
+	}
+
+	if s.GetPruneStats != nil {
+		pruneStats := s.GetPruneStats()
+		r.Pruned = &pruneStats
+	}
+
+	if s.Operator != "" {
+		balance, err := s.Store.GetAccountBalance(s.Operator)
+		if err != nil {
+			r.Error = err
+			return r, err
+		}
+		r.Stats.OperatorCredit = &balance.Credit
+	}
+
+	nodes, err := s.Store.ActiveHosts(store.HostQuery{})
 	if err != nil {
 		r.Error = err
 		return r, err
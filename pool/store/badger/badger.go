@@ -5,15 +5,12 @@ import (
 	"encoding/gob"
 	"fmt"
 	"math/big"
-	"math/rand"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/vipnode/vipnode/v2/pool/store"
 )
 
-// TODO: Set reasonable expiration values?
-
 type peers map[store.NodeID]time.Time
 
 // Open returns a store.Store implementation using Badger as the storage
@@ -80,6 +77,12 @@ func (s *badgerStore) GetNodeBalance(nodeID store.NodeID) (store.Balance, error)
 	var account store.Account
 	var r store.Balance
 	err := s.db.View(func(txn *badger.Txn) error {
+		// Balances outlive pruned nodes, but they're only spendable by known
+		// nodes.
+		nodeKey := []byte(fmt.Sprintf("vip:node:%s", nodeID))
+		if !hasKey(txn, nodeKey) {
+			return store.ErrUnregisteredNode
+		}
 		balanceKey := []byte(fmt.Sprintf("vip:trial:%s", nodeID))
 		if err := getItem(txn, accountKey, &account); err == badger.ErrKeyNotFound {
 			// No spendable account, use the trial account
@@ -88,13 +91,7 @@ func (s *badgerStore) GetNodeBalance(nodeID store.NodeID) (store.Balance, error)
 		} else {
 			return err
 		}
-		if err := getItem(txn, balanceKey, &r); err == badger.ErrKeyNotFound {
-			nodeKey := []byte(fmt.Sprintf("vip:node:%s", nodeID))
-			if !hasKey(txn, nodeKey) {
-				return store.ErrUnregisteredNode
-			}
-			return nil
-		} else if err != nil {
+		if err := getItem(txn, balanceKey, &r); err != nil && err != badger.ErrKeyNotFound {
 			return err
 		}
 		return nil
@@ -135,6 +132,20 @@ func (s *badgerStore) AddNodeBalance(nodeID store.NodeID, credit *big.Int) error
 	})
 }
 
+// StartTrial returns when the node's trial started, starting it at now if it
+// hasn't started yet.
+func (s *badgerStore) StartTrial(nodeID store.NodeID, now time.Time) (time.Time, error) {
+	key := []byte(fmt.Sprintf("vip:trialstart:%s", nodeID))
+	started := now
+	err := s.db.Update(func(txn *badger.Txn) error {
+		if err := getItem(txn, key, &started); err != badger.ErrKeyNotFound {
+			return err
+		}
+		return setItem(txn, key, &started)
+	})
+	return started, err
+}
+
 // GetAccountBalance returns an account's balance.
 func (s *badgerStore) GetAccountBalance(account store.Account) (store.Balance, error) {
 	balanceKey := []byte(fmt.Sprintf("vip:balance:%s", account))
@@ -210,6 +221,52 @@ func (s *badgerStore) AddAccountNode(account store.Account, nodeID store.NodeID)
 	})
 }
 
+// RemoveAccountNode de-authorizes a nodeID from spending an account's
+// balance. If moveShare is set, then the node's share of the account's credit
+// is moved back to the node's trial balance.
+func (s *badgerStore) RemoveAccountNode(account store.Account, nodeID store.NodeID, moveShare bool) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		accountKey := []byte(fmt.Sprintf("vip:account:%s", nodeID))
+		var nodeAccount store.Account
+		if err := getItem(txn, accountKey, &nodeAccount); err == badger.ErrKeyNotFound {
+			return store.ErrNotAuthorized
+		} else if err != nil {
+			return err
+		}
+		if nodeAccount != account {
+			return store.ErrNotAuthorized
+		}
+
+		if moveShare {
+			nodeIDs, err := accountNodes(txn, account)
+			if err != nil {
+				return err
+			}
+			balanceKey := []byte(fmt.Sprintf("vip:balance:%s", account))
+			var balance store.Balance
+			if err := getItem(txn, balanceKey, &balance); err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			trialKey := []byte(fmt.Sprintf("vip:trial:%s", nodeID))
+			var trialBalance store.Balance
+			if err := getItem(txn, trialKey, &trialBalance); err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			share := store.NodeShare(&balance.Credit, len(nodeIDs))
+			balance.Credit.Sub(&balance.Credit, share)
+			trialBalance.Credit.Add(&trialBalance.Credit, share)
+			if err := setItem(txn, balanceKey, &balance); err != nil {
+				return err
+			}
+			if err := setItem(txn, trialKey, &trialBalance); err != nil {
+				return err
+			}
+		}
+		return txn.Delete(accountKey)
+	})
+}
+
 // IsAccountNode returns nil if node is a valid spender of the given
 // account.
 func (s *badgerStore) IsAccountNode(account store.Account, nodeID store.NodeID) error {
@@ -231,33 +288,193 @@ func (s *badgerStore) IsAccountNode(account store.Account, nodeID store.NodeID)
 // GetSpenders returns the authorized nodeIDs for this account, these are
 // nodes that were added to accounts through AddAccountNode.
 func (s *badgerStore) GetAccountNodes(account store.Account) ([]store.NodeID, error) {
-	// FIXME: This could be more efficient if we had an account -> nodeID index
 	var r []store.NodeID
 	if err := s.db.View(func(txn *badger.Txn) error {
-		prefix := []byte("vip:account:")
-		var gotAccount store.Account
+		var err error
+		r, err = accountNodes(txn, account)
+		return err
+	}); err == badger.ErrKeyNotFound {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// accountNodes returns the nodeIDs that are authorized to spend the account's
+// balance within a transaction.
+func accountNodes(txn *badger.Txn, account store.Account) ([]store.NodeID, error) {
+	// FIXME: This could be more efficient if we had an account -> nodeID index
+	var r []store.NodeID
+	prefix := []byte("vip:account:")
+	var gotAccount store.Account
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		// Filter by account: Only accumulate the keys that mapped to our account.
+		if err := it.Item().Value(func(val []byte) error {
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(&gotAccount)
+		}); err != nil {
+			return nil, err
+		}
+		if gotAccount != account {
+			continue
+		}
+		key := it.Item().Key()
+		r = append(r, store.NodeID(key[len(prefix):]))
+	}
+	return r, nil
+}
+
+// GetAccountBalances returns the balances of all registered accounts.
+func (s *badgerStore) GetAccountBalances() ([]store.Balance, error) {
+	r := []store.Balance{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := []byte("vip:balance:")
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			// Filter by account: Only accumulate the keys that mapped to our account.
+			var balance store.Balance
 			if err := it.Item().Value(func(val []byte) error {
-				return gob.NewDecoder(bytes.NewReader(val)).Decode(&gotAccount)
+				return gob.NewDecoder(bytes.NewReader(val)).Decode(&balance)
 			}); err != nil {
 				return err
 			}
-			if gotAccount != account {
+			r = append(r, balance)
+		}
+		return nil
+	})
+	return r, err
+}
+
+// SetSettlement saves a settlement.
+func (s *badgerStore) SetSettlement(settlement store.Settlement) error {
+	// Zero-padded timestamp keeps the keys sorted by time
+	key := []byte(fmt.Sprintf("vip:settlement:%s:%020d", settlement.Account, settlement.Time.UnixNano()))
+	return s.db.Update(func(txn *badger.Txn) error {
+		return setItem(txn, key, &settlement)
+	})
+}
+
+// GetSettlements returns the account's settlements, oldest first.
+func (s *badgerStore) GetSettlements(account store.Account) ([]store.Settlement, error) {
+	return s.getSettlements([]byte(fmt.Sprintf("vip:settlement:%s:", account)), false)
+}
+
+// GetPendingSettlements returns the settlements that are not done yet.
+func (s *badgerStore) GetPendingSettlements() ([]store.Settlement, error) {
+	// FIXME: This could be more efficient with a pending settlements index
+	return s.getSettlements([]byte("vip:settlement:"), true)
+}
+
+func (s *badgerStore) getSettlements(prefix []byte, onlyPending bool) ([]store.Settlement, error) {
+	r := []store.Settlement{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var settlement store.Settlement
+			if err := it.Item().Value(func(val []byte) error {
+				return gob.NewDecoder(bytes.NewReader(val)).Decode(&settlement)
+			}); err != nil {
+				return err
+			}
+			if onlyPending && settlement.IsDone() {
 				continue
 			}
-			key := it.Item().Key()
-			r = append(r, store.NodeID(key[len(prefix):]))
+			r = append(r, settlement)
 		}
 		return nil
-	}); err == badger.ErrKeyNotFound {
-		return r, nil
+	})
+	return r, err
+}
+
+// GetChannel returns the account's payment channel.
+func (s *badgerStore) GetChannel(account store.Account) (*store.Channel, error) {
+	key := []byte(fmt.Sprintf("vip:channel:%s", account))
+	var r store.Channel
+	err := s.db.View(func(txn *badger.Txn) error {
+		return getItem(txn, key, &r)
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, store.ErrNoChannel
 	} else if err != nil {
 		return nil, err
 	}
-	return r, nil
+	return &r, nil
+}
+
+// SetChannel saves an account's payment channel.
+func (s *badgerStore) SetChannel(channel store.Channel) error {
+	key := []byte(fmt.Sprintf("vip:channel:%s", channel.Account))
+	return s.db.Update(func(txn *badger.Txn) error {
+		return setItem(txn, key, &channel)
+	})
+}
+
+// GetChannels returns the payment channels of all accounts.
+func (s *badgerStore) GetChannels() ([]store.Channel, error) {
+	r := []store.Channel{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := []byte("vip:channel:")
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var channel store.Channel
+			if err := it.Item().Value(func(val []byte) error {
+				return gob.NewDecoder(bytes.NewReader(val)).Decode(&channel)
+			}); err != nil {
+				return err
+			}
+			r = append(r, channel)
+		}
+		return nil
+	})
+	return r, err
+}
+
+// GetCheckpoint returns the last block number processed by the named process.
+func (s *badgerStore) GetCheckpoint(name string) (uint64, error) {
+	key := []byte(fmt.Sprintf("vip:checkpoint:%s", name))
+	var r uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		return getItem(txn, key, &r)
+	})
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	return r, err
+}
+
+// SetCheckpoint saves the last block number processed by the named process.
+func (s *badgerStore) SetCheckpoint(name string, blockNumber uint64) error {
+	key := []byte(fmt.Sprintf("vip:checkpoint:%s", name))
+	return s.db.Update(func(txn *badger.Txn) error {
+		return setItem(txn, key, &blockNumber)
+	})
+}
+
+// GetSubscription returns the account's subscription.
+func (s *badgerStore) GetSubscription(account store.Account) (*store.Subscription, error) {
+	key := []byte(fmt.Sprintf("vip:subscription:%s", account))
+	var r store.Subscription
+	err := s.db.View(func(txn *badger.Txn) error {
+		return getItem(txn, key, &r)
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, store.ErrNoSubscription
+	} else if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// SetSubscription saves an account's subscription.
+func (s *badgerStore) SetSubscription(subscription store.Subscription) error {
+	key := []byte(fmt.Sprintf("vip:subscription:%s", subscription.Account))
+	return s.db.Update(func(txn *badger.Txn) error {
+		return setItem(txn, key, &subscription)
+	})
 }
 
 // AllNodes returns all registered nodes, used for debugging.
@@ -281,32 +498,48 @@ func (s *badgerStore) AllNodes() ([]store.Node, error) {
 	return r, err
 }
 
-// ActiveHosts loads all nodes, then return a valid shuffled subset of size limit.
-func (s *badgerStore) ActiveHosts(kind string, limit int) ([]store.Node, error) {
+// ActiveHosts loads the hosts that were seen recently from the host index,
+// then returns the ones that match the query.
+func (s *badgerStore) ActiveHosts(query store.HostQuery) ([]store.Node, error) {
 	seenSince := time.Now().Add(-store.ExpireInterval)
 	var r []store.Node
+	var loads map[store.NodeID]int
+	if query.NeedsLoad() {
+		loads = map[store.NodeID]int{}
+	}
 	err := s.db.View(func(txn *badger.Txn) error {
-		prefix := []byte("vip:node:")
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			var n store.Node
-			var err error
-			err = it.Item().Value(func(val []byte) error {
-				return gob.NewDecoder(bytes.NewReader(val)).Decode(&n)
-			})
-			if err != nil {
-				return err
-			}
-			if !n.IsHost {
+		// Buckets sort by time, so the index from seenSince's bucket onwards
+		// only has the hosts that were seen recently.
+		prefix := []byte(hostIndexPrefix)
+		for it.Seek(hostIndexBucketPrefix(seenBucket(seenSince))); it.ValidForPrefix(prefix); it.Next() {
+			nodeKind, nodeID := parseHostIndexKey(it.Item().Key())
+			if query.Kind != "" && nodeKind != query.Kind {
 				continue
 			}
-			if kind != "" && n.Kind != kind {
+			var n store.Node
+			if err := getItem(txn, []byte(fmt.Sprintf("vip:node:%s", nodeID)), &n); err == badger.ErrKeyNotFound {
 				continue
+			} else if err != nil {
+				return err
 			}
-			if !n.LastSeen.After(seenSince) {
+			if !query.Match(n) || !n.LastSeen.After(seenSince) {
+				// The bucket can start before seenSince
 				continue
 			}
+			if loads != nil {
+				var nodePeers peers
+				if err := getItem(txn, []byte(fmt.Sprintf("vip:peers:%s", nodeID)), &nodePeers); err != nil && err != badger.ErrKeyNotFound {
+					return err
+				}
+				if !query.MatchLoad(len(nodePeers)) {
+					continue
+				}
+				loads[nodeID] = len(nodePeers)
+			}
 			r = append(r, n)
 		}
 		return nil
@@ -314,17 +547,7 @@ func (s *badgerStore) ActiveHosts(kind string, limit int) ([]store.Node, error)
 	if err != nil {
 		return nil, err
 	}
-	if limit <= 0 || len(r) < limit {
-		// Skip shuffle since it's a subset
-		return r, nil
-	}
-
-	// FIXME: Is there a different sorting method we want to use? Maybe sort by last seen?
-	rand.Shuffle(len(r), func(i, j int) {
-		r[i], r[j] = r[j], r[i]
-	})
-
-	return r[:limit], nil
+	return query.Sort(r, loads), nil
 }
 
 func (s *badgerStore) GetNode(nodeID store.NodeID) (*store.Node, error) {
@@ -345,9 +568,8 @@ func (s *badgerStore) SetNode(n store.Node) error {
 	if n.ID == "" {
 		return store.ErrMalformedNode
 	}
-	key := []byte(fmt.Sprintf("vip:node:%s", n.ID))
 	return s.db.Update(func(txn *badger.Txn) error {
-		return setItem(txn, key, &n)
+		return setNode(txn, n)
 	})
 }
 
@@ -404,7 +626,7 @@ func (s *badgerStore) UpdateNodePeers(nodeID store.NodeID, peers []string, block
 
 		node.LastSeen = now
 		node.BlockNumber = blockNumber
-		if err := setItem(txn, nodeKey, &node); err != nil {
+		if err := setNode(txn, node); err != nil {
 			return err
 		}
 
@@ -475,3 +697,294 @@ func (s *badgerStore) Stats() (*store.Stats, error) {
 
 	return &stats, err
 }
+
+// Dump calls fn with every record of the store's state.
+func (s *badgerStore) Dump(fn func(store.Record) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		var n store.Node
+		if err := loopItem(txn, []byte("vip:node:"), &n, func() error {
+			node := n
+			return fn(store.Record{Kind: store.RecordNode, Node: &node})
+		}); err != nil {
+			return err
+		}
+
+		var nodePeers peers
+		prefix := []byte("vip:peers:")
+		if err := loopItemKey(txn, prefix, &nodePeers, func(key []byte) error {
+			nodeID := store.NodeID(key[len(prefix):])
+			for peerID, lastSeen := range nodePeers {
+				if err := fn(store.Record{Kind: store.RecordPeer, Peer: &store.PeerLink{NodeID: nodeID, PeerID: peerID, LastSeen: lastSeen}}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		var account store.Account
+		prefix = []byte("vip:account:")
+		if err := loopItemKey(txn, prefix, &account, func(key []byte) error {
+			return fn(store.Record{Kind: store.RecordAccountNode, AccountNode: &store.AccountNode{Account: account, NodeID: store.NodeID(key[len(prefix):])}})
+		}); err != nil {
+			return err
+		}
+
+		var b store.Balance
+		if err := loopItem(txn, []byte("vip:balance:"), &b, func() error {
+			balance := b
+			return fn(store.Record{Kind: store.RecordBalance, Balance: &balance})
+		}); err != nil {
+			return err
+		}
+
+		prefix = []byte("vip:trial:")
+		if err := loopItemKey(txn, prefix, &b, func(key []byte) error {
+			credit := new(big.Int).Set(&b.Credit)
+			return fn(store.Record{Kind: store.RecordTrial, Trial: &store.TrialBalance{NodeID: store.NodeID(key[len(prefix):]), Credit: credit}})
+		}); err != nil {
+			return err
+		}
+
+		var started time.Time
+		prefix = []byte("vip:trialstart:")
+		if err := loopItemKey(txn, prefix, &started, func(key []byte) error {
+			return fn(store.Record{Kind: store.RecordTrialStart, TrialStart: &store.TrialStart{NodeID: store.NodeID(key[len(prefix):]), Started: started}})
+		}); err != nil {
+			return err
+		}
+
+		var nonce int64
+		prefix = []byte("vip:nonce:")
+		if err := loopItemKey(txn, prefix, &nonce, func(key []byte) error {
+			return fn(store.Record{Kind: store.RecordNonce, Nonce: &store.Nonce{ID: string(key[len(prefix):]), Nonce: nonce}})
+		}); err != nil {
+			return err
+		}
+
+		var subscription store.Subscription
+		if err := loopItem(txn, []byte("vip:subscription:"), &subscription, func() error {
+			sub := subscription
+			return fn(store.Record{Kind: store.RecordSubscription, Subscription: &sub})
+		}); err != nil {
+			return err
+		}
+
+		var settlement store.Settlement
+		if err := loopItem(txn, []byte("vip:settlement:"), &settlement, func() error {
+			r := settlement
+			return fn(store.Record{Kind: store.RecordSettlement, Settlement: &r})
+		}); err != nil {
+			return err
+		}
+
+		var channel store.Channel
+		if err := loopItem(txn, []byte("vip:channel:"), &channel, func() error {
+			c := channel
+			return fn(store.Record{Kind: store.RecordChannel, Channel: &c})
+		}); err != nil {
+			return err
+		}
+
+		var blockNumber uint64
+		prefix = []byte("vip:checkpoint:")
+		return loopItemKey(txn, prefix, &blockNumber, func(key []byte) error {
+			return fn(store.Record{Kind: store.RecordCheckpoint, Checkpoint: &store.Checkpoint{Name: string(key[len(prefix):]), BlockNumber: blockNumber}})
+		})
+	})
+}
+
+// Load saves a dumped record, replacing any existing state with the same key.
+func (s *badgerStore) Load(record store.Record) error {
+	switch {
+	case record.Kind == store.RecordNode && record.Node != nil:
+		return s.SetNode(*record.Node)
+	case record.Kind == store.RecordSubscription && record.Subscription != nil:
+		return s.SetSubscription(*record.Subscription)
+	case record.Kind == store.RecordSettlement && record.Settlement != nil:
+		return s.SetSettlement(*record.Settlement)
+	case record.Kind == store.RecordChannel && record.Channel != nil:
+		return s.SetChannel(*record.Channel)
+	case record.Kind == store.RecordCheckpoint && record.Checkpoint != nil:
+		return s.SetCheckpoint(record.Checkpoint.Name, record.Checkpoint.BlockNumber)
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		switch {
+		case record.Kind == store.RecordPeer && record.Peer != nil:
+			nodeKey := []byte(fmt.Sprintf("vip:node:%s", record.Peer.NodeID))
+			if !hasKey(txn, nodeKey) {
+				return store.ErrUnregisteredNode
+			}
+			peersKey := []byte(fmt.Sprintf("vip:peers:%s", record.Peer.NodeID))
+			nodePeers := peers{}
+			if err := getItem(txn, peersKey, &nodePeers); err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			nodePeers[record.Peer.PeerID] = record.Peer.LastSeen
+			return setItem(txn, peersKey, &nodePeers)
+		case record.Kind == store.RecordAccountNode && record.AccountNode != nil:
+			accountKey := []byte(fmt.Sprintf("vip:account:%s", record.AccountNode.NodeID))
+			return setItem(txn, accountKey, &record.AccountNode.Account)
+		case record.Kind == store.RecordBalance && record.Balance != nil:
+			balanceKey := []byte(fmt.Sprintf("vip:balance:%s", record.Balance.Account))
+			return setItem(txn, balanceKey, record.Balance)
+		case record.Kind == store.RecordTrial && record.Trial != nil && record.Trial.Credit != nil:
+			var balance store.Balance
+			balance.Credit.Set(record.Trial.Credit)
+			trialKey := []byte(fmt.Sprintf("vip:trial:%s", record.Trial.NodeID))
+			return setItem(txn, trialKey, &balance)
+		case record.Kind == store.RecordTrialStart && record.TrialStart != nil:
+			key := []byte(fmt.Sprintf("vip:trialstart:%s", record.TrialStart.NodeID))
+			return setItem(txn, key, &record.TrialStart.Started)
+		case record.Kind == store.RecordNonce && record.Nonce != nil:
+			key := []byte(fmt.Sprintf("vip:nonce:%s", record.Nonce.ID))
+			if s.nonceExpire > 0 {
+				return setExpiringItem(txn, key, &record.Nonce.Nonce, s.nonceExpire)
+			}
+			return setItem(txn, key, &record.Nonce.Nonce)
+		}
+		return store.ErrMalformedRecord
+	})
+}
+
+// Prune removes stale nodes, dangling peers, and empty trial balances. Large
+// prunes are committed in several transactions.
+func (s *badgerStore) Prune(seenBefore time.Time) (store.PruneStats, error) {
+	var r store.PruneStats
+	for {
+		var stats store.PruneStats
+		var more bool
+		err := s.db.Update(func(txn *badger.Txn) error {
+			var err error
+			stats, more, err = prune(txn, seenBefore)
+			return err
+		})
+		if err != nil {
+			return r, err
+		}
+		r.Add(stats)
+		if !more {
+			return r, nil
+		}
+	}
+}
+
+// prune removes as much stale state as fits in txn, and returns true if there
+// is more to remove.
+func prune(txn *badger.Txn, seenBefore time.Time) (r store.PruneStats, more bool, err error) {
+	live := map[store.NodeID]struct{}{}
+	var staleNodes [][]byte
+	var n store.Node
+	if err := loopItemKey(txn, []byte("vip:node:"), &n, func(key []byte) error {
+		if n.LastSeen.Before(seenBefore) {
+			// The index key is removed first, so that it isn't left behind
+			// if the transaction fills up in between.
+			if indexKey := hostIndexKey(n); indexKey != nil {
+				staleNodes = append(staleNodes, indexKey)
+			}
+			staleNodes = append(staleNodes, key)
+		} else {
+			live[n.ID] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return r, false, err
+	}
+
+	type peersUpdate struct {
+		key     []byte
+		peers   peers
+		remove  bool
+		removed int
+	}
+	var peersUpdates []peersUpdate
+	var nodePeers peers
+	prefix := []byte("vip:peers:")
+	if err := loopItemKey(txn, prefix, &nodePeers, func(key []byte) error {
+		if _, ok := live[store.NodeID(key[len(prefix):])]; !ok {
+			peersUpdates = append(peersUpdates, peersUpdate{key: key, remove: true, removed: len(nodePeers)})
+			return nil
+		}
+		removed := 0
+		for peerID := range nodePeers {
+			if _, ok := live[peerID]; !ok {
+				delete(nodePeers, peerID)
+				removed += 1
+			}
+		}
+		if removed > 0 {
+			peersUpdates = append(peersUpdates, peersUpdate{key: key, peers: nodePeers, removed: removed})
+		}
+		return nil
+	}); err != nil {
+		return r, false, err
+	}
+
+	var emptyTrials [][]byte
+	var balance store.Balance
+	if err := loopItemKey(txn, []byte("vip:trial:"), &balance, func(key []byte) error {
+		if balance.Credit.Sign() == 0 {
+			emptyTrials = append(emptyTrials, key)
+		}
+		return nil
+	}); err != nil {
+		return r, false, err
+	}
+
+	var staleTrialStarts [][]byte
+	var started time.Time
+	prefix = []byte("vip:trialstart:")
+	if err := loopItemKey(txn, prefix, &started, func(key []byte) error {
+		if _, ok := live[store.NodeID(key[len(prefix):])]; !ok {
+			staleTrialStarts = append(staleTrialStarts, key)
+		}
+		return nil
+	}); err != nil {
+		return r, false, err
+	}
+
+	// Stop early when the transaction is full, the rest is pruned by the
+	// next pass.
+	for _, key := range staleNodes {
+		if err := txn.Delete(key); err == badger.ErrTxnTooBig {
+			return r, true, nil
+		} else if err != nil {
+			return r, false, err
+		}
+		if bytes.HasPrefix(key, []byte("vip:node:")) {
+			r.Nodes += 1
+		}
+	}
+	for _, update := range peersUpdates {
+		var err error
+		if update.remove {
+			err = txn.Delete(update.key)
+		} else {
+			err = setItem(txn, update.key, &update.peers)
+		}
+		if err == badger.ErrTxnTooBig {
+			return r, true, nil
+		} else if err != nil {
+			return r, false, err
+		}
+		r.Peers += update.removed
+	}
+	for _, key := range emptyTrials {
+		if err := txn.Delete(key); err == badger.ErrTxnTooBig {
+			return r, true, nil
+		} else if err != nil {
+			return r, false, err
+		}
+		r.Trials += 1
+	}
+	for _, key := range staleTrialStarts {
+		if err := txn.Delete(key); err == badger.ErrTxnTooBig {
+			return r, true, nil
+		} else if err != nil {
+			return r, false, err
+		}
+	}
+	return r, false, nil
+}
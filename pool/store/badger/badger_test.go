@@ -1,12 +1,16 @@
 package badger
 
 import (
+	"bytes"
+	"fmt"
 	"math/big"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
 )
 
 type badgerTemp struct {
@@ -109,3 +113,151 @@ func TestBadgerStore(t *testing.T) {
 		})
 	})
 }
+
+func TestImportFromMemory(t *testing.T) {
+	src := memory.New()
+	nodeID := store.NodeID("abcd")
+	if err := src.SetNode(store.Node{ID: nodeID, IsHost: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddNodeBalance(nodeID, big.NewInt(7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddAccountBalance("efgh", big.NewInt(42)); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	if _, err := store.Export(&dump, src); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if n, err := store.Import(&dump, dst); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Errorf("wrong number of imported records: %d", n)
+	}
+
+	if node, err := dst.GetNode(nodeID); err != nil {
+		t.Error(err)
+	} else if !node.IsHost {
+		t.Errorf("wrong imported node: %+v", node)
+	}
+	if b, err := dst.GetNodeBalance(nodeID); err != nil {
+		t.Error(err)
+	} else if b.Credit.Int64() != 7 {
+		t.Errorf("wrong imported trial balance: %d", &b.Credit)
+	}
+	if b, err := dst.GetAccountBalance("efgh"); err != nil {
+		t.Error(err)
+	} else if b.Credit.Int64() != 42 {
+		t.Errorf("wrong imported account balance: %d", &b.Credit)
+	}
+}
+
+func TestPruneBatches(t *testing.T) {
+	// A small table size limits the size of each transaction, so that the
+	// prune needs several passes.
+	opts := badger.DefaultOptions("").WithInMemory(true).WithMaxTableSize(1 << 16)
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	num := 1000
+	for i := 0; i < num; i++ {
+		if err := s.SetNode(store.Node{ID: store.NodeID(fmt.Sprintf("%0128x", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats, err := s.Prune(time.Now()); err != nil {
+		t.Fatal(err)
+	} else if stats.Nodes != num {
+		t.Errorf("wrong number of pruned nodes: %d", stats.Nodes)
+	}
+}
+
+func TestHostIndex(t *testing.T) {
+	s, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	countIndex := func() int {
+		n := 0
+		if err := s.db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			prefix := []byte(hostIndexPrefix)
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				n += 1
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	host := store.Node{ID: "abcd", IsHost: true, Kind: "geth", LastSeen: time.Now().Add(-time.Hour)}
+	if err := s.SetNode(host); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := s.ActiveHosts(store.HostQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 0 {
+		t.Errorf("unexpected active hosts: %v", nodes)
+	}
+	if _, err := s.UpdateNodePeers(host.ID, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := s.ActiveHosts(store.HostQuery{Kind: "geth"}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 1 {
+		t.Errorf("wrong active hosts: %v", nodes)
+	}
+	if n := countIndex(); n != 1 {
+		t.Errorf("wrong number of index keys after moving buckets: %d", n)
+	}
+
+	host.Kind = "parity"
+	host.LastSeen = time.Now()
+	if err := s.SetNode(host); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := s.ActiveHosts(store.HostQuery{Kind: "geth"}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 0 {
+		t.Errorf("unexpected geth hosts: %v", nodes)
+	}
+	if n := countIndex(); n != 1 {
+		t.Errorf("wrong number of index keys after changing kind: %d", n)
+	}
+
+	host.IsHost = false
+	if err := s.SetNode(host); err != nil {
+		t.Fatal(err)
+	}
+	if n := countIndex(); n != 0 {
+		t.Errorf("wrong number of index keys for a client: %d", n)
+	}
+
+	host.IsHost = true
+	host.LastSeen = time.Now().Add(-time.Hour)
+	if err := s.SetNode(host); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Prune(time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countIndex(); n != 0 {
+		t.Errorf("wrong number of index keys after pruning: %d", n)
+	}
+}
@@ -62,3 +62,25 @@ func loopItem(txn *badger.Txn, prefix []byte, into interface{}, callback func()
 	}
 	return nil
 }
+
+// loopItemKey is like loopItem, but it also passes the item's key to the
+// callback.
+func loopItemKey(txn *badger.Txn, prefix []byte, into interface{}, callback func(key []byte) error) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		if err := item.Value(func(val []byte) error {
+			p := reflect.ValueOf(into).Elem()
+			p.Set(reflect.Zero(p.Type()))
+
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(into)
+		}); err != nil {
+			return err
+		}
+		if err := callback(item.KeyCopy(nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// hostIndexPrefix is the prefix of the index of hosts by last seen bucket and
+// kind. Each host has one key in the index:
+//
+//	vip:idx:host:<bucket>:<kind>:<nodeID>
+//
+// Buckets are fixed-width hex so that they sort by time, which lets
+// ActiveHosts seek to the hosts that were seen recently instead of decoding
+// every node.
+const hostIndexPrefix = "vip:idx:host:"
+
+// hostIndexBucket is the duration of each last seen bucket.
+const hostIndexBucket = store.KeepaliveInterval
+
+func seenBucket(t time.Time) uint64 {
+	seconds := t.Unix()
+	if seconds < 0 {
+		return 0
+	}
+	return uint64(seconds / int64(hostIndexBucket/time.Second))
+}
+
+func hostIndexBucketPrefix(bucket uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x:", hostIndexPrefix, bucket))
+}
+
+// hostIndexKey returns the node's key in the host index, or nil if the node
+// is not a host.
+func hostIndexKey(n store.Node) []byte {
+	if !n.IsHost {
+		return nil
+	}
+	return []byte(fmt.Sprintf("%s%016x:%s:%s", hostIndexPrefix, seenBucket(n.LastSeen), n.Kind, n.ID))
+}
+
+// parseHostIndexKey returns the kind and node ID of a host index key.
+func parseHostIndexKey(key []byte) (kind string, nodeID store.NodeID) {
+	// Skip the prefix and bucket
+	rest := key[len(hostIndexBucketPrefix(0)):]
+	i := bytes.LastIndexByte(rest, ':')
+	if i < 0 {
+		return "", store.NodeID(rest)
+	}
+	return string(rest[:i]), store.NodeID(rest[i+1:])
+}
+
+// setNode saves the node and moves its host index key if it changed.
+func setNode(txn *badger.Txn, n store.Node) error {
+	nodeKey := []byte(fmt.Sprintf("vip:node:%s", n.ID))
+	indexKey := hostIndexKey(n)
+
+	var old store.Node
+	if err := getItem(txn, nodeKey, &old); err == nil {
+		if oldKey := hostIndexKey(old); oldKey != nil && !bytes.Equal(oldKey, indexKey) {
+			if err := txn.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	if indexKey != nil {
+		if err := txn.Set(indexKey, nil); err != nil {
+			return err
+		}
+	}
+	return setItem(txn, nodeKey, &n)
+}
+
+// indexHosts adds every host to the host index, used to migrate databases
+// that predate the index. It indexes at most limit nodes from the cursor.
+func indexHosts(txn *badger.Txn, cursor []byte, limit int) (next []byte, err error) {
+	prefix := []byte("vip:node:")
+	if cursor == nil {
+		cursor = prefix
+	}
+	keys, next := scanKeys(txn, prefix, cursor, limit)
+	for _, key := range keys {
+		var n store.Node
+		if err := getItem(txn, key, &n); err != nil {
+			return nil, err
+		}
+		if key := hostIndexKey(n); key != nil {
+			if err := txn.Set(key, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return next, nil
+}
@@ -11,6 +11,7 @@ import (
 func MigrateLatest(db *badger.DB, id string) error {
 	m := Migration{
 		Steps:         migrations[:],
+		Batches:       batchMigrations,
 		LatestVersion: dbVersion,
 		DatabaseID:    id,
 	}
@@ -22,6 +23,17 @@ func MigrateLatest(db *badger.DB, id string) error {
 // should update the database version with each step.
 type MigrationStep func(txn *badger.Txn) error
 
+// BatchStep is a migration step to the next version that's too big for a
+// single transaction. It's called in a new transaction for each batch, with
+// the key to resume from (nil for the first batch), and rewrites at most limit
+// records. It returns the key that the next batch resumes from, or nil once
+// it's done. The version is updated for it after the last batch.
+type BatchStep func(txn *badger.Txn, cursor []byte, limit int) (next []byte, err error)
+
+// migrationBatchSize is how many records a batched migration step rewrites
+// in one transaction to begin with.
+const migrationBatchSize = 1000
+
 // Migration handles transforming the database state to the newest version.
 type Migration struct {
 	// StartVersion is the minimum version that is supported by the migration.
@@ -30,6 +42,8 @@ type Migration struct {
 	LatestVersion int
 	// Steps are the migration steps for transforming the database state across versions when run in sequence.
 	Steps []MigrationStep
+	// Batches are the batched migration steps by the version they migrate from, which are run instead of Steps for that version.
+	Batches map[int]BatchStep
 	// DatabaseID is an identifier for the database being migrated (e.g. opts.Dir), used for more descriptive errors.
 	DatabaseID string
 }
@@ -43,47 +57,118 @@ func (m *Migration) error(cause error, version int) MigrationError {
 	}
 }
 
-// Migrate performs the migration sequence.
+// Migrate performs the migration sequence. Consecutive steps run in a
+// single transaction, so that if one fails the database is left at the
+// version it started from. Batched steps commit each batch instead, so if one
+// fails the database is left at the version before it with some of its
+// batches applied, and the step starts over from the beginning next time.
 func (m *Migration) Migrate(db *badger.DB) error {
-	// Attempt to migrate
-	return db.Update(func(txn *badger.Txn) error {
-		oldVersion, err := getVersion(txn)
-		if err != nil {
-			return m.error(err, oldVersion)
-		}
+	var oldVersion int
+	if err := db.View(func(txn *badger.Txn) error {
+		var err error
+		oldVersion, err = getVersion(txn)
+		return err
+	}); err != nil {
+		return m.error(err, oldVersion)
+	}
 
-		if oldVersion == m.LatestVersion {
-			// No need to migrate
-			return nil
-		}
+	if oldVersion == m.LatestVersion {
+		// No need to migrate
+		return nil
+	}
 
-		if m.LatestVersion < oldVersion {
-			return m.error(errors.New("database is newer than the supported version"), oldVersion)
-		}
+	if m.LatestVersion < oldVersion {
+		return m.error(errors.New("database is newer than the supported version"), oldVersion)
+	}
 
-		if m.StartVersion > oldVersion {
-			return m.error(errors.New("database version too old, migration is not supported"), oldVersion)
-		}
+	if m.StartVersion > oldVersion {
+		return m.error(errors.New("database version too old, migration is not supported"), oldVersion)
+	}
 
-		// Migration from oldVersion to m.LatestVersion
-		for v := oldVersion; v < m.LatestVersion; {
-			err := m.Steps[v-m.StartVersion](txn)
-			if err != nil {
+	// Migration from oldVersion to m.LatestVersion
+	for v := oldVersion; v < m.LatestVersion; {
+		if step, ok := m.Batches[v]; ok {
+			if err := runBatches(db, v, step); err != nil {
 				return m.error(err, v)
 			}
-			nextVersion, err := getVersion(txn)
-			if err != nil {
-				return m.error(err, v)
+			v++
+			continue
+		}
+
+		// Run the steps up to the next batched one in one transaction
+		if err := db.Update(func(txn *badger.Txn) error {
+			for v < m.LatestVersion {
+				if _, ok := m.Batches[v]; ok {
+					return nil
+				}
+				err := m.Steps[v-m.StartVersion](txn)
+				if err != nil {
+					return err
+				}
+				nextVersion, err := getVersion(txn)
+				if err != nil {
+					return err
+				}
+				if nextVersion <= v {
+					return errors.New("migration failed to increment version")
+				}
+				v = nextVersion
 			}
-			if nextVersion <= v {
-				err = errors.New("migration failed to increment version")
-				return m.error(err, v)
+			return nil
+		}); err != nil {
+			return m.error(err, v)
+		}
+	}
+
+	return nil
+}
+
+// runBatches calls step from version to the next one until it's done, each
+// batch in its own transaction. The limit is halved whenever a batch is too
+// big for a transaction.
+func runBatches(db *badger.DB, version int, step BatchStep) error {
+	limit := migrationBatchSize
+	var cursor []byte
+	for {
+		var next []byte
+		err := db.Update(func(txn *badger.Txn) error {
+			if err := checkVersion(txn, version); err != nil {
+				return err
 			}
-			v = nextVersion
+			var err error
+			next, err = step(txn, cursor, limit)
+			if err != nil || next != nil {
+				return err
+			}
+			return setVersion(txn, version+1)
+		})
+		if err == badger.ErrTxnTooBig && limit > 1 {
+			limit /= 2
+			continue
+		} else if err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
 		}
+		cursor = next
+	}
+}
 
-		return nil
-	})
+// scanKeys returns up to limit keys with the prefix, starting from the key
+// from, and the key that follows them, or nil if there are no more.
+func scanKeys(txn *badger.Txn, prefix []byte, from []byte, limit int) (keys [][]byte, next []byte) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(from); it.ValidForPrefix(prefix); it.Next() {
+		if len(keys) == limit {
+			return keys, it.Item().KeyCopy(nil)
+		}
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	return keys, nil
 }
 
 func checkVersion(txn *badger.Txn, assertVersion int) error {
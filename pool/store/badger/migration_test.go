@@ -1,9 +1,15 @@
 package badger
 
 import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/vipnode/vipnode/v2/pool/store"
 )
 
 func TestMigration(t *testing.T) {
@@ -39,7 +45,7 @@ func TestMigration(t *testing.T) {
 	}
 
 	if err = db.View(func(txn *badger.Txn) error {
-		if err := checkVersion(txn, 2); err != nil {
+		if err := checkVersion(txn, dbVersion); err != nil {
 			t.Error(err)
 		}
 		if hasKey(txn, testNonceKey) {
@@ -50,3 +56,297 @@ func TestMigration(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMigrationHostIndex(t *testing.T) {
+	s, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Hosts that were saved before the index existed
+	hosts := []store.Node{
+		{ID: "abcd", IsHost: true, Kind: "geth", LastSeen: time.Now()},
+		{ID: "efgh", IsHost: true, Kind: "parity", LastSeen: time.Now()},
+	}
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		if err := setVersion(txn, 2); err != nil {
+			return err
+		}
+		for _, n := range hosts {
+			if err := setItem(txn, []byte("vip:node:"+n.ID), &n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := s.ActiveHosts(store.HostQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 0 {
+		t.Errorf("unexpected hosts before migrating: %v", nodes)
+	}
+
+	if err := MigrateLatest(s.db, "testdb"); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := s.ActiveHosts(store.HostQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 2 {
+		t.Errorf("wrong hosts after migrating: %v", nodes)
+	}
+	if nodes, err := s.ActiveHosts(store.HostQuery{Kind: "parity"}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 1 || nodes[0].ID != "efgh" {
+		t.Errorf("wrong parity hosts after migrating: %v", nodes)
+	}
+}
+
+func TestMigrationNormalize(t *testing.T) {
+	for _, limit := range []int{migrationBatchSize, 1} {
+		limit := limit
+		t.Run(fmt.Sprintf("limit%d", limit), func(t *testing.T) {
+			s, err := OpenTemp()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			nodeID := store.NodeID(strings.Repeat("ab", 64))
+			peerID := store.NodeID(strings.Repeat("cd", 64))
+			account := store.Account("0x961Aa96FebeE5465149a0787B03bFa14D8e9033F")
+			now := time.Now()
+
+			// Duplicates that were saved before IDs and accounts were normalized
+			upperID := store.NodeID(strings.ToUpper(string(nodeID)))
+			enodeID := store.NodeID("enode://" + string(nodeID) + "@127.0.0.1:30303")
+			lowerAccount := store.Account(strings.ToLower(string(account)))
+			nodes := []store.Node{
+				{ID: nodeID, IsHost: true, Kind: "geth", LastSeen: now.Add(-time.Hour)},
+				{ID: upperID, IsHost: true, Kind: "geth", LastSeen: now, Payout: lowerAccount},
+				{ID: enodeID, IsHost: true, Kind: "geth", LastSeen: now.Add(-time.Minute)},
+				{ID: peerID, LastSeen: now},
+			}
+			if err := s.db.Update(func(txn *badger.Txn) error {
+				if err := setVersion(txn, 3); err != nil {
+					return err
+				}
+				for _, n := range nodes {
+					if err := setNode(txn, n); err != nil {
+						return err
+					}
+				}
+				peers := map[store.NodeID]time.Time{
+					store.NodeID(strings.ToUpper(string(peerID))): now,
+				}
+				if err := setItem(txn, []byte(fmt.Sprintf("vip:peers:%s", enodeID)), &peers); err != nil {
+					return err
+				}
+				if err := setItem(txn, []byte(fmt.Sprintf("vip:account:%s", upperID)), &lowerAccount); err != nil {
+					return err
+				}
+				balances := map[store.Account]int64{account: 5, lowerAccount: 10}
+				for a, credit := range balances {
+					b := store.Balance{Account: a}
+					b.Credit.SetInt64(credit)
+					if err := setItem(txn, []byte(fmt.Sprintf("vip:balance:%s", a)), &b); err != nil {
+						return err
+					}
+				}
+				trials := map[store.NodeID]int64{nodeID: 3, upperID: 4}
+				for id, credit := range trials {
+					var b store.Balance
+					b.Credit.SetInt64(credit)
+					if err := setItem(txn, []byte(fmt.Sprintf("vip:trial:%s", id)), &b); err != nil {
+						return err
+					}
+				}
+				trialStarts := map[store.NodeID]time.Time{nodeID: now, upperID: now.Add(-time.Hour)}
+				for id, started := range trialStarts {
+					if err := setItem(txn, []byte(fmt.Sprintf("vip:trialstart:%s", id)), &started); err != nil {
+						return err
+					}
+				}
+				nonces := map[string]int64{string(upperID): now.UnixNano(), string(lowerAccount): now.UnixNano()}
+				for ID, nonce := range nonces {
+					if err := setExpiringItem(txn, []byte(fmt.Sprintf("vip:nonce:%s", ID)), &nonce, store.ExpireNonce); err != nil {
+						return err
+					}
+				}
+				settlement := store.Settlement{Account: lowerAccount, Amount: big.NewInt(42), Time: now, Status: store.SettlementPending}
+				if err := setItem(txn, []byte(fmt.Sprintf("vip:settlement:%s:%020d", lowerAccount, now.UnixNano())), &settlement); err != nil {
+					return err
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			m := Migration{
+				Steps:         migrations[:],
+				Batches:       map[int]BatchStep{3: normalizeKeys},
+				StartVersion:  0,
+				LatestVersion: dbVersion,
+				DatabaseID:    "testdb",
+			}
+			if limit != migrationBatchSize {
+				// Resume from the cursor after every record
+				m.Batches[3] = func(txn *badger.Txn, cursor []byte, _ int) ([]byte, error) {
+					return normalizeKeys(txn, cursor, limit)
+				}
+			}
+			if err := m.Migrate(s.db); err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := s.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.NumTotalHosts != 1 || stats.NumTotalClients != 1 {
+				t.Errorf("wrong node counts after migrating: %+v", stats)
+			}
+
+			node, err := s.GetNode(nodeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !node.LastSeen.Equal(now) || node.Payout != account {
+				t.Errorf("wrong node after migrating: %+v", node)
+			}
+			if hosts, err := s.ActiveHosts(store.HostQuery{}); err != nil {
+				t.Fatal(err)
+			} else if len(hosts) != 1 || hosts[0].ID != nodeID {
+				t.Errorf("wrong hosts after migrating: %v", hosts)
+			}
+
+			if peers, err := s.NodePeers(nodeID); err != nil {
+				t.Fatal(err)
+			} else if len(peers) != 1 || peers[0].ID != peerID {
+				t.Errorf("wrong peers after migrating: %v", peers)
+			}
+
+			balance, err := s.GetNodeBalance(nodeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if balance.Account != account || balance.Credit.Cmp(big.NewInt(15)) != 0 {
+				t.Errorf("wrong balance after migrating: %s", &balance)
+			}
+
+			var trial store.Balance
+			if err := s.db.View(func(txn *badger.Txn) error {
+				return getItem(txn, []byte(fmt.Sprintf("vip:trial:%s", nodeID)), &trial)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if trial.Credit.Cmp(big.NewInt(7)) != 0 {
+				t.Errorf("wrong trial balance after migrating: %s", &trial.Credit)
+			}
+
+			if started, err := s.StartTrial(nodeID, now.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			} else if !started.Equal(now.Add(-time.Hour)) {
+				t.Errorf("wrong trial start after migrating: %s", started)
+			}
+
+			// Nonces that were used before migrating can't be replayed
+			for _, ID := range []string{string(nodeID), string(account)} {
+				if err := s.CheckAndSaveNonce(ID, now.UnixNano()); err != store.ErrInvalidNonce {
+					t.Errorf("nonce of %s was replayed after migrating: %v", ID, err)
+				}
+				if err := s.CheckAndSaveNonce(ID, now.UnixNano()+1); err != nil {
+					t.Errorf("newer nonce of %s failed after migrating: %s", ID, err)
+				}
+			}
+			if err := s.db.View(func(txn *badger.Txn) error {
+				item, err := txn.Get([]byte(fmt.Sprintf("vip:nonce:%s", nodeID)))
+				if err != nil {
+					return err
+				}
+				if item.ExpiresAt() == 0 {
+					t.Errorf("nonce lost its expiry after migrating")
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if settlements, err := s.GetSettlements(account); err != nil {
+				t.Fatal(err)
+			} else if len(settlements) != 1 || settlements[0].Account != account || settlements[0].Amount.Cmp(big.NewInt(42)) != 0 {
+				t.Errorf("wrong settlements after migrating: %+v", settlements)
+			}
+
+		})
+	}
+}
+
+func TestMigrationBatches(t *testing.T) {
+	s, err := OpenTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		if err := setVersion(txn, 2); err != nil {
+			return err
+		}
+		for i := 0; i < 5; i++ {
+			n := store.Node{ID: store.NodeID(fmt.Sprintf("host%d", i)), IsHost: true, LastSeen: time.Now()}
+			if err := setItem(txn, []byte("vip:node:"+n.ID), &n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first batch is too big, then the hosts are indexed two at a time,
+	// each batch in its own transaction and resuming where the last one
+	// stopped.
+	var limits []int
+	var cursors []string
+	m := Migration{
+		StartVersion:  2,
+		LatestVersion: 3,
+		Batches: map[int]BatchStep{
+			2: func(txn *badger.Txn, cursor []byte, limit int) ([]byte, error) {
+				limits = append(limits, limit)
+				if len(limits) == 1 {
+					return nil, badger.ErrTxnTooBig
+				}
+				cursors = append(cursors, string(cursor))
+				var indexed int
+				prefix := []byte(hostIndexPrefix)
+				it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+				for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+					indexed++
+				}
+				it.Close()
+				if want := 2 * (len(limits) - 2); indexed != want {
+					t.Errorf("previous batches were not committed: got %d indexed hosts; want %d", indexed, want)
+				}
+				return indexHosts(txn, cursor, 2)
+			},
+		},
+		DatabaseID: "testdb",
+	}
+	if err := m.Migrate(s.db); err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 4 || limits[0] != migrationBatchSize || limits[1] != migrationBatchSize/2 {
+		t.Errorf("wrong batches: %v", limits)
+	}
+	if want := []string{"", "vip:node:host2", "vip:node:host4"}; !reflect.DeepEqual(cursors, want) {
+		t.Errorf("wrong cursors: got %q; want %q", cursors, want)
+	}
+	if nodes, err := s.ActiveHosts(store.HostQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 5 {
+		t.Errorf("wrong hosts after migrating: %v", nodes)
+	}
+}
@@ -0,0 +1,384 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// normalNodeID returns the normalized form of id, or id itself if it can't be
+// parsed.
+func normalNodeID(id store.NodeID) store.NodeID {
+	if r, err := store.ParseNodeID(string(id)); err == nil {
+		return r
+	}
+	return id
+}
+
+// normalAccount returns the normalized form of account, or account itself if
+// it can't be parsed, such as internal accounts.
+func normalAccount(account store.Account) store.Account {
+	if r, err := store.ParseAccount(string(account)); err == nil {
+		return r
+	}
+	return account
+}
+
+// normalizeKeys rewrites the node IDs and accounts that were saved before
+// they were normalized, merging the records that turn out to be duplicates.
+// Malformed IDs are left as they are for the pruner to remove. Payment
+// channels are keyed by accounts that are recovered from signatures, so they
+// are already normalized.
+//
+// Each record is merged into the record of its normalized key as it's
+// visited, in the same transaction that deletes it, so that resuming from the
+// cursor never merges a duplicate twice. At most limit records are visited.
+func normalizeKeys(txn *badger.Txn, cursor []byte, limit int) (next []byte, err error) {
+	steps := []struct {
+		prefix    []byte
+		normalize func(txn *badger.Txn, key []byte) error
+	}{
+		{[]byte("vip:node:"), normalizeNode},
+		{[]byte("vip:peers:"), normalizePeers},
+		{[]byte("vip:account:"), normalizeAccountNode},
+		{[]byte("vip:trial:"), normalizeTrial},
+		{[]byte("vip:trialstart:"), normalizeTrialStart},
+		{[]byte("vip:balance:"), normalizeBalance},
+		{[]byte("vip:subscription:"), normalizeSubscription},
+		{[]byte("vip:settlement:"), normalizeSettlement},
+		{[]byte("vip:nonce:"), normalizeNonce},
+	}
+
+	// Skip to the step that the cursor is in
+	i := 0
+	if cursor != nil {
+		for i < len(steps) && !bytes.HasPrefix(cursor, steps[i].prefix) {
+			i++
+		}
+	} else {
+		cursor = steps[0].prefix
+	}
+
+	for ; i < len(steps); i++ {
+		if !bytes.HasPrefix(cursor, steps[i].prefix) {
+			cursor = steps[i].prefix
+		}
+		if limit <= 0 {
+			return cursor, nil
+		}
+		keys, next := scanKeys(txn, steps[i].prefix, cursor, limit)
+		for _, key := range keys {
+			if err := steps[i].normalize(txn, key); err != nil {
+				return nil, err
+			}
+		}
+		if next != nil {
+			return next, nil
+		}
+		limit -= len(keys)
+	}
+	return nil, nil
+}
+
+// getDuplicate decodes the record at key into `into` if there is one.
+func getDuplicate(txn *badger.Txn, key []byte, into interface{}) error {
+	if err := getItem(txn, key, into); err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// normalizeNode keeps the most recently seen node of each normalized ID.
+func normalizeNode(txn *badger.Txn, key []byte) error {
+	var n store.Node
+	if err := getItem(txn, key, &n); err != nil {
+		return err
+	}
+	id := normalNodeID(n.ID)
+	if id == n.ID && normalAccount(n.Payout) == n.Payout {
+		return nil
+	}
+	if id != n.ID {
+		if indexKey := hostIndexKey(n); indexKey != nil {
+			if err := txn.Delete(indexKey); err != nil {
+				return err
+			}
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		var r store.Node
+		if err := getItem(txn, []byte(fmt.Sprintf("vip:node:%s", id)), &r); err == nil {
+			if !n.LastSeen.After(r.LastSeen) {
+				n = r
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+	}
+	n.ID = id
+	n.Payout = normalAccount(n.Payout)
+	return setNode(txn, n)
+}
+
+// normalizePeers merges the peers of each normalized ID, keeping the latest
+// timestamp of each peer.
+func normalizePeers(txn *badger.Txn, key []byte) error {
+	var nodePeers map[store.NodeID]time.Time
+	if err := getItem(txn, key, &nodePeers); err != nil {
+		return err
+	}
+	nodeID := store.NodeID(key[len("vip:peers:"):])
+	id := normalNodeID(nodeID)
+	changed := id != nodeID
+	peers := map[store.NodeID]time.Time{}
+	if changed {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		if err := getDuplicate(txn, []byte(fmt.Sprintf("vip:peers:%s", id)), &peers); err != nil {
+			return err
+		}
+	}
+	for peerID, timestamp := range nodePeers {
+		normalPeerID := normalNodeID(peerID)
+		if normalPeerID != peerID {
+			changed = true
+		}
+		if timestamp.After(peers[normalPeerID]) {
+			peers[normalPeerID] = timestamp
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return setItem(txn, []byte(fmt.Sprintf("vip:peers:%s", id)), &peers)
+}
+
+// normalizeAccountNode normalizes the node and account of a spender. If a
+// node has duplicates, then the one that was already normalized is kept.
+func normalizeAccountNode(txn *badger.Txn, key []byte) error {
+	var account store.Account
+	if err := getItem(txn, key, &account); err != nil {
+		return err
+	}
+	nodeID := store.NodeID(key[len("vip:account:"):])
+	id := normalNodeID(nodeID)
+	normalKey := []byte(fmt.Sprintf("vip:account:%s", id))
+	if id != nodeID {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		if hasKey(txn, normalKey) {
+			return nil
+		}
+	} else if normalAccount(account) == account {
+		return nil
+	}
+	account = normalAccount(account)
+	return setItem(txn, normalKey, &account)
+}
+
+// normalizeTrial adds up the trial balances of each normalized ID.
+func normalizeTrial(txn *badger.Txn, key []byte) error {
+	nodeID := store.NodeID(key[len("vip:trial:"):])
+	id := normalNodeID(nodeID)
+	if id == nodeID {
+		return nil
+	}
+	var balance, merged store.Balance
+	if err := getItem(txn, key, &balance); err != nil {
+		return err
+	}
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	normalKey := []byte(fmt.Sprintf("vip:trial:%s", id))
+	if err := getDuplicate(txn, normalKey, &merged); err != nil {
+		return err
+	}
+	mergeBalance(&merged, &balance)
+	return setItem(txn, normalKey, &merged)
+}
+
+// normalizeTrialStart keeps the earliest trial start of each normalized ID,
+// so that renaming a node doesn't restart its trial.
+func normalizeTrialStart(txn *badger.Txn, key []byte) error {
+	nodeID := store.NodeID(key[len("vip:trialstart:"):])
+	id := normalNodeID(nodeID)
+	if id == nodeID {
+		return nil
+	}
+	var started time.Time
+	if err := getItem(txn, key, &started); err != nil {
+		return err
+	}
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	normalKey := []byte(fmt.Sprintf("vip:trialstart:%s", id))
+	var r time.Time
+	if err := getItem(txn, normalKey, &r); err == nil {
+		if r.Before(started) {
+			return nil
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	return setItem(txn, normalKey, &started)
+}
+
+// normalizeBalance adds up the balances of each normalized account.
+func normalizeBalance(txn *badger.Txn, key []byte) error {
+	var balance store.Balance
+	if err := getItem(txn, key, &balance); err != nil {
+		return err
+	}
+	account := store.Account(key[len("vip:balance:"):])
+	normal := normalAccount(account)
+	if normal == account && (balance.Account == "" || balance.Account == normal) {
+		return nil
+	}
+	normalKey := []byte(fmt.Sprintf("vip:balance:%s", normal))
+	var merged store.Balance
+	if normal != account {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		if err := getDuplicate(txn, normalKey, &merged); err != nil {
+			return err
+		}
+	}
+	mergeBalance(&merged, &balance)
+	merged.Account = normal
+	return setItem(txn, normalKey, &merged)
+}
+
+// mergeBalance adds b into the balance, keeping the latest withdraw and
+// unlock times.
+func mergeBalance(into *store.Balance, b *store.Balance) {
+	if into.Account == "" {
+		into.Account = b.Account
+	}
+	into.Credit.Add(&into.Credit, &b.Credit)
+	into.Deposit.Add(&into.Deposit, &b.Deposit)
+	into.Locked.Add(&into.Locked, &b.Locked)
+	if b.NextWithdraw.After(into.NextWithdraw) {
+		into.NextWithdraw = b.NextWithdraw
+	}
+	if b.Unlocks.After(into.Unlocks) {
+		into.Unlocks = b.Unlocks
+	}
+}
+
+// normalizeSubscription keeps the subscription of each normalized account
+// that expires last.
+func normalizeSubscription(txn *badger.Txn, key []byte) error {
+	account := store.Account(key[len("vip:subscription:"):])
+	normal := normalAccount(account)
+	if normal == account {
+		return nil
+	}
+	var subscription store.Subscription
+	if err := getItem(txn, key, &subscription); err != nil {
+		return err
+	}
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	normalKey := []byte(fmt.Sprintf("vip:subscription:%s", normal))
+	var r store.Subscription
+	if err := getItem(txn, normalKey, &r); err == nil {
+		if !subscription.Expires.After(r.Expires) {
+			return nil
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	subscription.Account = normal
+	return setItem(txn, normalKey, &subscription)
+}
+
+// normalizeSettlement moves a settlement, which pool_withdrawals lists, to
+// the normalized account's key. They are unique by time so nothing needs
+// merging.
+func normalizeSettlement(txn *badger.Txn, key []byte) error {
+	// Keys are vip:settlement:<account>:<time>
+	rest := string(key[len("vip:settlement:"):])
+	i := strings.LastIndexByte(rest, ':')
+	if i < 0 {
+		return nil
+	}
+	var settlement store.Settlement
+	if err := getItem(txn, key, &settlement); err != nil {
+		return err
+	}
+	account := store.Account(rest[:i])
+	normal := normalAccount(account)
+	if normal == account && settlement.Account == normal {
+		return nil
+	}
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	settlement.Account = normal
+	normalKey := []byte(fmt.Sprintf("vip:settlement:%s:%020d", settlement.Account, settlement.Time.UnixNano()))
+	return setItem(txn, normalKey, &settlement)
+}
+
+// normalizeNonce keeps the highest nonce of each normalized node ID or
+// account, so that replay checks still cover the requests that were signed
+// with a non-normalized ID. The latest expiry of the duplicates is kept.
+func normalizeNonce(txn *badger.Txn, key []byte) error {
+	// Nonces are kept by node ID for nodes, and by account for wallets
+	ID := string(key[len("vip:nonce:"):])
+	normal := string(normalNodeID(store.NodeID(ID)))
+	if normal == ID {
+		normal = string(normalAccount(store.Account(ID)))
+	}
+	if normal == ID {
+		return nil
+	}
+	nonce, expiresAt, err := getNonce(txn, key)
+	if err != nil {
+		return err
+	}
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	normalKey := []byte(fmt.Sprintf("vip:nonce:%s", normal))
+	if r, rExpiresAt, err := getNonce(txn, normalKey); err == nil {
+		if r > nonce {
+			nonce = r
+		}
+		if expiresAt != 0 && (rExpiresAt == 0 || rExpiresAt > expiresAt) {
+			expiresAt = rExpiresAt
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(nonce); err != nil {
+		return err
+	}
+	entry := badger.NewEntry(normalKey, buf.Bytes())
+	entry.ExpiresAt = expiresAt
+	return txn.SetEntry(entry)
+}
+
+// getNonce returns the nonce at key and when it expires.
+func getNonce(txn *badger.Txn, key []byte) (nonce int64, expiresAt uint64, err error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = item.Value(func(val []byte) error {
+		return gob.NewDecoder(bytes.NewReader(val)).Decode(&nonce)
+	})
+	return nonce, item.ExpiresAt(), err
+}
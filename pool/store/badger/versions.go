@@ -4,7 +4,7 @@ import (
 	"github.com/dgraph-io/badger/v2"
 )
 
-const dbVersion = 2
+const dbVersion = 4
 
 var migrations = [dbVersion]MigrationStep{
 	// Version 0 -> 1
@@ -31,4 +31,20 @@ var migrations = [dbVersion]MigrationStep{
 
 		return setVersion(txn, 2)
 	},
+
+	// Version 2 -> 3 is batched
+	nil,
+
+	// Version 3 -> 4 is batched
+	nil,
+}
+
+// batchMigrations are the migration steps that are too big for a single
+// transaction, by the version they migrate from.
+var batchMigrations = map[int]BatchStep{
+	// Version 2 -> 3 (added the host index)
+	2: indexHosts,
+
+	// Version 3 -> 4 (normalized node IDs and accounts)
+	3: normalizeKeys,
 }
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+// DumpVersion is the version of the dump format that Export writes.
+const DumpVersion = 1
+
+// RecordKind is the type of state in a dump Record.
+type RecordKind string
+
+const (
+	RecordHeader       RecordKind = "header"
+	RecordNode         RecordKind = "node"
+	RecordPeer         RecordKind = "peer"
+	RecordAccountNode  RecordKind = "account_node"
+	RecordBalance      RecordKind = "balance"
+	RecordTrial        RecordKind = "trial"
+	RecordTrialStart   RecordKind = "trial_start"
+	RecordNonce        RecordKind = "nonce"
+	RecordSubscription RecordKind = "subscription"
+	RecordSettlement   RecordKind = "settlement"
+	RecordChannel      RecordKind = "channel"
+	RecordCheckpoint   RecordKind = "checkpoint"
+)
+
+// Record is one piece of a store's state in a dump. Only the field that
+// matches the Kind is set.
+type Record struct {
+	Kind RecordKind `json:"kind"`
+
+	Header       *DumpHeader   `json:"header,omitempty"`
+	Node         *Node         `json:"node,omitempty"`
+	Peer         *PeerLink     `json:"peer,omitempty"`
+	AccountNode  *AccountNode  `json:"account_node,omitempty"`
+	Balance      *Balance      `json:"balance,omitempty"`
+	Trial        *TrialBalance `json:"trial,omitempty"`
+	TrialStart   *TrialStart   `json:"trial_start,omitempty"`
+	Nonce        *Nonce        `json:"nonce,omitempty"`
+	Subscription *Subscription `json:"subscription,omitempty"`
+	Settlement   *Settlement   `json:"settlement,omitempty"`
+	Channel      *Channel      `json:"channel,omitempty"`
+	Checkpoint   *Checkpoint   `json:"checkpoint,omitempty"`
+}
+
+// DumpHeader is the first record of a dump.
+type DumpHeader struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// PeerLink is a peer that a node reported, with the peer's LastSeen when it
+// was reported.
+type PeerLink struct {
+	NodeID   NodeID    `json:"node_id"`
+	PeerID   NodeID    `json:"peer_id"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// AccountNode is a node that is authorized to spend an account's balance.
+type AccountNode struct {
+	Account Account `json:"account"`
+	NodeID  NodeID  `json:"node_id"`
+}
+
+// TrialBalance is the credit of a node that has no account.
+type TrialBalance struct {
+	NodeID NodeID   `json:"node_id"`
+	Credit *big.Int `json:"credit"`
+}
+
+// TrialStart is when a node's trial started.
+type TrialStart struct {
+	NodeID  NodeID    `json:"node_id"`
+	Started time.Time `json:"started"`
+}
+
+// Nonce is the latest nonce seen for an ID.
+type Nonce struct {
+	ID    string `json:"id"`
+	Nonce int64  `json:"nonce"`
+}
+
+// Checkpoint is the last block number processed by a named process.
+type Checkpoint struct {
+	Name        string `json:"name"`
+	BlockNumber uint64 `json:"block_number"`
+}
+
+// ErrMalformedRecord is returned when loading a record that is missing the
+// field of its kind, or has an unknown kind.
+var ErrMalformedRecord = errors.New("malformed dump record")
+
+// DumpStore streams the complete state of a store, for backups and for
+// moving state between storage drivers.
+type DumpStore interface {
+	// Dump calls fn with every record of the store's state, stopping at the
+	// first error. Nodes are dumped before the records that refer to them.
+	Dump(fn func(Record) error) error
+	// Load saves a dumped record as-is, replacing any existing state with the
+	// same key. Records that refer to nodes must be loaded after the nodes.
+	Load(record Record) error
+}
+
+// Export writes a header and then every record of the store to w, one JSON
+// record per line. It returns the number of records written, excluding the
+// header.
+func Export(w io.Writer, s DumpStore) (int, error) {
+	enc := json.NewEncoder(w)
+	header := Record{
+		Kind: RecordHeader,
+		Header: &DumpHeader{
+			Version: DumpVersion,
+			Created: time.Now().UTC(),
+		},
+	}
+	if err := enc.Encode(header); err != nil {
+		return 0, err
+	}
+	n := 0
+	err := s.Dump(func(record Record) error {
+		n += 1
+		return enc.Encode(record)
+	})
+	return n, err
+}
+
+// Import loads the records that were written by Export from r into s. It
+// returns the number of records loaded, excluding the header.
+func Import(r io.Reader, s DumpStore) (int, error) {
+	dec := json.NewDecoder(r)
+	var header Record
+	if err := dec.Decode(&header); err == io.EOF {
+		return 0, errors.New("empty dump")
+	} else if err != nil {
+		return 0, err
+	}
+	if header.Kind != RecordHeader || header.Header == nil {
+		return 0, errors.New("dump is missing a header")
+	}
+	if header.Header.Version != DumpVersion {
+		return 0, fmt.Errorf("unsupported dump version: %d", header.Header.Version)
+	}
+	n := 0
+	for {
+		var record Record
+		if err := dec.Decode(&record); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if err := s.Load(record); err != nil {
+			return n, fmt.Errorf("failed to load %s record: %s", record.Kind, err)
+		}
+		n += 1
+	}
+}
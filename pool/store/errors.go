@@ -13,3 +13,16 @@ var ErrMalformedNode = errors.New("malformed node")
 
 // ErrNotAuthorized is returned when a node is not an authorized spender of an account's balance.
 var ErrNotAuthorized = errors.New("node is not an authorized spender")
+
+// ErrNoSubscription is returned when an account does not have a subscription.
+var ErrNoSubscription = errors.New("account does not have a subscription")
+
+// ErrNoChannel is returned when an account does not have a payment channel.
+var ErrNoChannel = errors.New("account does not have a payment channel")
+
+// ErrInvalidNodeID is returned when a node ID is not a hex-encoded public key.
+var ErrInvalidNodeID = errors.New("invalid node ID, must be a 128-character hex public key")
+
+// ErrInvalidAccount is returned when an account is not a hex address, or it
+// has mixed case that fails the checksum.
+var ErrInvalidAccount = errors.New("invalid account, must be a checksummed hex address")
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// HostOrder is the order of the hosts that ActiveHosts returns.
+type HostOrder string
+
+const (
+	// OrderRandom shuffles the hosts, to spread the clients across them.
+	OrderRandom HostOrder = ""
+	// OrderLastSeen returns the most recently seen hosts first.
+	OrderLastSeen HostOrder = "last_seen"
+	// OrderBlockNumber returns the hosts with the highest block number first.
+	OrderBlockNumber HostOrder = "block_number"
+	// OrderLoad returns the hosts with the fewest peers first.
+	OrderLoad HostOrder = "load"
+	// OrderPrice returns the cheapest hosts first, and the hosts without a
+	// price last.
+	OrderPrice HostOrder = "price"
+)
+
+// HostQuery selects the active hosts that ActiveHosts returns. The zero value
+// matches every active host in random order.
+type HostQuery struct {
+	// Kind is the node kind of the hosts, such as "geth". (Optional)
+	Kind string
+	// Network is the network ID of the hosts, such as 1 for mainnet. Hosts
+	// that didn't report their network match any network, such as hosts that
+	// connected with vipnode_host. (Optional)
+	Network int
+	// MinBlockNumber is the minimum block number that the hosts reported.
+	MinBlockNumber uint64
+	// Capabilities that the hosts must all have. (Optional)
+	Capabilities []string
+	// Labels that the hosts must all have with the same value. (Optional)
+	Labels map[string]string
+	// Exclude skips these nodes, such as the requesting node and the hosts it
+	// is already connected to.
+	Exclude []NodeID
+	// MaxLoad is the maximum number of peers that the hosts can have, or 0
+	// for no maximum.
+	MaxLoad int
+	// Order of the returned hosts. (Default: OrderRandom)
+	Order HostOrder
+	// Limit is the maximum number of hosts to return, or 0 for all of them.
+	Limit int
+}
+
+// Match returns true if n is a host that matches the query, ignoring the
+// activity and load of the host which are up to the store to check.
+func (q *HostQuery) Match(n Node) bool {
+	if !n.IsHost {
+		return false
+	}
+	if q.Kind != "" && n.Kind != q.Kind {
+		return false
+	}
+	if q.Network != 0 && n.Network != 0 && n.Network != q.Network {
+		return false
+	}
+	if n.BlockNumber < q.MinBlockNumber {
+		return false
+	}
+	for _, id := range q.Exclude {
+		if id == n.ID {
+			return false
+		}
+	}
+	for _, capability := range q.Capabilities {
+		if !n.HasCapability(capability) {
+			return false
+		}
+	}
+	for key, value := range q.Labels {
+		if v, ok := n.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// NeedsLoad returns true if the query depends on the number of peers of each
+// host, so the store should count them.
+func (q *HostQuery) NeedsLoad() bool {
+	return q.MaxLoad > 0 || q.Order == OrderLoad
+}
+
+// MatchLoad returns true if a host with the number of peers is within the
+// query's MaxLoad.
+func (q *HostQuery) MatchLoad(numPeers int) bool {
+	return q.MaxLoad <= 0 || numPeers <= q.MaxLoad
+}
+
+// Sort orders the matched hosts and truncates them to the query's Limit.
+// loads are the number of peers of each host, which are only required if
+// NeedsLoad is true.
+func (q *HostQuery) Sort(hosts []Node, loads map[NodeID]int) []Node {
+	switch q.Order {
+	case OrderLastSeen:
+		sort.SliceStable(hosts, func(i, j int) bool {
+			return hosts[i].LastSeen.After(hosts[j].LastSeen)
+		})
+	case OrderBlockNumber:
+		sort.SliceStable(hosts, func(i, j int) bool {
+			return hosts[i].BlockNumber > hosts[j].BlockNumber
+		})
+	case OrderLoad:
+		sort.SliceStable(hosts, func(i, j int) bool {
+			return loads[hosts[i].ID] < loads[hosts[j].ID]
+		})
+	case OrderPrice:
+		sort.SliceStable(hosts, func(i, j int) bool {
+			a, b := hosts[i].Price, hosts[j].Price
+			if a == nil || b == nil {
+				return a != nil && b == nil
+			}
+			return a.Cmp(b) < 0
+		})
+	default:
+		if q.Limit <= 0 || len(hosts) <= q.Limit {
+			// Skip shuffle since it's a subset
+			return hosts
+		}
+		rand.Shuffle(len(hosts), func(i, j int) {
+			hosts[i], hosts[j] = hosts[j], hosts[i]
+		})
+	}
+	if q.Limit > 0 && len(hosts) > q.Limit {
+		return hosts[:q.Limit]
+	}
+	return hosts
+}
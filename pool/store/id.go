@@ -0,0 +1,66 @@
+package store
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// nodeIDLen is the length of a hex-encoded node ID, which is the node's
+// uncompressed secp256k1 public key without the 0x04 prefix.
+const nodeIDLen = 128
+
+// Account is a wallet address. Accounts from RPC requests are normalized with
+// ParseAccount into their checksummed form, such that each wallet has one
+// key in the store.
+type Account string
+
+// NodeID is the hex-encoded public key of a node. Node IDs from RPC requests
+// are normalized with ParseNodeID into lowercase hex, such that each node has
+// one key in the store.
+type NodeID string
+
+func (id NodeID) IsZero() bool {
+	return id == ""
+}
+
+func (id NodeID) String() string {
+	return string(id)
+}
+
+// ParseNodeID validates and normalizes a node ID. It accepts an enode URI,
+// which is reduced to its node ID.
+func ParseNodeID(s string) (NodeID, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "enode://") {
+		s = s[len("enode://"):]
+		if i := strings.IndexByte(s, '@'); i >= 0 {
+			s = s[:i]
+		}
+	}
+	s = strings.TrimPrefix(s, "0x")
+	if len(s) != nodeIDLen {
+		return "", ErrInvalidNodeID
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", ErrInvalidNodeID
+	}
+	return NodeID(strings.ToLower(s)), nil
+}
+
+// ParseAccount validates and normalizes a hex wallet address into its
+// checksummed form. All-lowercase and all-uppercase addresses are accepted,
+// but mixed-case addresses must already have a valid checksum.
+func ParseAccount(s string) (Account, error) {
+	s = strings.TrimSpace(s)
+	if !common.IsHexAddress(s) {
+		return "", ErrInvalidAccount
+	}
+	addr := common.HexToAddress(s).Hex()
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && digits != addr[2:] {
+		return "", ErrInvalidAccount
+	}
+	return Account(addr), nil
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNodeID(t *testing.T) {
+	id := strings.Repeat("ab", 64)
+	testcases := []struct {
+		input string
+		want  NodeID
+		err   error
+	}{
+		{id, NodeID(id), nil},
+		{strings.ToUpper(id), NodeID(id), nil},
+		{"0x" + id, NodeID(id), nil},
+		{"enode://" + id, NodeID(id), nil},
+		{"enode://" + id + "@127.0.0.1:30303", NodeID(id), nil},
+		{"", "", ErrInvalidNodeID},
+		{"abcd", "", ErrInvalidNodeID},
+		{id + "ab", "", ErrInvalidNodeID},
+		{strings.Repeat("zz", 64), "", ErrInvalidNodeID},
+	}
+	for _, tc := range testcases {
+		got, err := ParseNodeID(tc.input)
+		if err != tc.err {
+			t.Errorf("ParseNodeID(%q): got error %v; want %v", tc.input, err, tc.err)
+		}
+		if got != tc.want {
+			t.Errorf("ParseNodeID(%q): got %q; want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestParseAccount(t *testing.T) {
+	account := "0x961Aa96FebeE5465149a0787B03bFa14D8e9033F"
+	testcases := []struct {
+		input string
+		want  Account
+		err   error
+	}{
+		{account, Account(account), nil},
+		{strings.ToLower(account), Account(account), nil},
+		{"0x" + strings.ToUpper(account[2:]), Account(account), nil},
+		{"0x961aa96febeE5465149a0787B03bFa14D8e9033F", "", ErrInvalidAccount},
+		{"", "", ErrInvalidAccount},
+		{"0x1234", "", ErrInvalidAccount},
+		{"vipnode:subscriptions", "", ErrInvalidAccount},
+	}
+	for _, tc := range testcases {
+		got, err := ParseAccount(tc.input)
+		if err != tc.err {
+			t.Errorf("ParseAccount(%q): got error %v; want %v", tc.input, err, tc.err)
+		}
+		if got != tc.want {
+			t.Errorf("ParseAccount(%q): got %q; want %q", tc.input, got, tc.want)
+		}
+	}
+}
@@ -17,6 +17,13 @@ func New() *memoryStore {
 		accounts: map[store.NodeID]store.Account{},
 		trials:   map[store.NodeID]store.Balance{},
 		nonces:   map[string]int64{},
+
+		trialStarts: map[store.NodeID]time.Time{},
+
+		subscriptions: map[store.Account]store.Subscription{},
+		settlements:   map[store.Account][]store.Settlement{},
+		channels:      map[store.Account]store.Channel{},
+		checkpoints:   map[string]uint64{},
 	}
 }
 
@@ -44,7 +51,22 @@ type memoryStore struct {
 	// Trial balances to be migrated once registered
 	trials map[store.NodeID]store.Balance
 
+	// Trial start times
+	trialStarts map[store.NodeID]time.Time
+
 	nonces map[string]int64
+
+	// Prepaid account subscriptions
+	subscriptions map[store.Account]store.Subscription
+
+	// Settlement records
+	settlements map[store.Account][]store.Settlement
+
+	// Payment channels
+	channels map[store.Account]store.Channel
+
+	// Chain scanning progress
+	checkpoints map[string]uint64
 }
 
 // CheckAndSaveNonce asserts that this is the highest nonce seen for this NodeID.
@@ -108,6 +130,19 @@ func (s *memoryStore) AddNodeBalance(nodeID store.NodeID, credit *big.Int) error
 	return nil
 }
 
+// StartTrial returns when the node's trial started, starting it at now if it
+// hasn't started yet.
+func (s *memoryStore) StartTrial(nodeID store.NodeID, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started, ok := s.trialStarts[nodeID]
+	if !ok {
+		started = now
+		s.trialStarts[nodeID] = started
+	}
+	return started, nil
+}
+
 // GetAccountBalance returns an account's balance.
 func (s *memoryStore) GetAccountBalance(account store.Account) (store.Balance, error) {
 	s.mu.Lock()
@@ -122,6 +157,7 @@ func (s *memoryStore) AddAccountBalance(account store.Account, credit *big.Int)
 
 	balance := s.balances[account]
 	balance.Credit.Add(&balance.Credit, credit)
+	balance.Account = account
 	s.balances[account] = balance
 	return nil
 }
@@ -149,6 +185,38 @@ func (s *memoryStore) AddAccountNode(account store.Account, nodeID store.NodeID)
 	return nil
 }
 
+// RemoveAccountNode de-authorizes a nodeID from spending an account's
+// balance. If moveShare is set, then the node's share of the account's credit
+// is moved back to the node's trial balance.
+func (s *memoryStore) RemoveAccountNode(account store.Account, nodeID store.NodeID, moveShare bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodeAccount, ok := s.accounts[nodeID]
+	if !ok || nodeAccount != account {
+		return store.ErrNotAuthorized
+	}
+
+	if moveShare {
+		numNodes := 0
+		for _, a := range s.accounts {
+			if a == account {
+				numNodes++
+			}
+		}
+		balance := s.balances[account]
+		share := store.NodeShare(&balance.Credit, numNodes)
+		balance.Credit.Sub(&balance.Credit, share)
+		s.balances[account] = balance
+
+		trialBalance := s.trials[nodeID]
+		trialBalance.Credit.Add(&trialBalance.Credit, share)
+		s.trials[nodeID] = trialBalance
+	}
+	delete(s.accounts, nodeID)
+	return nil
+}
+
 // AddAccountNode authorizes a nodeID to be a spender of an account's
 // balance.
 func (s *memoryStore) IsAccountNode(account store.Account, nodeID store.NodeID) error {
@@ -177,6 +245,121 @@ func (s *memoryStore) GetAccountNodes(account store.Account) ([]store.NodeID, er
 	return r, nil
 }
 
+// GetAccountBalances returns the balances of all registered accounts.
+func (s *memoryStore) GetAccountBalances() ([]store.Balance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := make([]store.Balance, 0, len(s.balances))
+	for _, balance := range s.balances {
+		r = append(r, balance)
+	}
+	return r, nil
+}
+
+// SetSettlement saves a settlement.
+func (s *memoryStore) SetSettlement(settlement store.Settlement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settlements := s.settlements[settlement.Account]
+	for i := range settlements {
+		if settlements[i].Time.Equal(settlement.Time) {
+			settlements[i] = settlement
+			return nil
+		}
+	}
+	s.settlements[settlement.Account] = append(settlements, settlement)
+	return nil
+}
+
+// GetSettlements returns the account's settlements, oldest first.
+func (s *memoryStore) GetSettlements(account store.Account) ([]store.Settlement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := make([]store.Settlement, len(s.settlements[account]))
+	copy(r, s.settlements[account])
+	return r, nil
+}
+
+// GetPendingSettlements returns the settlements that are not done yet.
+func (s *memoryStore) GetPendingSettlements() ([]store.Settlement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := []store.Settlement{}
+	for _, settlements := range s.settlements {
+		for _, settlement := range settlements {
+			if !settlement.IsDone() {
+				r = append(r, settlement)
+			}
+		}
+	}
+	return r, nil
+}
+
+// GetChannel returns the account's payment channel.
+func (s *memoryStore) GetChannel(account store.Account) (*store.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channel, ok := s.channels[account]
+	if !ok {
+		return nil, store.ErrNoChannel
+	}
+	return &channel, nil
+}
+
+// SetChannel saves an account's payment channel.
+func (s *memoryStore) SetChannel(channel store.Channel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[channel.Account] = channel
+	return nil
+}
+
+// GetChannels returns the payment channels of all accounts.
+func (s *memoryStore) GetChannels() ([]store.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := make([]store.Channel, 0, len(s.channels))
+	for _, channel := range s.channels {
+		r = append(r, channel)
+	}
+	return r, nil
+}
+
+// GetCheckpoint returns the last block number processed by the named process.
+func (s *memoryStore) GetCheckpoint(name string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[name], nil
+}
+
+// SetCheckpoint saves the last block number processed by the named process.
+func (s *memoryStore) SetCheckpoint(name string, blockNumber uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[name] = blockNumber
+	return nil
+}
+
+// GetSubscription returns the account's subscription.
+func (s *memoryStore) GetSubscription(account store.Account) (*store.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription, ok := s.subscriptions[account]
+	if !ok {
+		return nil, store.ErrNoSubscription
+	}
+	return &subscription, nil
+}
+
+// SetSubscription saves an account's subscription.
+func (s *memoryStore) SetSubscription(subscription store.Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[subscription.Account] = subscription
+	return nil
+}
+
 // GetNode returns the node with the given ID.
 func (s *memoryStore) GetNode(id store.NodeID) (*store.Node, error) {
 	s.mu.Lock()
@@ -211,27 +394,38 @@ func (s *memoryStore) RemoveNode(nodeID store.NodeID) error {
 	return nil
 }
 
-// ActiveHosts returns `limit`-number of `kind` nodes. This could be an
-// empty list, if none are available.
-func (s *memoryStore) ActiveHosts(kind string, limit int) ([]store.Node, error) {
+// ActiveHosts returns the hosts that were seen recently and match the
+// query. This could be an empty list, if none are available.
+func (s *memoryStore) ActiveHosts(query store.HostQuery) ([]store.Node, error) {
 	seenSince := time.Now().Add(-store.ExpireInterval)
+	limit := query.Limit
+	if query.Order != store.OrderRandom {
+		// Every match is needed to sort them
+		limit = 0
+	}
 	r := make([]store.Node, 0, limit)
+	var loads map[store.NodeID]int
+	if query.NeedsLoad() {
+		loads = map[store.NodeID]int{}
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// TODO: Do something other than random, such as by availability?
 	for _, n := range s.nodes {
 		// Ranging over a map is implicitly random, so
 		// results are shuffled as is desireable.
-		if !n.IsHost {
-			continue
-		}
-		if kind != "" && n.Kind != kind {
+		if !query.Match(n.Node) {
 			continue
 		}
 		if !n.LastSeen.After(seenSince) {
 			continue
 		}
+		if loads != nil {
+			if !query.MatchLoad(len(n.peers)) {
+				continue
+			}
+			loads[n.ID] = len(n.peers)
+		}
 		r = append(r, n.Node)
 		limit -= 1
 		if limit == 0 {
@@ -240,7 +434,7 @@ func (s *memoryStore) ActiveHosts(kind string, limit int) ([]store.Node, error)
 			break
 		}
 	}
-	return r, nil
+	return query.Sort(r, loads), nil
 }
 
 // NodePeers returns a list of active connected peers that this pool knows
@@ -282,11 +476,7 @@ func (s *memoryStore) UpdateNodePeers(nodeID store.NodeID, peers []string, block
 	for _, peer := range peers {
 		// Only update peers we already know about
 		// FIXME: If symmetric peers disappear at the same time, then reappear, will it be a problem if they never become inactive? (Okay if the balance manager caps the update interval?)
-		peerID, err := store.ParseNodeID(peer)
-		if err != nil {
-			// Skip bad peers
-			continue
-		}
+		peerID := store.NodeID(peer)
 		if peer, ok := s.nodes[peerID]; ok {
 			node.peers[peerID] = peer.LastSeen
 		}
@@ -327,3 +517,160 @@ func (s *memoryStore) Stats() (*store.Stats, error) {
 func (s *memoryStore) Close() error {
 	return nil
 }
+
+// Dump calls fn with every record of the store's state.
+func (s *memoryStore) Dump(fn func(store.Record) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, node := range s.nodes {
+		n := node.Node
+		if err := fn(store.Record{Kind: store.RecordNode, Node: &n}); err != nil {
+			return err
+		}
+	}
+	for nodeID, node := range s.nodes {
+		for peerID, lastSeen := range node.peers {
+			if err := fn(store.Record{Kind: store.RecordPeer, Peer: &store.PeerLink{NodeID: nodeID, PeerID: peerID, LastSeen: lastSeen}}); err != nil {
+				return err
+			}
+		}
+	}
+	for nodeID, account := range s.accounts {
+		if err := fn(store.Record{Kind: store.RecordAccountNode, AccountNode: &store.AccountNode{Account: account, NodeID: nodeID}}); err != nil {
+			return err
+		}
+	}
+	for _, balance := range s.balances {
+		b := balance
+		if err := fn(store.Record{Kind: store.RecordBalance, Balance: &b}); err != nil {
+			return err
+		}
+	}
+	for nodeID, balance := range s.trials {
+		credit := new(big.Int).Set(&balance.Credit)
+		if err := fn(store.Record{Kind: store.RecordTrial, Trial: &store.TrialBalance{NodeID: nodeID, Credit: credit}}); err != nil {
+			return err
+		}
+	}
+	for nodeID, started := range s.trialStarts {
+		if err := fn(store.Record{Kind: store.RecordTrialStart, TrialStart: &store.TrialStart{NodeID: nodeID, Started: started}}); err != nil {
+			return err
+		}
+	}
+	for id, nonce := range s.nonces {
+		if err := fn(store.Record{Kind: store.RecordNonce, Nonce: &store.Nonce{ID: id, Nonce: nonce}}); err != nil {
+			return err
+		}
+	}
+	for _, subscription := range s.subscriptions {
+		sub := subscription
+		if err := fn(store.Record{Kind: store.RecordSubscription, Subscription: &sub}); err != nil {
+			return err
+		}
+	}
+	for _, settlements := range s.settlements {
+		for i := range settlements {
+			settlement := settlements[i]
+			if err := fn(store.Record{Kind: store.RecordSettlement, Settlement: &settlement}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, channel := range s.channels {
+		c := channel
+		if err := fn(store.Record{Kind: store.RecordChannel, Channel: &c}); err != nil {
+			return err
+		}
+	}
+	for name, blockNumber := range s.checkpoints {
+		if err := fn(store.Record{Kind: store.RecordCheckpoint, Checkpoint: &store.Checkpoint{Name: name, BlockNumber: blockNumber}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load saves a dumped record, replacing any existing state with the same key.
+func (s *memoryStore) Load(record store.Record) error {
+	switch {
+	case record.Kind == store.RecordSubscription && record.Subscription != nil:
+		return s.SetSubscription(*record.Subscription)
+	case record.Kind == store.RecordSettlement && record.Settlement != nil:
+		return s.SetSettlement(*record.Settlement)
+	case record.Kind == store.RecordChannel && record.Channel != nil:
+		return s.SetChannel(*record.Channel)
+	case record.Kind == store.RecordCheckpoint && record.Checkpoint != nil:
+		return s.SetCheckpoint(record.Checkpoint.Name, record.Checkpoint.BlockNumber)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case record.Kind == store.RecordNode && record.Node != nil:
+		if record.Node.ID.IsZero() {
+			return store.ErrMalformedNode
+		}
+		node := memNode{Node: *record.Node, peers: map[store.NodeID]time.Time{}}
+		if existing, ok := s.nodes[node.ID]; ok {
+			node.peers = existing.peers
+		}
+		s.nodes[node.ID] = node
+	case record.Kind == store.RecordPeer && record.Peer != nil:
+		node, ok := s.nodes[record.Peer.NodeID]
+		if !ok {
+			return store.ErrUnregisteredNode
+		}
+		node.peers[record.Peer.PeerID] = record.Peer.LastSeen
+	case record.Kind == store.RecordAccountNode && record.AccountNode != nil:
+		s.accounts[record.AccountNode.NodeID] = record.AccountNode.Account
+	case record.Kind == store.RecordBalance && record.Balance != nil:
+		s.balances[record.Balance.Account] = *record.Balance
+	case record.Kind == store.RecordTrial && record.Trial != nil && record.Trial.Credit != nil:
+		var balance store.Balance
+		balance.Credit.Set(record.Trial.Credit)
+		s.trials[record.Trial.NodeID] = balance
+	case record.Kind == store.RecordTrialStart && record.TrialStart != nil:
+		s.trialStarts[record.TrialStart.NodeID] = record.TrialStart.Started
+	case record.Kind == store.RecordNonce && record.Nonce != nil:
+		s.nonces[record.Nonce.ID] = record.Nonce.Nonce
+	default:
+		return store.ErrMalformedRecord
+	}
+	return nil
+}
+
+// Prune removes stale nodes, dangling peers, and empty trial balances.
+func (s *memoryStore) Prune(seenBefore time.Time) (store.PruneStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var r store.PruneStats
+	for nodeID, node := range s.nodes {
+		if node.LastSeen.Before(seenBefore) {
+			delete(s.nodes, nodeID)
+			r.Nodes += 1
+			r.Peers += len(node.peers)
+		}
+	}
+	for _, node := range s.nodes {
+		for peerID := range node.peers {
+			if _, ok := s.nodes[peerID]; !ok {
+				delete(node.peers, peerID)
+				r.Peers += 1
+			}
+		}
+	}
+	for nodeID, balance := range s.trials {
+		if balance.Credit.Sign() == 0 {
+			delete(s.trials, nodeID)
+			r.Trials += 1
+		}
+	}
+	for nodeID := range s.trialStarts {
+		if _, ok := s.nodes[nodeID]; !ok {
+			delete(s.trialStarts, nodeID)
+		}
+	}
+	return r, nil
+}
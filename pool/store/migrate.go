@@ -0,0 +1,141 @@
+package store
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/vipnode/vipnode/v2/internal/pretty"
+)
+
+// Copy loads every record of src into dst, such as to move a pool's state to
+// another storage driver. The destination should be empty, and must not be
+// the same store as the source. It returns the number of records copied.
+func Copy(dst DumpStore, src DumpStore) (int, error) {
+	n := 0
+	err := src.Dump(func(record Record) error {
+		if err := dst.Load(record); err != nil {
+			return fmt.Errorf("failed to load %s record: %s", record.Kind, err)
+		}
+		n += 1
+		return nil
+	})
+	return n, err
+}
+
+// VerifyError is returned by Verify with the differences between two stores.
+type VerifyError []string
+
+func (err VerifyError) Error() string {
+	return fmt.Sprintf("stores differ: %s", strings.Join(err, "; "))
+}
+
+// Verify compares the node counts, account balance totals, and node balances
+// of two stores, such as after a Copy. It returns a VerifyError listing the
+// differences, if any.
+func Verify(a Store, b Store) error {
+	var diff VerifyError
+
+	nodesA, err := dumpNodes(a)
+	if err != nil {
+		return err
+	}
+	nodesB, err := dumpNodes(b)
+	if err != nil {
+		return err
+	}
+	if len(nodesA) != len(nodesB) {
+		diff = append(diff, fmt.Sprintf("node count %d != %d", len(nodesA), len(nodesB)))
+	}
+
+	statsA, err := a.Stats()
+	if err != nil {
+		return err
+	}
+	statsB, err := b.Stats()
+	if err != nil {
+		return err
+	}
+	if statsA.NumTotalHosts != statsB.NumTotalHosts {
+		diff = append(diff, fmt.Sprintf("host count %d != %d", statsA.NumTotalHosts, statsB.NumTotalHosts))
+	}
+	if statsA.NumTotalClients != statsB.NumTotalClients {
+		diff = append(diff, fmt.Sprintf("client count %d != %d", statsA.NumTotalClients, statsB.NumTotalClients))
+	}
+	if statsA.NumTrialBalances != statsB.NumTrialBalances {
+		diff = append(diff, fmt.Sprintf("trial balance count %d != %d", statsA.NumTrialBalances, statsB.NumTrialBalances))
+	}
+
+	totalsA, err := accountTotals(a)
+	if err != nil {
+		return err
+	}
+	totalsB, err := accountTotals(b)
+	if err != nil {
+		return err
+	}
+	accounts := make([]string, 0, len(totalsA))
+	for account := range totalsA {
+		accounts = append(accounts, string(account))
+	}
+	for account := range totalsB {
+		if _, ok := totalsA[account]; !ok {
+			accounts = append(accounts, string(account))
+		}
+	}
+	sort.Strings(accounts)
+	for _, account := range accounts {
+		totalA, totalB := totalsA[Account(account)], totalsB[Account(account)]
+		if totalA == nil || totalB == nil || totalA.Cmp(totalB) != 0 {
+			diff = append(diff, fmt.Sprintf("account %q balance %s != %s", account, totalA, totalB))
+		}
+	}
+
+	for _, node := range nodesA {
+		balanceA, err := a.GetNodeBalance(node.ID)
+		if err != nil {
+			return err
+		}
+		balanceB, err := b.GetNodeBalance(node.ID)
+		if err == ErrUnregisteredNode {
+			diff = append(diff, fmt.Sprintf("node %s is missing", pretty.Abbrev(string(node.ID))))
+			continue
+		} else if err != nil {
+			return err
+		}
+		if balanceA.Account != balanceB.Account || balanceA.Credit.Cmp(&balanceB.Credit) != 0 {
+			diff = append(diff, fmt.Sprintf("node %s balance %s != %s", pretty.Abbrev(string(node.ID)), &balanceA, &balanceB))
+		}
+	}
+
+	if len(diff) > 0 {
+		return diff
+	}
+	return nil
+}
+
+// accountTotals returns the credit and deposit total of each account balance.
+func accountTotals(s Store) (map[Account]*big.Int, error) {
+	balances, err := s.GetAccountBalances()
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[Account]*big.Int, len(balances))
+	for _, b := range balances {
+		r[b.Account] = new(big.Int).Add(&b.Credit, &b.Deposit)
+	}
+	return r, nil
+}
+
+// dumpNodes returns all of the store's nodes.
+func dumpNodes(s DumpStore) ([]Node, error) {
+	var r []Node
+	err := s.Dump(func(record Record) error {
+		if record.Kind == RecordNode && record.Node != nil {
+			r = append(r, *record.Node)
+		}
+		return nil
+	})
+	return r, err
+}
@@ -0,0 +1,215 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// eachRow runs query and calls fn with each of the resulting rows.
+func eachRow(q queryer, fn func(row scanner) error, query string, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Dump calls fn with every record of the store's state.
+func (s *sqlStore) Dump(fn func(store.Record) error) error {
+	// Dump from a single transaction, so that the records are consistent.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := eachRow(tx, func(row scanner) error {
+		n, err := scanNode(row)
+		if err != nil {
+			return err
+		}
+		return fn(store.Record{Kind: store.RecordNode, Node: &n})
+	}, `SELECT `+nodeColumns+` FROM nodes n ORDER BY n.id`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		var nodeID, peerID string
+		var lastSeen time.Time
+		if err := row.Scan(&nodeID, &peerID, &lastSeen); err != nil {
+			return err
+		}
+		return fn(store.Record{Kind: store.RecordPeer, Peer: &store.PeerLink{
+			NodeID:   store.NodeID(nodeID),
+			PeerID:   store.NodeID(peerID),
+			LastSeen: lastSeen,
+		}})
+	}, `SELECT node_id, peer_id, last_seen FROM peers ORDER BY node_id, peer_id`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		var account, nodeID string
+		if err := row.Scan(&account, &nodeID); err != nil {
+			return err
+		}
+		return fn(store.Record{Kind: store.RecordAccountNode, AccountNode: &store.AccountNode{
+			Account: store.Account(account),
+			NodeID:  store.NodeID(nodeID),
+		}})
+	}, `SELECT account, node_id FROM account_nodes ORDER BY account, node_id`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		balance, err := scanBalance(row)
+		if err != nil {
+			return err
+		}
+		return fn(store.Record{Kind: store.RecordBalance, Balance: &balance})
+	}, `SELECT `+balanceColumns+` FROM balances ORDER BY account`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		var nodeID string
+		var credit sql.NullString
+		if err := row.Scan(&nodeID, &credit); err != nil {
+			return err
+		}
+		amount, err := parseNullBig(credit)
+		if err != nil {
+			return err
+		}
+		return fn(store.Record{Kind: store.RecordTrial, Trial: &store.TrialBalance{
+			NodeID: store.NodeID(nodeID),
+			Credit: amount,
+		}})
+	}, `SELECT node_id, credit FROM trials ORDER BY node_id`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		var r store.TrialStart
+		var nodeID string
+		if err := row.Scan(&nodeID, &r.Started); err != nil {
+			return err
+		}
+		r.NodeID = store.NodeID(nodeID)
+		return fn(store.Record{Kind: store.RecordTrialStart, TrialStart: &r})
+	}, `SELECT node_id, started FROM trial_starts ORDER BY node_id`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		var r store.Nonce
+		if err := row.Scan(&r.ID, &r.Nonce); err != nil {
+			return err
+		}
+		return fn(store.Record{Kind: store.RecordNonce, Nonce: &r})
+	}, `SELECT id, nonce FROM nonces ORDER BY id`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		var r store.Subscription
+		var account string
+		if err := row.Scan(&account, &r.Plan, &r.MaxHosts, &r.Expires, &r.Renew); err != nil {
+			return err
+		}
+		r.Account = store.Account(account)
+		return fn(store.Record{Kind: store.RecordSubscription, Subscription: &r})
+	}, `SELECT account, plan, max_hosts, expires, renew FROM subscriptions ORDER BY account`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		r, err := scanSettlement(row)
+		if err != nil {
+			return err
+		}
+		return fn(store.Record{Kind: store.RecordSettlement, Settlement: &r})
+	}, `SELECT `+settlementColumns+` FROM settlements ORDER BY account, time`); err != nil {
+		return err
+	}
+
+	if err := eachRow(tx, func(row scanner) error {
+		r, err := scanChannel(row)
+		if err != nil {
+			return err
+		}
+		return fn(store.Record{Kind: store.RecordChannel, Channel: &r})
+	}, `SELECT `+channelColumns+` FROM channels ORDER BY account`); err != nil {
+		return err
+	}
+
+	return eachRow(tx, func(row scanner) error {
+		var r store.Checkpoint
+		var blockNumber int64
+		if err := row.Scan(&r.Name, &blockNumber); err != nil {
+			return err
+		}
+		r.BlockNumber = uint64(blockNumber)
+		return fn(store.Record{Kind: store.RecordCheckpoint, Checkpoint: &r})
+	}, `SELECT name, block_number FROM checkpoints ORDER BY name`)
+}
+
+// Load saves a dumped record, replacing any existing state with the same key.
+func (s *sqlStore) Load(record store.Record) error {
+	switch {
+	case record.Kind == store.RecordNode && record.Node != nil:
+		return s.SetNode(*record.Node)
+	case record.Kind == store.RecordSubscription && record.Subscription != nil:
+		return s.SetSubscription(*record.Subscription)
+	case record.Kind == store.RecordSettlement && record.Settlement != nil:
+		return s.SetSettlement(*record.Settlement)
+	case record.Kind == store.RecordChannel && record.Channel != nil:
+		return s.SetChannel(*record.Channel)
+	case record.Kind == store.RecordCheckpoint && record.Checkpoint != nil:
+		return s.SetCheckpoint(record.Checkpoint.Name, record.Checkpoint.BlockNumber)
+	}
+
+	return s.update(func(tx *sql.Tx) error {
+		var err error
+		switch {
+		case record.Kind == store.RecordPeer && record.Peer != nil:
+			if ok, err := hasNode(tx, record.Peer.NodeID); err != nil {
+				return err
+			} else if !ok {
+				return store.ErrUnregisteredNode
+			}
+			_, err = tx.Exec(`INSERT INTO peers (node_id, peer_id, last_seen) VALUES ($1, $2, $3)
+				ON CONFLICT (node_id, peer_id) DO UPDATE SET last_seen = excluded.last_seen`,
+				string(record.Peer.NodeID), string(record.Peer.PeerID), utc(record.Peer.LastSeen))
+		case record.Kind == store.RecordAccountNode && record.AccountNode != nil:
+			_, err = tx.Exec(`INSERT INTO account_nodes (node_id, account) VALUES ($1, $2)
+				ON CONFLICT (node_id) DO UPDATE SET account = excluded.account`,
+				string(record.AccountNode.NodeID), string(record.AccountNode.Account))
+		case record.Kind == store.RecordBalance && record.Balance != nil:
+			err = setBalance(tx, *record.Balance)
+		case record.Kind == store.RecordTrial && record.Trial != nil && record.Trial.Credit != nil:
+			var balance store.Balance
+			balance.Credit.Set(record.Trial.Credit)
+			err = setTrial(tx, record.Trial.NodeID, balance)
+		case record.Kind == store.RecordTrialStart && record.TrialStart != nil:
+			_, err = tx.Exec(`INSERT INTO trial_starts (node_id, started) VALUES ($1, $2)
+				ON CONFLICT (node_id) DO UPDATE SET started = excluded.started`,
+				string(record.TrialStart.NodeID), utc(record.TrialStart.Started))
+		case record.Kind == store.RecordNonce && record.Nonce != nil:
+			_, err = tx.Exec(`INSERT INTO nonces (id, nonce) VALUES ($1, $2)
+				ON CONFLICT (id) DO UPDATE SET nonce = excluded.nonce`,
+				record.Nonce.ID, record.Nonce.Nonce)
+		default:
+			err = store.ErrMalformedRecord
+		}
+		return err
+	})
+}
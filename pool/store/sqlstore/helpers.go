@@ -0,0 +1,65 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// nullBigText returns the decimal text of n, or NULL if n is nil.
+func nullBigText(n *big.Int) sql.NullString {
+	if n == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: n.String(), Valid: true}
+}
+
+// parseBig sets into from the decimal text of an amount column.
+func parseBig(into *big.Int, text string) error {
+	if _, ok := into.SetString(text, 10); !ok {
+		return fmt.Errorf("invalid amount in database: %q", text)
+	}
+	return nil
+}
+
+// parseNullBig returns the amount from the decimal text of a nullable amount
+// column, or nil if it's NULL.
+func parseNullBig(text sql.NullString) (*big.Int, error) {
+	if !text.Valid {
+		return nil, nil
+	}
+	r := new(big.Int)
+	if err := parseBig(r, text.String); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// utc normalizes timestamps before they're stored, so that they compare
+// correctly in the database.
+func utc(t time.Time) time.Time {
+	return t.UTC()
+}
+
+// execCount runs a statement and returns the number of rows it affected.
+func execCount(q queryer, query string, args ...interface{}) (int, error) {
+	res, err := q.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,189 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const dbVersion = 5
+
+// migrations are the statements that transform the schema from each version
+// to the next. The statements should be portable between SQLite and
+// Postgres, so amounts in wei are stored as decimal TEXT (SQLite's NUMERIC
+// loses precision above 64 bits) and timestamps are stored in UTC.
+var migrations = [dbVersion][]string{
+	// Version 0 -> 1
+	{
+		`CREATE TABLE nonces (
+			id TEXT PRIMARY KEY,
+			nonce BIGINT NOT NULL
+		)`,
+		`CREATE TABLE nodes (
+			id TEXT PRIMARY KEY,
+			uri TEXT NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			kind TEXT NOT NULL,
+			is_host BOOLEAN NOT NULL,
+			payout TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			price TEXT,
+			node_version TEXT NOT NULL,
+			vipnode_version TEXT NOT NULL
+		)`,
+		`CREATE INDEX nodes_host_last_seen ON nodes (is_host, last_seen)`,
+		`CREATE TABLE peers (
+			node_id TEXT NOT NULL,
+			peer_id TEXT NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			PRIMARY KEY (node_id, peer_id)
+		)`,
+		`CREATE TABLE balances (
+			account TEXT PRIMARY KEY,
+			credit TEXT NOT NULL,
+			deposit TEXT NOT NULL,
+			next_withdraw TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE trials (
+			node_id TEXT PRIMARY KEY,
+			credit TEXT NOT NULL
+		)`,
+		`CREATE TABLE account_nodes (
+			node_id TEXT PRIMARY KEY,
+			account TEXT NOT NULL
+		)`,
+		`CREATE INDEX account_nodes_account ON account_nodes (account)`,
+		`CREATE TABLE subscriptions (
+			account TEXT PRIMARY KEY,
+			plan TEXT NOT NULL,
+			max_hosts INTEGER NOT NULL,
+			expires TIMESTAMP NOT NULL,
+			renew BOOLEAN NOT NULL
+		)`,
+		`CREATE TABLE settlements (
+			account TEXT NOT NULL,
+			time TIMESTAMP NOT NULL,
+			amount TEXT,
+			tx_id TEXT NOT NULL,
+			credit TEXT,
+			new_balance TEXT,
+			status TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			nonce BIGINT NOT NULL,
+			gas_price TEXT,
+			replaced_tx_ids TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			updated TIMESTAMP NOT NULL,
+			PRIMARY KEY (account, time)
+		)`,
+		`CREATE INDEX settlements_status ON settlements (status)`,
+		`CREATE TABLE channels (
+			account TEXT PRIMARY KEY,
+			amount TEXT,
+			nonce BIGINT NOT NULL,
+			sig TEXT NOT NULL,
+			claimed TEXT,
+			updated TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE checkpoints (
+			name TEXT PRIMARY KEY,
+			block_number BIGINT NOT NULL
+		)`,
+	},
+	// Version 1 -> 2 (added node attributes for host queries)
+	{
+		`ALTER TABLE nodes ADD COLUMN network INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE nodes ADD COLUMN capabilities TEXT NOT NULL DEFAULT '[]'`,
+		`ALTER TABLE nodes ADD COLUMN labels TEXT NOT NULL DEFAULT '{}'`,
+	},
+	// Version 2 -> 3 (added trial start times)
+	{
+		`CREATE TABLE trial_starts (
+			node_id TEXT PRIMARY KEY,
+			started TIMESTAMP NOT NULL
+		)`,
+	},
+	// Version 3 -> 4 (added payment channel claims to settlements)
+	{
+		`ALTER TABLE settlements ADD COLUMN claimed TEXT`,
+	},
+	// Version 4 -> 5 (added timelocked deposits to balances)
+	{
+		`ALTER TABLE balances ADD COLUMN locked TEXT NOT NULL DEFAULT '0'`,
+		`ALTER TABLE balances ADD COLUMN unlocks TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00'`,
+	},
+}
+
+// MigrateLatest converts the database to the latest schema version that we
+// know of. Each version's statements run in their own transaction.
+func MigrateLatest(db *sql.DB, id string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS vip_version (version INTEGER NOT NULL)`); err != nil {
+		return MigrationError{Path: id, NewVersion: dbVersion, Cause: err}
+	}
+	version, err := getVersion(db)
+	if err != nil {
+		return MigrationError{Path: id, NewVersion: dbVersion, Cause: err}
+	}
+	if version > dbVersion {
+		return MigrationError{
+			OldVersion: version,
+			NewVersion: dbVersion,
+			Path:       id,
+			Cause:      errors.New("database is newer than the supported version"),
+		}
+	}
+	for v := version; v < dbVersion; v++ {
+		if err := migrate(db, v); err != nil {
+			return MigrationError{OldVersion: v, NewVersion: dbVersion, Path: id, Cause: err}
+		}
+	}
+	return nil
+}
+
+// migrate runs the migration from version to version+1.
+func migrate(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range migrations[version] {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if err := setVersion(tx, version+1); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func getVersion(db queryer) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT version FROM vip_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+func setVersion(db queryer, version int) error {
+	if _, err := db.Exec(`DELETE FROM vip_version`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO vip_version (version) VALUES ($1)`, version)
+	return err
+}
+
+// MigrationError is returned when the database is opened with an outdated
+// version and migation fails.
+type MigrationError struct {
+	OldVersion int
+	NewVersion int
+	Path       string
+	Cause      error
+}
+
+func (err MigrationError) Error() string {
+	return fmt.Sprintf("sql database migration error: Failed to migrate from version %d to %d at path %q: %s", err.OldVersion, err.NewVersion, err.Path, err.Cause)
+}
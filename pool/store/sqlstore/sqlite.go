@@ -0,0 +1,32 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"net/url"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// OpenSQLite returns a store.Store implementation backed by the SQLite
+// database file at path, which is created if it doesn't exist. Use ":memory:"
+// for a temporary database.
+func OpenSQLite(path string) (*sqlStore, error) {
+	dsn := path
+	if path != ":memory:" {
+		// Wait on locks instead of failing, and allow reads during writes.
+		dsn = "file:" + (&url.URL{Path: path}).EscapedPath() + "?_busy_timeout=5000&_journal_mode=WAL"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer, and each connection to ":memory:" is a
+	// separate database.
+	db.SetMaxOpenConns(1)
+	s, err := open(db, path)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
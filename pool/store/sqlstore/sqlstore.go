@@ -0,0 +1,886 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+)
+
+// Open returns a store.Store implementation using a database/sql driver, and
+// migrates the database to the latest schema. The schema is portable between
+// SQLite and Postgres. The store should be (*sqlStore).Close()'d after use.
+func Open(driverName string, dataSourceName string) (*sqlStore, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	s, err := open(db, dataSourceName)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func open(db *sql.DB, id string) (*sqlStore, error) {
+	if err := MigrateLatest(db, id); err != nil {
+		return nil, err
+	}
+	return &sqlStore{
+		db:          db,
+		nonceExpire: store.ExpireNonce,
+	}, nil
+}
+
+var _ store.Store = &sqlStore{}
+
+type sqlStore struct {
+	db *sql.DB
+
+	// mu serializes write transactions, so that read-modify-write updates of
+	// balances are consistent without relying on driver-specific row locks.
+	mu sync.Mutex
+
+	nonceExpire time.Duration
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// update runs fn in a write transaction, which is committed if fn succeeds.
+func (s *sqlStore) update(fn func(tx *sql.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func hasNode(q queryer, nodeID store.NodeID) (bool, error) {
+	var n int
+	err := q.QueryRow(`SELECT 1 FROM nodes WHERE id = $1`, string(nodeID)).Scan(&n)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) CheckAndSaveNonce(ID string, nonce int64) error {
+	// If nonceExpire is set, nonce should be within nonceExpire of now.
+	if s.nonceExpire > 0 {
+		if nonce <= time.Now().Add(-s.nonceExpire).UnixNano() {
+			// Nonce is too old
+			return store.ErrInvalidNonce
+		}
+	}
+	return s.update(func(tx *sql.Tx) error {
+		var lastNonce int64
+		if err := tx.QueryRow(`SELECT nonce FROM nonces WHERE id = $1`, ID).Scan(&lastNonce); err == nil {
+			if lastNonce >= nonce {
+				return store.ErrInvalidNonce
+			}
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO nonces (id, nonce) VALUES ($1, $2)
+			ON CONFLICT (id) DO UPDATE SET nonce = excluded.nonce`, ID, nonce)
+		return err
+	})
+}
+
+// nodeAccount returns the account that nodeID is authorized to spend, or ""
+// if it has none.
+func nodeAccount(q queryer, nodeID store.NodeID) (store.Account, error) {
+	var account string
+	err := q.QueryRow(`SELECT account FROM account_nodes WHERE node_id = $1`, string(nodeID)).Scan(&account)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return store.Account(account), err
+}
+
+const balanceColumns = `account, credit, deposit, next_withdraw, locked, unlocks`
+
+func scanBalance(row scanner) (store.Balance, error) {
+	var r store.Balance
+	var account, credit, deposit, locked string
+	if err := row.Scan(&account, &credit, &deposit, &r.NextWithdraw, &locked, &r.Unlocks); err != nil {
+		return r, err
+	}
+	r.Account = store.Account(account)
+	if err := parseBig(&r.Credit, credit); err != nil {
+		return r, err
+	}
+	if err := parseBig(&r.Locked, locked); err != nil {
+		return r, err
+	}
+	return r, parseBig(&r.Deposit, deposit)
+}
+
+// getBalance returns the account's balance, or an empty balance if it has
+// none.
+func getBalance(q queryer, account store.Account) (store.Balance, error) {
+	r, err := scanBalance(q.QueryRow(`SELECT `+balanceColumns+` FROM balances WHERE account = $1`, string(account)))
+	if err == sql.ErrNoRows {
+		return store.Balance{}, nil
+	}
+	return r, err
+}
+
+func setBalance(q queryer, balance store.Balance) error {
+	_, err := q.Exec(`INSERT INTO balances (`+balanceColumns+`) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (account) DO UPDATE SET credit = excluded.credit, deposit = excluded.deposit, next_withdraw = excluded.next_withdraw,
+			locked = excluded.locked, unlocks = excluded.unlocks`,
+		string(balance.Account), balance.Credit.String(), balance.Deposit.String(), utc(balance.NextWithdraw),
+		balance.Locked.String(), utc(balance.Unlocks))
+	return err
+}
+
+// getTrial returns the node's trial balance, or an empty balance if it has
+// none.
+func getTrial(q queryer, nodeID store.NodeID) (store.Balance, error) {
+	var r store.Balance
+	var credit string
+	err := q.QueryRow(`SELECT credit FROM trials WHERE node_id = $1`, string(nodeID)).Scan(&credit)
+	if err == sql.ErrNoRows {
+		return r, nil
+	} else if err != nil {
+		return r, err
+	}
+	return r, parseBig(&r.Credit, credit)
+}
+
+func setTrial(q queryer, nodeID store.NodeID, balance store.Balance) error {
+	_, err := q.Exec(`INSERT INTO trials (node_id, credit) VALUES ($1, $2)
+		ON CONFLICT (node_id) DO UPDATE SET credit = excluded.credit`,
+		string(nodeID), balance.Credit.String())
+	return err
+}
+
+// GetNodeBalance returns the current account balance for a node.
+func (s *sqlStore) GetNodeBalance(nodeID store.NodeID) (store.Balance, error) {
+	if ok, err := hasNode(s.db, nodeID); err != nil {
+		return store.Balance{}, err
+	} else if !ok {
+		return store.Balance{}, store.ErrUnregisteredNode
+	}
+	account, err := nodeAccount(s.db, nodeID)
+	if err != nil {
+		return store.Balance{}, err
+	}
+	if account == "" {
+		// No spendable account, use the trial account
+		return getTrial(s.db, nodeID)
+	}
+	return getBalance(s.db, account)
+}
+
+// AddNodeBalance adds some credit amount to a node's account balance. (Can be negative)
+// If only a node is provided which doesn't have an account registered to
+// it, it should retain a balance, such as through temporary trial accounts
+// that get migrated later.
+func (s *sqlStore) AddNodeBalance(nodeID store.NodeID, credit *big.Int) error {
+	return s.update(func(tx *sql.Tx) error {
+		if ok, err := hasNode(tx, nodeID); err != nil {
+			return err
+		} else if !ok {
+			return store.ErrUnregisteredNode
+		}
+		account, err := nodeAccount(tx, nodeID)
+		if err != nil {
+			return err
+		}
+		if account == "" {
+			balance, err := getTrial(tx, nodeID)
+			if err != nil {
+				return err
+			}
+			balance.Credit.Add(&balance.Credit, credit)
+			return setTrial(tx, nodeID, balance)
+		}
+		balance, err := getBalance(tx, account)
+		if err != nil {
+			return err
+		}
+		balance.Credit.Add(&balance.Credit, credit)
+		balance.Account = account
+		return setBalance(tx, balance)
+	})
+}
+
+// StartTrial returns when the node's trial started, starting it at now if it
+// hasn't started yet.
+func (s *sqlStore) StartTrial(nodeID store.NodeID, now time.Time) (time.Time, error) {
+	var started time.Time
+	err := s.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO trial_starts (node_id, started) VALUES ($1, $2)
+			ON CONFLICT (node_id) DO NOTHING`, string(nodeID), utc(now)); err != nil {
+			return err
+		}
+		return tx.QueryRow(`SELECT started FROM trial_starts WHERE node_id = $1`, string(nodeID)).Scan(&started)
+	})
+	return started, err
+}
+
+// GetAccountBalance returns an account's balance.
+func (s *sqlStore) GetAccountBalance(account store.Account) (store.Balance, error) {
+	return getBalance(s.db, account)
+}
+
+// AddAccountBalance adds credit to an account balance. (Can be negative)
+func (s *sqlStore) AddAccountBalance(account store.Account, credit *big.Int) error {
+	return s.update(func(tx *sql.Tx) error {
+		balance, err := getBalance(tx, account)
+		if err != nil {
+			return err
+		}
+		balance.Credit.Add(&balance.Credit, credit)
+		balance.Account = account
+		return setBalance(tx, balance)
+	})
+}
+
+// AddAccountNode authorizes a nodeID to be a spender of an account's
+// balance. This should migrate any existing node's balance credit to the
+// account.
+func (s *sqlStore) AddAccountNode(account store.Account, nodeID store.NodeID) error {
+	return s.update(func(tx *sql.Tx) error {
+		if ok, err := hasNode(tx, nodeID); err != nil {
+			return err
+		} else if !ok {
+			return store.ErrUnregisteredNode
+		}
+
+		trialBalance, err := getTrial(tx, nodeID)
+		if err != nil {
+			return err
+		}
+		balance, err := getBalance(tx, account)
+		if err != nil {
+			return err
+		}
+
+		// Authorize node
+		if _, err := tx.Exec(`INSERT INTO account_nodes (node_id, account) VALUES ($1, $2)
+			ON CONFLICT (node_id) DO UPDATE SET account = excluded.account`,
+			string(nodeID), string(account)); err != nil {
+			return err
+		}
+
+		// Merge trial and save
+		balance.Credit.Add(&balance.Credit, &trialBalance.Credit)
+		balance.Account = account
+		if err := setBalance(tx, balance); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM trials WHERE node_id = $1`, string(nodeID))
+		return err
+	})
+}
+
+// RemoveAccountNode de-authorizes a nodeID from spending an account's
+// balance. If moveShare is set, then the node's share of the account's credit
+// is moved back to the node's trial balance.
+func (s *sqlStore) RemoveAccountNode(account store.Account, nodeID store.NodeID, moveShare bool) error {
+	return s.update(func(tx *sql.Tx) error {
+		if got, err := nodeAccount(tx, nodeID); err != nil {
+			return err
+		} else if got == "" || got != account {
+			return store.ErrNotAuthorized
+		}
+
+		if moveShare {
+			var numNodes int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM account_nodes WHERE account = $1`, string(account)).Scan(&numNodes); err != nil {
+				return err
+			}
+			balance, err := getBalance(tx, account)
+			if err != nil {
+				return err
+			}
+			trialBalance, err := getTrial(tx, nodeID)
+			if err != nil {
+				return err
+			}
+
+			share := store.NodeShare(&balance.Credit, numNodes)
+			balance.Credit.Sub(&balance.Credit, share)
+			balance.Account = account
+			trialBalance.Credit.Add(&trialBalance.Credit, share)
+			if err := setBalance(tx, balance); err != nil {
+				return err
+			}
+			if err := setTrial(tx, nodeID, trialBalance); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`DELETE FROM account_nodes WHERE node_id = $1`, string(nodeID))
+		return err
+	})
+}
+
+// IsAccountNode returns nil if node is a valid spender of the given
+// account.
+func (s *sqlStore) IsAccountNode(account store.Account, nodeID store.NodeID) error {
+	got, err := nodeAccount(s.db, nodeID)
+	if err != nil {
+		return err
+	}
+	if got == "" || got != account {
+		return store.ErrNotAuthorized
+	}
+	return nil
+}
+
+// GetAccountNodes returns the authorized nodeIDs for this account, these are
+// nodes that were added to accounts through AddAccountNode.
+func (s *sqlStore) GetAccountNodes(account store.Account) ([]store.NodeID, error) {
+	rows, err := s.db.Query(`SELECT node_id FROM account_nodes WHERE account = $1 ORDER BY node_id`, string(account))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var r []store.NodeID
+	for rows.Next() {
+		var nodeID string
+		if err := rows.Scan(&nodeID); err != nil {
+			return nil, err
+		}
+		r = append(r, store.NodeID(nodeID))
+	}
+	return r, rows.Err()
+}
+
+// GetAccountBalances returns the balances of all registered accounts.
+func (s *sqlStore) GetAccountBalances() ([]store.Balance, error) {
+	rows, err := s.db.Query(`SELECT ` + balanceColumns + ` FROM balances ORDER BY account`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []store.Balance{}
+	for rows.Next() {
+		balance, err := scanBalance(rows)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, balance)
+	}
+	return r, rows.Err()
+}
+
+const settlementColumns = `account, time, amount, tx_id, credit, new_balance, status, block_number, nonce, gas_price, replaced_tx_ids, attempts, updated, claimed`
+
+func scanSettlement(row scanner) (store.Settlement, error) {
+	var r store.Settlement
+	var account, status, replaced string
+	var amount, credit, newBalance, gasPrice, claimed sql.NullString
+	var blockNumber, nonce int64
+	if err := row.Scan(&account, &r.Time, &amount, &r.TxID, &credit, &newBalance, &status, &blockNumber, &nonce, &gasPrice, &replaced, &r.Attempts, &r.Updated, &claimed); err != nil {
+		return r, err
+	}
+	r.Account = store.Account(account)
+	r.Status = store.SettlementStatus(status)
+	r.BlockNumber = uint64(blockNumber)
+	r.Nonce = uint64(nonce)
+	var err error
+	if r.Amount, err = parseNullBig(amount); err != nil {
+		return r, err
+	}
+	if r.Credit, err = parseNullBig(credit); err != nil {
+		return r, err
+	}
+	if r.NewBalance, err = parseNullBig(newBalance); err != nil {
+		return r, err
+	}
+	if r.GasPrice, err = parseNullBig(gasPrice); err != nil {
+		return r, err
+	}
+	if r.Claimed, err = parseNullBig(claimed); err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal([]byte(replaced), &r.ReplacedTxIDs); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// SetSettlement saves a settlement.
+func (s *sqlStore) SetSettlement(settlement store.Settlement) error {
+	replaced, err := json.Marshal(settlement.ReplacedTxIDs)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO settlements (`+settlementColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			ON CONFLICT (account, time) DO UPDATE SET
+				amount = excluded.amount,
+				tx_id = excluded.tx_id,
+				credit = excluded.credit,
+				new_balance = excluded.new_balance,
+				status = excluded.status,
+				block_number = excluded.block_number,
+				nonce = excluded.nonce,
+				gas_price = excluded.gas_price,
+				replaced_tx_ids = excluded.replaced_tx_ids,
+				attempts = excluded.attempts,
+				updated = excluded.updated,
+				claimed = excluded.claimed`,
+			string(settlement.Account),
+			utc(settlement.Time),
+			nullBigText(settlement.Amount),
+			settlement.TxID,
+			nullBigText(settlement.Credit),
+			nullBigText(settlement.NewBalance),
+			string(settlement.Status),
+			int64(settlement.BlockNumber),
+			int64(settlement.Nonce),
+			nullBigText(settlement.GasPrice),
+			string(replaced),
+			settlement.Attempts,
+			utc(settlement.Updated),
+			nullBigText(settlement.Claimed),
+		)
+		return err
+	})
+}
+
+// GetSettlements returns the account's settlements, oldest first.
+func (s *sqlStore) GetSettlements(account store.Account) ([]store.Settlement, error) {
+	return s.getSettlements(`SELECT `+settlementColumns+` FROM settlements WHERE account = $1 ORDER BY time`, string(account))
+}
+
+// GetPendingSettlements returns the settlements that are not done yet.
+func (s *sqlStore) GetPendingSettlements() ([]store.Settlement, error) {
+	return s.getSettlements(`SELECT `+settlementColumns+` FROM settlements WHERE status NOT IN ($1, $2) ORDER BY account, time`,
+		string(store.SettlementConfirmed), string(store.SettlementFailed))
+}
+
+func (s *sqlStore) getSettlements(query string, args ...interface{}) ([]store.Settlement, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []store.Settlement{}
+	for rows.Next() {
+		settlement, err := scanSettlement(rows)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, settlement)
+	}
+	return r, rows.Err()
+}
+
+const channelColumns = `account, amount, nonce, sig, claimed, updated`
+
+func scanChannel(row scanner) (store.Channel, error) {
+	var r store.Channel
+	var account string
+	var amount, claimed sql.NullString
+	if err := row.Scan(&account, &amount, &r.Nonce, &r.Sig, &claimed, &r.Updated); err != nil {
+		return r, err
+	}
+	r.Account = store.Account(account)
+	var err error
+	if r.Amount, err = parseNullBig(amount); err != nil {
+		return r, err
+	}
+	if r.Claimed, err = parseNullBig(claimed); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// GetChannel returns the account's payment channel.
+func (s *sqlStore) GetChannel(account store.Account) (*store.Channel, error) {
+	r, err := scanChannel(s.db.QueryRow(`SELECT `+channelColumns+` FROM channels WHERE account = $1`, string(account)))
+	if err == sql.ErrNoRows {
+		return nil, store.ErrNoChannel
+	} else if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// SetChannel saves an account's payment channel.
+func (s *sqlStore) SetChannel(channel store.Channel) error {
+	return s.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO channels (`+channelColumns+`) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (account) DO UPDATE SET
+				amount = excluded.amount,
+				nonce = excluded.nonce,
+				sig = excluded.sig,
+				claimed = excluded.claimed,
+				updated = excluded.updated`,
+			string(channel.Account),
+			nullBigText(channel.Amount),
+			channel.Nonce,
+			channel.Sig,
+			nullBigText(channel.Claimed),
+			utc(channel.Updated),
+		)
+		return err
+	})
+}
+
+// GetChannels returns the payment channels of all accounts.
+func (s *sqlStore) GetChannels() ([]store.Channel, error) {
+	rows, err := s.db.Query(`SELECT ` + channelColumns + ` FROM channels ORDER BY account`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []store.Channel{}
+	for rows.Next() {
+		channel, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, channel)
+	}
+	return r, rows.Err()
+}
+
+// GetCheckpoint returns the last block number processed by the named process.
+func (s *sqlStore) GetCheckpoint(name string) (uint64, error) {
+	var r int64
+	err := s.db.QueryRow(`SELECT block_number FROM checkpoints WHERE name = $1`, name).Scan(&r)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return uint64(r), err
+}
+
+// SetCheckpoint saves the last block number processed by the named process.
+func (s *sqlStore) SetCheckpoint(name string, blockNumber uint64) error {
+	return s.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO checkpoints (name, block_number) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET block_number = excluded.block_number`,
+			name, int64(blockNumber))
+		return err
+	})
+}
+
+// GetSubscription returns the account's subscription.
+func (s *sqlStore) GetSubscription(account store.Account) (*store.Subscription, error) {
+	r := store.Subscription{Account: account}
+	err := s.db.QueryRow(`SELECT plan, max_hosts, expires, renew FROM subscriptions WHERE account = $1`, string(account)).Scan(&r.Plan, &r.MaxHosts, &r.Expires, &r.Renew)
+	if err == sql.ErrNoRows {
+		return nil, store.ErrNoSubscription
+	} else if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// SetSubscription saves an account's subscription.
+func (s *sqlStore) SetSubscription(subscription store.Subscription) error {
+	return s.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO subscriptions (account, plan, max_hosts, expires, renew) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (account) DO UPDATE SET
+				plan = excluded.plan,
+				max_hosts = excluded.max_hosts,
+				expires = excluded.expires,
+				renew = excluded.renew`,
+			string(subscription.Account),
+			subscription.Plan,
+			subscription.MaxHosts,
+			utc(subscription.Expires),
+			subscription.Renew,
+		)
+		return err
+	})
+}
+
+const nodeColumns = `n.id, n.uri, n.last_seen, n.kind, n.is_host, n.payout, n.block_number, n.price, n.node_version, n.vipnode_version, n.network, n.capabilities, n.labels`
+
+func scanNode(row scanner, extra ...interface{}) (store.Node, error) {
+	var r store.Node
+	var id, payout, capabilities, labels string
+	var blockNumber int64
+	var price sql.NullString
+	dest := []interface{}{&id, &r.URI, &r.LastSeen, &r.Kind, &r.IsHost, &payout, &blockNumber, &price, &r.NodeVersion, &r.VipnodeVersion, &r.Network, &capabilities, &labels}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return r, err
+	}
+	r.ID = store.NodeID(id)
+	r.Payout = store.Account(payout)
+	r.BlockNumber = uint64(blockNumber)
+	if err := json.Unmarshal([]byte(capabilities), &r.Capabilities); err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal([]byte(labels), &r.Labels); err != nil {
+		return r, err
+	}
+	var err error
+	r.Price, err = parseNullBig(price)
+	return r, err
+}
+
+func (s *sqlStore) queryNodes(query string, args ...interface{}) ([]store.Node, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var r []store.Node
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, n)
+	}
+	return r, rows.Err()
+}
+
+// AllNodes returns all registered nodes, used for debugging.
+func (s *sqlStore) AllNodes() ([]store.Node, error) {
+	return s.queryNodes(`SELECT ` + nodeColumns + ` FROM nodes n ORDER BY n.id`)
+}
+
+// ActiveHosts returns the hosts that were seen recently and match the
+// query. The indexed attributes are filtered by the database, and the rest
+// of the query is applied to the results.
+func (s *sqlStore) ActiveHosts(query store.HostQuery) ([]store.Node, error) {
+	seenSince := utc(time.Now().Add(-store.ExpireInterval))
+	rows, err := s.db.Query(`SELECT `+nodeColumns+`, (SELECT COUNT(*) FROM peers p WHERE p.node_id = n.id)
+		FROM nodes n
+		WHERE n.is_host = $1 AND n.last_seen > $2 AND ($3 = '' OR n.kind = $3) AND ($4 = 0 OR n.network = 0 OR n.network = $4) AND n.block_number >= $5`,
+		true, seenSince, query.Kind, query.Network, int64(query.MinBlockNumber))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var r []store.Node
+	loads := map[store.NodeID]int{}
+	for rows.Next() {
+		var numPeers int
+		n, err := scanNode(rows, &numPeers)
+		if err != nil {
+			return nil, err
+		}
+		if !query.Match(n) || !query.MatchLoad(numPeers) {
+			continue
+		}
+		loads[n.ID] = numPeers
+		r = append(r, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return query.Sort(r, loads), nil
+}
+
+func (s *sqlStore) GetNode(nodeID store.NodeID) (*store.Node, error) {
+	r, err := scanNode(s.db.QueryRow(`SELECT `+nodeColumns+` FROM nodes n WHERE n.id = $1`, string(nodeID)))
+	if err == sql.ErrNoRows {
+		return nil, store.ErrUnregisteredNode
+	} else if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *sqlStore) SetNode(n store.Node) error {
+	if n.ID == "" {
+		return store.ErrMalformedNode
+	}
+	return s.update(func(tx *sql.Tx) error {
+		capabilities, err := json.Marshal(n.Capabilities)
+		if err != nil {
+			return err
+		}
+		if n.Capabilities == nil {
+			capabilities = []byte("[]")
+		}
+		labels, err := json.Marshal(n.Labels)
+		if err != nil {
+			return err
+		}
+		if n.Labels == nil {
+			labels = []byte("{}")
+		}
+		_, err = tx.Exec(`INSERT INTO nodes (id, uri, last_seen, kind, is_host, payout, block_number, price, node_version, vipnode_version, network, capabilities, labels)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			ON CONFLICT (id) DO UPDATE SET
+				uri = excluded.uri,
+				last_seen = excluded.last_seen,
+				kind = excluded.kind,
+				is_host = excluded.is_host,
+				payout = excluded.payout,
+				block_number = excluded.block_number,
+				price = excluded.price,
+				node_version = excluded.node_version,
+				vipnode_version = excluded.vipnode_version,
+				network = excluded.network,
+				capabilities = excluded.capabilities,
+				labels = excluded.labels`,
+			string(n.ID),
+			n.URI,
+			utc(n.LastSeen),
+			n.Kind,
+			n.IsHost,
+			string(n.Payout),
+			int64(n.BlockNumber),
+			nullBigText(n.Price),
+			n.NodeVersion,
+			n.VipnodeVersion,
+			n.Network,
+			string(capabilities),
+			string(labels),
+		)
+		return err
+	})
+}
+
+func (s *sqlStore) NodePeers(nodeID store.NodeID) ([]store.Node, error) {
+	if ok, err := hasNode(s.db, nodeID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, store.ErrUnregisteredNode
+	}
+	// Peer nodes we no longer know about are skipped by the join
+	return s.queryNodes(`SELECT `+nodeColumns+` FROM peers p JOIN nodes n ON n.id = p.peer_id WHERE p.node_id = $1`, string(nodeID))
+}
+
+// UpdateNodePeers updates the Node's peers and the node's LastSeen timestamp.
+// This is used as a keepalive, and to keep track of which client is connected
+// to which host.
+// Node's LastSeen should only be updated when it calls UpdateNodePeers.
+// Node's LastSeen should be counted whether it's inactive only when it's
+// included as a peer by another node in an UpdateNodePeers call.
+func (s *sqlStore) UpdateNodePeers(nodeID store.NodeID, peers []string, blockNumber uint64) (inactive []store.NodeID, err error) {
+	now := utc(time.Now())
+	err = s.update(func(tx *sql.Tx) error {
+		// Update this node's LastSeen
+		if res, err := tx.Exec(`UPDATE nodes SET last_seen = $1, block_number = $2 WHERE id = $3`, now, int64(blockNumber), string(nodeID)); err != nil {
+			return err
+		} else if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return store.ErrUnregisteredNode
+		}
+
+		// Update peers
+		// Note: Just because this node has seen some peer, it doesn't mean that
+		// the node is active (ie. peers are not active nodes necessarily).
+		// We save the peer's own LastSeen to determine if it's active.
+		for _, peerID := range peers {
+			var lastSeen time.Time
+			if err := tx.QueryRow(`SELECT last_seen FROM nodes WHERE id = $1`, peerID).Scan(&lastSeen); err == sql.ErrNoRows {
+				// We don't know about this node, ignore
+				continue
+			} else if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO peers (node_id, peer_id, last_seen) VALUES ($1, $2, $3)
+				ON CONFLICT (node_id, peer_id) DO UPDATE SET last_seen = excluded.last_seen`,
+				string(nodeID), peerID, utc(lastSeen)); err != nil {
+				return err
+			}
+		}
+
+		inactiveDeadline := now.Add(-store.ExpireInterval)
+		rows, err := tx.Query(`SELECT peer_id FROM peers WHERE node_id = $1 AND last_seen <= $2`, string(nodeID), inactiveDeadline)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var peerID string
+			if err := rows.Scan(&peerID); err != nil {
+				rows.Close()
+				return err
+			}
+			inactive = append(inactive, store.NodeID(peerID))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM peers WHERE node_id = $1 AND last_seen <= $2`, string(nodeID), inactiveDeadline)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inactive, nil
+}
+
+// Stats returns aggregate statistics about the store state.
+func (s *sqlStore) Stats() (*store.Stats, error) {
+	stats := store.Stats{}
+
+	nodes, err := s.queryNodes(`SELECT ` + nodeColumns + ` FROM nodes n`)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		stats.CountNode(n)
+	}
+
+	balances, err := s.GetAccountBalances()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range balances {
+		stats.CountBalance(b)
+	}
+
+	rows, err := s.db.Query(`SELECT credit FROM trials`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var credit string
+		var b store.Balance
+		if err := rows.Scan(&credit); err != nil {
+			return nil, err
+		}
+		if err := parseBig(&b.Credit, credit); err != nil {
+			return nil, err
+		}
+		stats.CountBalance(b)
+	}
+	return &stats, rows.Err()
+}
+
+// Prune removes stale nodes, dangling peers, and empty trial balances.
+func (s *sqlStore) Prune(seenBefore time.Time) (store.PruneStats, error) {
+	var r store.PruneStats
+	err := s.update(func(tx *sql.Tx) error {
+		var err error
+		if r.Nodes, err = execCount(tx, `DELETE FROM nodes WHERE last_seen < $1`, utc(seenBefore)); err != nil {
+			return err
+		}
+		if r.Peers, err = execCount(tx, `DELETE FROM peers
+			WHERE node_id NOT IN (SELECT id FROM nodes) OR peer_id NOT IN (SELECT id FROM nodes)`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM trial_starts WHERE node_id NOT IN (SELECT id FROM nodes)`); err != nil {
+			return err
+		}
+		// Amounts are stored as their canonical decimal text
+		r.Trials, err = execCount(tx, `DELETE FROM trials WHERE credit = '0'`)
+		return err
+	})
+	if err != nil {
+		return store.PruneStats{}, err
+	}
+	return r, nil
+}
@@ -0,0 +1,141 @@
+package sqlstore
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vipnode/vipnode/v2/pool/store"
+	"github.com/vipnode/vipnode/v2/pool/store/memory"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	t.Run("SQLiteStore", func(t *testing.T) {
+		store.TestSuite(t, func() store.Store {
+			s, err := OpenSQLite(":memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		})
+	})
+}
+
+func TestMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vipnode-sqlstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pool.db")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := getVersion(s.db); err != nil {
+		t.Fatal(err)
+	} else if version != dbVersion {
+		t.Errorf("wrong version: %d", version)
+	}
+	if err := s.AddAccountBalance("abcd", big.NewInt(42)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening keeps the data and doesn't migrate again
+	s, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.GetAccountBalance("abcd"); err != nil {
+		t.Fatal(err)
+	} else if b.Credit.Cmp(big.NewInt(42)) != 0 {
+		t.Errorf("wrong balance after reopening: %d", &b.Credit)
+	}
+
+	// Databases from the future are not supported
+	if err := setVersion(s.db, dbVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := OpenSQLite(path); err == nil {
+		t.Fatal("expected migration error")
+	} else if _, ok := err.(MigrationError); !ok {
+		t.Errorf("wrong error type: %T", err)
+	}
+}
+
+func TestBigAmounts(t *testing.T) {
+	s, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Amounts beyond 64 bits must not lose precision
+	amount, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	if err := s.AddAccountBalance("abcd", amount); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddAccountBalance("abcd", big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Add(amount, big.NewInt(1))
+	if b, err := s.GetAccountBalance("abcd"); err != nil {
+		t.Fatal(err)
+	} else if b.Credit.Cmp(want) != 0 {
+		t.Errorf("wrong balance: got %d; want %d", &b.Credit, want)
+	}
+}
+
+func TestCopyFromMemory(t *testing.T) {
+	src := memory.New()
+	host := store.Node{ID: store.NodeID("abcd"), IsHost: true}
+	client := store.Node{ID: store.NodeID("efgh")}
+	for _, n := range []store.Node{host, client} {
+		if err := src.SetNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.AddNodeBalance(host.ID, big.NewInt(7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddAccountNode("0x42", client.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddAccountBalance("0x42", big.NewInt(-42)); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if n, err := store.Copy(dst, src); err != nil {
+		t.Fatal(err)
+	} else if n != 5 {
+		t.Errorf("wrong number of copied records: %d", n)
+	}
+	if err := store.Verify(src, dst); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if err := dst.AddAccountBalance("0x42", big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.SetNode(store.Node{ID: store.NodeID("ijkl")}); err != nil {
+		t.Fatal(err)
+	}
+	err = store.Verify(src, dst)
+	if diff, ok := err.(store.VerifyError); !ok {
+		t.Errorf("expected VerifyError, got: %v", err)
+	} else if len(diff) != 4 {
+		// Node count, client count, account total, and the client's balance
+		t.Errorf("wrong differences: %q", diff)
+	}
+}
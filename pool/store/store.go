@@ -20,29 +20,22 @@ const ExpireInterval = KeepaliveInterval * 2
 // aggressively. Skewed clocks will get invalid nonce errors.
 const ExpireNonce = 15 * time.Minute
 
-// FIXME: placeholder types, replace with go-ethereum types
-
-type Account string // TODO: Switch to common.Address?
-type NodeID string  // TODO: Switch to discv5.NodeID?
-
-func (id NodeID) IsZero() bool {
-	return id == ""
-}
-
-func (id NodeID) String() string {
-	return string(id)
-}
-
-func ParseNodeID(s string) (NodeID, error) {
-	return NodeID(s), nil
-}
-
 // Balance describes a node's account balance on the pool.
 type Balance struct {
 	Account      Account   `json:"account,omitempty"`
 	Deposit      big.Int   `json:"deposit"`
 	Credit       big.Int   `json:"credit"`
 	NextWithdraw time.Time `json:"next_withdraw,omitempty"`
+	// Locked is the deposit that is timelocked because the account forced a
+	// withdraw, which is not included in Deposit. It can be withdrawn from
+	// the contract after Unlocks.
+	Locked  big.Int   `json:"locked"`
+	Unlocks time.Time `json:"unlocks,omitempty"`
+}
+
+// IsLocked returns true if the balance has a timelocked deposit.
+func (b *Balance) IsLocked() bool {
+	return !b.Unlocks.IsZero()
 }
 
 func (b *Balance) String() string {
@@ -54,6 +47,106 @@ func (b *Balance) String() string {
 	return fmt.Sprintf("Balance(%q, %s)", account, ether.Print(total))
 }
 
+// NodeShare returns a node's share of an account's credit when it's split
+// evenly between numNodes nodes. Debt is not shared, so a non-positive credit
+// has a zero share.
+func NodeShare(credit *big.Int, numNodes int) *big.Int {
+	if credit.Sign() <= 0 || numNodes <= 0 {
+		return new(big.Int)
+	}
+	return new(big.Int).Div(credit, big.NewInt(int64(numNodes)))
+}
+
+// Subscription is a prepaid plan that an account has bought, which replaces
+// metered billing until it expires.
+type Subscription struct {
+	Account  Account   `json:"account"`
+	Plan     string    `json:"plan"`
+	MaxHosts int       `json:"max_hosts"`
+	Expires  time.Time `json:"expires"`
+	// Renew is set if the subscription should be renewed from the account's
+	// balance when it expires.
+	Renew bool `json:"renew"`
+}
+
+// Active returns whether the subscription has not expired at the given time.
+func (s *Subscription) Active(now time.Time) bool {
+	return now.Before(s.Expires)
+}
+
+// SettlementStatus is the state of a settlement transaction.
+type SettlementStatus string
+
+const (
+	// SettlementSubmitting is a settlement whose credit was deducted and
+	// whose transaction is being sent. If a settlement stays in this state,
+	// then the pool stopped before it recorded the transaction, and it needs
+	// to be checked manually.
+	SettlementSubmitting SettlementStatus = "submitting"
+	// SettlementPending is a submitted transaction that was not mined yet.
+	SettlementPending SettlementStatus = "pending"
+	// SettlementMined is a successful transaction that is waiting for
+	// confirmations.
+	SettlementMined SettlementStatus = "mined"
+	// SettlementConfirmed is a successful transaction with enough
+	// confirmations.
+	SettlementConfirmed SettlementStatus = "confirmed"
+	// SettlementFailed is a transaction that reverted or was dropped. The
+	// settled credit is returned to the account.
+	SettlementFailed SettlementStatus = "failed"
+)
+
+// Settlement is a record of an account's balance that was paid out. A
+// settlement is identified by its Account and Time.
+type Settlement struct {
+	Account Account   `json:"account"`
+	Amount  *big.Int  `json:"amount"`
+	TxID    string    `json:"tx_id"`
+	Time    time.Time `json:"time"`
+
+	// Credit is the amount that was deducted from the account's credit,
+	// which is returned if the settlement fails.
+	Credit *big.Int `json:"credit,omitempty"`
+	// NewBalance is the on-chain balance that the settlement sets.
+	NewBalance *big.Int `json:"new_balance,omitempty"`
+	// Claimed is the payment channel amount that the settlement claims from
+	// the account's deposit, which is unclaimed again if the settlement
+	// fails.
+	Claimed *big.Int `json:"claimed,omitempty"`
+
+	Status      SettlementStatus `json:"status"`
+	BlockNumber uint64           `json:"block_number,omitempty"`
+	// Nonce and GasPrice of the latest transaction, used to replace it if
+	// it gets stuck.
+	Nonce    uint64   `json:"nonce,omitempty"`
+	GasPrice *big.Int `json:"gas_price,omitempty"`
+	// ReplacedTxIDs are the previous transactions that TxID replaced, any
+	// of which could still be mined instead.
+	ReplacedTxIDs []string  `json:"replaced_tx_ids,omitempty"`
+	Attempts      int       `json:"attempts"`
+	Updated       time.Time `json:"updated"`
+}
+
+// IsDone returns true if the settlement is confirmed or failed.
+func (s *Settlement) IsDone() bool {
+	return s.Status == SettlementConfirmed || s.Status == SettlementFailed
+}
+
+// Channel is the latest state of a client account's unidirectional payment
+// channel to the pool, which is backed by the account's on-chain deposit.
+type Channel struct {
+	Account Account `json:"account"`
+	// Amount is the cumulative amount of the latest balance proof.
+	Amount *big.Int `json:"amount"`
+	// Nonce and Sig of the latest balance proof, which are needed to close
+	// the channel.
+	Nonce int64  `json:"nonce"`
+	Sig   string `json:"sig"`
+	// Claimed is the cumulative amount that was already claimed on-chain.
+	Claimed *big.Int  `json:"claimed"`
+	Updated time.Time `json:"updated"`
+}
+
 // Node stores metadata requires for tracking full nodes.
 type Node struct {
 	ID          NodeID
@@ -63,9 +156,41 @@ type Node struct {
 	IsHost      bool
 	Payout      Account
 	BlockNumber uint64 `json:"block_number"`
+	// Price is the amount the host charges per interval of a client
+	// connection, in wei. (Optional, only set for hosts)
+	Price *big.Int `json:"price,omitempty"`
 
 	NodeVersion    string `json:"node_version"`
 	VipnodeVersion string `json:"vipnode_version"`
+
+	// Network is the ID of the Ethereum network that the node is on, or 0 if
+	// it's unknown.
+	Network int `json:"network,omitempty"`
+	// Capabilities are the features that the node advertised, such as
+	// "archive". (Optional)
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Labels are operator-defined attributes of the node, such as
+	// "region": "eu". (Optional)
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// HasCapability returns true if the node advertised the capability.
+func (n *Node) HasCapability(capability string) bool {
+	for _, c := range n.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Usage is the cumulative traffic that a node reports for one of its peers
+// since the peers connected.
+type Usage struct {
+	Peer     NodeID
+	BytesIn  uint64
+	BytesOut uint64
+	Requests uint64
 }
 
 // Stats contains various aggregate stats of the store state, used for
@@ -79,10 +204,22 @@ type Stats struct {
 	TotalCredit       big.Int `json:"total_credit"`
 	TotalDeposit      big.Int `json:"total_deposit"`
 	NumTrialBalances  int     `json:"num_trial_balances"`
+	// OperatorCredit is the credit accumulated by the pool operator's
+	// commission account, if one is configured.
+	OperatorCredit *big.Int `json:"operator_credit,omitempty"`
 
 	activeSince time.Time
 }
 
+// CacheStats are the counters of a cache in front of a store, such as the
+// contract balance cache.
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
 // CountNode is a helper for aggregating node-related stats. It is not
 // goroutine-safe.
 func (stats *Stats) CountNode(n Node) {
@@ -121,6 +258,13 @@ type Store interface {
 	NonceStore
 	PoolStore
 	AccountStore
+	TrialStore
+	SubscriptionStore
+	SettlementStore
+	ChannelStore
+	CheckpointStore
+	DumpStore
+	PruneStore
 
 	// Stats returns aggregate statistics about the store state.
 	Stats() (*Stats, error)
@@ -134,17 +278,15 @@ type NonceStore interface {
 	CheckAndSaveNonce(ID string, nonce int64) error
 }
 
-// TODO: Replace ActiveHosts params with HostQuery type?
-
 type PoolStore interface {
 	// GetNode returns the node from the set of active nods.
 	GetNode(NodeID) (*Node, error)
 	// SetNode adds a Node to the set of active nodes.
 	SetNode(Node) error
 
-	// ActiveHosts returns `limit`-number of `kind` nodes. This could be an
-	// empty list, if none are available.
-	ActiveHosts(kind string, limit int) ([]Node, error)
+	// ActiveHosts returns the hosts that were seen recently and match the
+	// query. This could be an empty list, if none are available.
+	ActiveHosts(query HostQuery) ([]Node, error)
 
 	// NodePeers returns a list of active connected peers that this pool knows
 	// about for this NodeID.
@@ -165,12 +307,73 @@ type AccountStore interface {
 	// balance. This should migrate any existing node's balance credit to the
 	// account.
 	AddAccountNode(account Account, nodeID NodeID) error
+	// RemoveAccountNode de-authorizes a nodeID from spending an account's
+	// balance, or returns ErrNotAuthorized if it's not a spender of the
+	// account. If moveShare is set, then the node's share of the account's
+	// credit (split evenly between the account's nodes) is moved back to the
+	// node's trial balance.
+	RemoveAccountNode(account Account, nodeID NodeID, moveShare bool) error
 	// IsAccountNode returns nil if node is a valid spender of the given
 	// account.
 	IsAccountNode(account Account, nodeID NodeID) error
 	// GetSpenders returns the authorized nodeIDs for this account, these are
 	// nodes that were added to accounts through AddAccountNode.
 	GetAccountNodes(account Account) ([]NodeID, error)
+	// GetAccountBalances returns the balances of all registered accounts,
+	// excluding trial balances.
+	GetAccountBalances() ([]Balance, error)
+}
+
+// SettlementStore keeps records of account settlements.
+type SettlementStore interface {
+	// SetSettlement saves a settlement, replacing any existing settlement
+	// with the same Account and Time.
+	SetSettlement(settlement Settlement) error
+	// GetSettlements returns the account's settlements, oldest first.
+	GetSettlements(account Account) ([]Settlement, error)
+	// GetPendingSettlements returns the settlements of all accounts that are
+	// not confirmed or failed yet.
+	GetPendingSettlements() ([]Settlement, error)
+}
+
+// ChannelStore keeps the latest state of account payment channels.
+type ChannelStore interface {
+	// GetChannel returns the account's channel, or ErrNoChannel if the
+	// account never sent a balance proof.
+	GetChannel(account Account) (*Channel, error)
+	// SetChannel saves an account's channel, replacing any existing channel.
+	SetChannel(channel Channel) error
+	// GetChannels returns the channels of all accounts.
+	GetChannels() ([]Channel, error)
+}
+
+// CheckpointStore keeps the progress of background processes that scan the
+// chain, such as deposit reconciliation.
+type CheckpointStore interface {
+	// GetCheckpoint returns the last block number processed by the named
+	// process, or 0 if it never ran.
+	GetCheckpoint(name string) (uint64, error)
+	// SetCheckpoint saves the last block number processed by the named
+	// process.
+	SetCheckpoint(name string, blockNumber uint64) error
+}
+
+// TrialStore keeps when each node's trial started, so that trials don't
+// restart when the pool restarts.
+type TrialStore interface {
+	// StartTrial returns when the node's trial started, starting it at now if
+	// it hasn't started yet.
+	StartTrial(nodeID NodeID, now time.Time) (time.Time, error)
+}
+
+// SubscriptionStore manages prepaid account subscriptions.
+type SubscriptionStore interface {
+	// GetSubscription returns the account's subscription, or
+	// ErrNoSubscription if the account never had one.
+	GetSubscription(account Account) (*Subscription, error)
+	// SetSubscription saves an account's subscription, replacing any
+	// existing subscription.
+	SetSubscription(subscription Subscription) error
 }
 
 // BalanceStore is a store subset required for the balance manager.
@@ -188,3 +391,28 @@ type BalanceStore interface {
 	// AddNodeBalance adds credit to an account balance. (Can be negative)
 	AddAccountBalance(account Account, credit *big.Int) error
 }
+
+// PruneStats are the counts of state that was removed by pruning.
+type PruneStats struct {
+	Nodes  int `json:"nodes"`
+	Peers  int `json:"peers"`
+	Trials int `json:"trials"`
+}
+
+// Add adds the counts of other to stats.
+func (stats *PruneStats) Add(other PruneStats) {
+	stats.Nodes += other.Nodes
+	stats.Peers += other.Peers
+	stats.Trials += other.Trials
+}
+
+// PruneStore removes stale state, so that it doesn't grow forever.
+type PruneStore interface {
+	// Prune removes the nodes that were last seen before seenBefore along
+	// with their peers and trial start times, the peers of nodes that are no
+	// longer registered, and trial balances that are zero. Nonzero balances
+	// (including the trial balances of pruned nodes) and the accounts that
+	// nodes are authorized to spend are kept, so they're restored if the
+	// node connects again.
+	Prune(seenBefore time.Time) (PruneStats, error)
+}
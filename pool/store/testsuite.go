@@ -1,10 +1,13 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -220,7 +223,7 @@ func TestSuite(t *testing.T, newStore func() Store) {
 		s := newStore()
 		defer s.Close()
 
-		if hosts, err := s.ActiveHosts("", 3); err != nil {
+		if hosts, err := s.ActiveHosts(HostQuery{Limit: 3}); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		} else if len(hosts) != 0 {
 			t.Errorf("unexpected hosts: %v", hosts)
@@ -241,7 +244,7 @@ func TestSuite(t *testing.T, newStore func() Store) {
 				t.Error(err)
 			}
 		}
-		if hosts, err := s.ActiveHosts("", 10); err != nil {
+		if hosts, err := s.ActiveHosts(HostQuery{Limit: 10}); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		} else if got, want := Nodes(hosts).IDs(), []string{
 			nodes[6].ID.String(),
@@ -250,7 +253,7 @@ func TestSuite(t *testing.T, newStore func() Store) {
 			t.Errorf("got: %v; want: %v", got, want)
 		}
 
-		if hosts, err := s.ActiveHosts("", 1); err != nil {
+		if hosts, err := s.ActiveHosts(HostQuery{Limit: 1}); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		} else if len(hosts) != 1 {
 			t.Errorf("wrong number of hosts: %d", len(hosts))
@@ -275,6 +278,109 @@ func TestSuite(t *testing.T, newStore func() Store) {
 		}
 	})
 
+	t.Run("HostQuery", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		hosts := makeNodes(0, 4)
+		clients := makeNodes(10, 2)
+		for i := range hosts {
+			hosts[i].IsHost = true
+			hosts[i].Kind = "geth"
+			hosts[i].Network = 1
+		}
+		hosts[0].Capabilities = []string{"archive", "les"}
+		hosts[0].Labels = map[string]string{"region": "eu"}
+		hosts[0].Price = big.NewInt(10)
+		hosts[1].Kind = "parity"
+		hosts[1].Labels = map[string]string{"region": "us"}
+		hosts[1].Price = big.NewInt(5)
+		hosts[2].Network = 5
+		hosts[3].Network = 0 // Unknown network
+		hosts[3].Price = big.NewInt(20)
+		if err := addActiveNodes(s, append(clients, hosts...)...); err != nil {
+			t.Fatal(err)
+		}
+		blockNumbers := []uint64{100, 200, 300, 50}
+		for i, n := range hosts {
+			var peers []string
+			if i == 3 {
+				peers = []string{string(clients[0].ID), string(clients[1].ID)}
+			}
+			if _, err := s.UpdateNodePeers(n.ID, peers, blockNumbers[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ids := func(nodes ...Node) []string {
+			r := make([]string, 0, len(nodes))
+			for _, n := range nodes {
+				r = append(r, n.ID.String())
+			}
+			return r
+		}
+
+		// Filters
+		for i, tc := range []struct {
+			query HostQuery
+			want  Nodes
+		}{
+			{HostQuery{}, hosts},
+			{HostQuery{Kind: "geth"}, Nodes{hosts[0], hosts[2], hosts[3]}},
+			{HostQuery{Network: 1}, Nodes{hosts[0], hosts[1], hosts[3]}},
+			{HostQuery{Network: 2}, hosts[3:]},
+			{HostQuery{MinBlockNumber: 100}, hosts[:3]},
+			{HostQuery{Capabilities: []string{"archive"}}, hosts[:1]},
+			{HostQuery{Capabilities: []string{"archive", "full"}}, Nodes{}},
+			{HostQuery{Labels: map[string]string{"region": "eu"}}, hosts[:1]},
+			{HostQuery{Labels: map[string]string{"region": "asia"}}, Nodes{}},
+			{HostQuery{Exclude: []NodeID{hosts[0].ID, hosts[1].ID, clients[0].ID}}, hosts[2:]},
+			{HostQuery{MaxLoad: 1}, hosts[:3]},
+			{HostQuery{MaxLoad: 2}, hosts},
+			{HostQuery{Kind: "geth", Network: 1, MinBlockNumber: 60}, hosts[:1]},
+		} {
+			got, err := s.ActiveHosts(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := Nodes(got).IDs(), tc.want.IDs(); !reflect.DeepEqual(got, want) {
+				t.Errorf("query %d %+v: got %q; want %q", i, tc.query, got, want)
+			}
+		}
+
+		// Ordering
+		for i, tc := range []struct {
+			query HostQuery
+			want  []string
+		}{
+			{HostQuery{Order: OrderBlockNumber}, ids(hosts[2], hosts[1], hosts[0], hosts[3])},
+			{HostQuery{Order: OrderBlockNumber, Limit: 2}, ids(hosts[2], hosts[1])},
+			{HostQuery{Order: OrderPrice}, ids(hosts[1], hosts[0], hosts[3], hosts[2])},
+			{HostQuery{Order: OrderPrice, Kind: "geth", Limit: 1}, ids(hosts[0])},
+			{HostQuery{Order: OrderLastSeen, Limit: 1}, ids(hosts[3])},
+		} {
+			got, err := s.ActiveHosts(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(got...); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ordered query %d %+v: got %q; want %q", i, tc.query, got, tc.want)
+			}
+		}
+		if got, err := s.ActiveHosts(HostQuery{Order: OrderLoad}); err != nil {
+			t.Fatal(err)
+		} else if len(got) != len(hosts) || got[len(got)-1].ID != hosts[3].ID {
+			t.Errorf("wrong load order: %q", ids(got...))
+		}
+
+		// Attributes are saved
+		if n, err := s.GetNode(hosts[0].ID); err != nil {
+			t.Error(err)
+		} else if n.Network != 1 || !n.HasCapability("les") || n.Labels["region"] != "eu" {
+			t.Errorf("wrong node attributes: %+v", n)
+		}
+	})
+
 	t.Run("Spender", func(t *testing.T) {
 		s := newStore()
 		defer s.Close()
@@ -321,6 +427,419 @@ func TestSuite(t *testing.T, newStore func() Store) {
 		}
 	})
 
+	t.Run("TrialStart", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		nodes := makeNodes(0, 1)
+		if err := addActiveNodes(s, nodes...); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().UTC().Round(0)
+		if started, err := s.StartTrial(nodes[0].ID, now); err != nil {
+			t.Fatal(err)
+		} else if !started.Equal(now) {
+			t.Errorf("wrong trial start: got %s; want %s", started, now)
+		}
+		// Starting again keeps the first start time
+		if started, err := s.StartTrial(nodes[0].ID, now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		} else if !started.Equal(now) {
+			t.Errorf("trial start changed: got %s; want %s", started, now)
+		}
+	})
+
+	t.Run("Subscription", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		account := accounts[0]
+		if _, err := s.GetSubscription(account); err != ErrNoSubscription {
+			t.Errorf("expected ErrNoSubscription, got: %s", err)
+		}
+
+		expires := time.Now().Add(time.Hour).Round(0)
+		want := Subscription{
+			Account:  account,
+			Plan:     "monthly",
+			MaxHosts: 3,
+			Expires:  expires,
+			Renew:    true,
+		}
+		if err := s.SetSubscription(want); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if got, err := s.GetSubscription(account); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if !got.Expires.Equal(want.Expires) || got.Plan != want.Plan || got.MaxHosts != want.MaxHosts || !got.Renew {
+			t.Errorf("wrong subscription:\n got: %+v\nwant: %+v", got, want)
+		}
+
+		if _, err := s.GetSubscription(accounts[1]); err != ErrNoSubscription {
+			t.Errorf("expected ErrNoSubscription, got: %s", err)
+		}
+	})
+
+	t.Run("Settlement", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		if err := s.AddAccountBalance(accounts[0], big.NewInt(42)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err := s.AddAccountBalance(accounts[1], big.NewInt(-42)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		balances, err := s.GetAccountBalances()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		got := map[Account]int64{}
+		for _, b := range balances {
+			got[b.Account] = b.Credit.Int64()
+		}
+		if want := map[Account]int64{accounts[0]: 42, accounts[1]: -42}; !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong account balances: got %v; want %v", got, want)
+		}
+
+		if settlements, err := s.GetSettlements(accounts[0]); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if len(settlements) != 0 {
+			t.Errorf("unexpected settlements: %v", settlements)
+		}
+		now := time.Now().Round(0)
+		for i := 0; i < 3; i++ {
+			settlement := Settlement{
+				Account: accounts[0],
+				Amount:  big.NewInt(int64(i)),
+				TxID:    fmt.Sprintf("tx%d", i),
+				Time:    now.Add(time.Duration(i) * time.Second),
+				Status:  SettlementPending,
+			}
+			if err := s.SetSettlement(settlement); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+		settlements, err := s.GetSettlements(accounts[0])
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if len(settlements) != 3 {
+			t.Fatalf("wrong number of settlements: %d", len(settlements))
+		}
+		for i, settlement := range settlements {
+			if want := fmt.Sprintf("tx%d", i); settlement.TxID != want || settlement.Amount.Int64() != int64(i) {
+				t.Errorf("wrong settlement %d: %+v", i, settlement)
+			}
+		}
+		if settlements, err := s.GetSettlements(accounts[1]); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if len(settlements) != 0 {
+			t.Errorf("unexpected settlements: %v", settlements)
+		}
+
+		// Update the status of a settlement
+		settlements[1].Status = SettlementConfirmed
+		settlements[1].Claimed = big.NewInt(7)
+		if err := s.SetSettlement(settlements[1]); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if got, err := s.GetSettlements(accounts[0]); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if len(got) != 3 || got[1].Status != SettlementConfirmed || got[1].Claimed == nil || got[1].Claimed.Int64() != 7 {
+			t.Errorf("settlement was not updated: %+v", got)
+		} else if got[0].Claimed != nil {
+			t.Errorf("unexpected claimed amount: %d", got[0].Claimed)
+		}
+		pending, err := s.GetPendingSettlements()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if len(pending) != 2 {
+			t.Errorf("wrong number of pending settlements: %+v", pending)
+		}
+	})
+
+	t.Run("Channel", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		if _, err := s.GetChannel(accounts[0]); err != ErrNoChannel {
+			t.Errorf("expected ErrNoChannel, got: %s", err)
+		}
+		if channels, err := s.GetChannels(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if len(channels) != 0 {
+			t.Errorf("unexpected channels: %v", channels)
+		}
+
+		want := Channel{
+			Account: accounts[0],
+			Amount:  big.NewInt(42),
+			Nonce:   1,
+			Sig:     "abcd",
+			Claimed: big.NewInt(0),
+			Updated: time.Now().Round(0),
+		}
+		if err := s.SetChannel(want); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		want.Amount = big.NewInt(69)
+		want.Nonce = 2
+		if err := s.SetChannel(want); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if got, err := s.GetChannel(accounts[0]); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if got.Amount.Cmp(want.Amount) != 0 || got.Nonce != want.Nonce || got.Sig != want.Sig || !got.Updated.Equal(want.Updated) {
+			t.Errorf("wrong channel:\n got: %+v\nwant: %+v", got, want)
+		}
+		if _, err := s.GetChannel(accounts[1]); err != ErrNoChannel {
+			t.Errorf("expected ErrNoChannel, got: %s", err)
+		}
+		if channels, err := s.GetChannels(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if len(channels) != 1 || channels[0].Account != accounts[0] {
+			t.Errorf("wrong channels: %v", channels)
+		}
+	})
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		if n, err := s.GetCheckpoint("deposits"); err != nil {
+			t.Error(err)
+		} else if n != 0 {
+			t.Errorf("unexpected checkpoint: %d", n)
+		}
+		if err := s.SetCheckpoint("deposits", 42); err != nil {
+			t.Error(err)
+		}
+		if err := s.SetCheckpoint("other", 7); err != nil {
+			t.Error(err)
+		}
+		if n, err := s.GetCheckpoint("deposits"); err != nil {
+			t.Error(err)
+		} else if n != 42 {
+			t.Errorf("wrong checkpoint: %d", n)
+		}
+	})
+
+	t.Run("Dump", func(t *testing.T) {
+		s := newStore()
+
+		nodes := makeNodes(0, 3)
+		nodes[0].IsHost = true
+		nodes[0].Kind = "geth"
+		nodes[0].Price = big.NewInt(1000)
+		if err := addActiveNodes(s, nodes...); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UpdateNodePeers(nodes[0].ID, []string{string(nodes[1].ID), string(nodes[2].ID)}, 42); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddAccountNode(accounts[0], nodes[1].ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddAccountBalance(accounts[0], big.NewInt(42)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddNodeBalance(nodes[2].ID, big.NewInt(7)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CheckAndSaveNonce("foo", time.Now().UnixNano()); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().UTC().Round(0)
+		if _, err := s.StartTrial(nodes[2].ID, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetSubscription(Subscription{Account: accounts[0], Plan: "monthly", MaxHosts: 3, Expires: now}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetSettlement(Settlement{Account: accounts[0], Amount: big.NewInt(1), TxID: "tx", Time: now, Status: SettlementPending}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetChannel(Channel{Account: accounts[1], Amount: big.NewInt(2), Nonce: 1, Sig: "abcd", Updated: now}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetCheckpoint("deposits", 42); err != nil {
+			t.Fatal(err)
+		}
+
+		var dump bytes.Buffer
+		n, err := Export(&dump, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 3 nodes, 2 peers, 1 account node, 1 balance, 1 trial, 1 trial
+		// start, 1 nonce, 1 subscription, 1 settlement, 1 channel, 1
+		// checkpoint
+		if want := 14; n != want {
+			t.Errorf("wrong number of exported records: got %d; want %d", n, want)
+		}
+		want := dump.String()
+		s.Close()
+
+		s = newStore()
+		defer s.Close()
+		if loaded, err := Import(strings.NewReader(want), s); err != nil {
+			t.Fatal(err)
+		} else if loaded != n {
+			t.Errorf("wrong number of imported records: got %d; want %d", loaded, n)
+		}
+		dump.Reset()
+		if _, err := Export(&dump, s); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := dumpLines(dump.String()), dumpLines(want); !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong state after import:\n got: %q\nwant: %q", got, want)
+		}
+
+		if b, err := s.GetNodeBalance(nodes[1].ID); err != nil {
+			t.Error(err)
+		} else if b.Credit.Int64() != 42 {
+			t.Errorf("wrong imported balance: %d", &b.Credit)
+		}
+		if peers, err := s.NodePeers(nodes[0].ID); err != nil {
+			t.Error(err)
+		} else if got, want := Nodes(peers).IDs(), Nodes(nodes[1:]).IDs(); !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong imported peers: got %q; want %q", got, want)
+		}
+		if err := s.CheckAndSaveNonce("foo", time.Now().Add(-time.Second).UnixNano()); err != ErrInvalidNonce {
+			t.Errorf("expected ErrInvalidNonce for an imported nonce, got: %s", err)
+		}
+
+		// Timelocked deposits are kept
+		unlocks := now.Add(time.Hour)
+		locked := Balance{Account: accounts[1], Unlocks: unlocks}
+		locked.Locked.SetInt64(5)
+		var lockedDump bytes.Buffer
+		enc := json.NewEncoder(&lockedDump)
+		if err := enc.Encode(Record{Kind: RecordHeader, Header: &DumpHeader{Version: DumpVersion, Created: now}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(Record{Kind: RecordBalance, Balance: &locked}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Import(&lockedDump, s); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := s.GetAccountBalance(accounts[1]); err != nil {
+			t.Error(err)
+		} else if b.Locked.Int64() != 5 || !b.Unlocks.Equal(unlocks) {
+			t.Errorf("wrong imported timelock: %d until %s", &b.Locked, b.Unlocks)
+		}
+
+		if _, err := Import(strings.NewReader(`{"kind":"node"}`), s); err == nil {
+			t.Error("expected an error for a dump without a header")
+		}
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		nodes := makeNodes(0, 4)
+		if err := addActiveNodes(s, nodes...); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UpdateNodePeers(nodes[0].ID, []string{string(nodes[1].ID), string(nodes[2].ID)}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddNodeBalance(nodes[1].ID, big.NewInt(7)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddNodeBalance(nodes[2].ID, big.NewInt(5)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddNodeBalance(nodes[2].ID, big.NewInt(-5)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddAccountNode(accounts[0], nodes[3].ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddAccountBalance(accounts[0], big.NewInt(42)); err != nil {
+			t.Fatal(err)
+		}
+		trialStart := time.Now().Add(-2 * time.Hour).UTC().Round(0)
+		for _, n := range nodes[1:3] {
+			if _, err := s.StartTrial(n.ID, trialStart); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Nodes 1 and 3 go stale
+		for _, n := range []Node{nodes[1], nodes[3]} {
+			n.LastSeen = time.Now().Add(-time.Hour)
+			if err := s.SetNode(n); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stats, err := s.Prune(time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Node 0's peer link to node 1 is removed, and node 2's empty trial
+		// balance.
+		if want := (PruneStats{Nodes: 2, Peers: 1, Trials: 1}); stats != want {
+			t.Errorf("wrong prune stats: got %+v; want %+v", stats, want)
+		}
+		if _, err := s.GetNode(nodes[1].ID); err != ErrUnregisteredNode {
+			t.Errorf("expected ErrUnregisteredNode for a pruned node, got: %s", err)
+		}
+		if peers, err := s.NodePeers(nodes[0].ID); err != nil {
+			t.Error(err)
+		} else if got, want := Nodes(peers).IDs(), Nodes(nodes[2:3]).IDs(); !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong peers after prune: got %q; want %q", got, want)
+		}
+		if stats, err := s.Prune(time.Now().Add(-time.Minute)); err != nil {
+			t.Error(err)
+		} else if (stats != PruneStats{}) {
+			t.Errorf("unexpected second prune: %+v", stats)
+		}
+
+		// Balances and account authorizations are restored when the pruned
+		// nodes connect again.
+		if spenders, err := s.GetAccountNodes(accounts[0]); err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(spenders, []NodeID{nodes[3].ID}) {
+			t.Errorf("wrong spenders after prune: %q", spenders)
+		}
+		for _, n := range []Node{nodes[1], nodes[3]} {
+			if _, err := s.GetNodeBalance(n.ID); err != ErrUnregisteredNode {
+				t.Errorf("expected ErrUnregisteredNode for the balance of a pruned node, got: %v", err)
+			}
+		}
+		if err := addActiveNodes(s, nodes[1], nodes[3]); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := s.GetNodeBalance(nodes[1].ID); err != nil {
+			t.Error(err)
+		} else if b.Credit.Int64() != 7 {
+			t.Errorf("wrong trial balance after prune: %d", &b.Credit)
+		}
+		// The pruned node's trial start is removed, but not the live node's
+		now := time.Now().UTC().Round(0)
+		if started, err := s.StartTrial(nodes[1].ID, now); err != nil {
+			t.Error(err)
+		} else if !started.Equal(now) {
+			t.Errorf("wrong trial start after prune: got %s; want %s", started, now)
+		}
+		if started, err := s.StartTrial(nodes[2].ID, now); err != nil {
+			t.Error(err)
+		} else if !started.Equal(trialStart) {
+			t.Errorf("wrong trial start of a live node after prune: got %s; want %s", started, trialStart)
+		}
+		if b, err := s.GetNodeBalance(nodes[3].ID); err != nil {
+			t.Error(err)
+		} else if b.Credit.Int64() != 42 {
+			t.Errorf("wrong account balance after prune: %d", &b.Credit)
+		}
+	})
+
 	t.Run("SpenderBalance", func(t *testing.T) {
 		s := newStore()
 		defer s.Close()
@@ -375,6 +894,92 @@ func TestSuite(t *testing.T, newStore func() Store) {
 		}
 
 	})
+
+	t.Run("RemoveSpender", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		account := accounts[0]
+		nodes := makeNodes(0, 3)
+		for _, node := range nodes {
+			if err := s.SetNode(node); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddAccountNode(account, node.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.AddAccountBalance(account, big.NewInt(90)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.RemoveAccountNode(accounts[1], nodes[0].ID, false); err != ErrNotAuthorized {
+			t.Errorf("expected ErrNotAuthorized, got: %v", err)
+		}
+
+		// Removing without the share leaves the account's balance
+		if err := s.RemoveAccountNode(account, nodes[0].ID, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.IsAccountNode(account, nodes[0].ID); err != ErrNotAuthorized {
+			t.Errorf("expected ErrNotAuthorized, got: %v", err)
+		}
+		if b, err := s.GetNodeBalance(nodes[0].ID); err != nil {
+			t.Error(err)
+		} else if b.Account != "" || b.Credit.Sign() != 0 {
+			t.Errorf("invalid removed node balance: %s", &b)
+		}
+		if err := s.RemoveAccountNode(account, nodes[0].ID, false); err != ErrNotAuthorized {
+			t.Errorf("expected ErrNotAuthorized, got: %v", err)
+		}
+
+		// Removing with the share splits the credit between the remaining
+		// nodes
+		if err := s.RemoveAccountNode(account, nodes[1].ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := s.GetNodeBalance(nodes[1].ID); err != nil {
+			t.Error(err)
+		} else if b.Account != "" || b.Credit.Cmp(big.NewInt(45)) != 0 {
+			t.Errorf("invalid removed node balance: %s", &b)
+		}
+		if b, err := s.GetAccountBalance(account); err != nil {
+			t.Error(err)
+		} else if b.Credit.Cmp(big.NewInt(45)) != 0 {
+			t.Errorf("invalid account credit: %d", &b.Credit)
+		}
+		if spenders, err := s.GetAccountNodes(account); err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(spenders, []NodeID{nodes[2].ID}) {
+			t.Errorf("invalid spenders: %q", spenders)
+		}
+
+		// Debt is not shared
+		if err := s.AddAccountBalance(account, big.NewInt(-100)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemoveAccountNode(account, nodes[2].ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := s.GetAccountBalance(account); err != nil {
+			t.Error(err)
+		} else if b.Credit.Cmp(big.NewInt(-55)) != 0 {
+			t.Errorf("invalid account credit: %d", &b.Credit)
+		}
+		if b, err := s.GetNodeBalance(nodes[2].ID); err != nil {
+			t.Error(err)
+		} else if b.Credit.Sign() != 0 {
+			t.Errorf("invalid removed node credit: %d", &b.Credit)
+		}
+	})
+}
+
+// dumpLines returns the sorted records of an exported dump, without the header.
+func dumpLines(dump string) []string {
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	r := lines[1:]
+	sort.Strings(r)
+	return r
 }
 
 type Nodes []Node